@@ -0,0 +1,64 @@
+// Keygen generates key pair encrypting agent payloads: the private key is put to server
+// crypto keys directory, the public key is given to agents along with the key ID.
+//
+// Example:
+//
+//	go run cmd/keygen/main.go -type x25519 -id 2024-06 -out keys
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/unbeman/ya-prac-mcas/internal/cryptokeys"
+)
+
+func main() {
+	keyType := flag.String("type", cryptokeys.RSAKey, "key type, allowed [rsa, x25519]")
+	bits := flag.Int("bits", 4096, "RSA key size")
+	id := flag.String("id", "", "key ID, private key is saved as <key ID>.pem, empty ID is the server CRYPTO_KEY key")
+	out := flag.String("out", ".", "output directory")
+	flag.Parse()
+
+	private, public, err := cryptokeys.GenerateKey(*keyType, *bits)
+	if err != nil {
+		log.Fatalf("can't generate key: %v", err)
+	}
+
+	privateName, publicName := "private.pem", "public.pem"
+	if *id != cryptokeys.DefaultKeyID {
+		privateName, publicName = *id+".pem", *id+".pub"
+	}
+	privatePath, publicPath := filepath.Join(*out, privateName), filepath.Join(*out, publicName)
+	if err = writeFile(privatePath, private, 0600); err != nil {
+		log.Fatal(err)
+	}
+	if err = writeFile(publicPath, public, 0644); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("server private key: %v\n", privatePath)
+	fmt.Printf("agent public key:   %v\n", publicPath)
+	if *id == cryptokeys.DefaultKeyID {
+		fmt.Printf("server: -crypto-key %v\nagent:  -crypto-key %v\n", privatePath, publicPath)
+		return
+	}
+	fmt.Printf("server: -crypto-keys-dir %v\nagent:  -crypto-key %v -crypto-key-id %v\n", *out, publicPath, *id)
+}
+
+// writeFile creates new file, existing keys aren't overwritten.
+func writeFile(path string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return fmt.Errorf("can't create key file: %w", err)
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("can't write key file: %w", err)
+	}
+	return file.Close()
+}
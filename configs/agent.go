@@ -19,6 +19,14 @@ const (
 	ClientTimeoutDefault       = 5 * time.Second
 	RateTokensCountDefault     = 100
 	PublicCryptoKeyPathDefault = ""
+	FormatDefault              = JSONFormat
+)
+
+// Allowed HTTP body formats.
+const (
+	JSONFormat     = "json"
+	ProtobufFormat = "protobuf"
+	NDJSONFormat   = "ndjson"
 )
 
 type AgentOption func(config *AgentConfig)
@@ -28,7 +36,10 @@ type ConnectionConfig struct {
 	RateTokensCount int    `json:"rate_tokens_count,omitempty"`
 	ClientTimeout   time.Duration
 	ReportTimeout   time.Duration
-	Protocol        string `env:"PROTOCOL" json:"protocol,omitempty"`
+	Protocol        string          `env:"PROTOCOL" json:"protocol,omitempty"`
+	Format          string          `env:"FORMAT" json:"format,omitempty"`
+	TLS             ClientTLSConfig `json:"-"`
+	Token           string          `env:"TOKEN" json:"token,omitempty"`
 }
 
 func (cfg *ConnectionConfig) UnmarshalJSON(data []byte) error {
@@ -68,12 +79,16 @@ func newHttConnectionConfig() ConnectionConfig {
 		ClientTimeout:   ClientTimeoutDefault,
 		ReportTimeout:   ReportTimeoutDefault,
 		RateTokensCount: RateTokensCountDefault,
+		Format:          FormatDefault,
 	}
 }
 
 type AgentConfig struct {
 	HashKey             string        `env:"KEY" json:"key,omitempty"`
+	KeyID               string        `env:"KEY_ID" json:"key_id,omitempty"`
+	ReplayProtection    bool          `env:"REPLAY_PROTECTION" json:"replay_protection,omitempty"`
 	PublicCryptoKeyPath string        `env:"CRYPTO_KEY" json:"crypto_key,omitempty"`
+	CryptoKeyID         string        `env:"CRYPTO_KEY_ID" json:"crypto_key_id,omitempty"`
 	PollInterval        time.Duration `env:"POLL_INTERVAL"`
 	ReportInterval      time.Duration `env:"REPORT_INTERVAL"`
 	Connection          ConnectionConfig
@@ -125,11 +140,20 @@ func (cfg *AgentConfig) FromFlags() *AgentConfig {
 	flag.StringVar(&cfg.Connection.Address, "a", cfg.Connection.Address, "metrics collection server address")
 	flag.IntVar(&cfg.Connection.RateTokensCount, "l", cfg.Connection.RateTokensCount, "limit request count in one second")
 	flag.StringVar(&cfg.HashKey, "k", cfg.HashKey, "key for calculating the metric hash")
+	flag.StringVar(&cfg.KeyID, "key-id", cfg.KeyID, "ID of the hash key in server keyring")
+	flag.BoolVar(&cfg.ReplayProtection, "replay-protection", cfg.ReplayProtection, "sign metrics along with timestamp and nonce")
 	flag.StringVar(&cfg.PublicCryptoKeyPath, "crypto-key", cfg.PublicCryptoKeyPath, "path to public crypto key file")
+	flag.StringVar(&cfg.CryptoKeyID, "crypto-key-id", cfg.CryptoKeyID, "ID of the server private key decrypting metrics")
 	flag.DurationVar(&cfg.PollInterval, "p", cfg.PollInterval, "poll interval")
 	flag.DurationVar(&cfg.ReportInterval, "r", cfg.ReportInterval, "report interval")
 	flag.StringVar(&cfg.Logger.Level, "e", cfg.Logger.Level, "log level, allowed [info, debug]")
 	flag.StringVar(&cfg.Connection.Protocol, "protocol", cfg.Connection.Protocol, "agent's client protocol, allowed [http, grpc]")
+	flag.BoolVar(&cfg.Connection.TLS.Enabled, "tls", cfg.Connection.TLS.Enabled, "connect to server by TLS")
+	flag.StringVar(&cfg.Connection.TLS.CAFile, "tls-ca", cfg.Connection.TLS.CAFile, "path to CA bundle of server certificate, enables TLS")
+	flag.StringVar(&cfg.Connection.TLS.CertFile, "tls-cert", cfg.Connection.TLS.CertFile, "path to client certificate")
+	flag.StringVar(&cfg.Connection.TLS.KeyFile, "tls-key", cfg.Connection.TLS.KeyFile, "path to client certificate key")
+	flag.StringVar(&cfg.Connection.Token, "token", cfg.Connection.Token, "API token sent as bearer authorization")
+	flag.StringVar(&cfg.Connection.Format, "format", cfg.Connection.Format, "http body format, allowed [json, protobuf, ndjson]")
 
 	flag.Parse()
 	return cfg
@@ -165,6 +189,11 @@ func (cfg *AgentConfig) fromJSON(path string) error {
 		log.Fatalf("can't unmarshal json config connection, reason: %v", err)
 	}
 
+	err = json.Unmarshal(data, &cfg.Connection.TLS)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config tls, reason: %v", err)
+	}
+
 	return nil
 }
 
@@ -1,10 +1,16 @@
 // Package configs describes applications settings.
 package configs
 
+import (
+	"encoding/json"
+	"time"
+)
+
 // Default config settings
 const (
-	ServerAddressDefault = "127.0.0.1:8080"
-	KeyDefault           = ""
+	ServerAddressDefault     = "127.0.0.1:8080"
+	KeyDefault               = ""
+	TLSReloadIntervalDefault = time.Minute
 )
 
 var LogLevelDefault = "info"
@@ -16,3 +22,58 @@ type LoggerConfig struct {
 func newLoggerConfig() LoggerConfig {
 	return LoggerConfig{Level: LogLevelDefault}
 }
+
+// TLSConfig describes server certificate, files are reloaded when they change.
+// Client certificates are required and verified against ClientCAFile when it's set.
+type TLSConfig struct {
+	CertFile       string        `env:"TLS_CERT" json:"tls_cert,omitempty"`
+	KeyFile        string        `env:"TLS_KEY" json:"tls_key,omitempty"`
+	ClientCAFile   string        `env:"TLS_CLIENT_CA" json:"tls_client_ca,omitempty"`
+	ReloadInterval time.Duration `env:"TLS_RELOAD_INTERVAL"`
+}
+
+func (cfg *TLSConfig) Enabled() bool {
+	return cfg.CertFile != ""
+}
+
+func (cfg *TLSConfig) UnmarshalJSON(data []byte) error {
+	type RealCfg TLSConfig
+	jCfg := struct {
+		ReloadInterval string `json:"tls_reload_interval,omitempty"`
+		*RealCfg
+	}{
+		RealCfg: (*RealCfg)(cfg),
+	}
+
+	err := json.Unmarshal(data, &jCfg)
+	if err != nil {
+		return err
+	}
+	if jCfg.ReloadInterval != "" {
+		cfg.ReloadInterval, err = time.ParseDuration(jCfg.ReloadInterval)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newTLSConfig() TLSConfig {
+	return TLSConfig{ReloadInterval: TLSReloadIntervalDefault}
+}
+
+// ClientTLSConfig describes connection to TLS server.
+// CAFile pins server CA instead of system roots, client certificate is sent when CertFile and KeyFile are set.
+type ClientTLSConfig struct {
+	Enabled    bool   `env:"TLS" json:"tls,omitempty"`
+	CAFile     string `env:"TLS_CA" json:"tls_ca,omitempty"`
+	CertFile   string `env:"TLS_CERT" json:"tls_cert,omitempty"`
+	KeyFile    string `env:"TLS_KEY" json:"tls_key,omitempty"`
+	ServerName string `env:"TLS_SERVER_NAME" json:"tls_server_name,omitempty"`
+}
+
+// IsEnabled reports if TLS is enabled explicitly or by pinned CA.
+func (cfg *ClientTLSConfig) IsEnabled() bool {
+	return cfg.Enabled || cfg.CAFile != ""
+}
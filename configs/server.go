@@ -6,6 +6,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/caarlos0/env/v6"
@@ -28,8 +30,43 @@ const (
 	DSNDefault                  = ""
 	PGMigrationDirDefault       = "migrations"
 	PrivateCryptoKeyPathDefault = ""
+	MaxBodySizeDefault          = 10 << 20
+	MaxBatchSizeDefault         = 10000
+	MaxNameLengthDefault        = 256
+	StatsDFlushIntervalDefault  = 10 * time.Second
+	GraphiteAddressDefault      = ""
+	ScrapeIntervalDefault       = 15 * time.Second
+	ScrapeTimeoutDefault        = 5 * time.Second
+	AlertIntervalDefault        = 15 * time.Second
+	AlertWebhookTimeoutDefault  = 5 * time.Second
+	RecordingIntervalDefault    = 15 * time.Second
+	HistorySizeDefault          = 60
+	WebhookQueueSizeDefault     = 1000
+	WebhookRetriesDefault       = 3
+	WebhookRetryIntervalDefault = time.Second
+	WebhookTimeoutDefault       = 5 * time.Second
+	ExportIntervalDefault       = 10 * time.Second
+	ExportBatchSizeDefault      = 1000
+	ExportBufferSizeDefault     = 100000
+	ExportRetriesDefault        = 3
+	ExportRetryIntervalDefault  = time.Second
+	ExportTimeoutDefault        = 5 * time.Second
+	UpstreamIntervalDefault     = 10 * time.Second
+	UpstreamTimeoutDefault      = 5 * time.Second
+	UpstreamBacklogSizeDefault  = 1000
+	ClusterVirtualNodesDefault  = 128
+	ClusterHealthCheckDefault   = 5 * time.Second
+	ClusterTimeoutDefault       = 3 * time.Second
+	ReplicationBacklogDefault   = 10000
+	ReplicationRetryDefault     = time.Second
+	AuthReloadIntervalDefault   = 30 * time.Second
+	KeyringReloadDefault        = time.Minute
+	ReplayWindowDefault         = 5 * time.Minute
 )
 
+// IngestLabelTagsDefault keeps all tags of Graphite and InfluxDB samples in metric names.
+var IngestLabelTagsDefault = []string{"*"}
+
 type ServerOption func(config *ServerConfig)
 
 type PostgresConfig struct {
@@ -91,15 +128,768 @@ func newBackupConfig() *BackupConfig {
 	}
 }
 
+// LimitsConfig restricts incoming requests, zero value means no limit.
+type LimitsConfig struct {
+	MaxBodySize   int64 `env:"MAX_BODY_SIZE" json:"max_body_size,omitempty"`
+	MaxBatchSize  int   `env:"MAX_BATCH_SIZE" json:"max_batch_size,omitempty"`
+	MaxNameLength int   `env:"MAX_NAME_LENGTH" json:"max_name_length,omitempty"`
+}
+
+func newLimitsConfig() LimitsConfig {
+	return LimitsConfig{
+		MaxBodySize:   MaxBodySizeDefault,
+		MaxBatchSize:  MaxBatchSizeDefault,
+		MaxNameLength: MaxNameLengthDefault,
+	}
+}
+
+// QuotaConfig describes limits of updates sent by every client (API token, hash key ID or IP),
+// MaxSeries limits series created by client. Zero value disables the limit.
+type QuotaConfig struct {
+	RequestsPerSecond float64 `env:"QUOTA_REQUESTS_PER_SECOND" json:"quota_requests_per_second,omitempty"`
+	RequestsBurst     int     `env:"QUOTA_REQUESTS_BURST" json:"quota_requests_burst,omitempty"`
+	MetricsPerMinute  int     `env:"QUOTA_METRICS_PER_MINUTE" json:"quota_metrics_per_minute,omitempty"`
+	MaxSeries         int     `env:"QUOTA_MAX_SERIES" json:"quota_max_series,omitempty"`
+}
+
+func (cfg *QuotaConfig) Enabled() bool {
+	return cfg.RequestsPerSecond > 0 || cfg.MetricsPerMinute > 0 || cfg.MaxSeries > 0
+}
+
+// CardinalityConfig describes limits of stored series count, zero value disables the limit.
+// PrefixLimits entries are "<name prefix>=<max series>", series are limited by the longest matching prefix.
+type CardinalityConfig struct {
+	MaxSeries    int      `env:"CARDINALITY_MAX_SERIES" json:"cardinality_max_series,omitempty"`
+	PrefixLimits []string `env:"CARDINALITY_PREFIX_LIMITS" envSeparator:"," json:"cardinality_prefix_limits,omitempty"`
+}
+
+// StatsDConfig describes optional StatsD listeners, empty address disables listener.
+type StatsDConfig struct {
+	UDPAddress    string        `env:"STATSD_UDP_ADDRESS" json:"statsd_udp_address,omitempty"`
+	TCPAddress    string        `env:"STATSD_TCP_ADDRESS" json:"statsd_tcp_address,omitempty"`
+	FlushInterval time.Duration `env:"STATSD_FLUSH_INTERVAL"`
+}
+
+func (cfg *StatsDConfig) Enabled() bool {
+	return cfg.UDPAddress != "" || cfg.TCPAddress != ""
+}
+
+func (cfg *StatsDConfig) UnmarshalJSON(data []byte) error {
+	type RealCfg StatsDConfig
+	jCfg := struct {
+		FlushInterval string `json:"statsd_flush_interval,omitempty"`
+		*RealCfg
+	}{
+		RealCfg: (*RealCfg)(cfg),
+	}
+
+	err := json.Unmarshal(data, &jCfg)
+	if err != nil {
+		return err
+	}
+	if jCfg.FlushInterval != "" {
+		cfg.FlushInterval, err = time.ParseDuration(jCfg.FlushInterval)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newStatsDConfig() StatsDConfig {
+	return StatsDConfig{FlushInterval: StatsDFlushIntervalDefault}
+}
+
+// IngestConfig describes Graphite plaintext listener and mapping rules
+// of Graphite and InfluxDB line protocol samples.
+type IngestConfig struct {
+	GraphiteAddress string   `env:"GRAPHITE_ADDRESS" json:"graphite_address,omitempty"`
+	CounterPatterns []string `env:"INGEST_COUNTER_PATTERNS" envSeparator:"," json:"ingest_counter_patterns,omitempty"`
+	LabelTags       []string `env:"INGEST_LABEL_TAGS" envSeparator:"," json:"ingest_label_tags,omitempty"`
+}
+
+func newIngestConfig() IngestConfig {
+	return IngestConfig{GraphiteAddress: GraphiteAddressDefault, LabelTags: IngestLabelTagsDefault}
+}
+
+// RelabelRule describes Prometheus-like relabeling of scraped samples.
+// Metric name is available as __name__ label.
+type RelabelRule struct {
+	SourceLabels []string `json:"source_labels,omitempty"`
+	Separator    string   `json:"separator,omitempty"`
+	Regex        string   `json:"regex,omitempty"`
+	TargetLabel  string   `json:"target_label,omitempty"`
+	Replacement  *string  `json:"replacement,omitempty"`
+	Action       string   `json:"action,omitempty"` // replace, keep, drop, labeldrop, labelkeep
+}
+
+// ScrapeTarget describes HTTP endpoint exposing metrics in Prometheus text format.
+// Zero Interval and Timeout are replaced by ScrapeConfig ones.
+type ScrapeTarget struct {
+	Name     string        `json:"name,omitempty"`
+	URL      string        `json:"url"`
+	Interval time.Duration `json:"-"`
+	Timeout  time.Duration `json:"-"`
+	Relabel  []RelabelRule `json:"relabel,omitempty"`
+}
+
+func (cfg *ScrapeTarget) UnmarshalJSON(data []byte) error {
+	type RealCfg ScrapeTarget
+	jCfg := struct {
+		Interval string `json:"interval,omitempty"`
+		Timeout  string `json:"timeout,omitempty"`
+		*RealCfg
+	}{
+		RealCfg: (*RealCfg)(cfg),
+	}
+
+	err := json.Unmarshal(data, &jCfg)
+	if err != nil {
+		return err
+	}
+	if jCfg.Interval != "" {
+		cfg.Interval, err = time.ParseDuration(jCfg.Interval)
+		if err != nil {
+			return err
+		}
+	}
+	if jCfg.Timeout != "" {
+		cfg.Timeout, err = time.ParseDuration(jCfg.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ScrapeConfig describes pull mode, no targets means pull mode is disabled.
+type ScrapeConfig struct {
+	Interval time.Duration  `env:"SCRAPE_INTERVAL"`
+	Timeout  time.Duration  `env:"SCRAPE_TIMEOUT"`
+	Targets  []ScrapeTarget `json:"scrape_targets,omitempty"`
+}
+
+func (cfg *ScrapeConfig) UnmarshalJSON(data []byte) error {
+	type RealCfg ScrapeConfig
+	jCfg := struct {
+		Interval string `json:"scrape_interval,omitempty"`
+		Timeout  string `json:"scrape_timeout,omitempty"`
+		*RealCfg
+	}{
+		RealCfg: (*RealCfg)(cfg),
+	}
+
+	err := json.Unmarshal(data, &jCfg)
+	if err != nil {
+		return err
+	}
+	if jCfg.Interval != "" {
+		cfg.Interval, err = time.ParseDuration(jCfg.Interval)
+		if err != nil {
+			return err
+		}
+	}
+	if jCfg.Timeout != "" {
+		cfg.Timeout, err = time.ParseDuration(jCfg.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newScrapeConfig() ScrapeConfig {
+	return ScrapeConfig{Interval: ScrapeIntervalDefault, Timeout: ScrapeTimeoutDefault}
+}
+
+// AlertRule describes named alert condition, e.g. `gauge FreeMemory < 500MB for 2m`.
+type AlertRule struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+}
+
+// AlertingConfig describes alert rules evaluation and webhook notifications.
+type AlertingConfig struct {
+	Interval       time.Duration `env:"ALERT_INTERVAL"`
+	WebhookTimeout time.Duration `env:"ALERT_WEBHOOK_TIMEOUT"`
+	Webhooks       []string      `env:"ALERT_WEBHOOKS" envSeparator:"," json:"alert_webhooks,omitempty"`
+	Rules          []AlertRule   `json:"alert_rules,omitempty"`
+}
+
+func (cfg *AlertingConfig) UnmarshalJSON(data []byte) error {
+	type RealCfg AlertingConfig
+	jCfg := struct {
+		Interval       string `json:"alert_interval,omitempty"`
+		WebhookTimeout string `json:"alert_webhook_timeout,omitempty"`
+		*RealCfg
+	}{
+		RealCfg: (*RealCfg)(cfg),
+	}
+
+	err := json.Unmarshal(data, &jCfg)
+	if err != nil {
+		return err
+	}
+	if jCfg.Interval != "" {
+		cfg.Interval, err = time.ParseDuration(jCfg.Interval)
+		if err != nil {
+			return err
+		}
+	}
+	if jCfg.WebhookTimeout != "" {
+		cfg.WebhookTimeout, err = time.ParseDuration(jCfg.WebhookTimeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newAlertingConfig() AlertingConfig {
+	return AlertingConfig{Interval: AlertIntervalDefault, WebhookTimeout: AlertWebhookTimeoutDefault}
+}
+
+// RecordingRule describes derived gauge, e.g. `MemoryUsedRatio = 1 - FreeMemory / TotalMemory`.
+type RecordingRule struct {
+	Name string `json:"name"`
+	Expr string `json:"expr"`
+}
+
+// RecordingConfig describes recording rules evaluation.
+type RecordingConfig struct {
+	Interval time.Duration   `env:"RECORDING_INTERVAL"`
+	Rules    []RecordingRule `json:"recording_rules,omitempty"`
+}
+
+func (cfg *RecordingConfig) UnmarshalJSON(data []byte) error {
+	type RealCfg RecordingConfig
+	jCfg := struct {
+		Interval string `json:"recording_interval,omitempty"`
+		*RealCfg
+	}{
+		RealCfg: (*RealCfg)(cfg),
+	}
+
+	err := json.Unmarshal(data, &jCfg)
+	if err != nil {
+		return err
+	}
+	if jCfg.Interval != "" {
+		cfg.Interval, err = time.ParseDuration(jCfg.Interval)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newRecordingConfig() RecordingConfig {
+	return RecordingConfig{Interval: RecordingIntervalDefault}
+}
+
+// WebhookSubscription describes metrics pushed to URL on change.
+// Metric is pushed when its value changed at least by MinChange since the last push,
+// zero MinChange pushes every update. Empty Type matches both gauges and counters.
+type WebhookSubscription struct {
+	URL       string  `json:"url"`
+	Pattern   string  `json:"pattern"`
+	Type      string  `json:"type,omitempty"`
+	MinChange float64 `json:"min_change,omitempty"`
+}
+
+// ParseWebhookSubscription parses `pattern [type] [min_change] url` form.
+func ParseWebhookSubscription(value string) (WebhookSubscription, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 || len(fields) > 4 {
+		return WebhookSubscription{}, fmt.Errorf("expected `pattern [type] [min_change] url`, got %v", value)
+	}
+	sub := WebhookSubscription{Pattern: fields[0], URL: fields[len(fields)-1]}
+	for _, field := range fields[1 : len(fields)-1] {
+		if minChange, err := strconv.ParseFloat(field, 64); err == nil {
+			sub.MinChange = minChange
+		} else {
+			sub.Type = field
+		}
+	}
+	return sub, nil
+}
+
+// WebhooksConfig describes metric change subscriptions and their delivery queue.
+type WebhooksConfig struct {
+	QueueSize     int                   `env:"WEBHOOK_QUEUE_SIZE" json:"webhook_queue_size,omitempty"`
+	Retries       int                   `env:"WEBHOOK_RETRIES" json:"webhook_retries,omitempty"`
+	RetryInterval time.Duration         `env:"WEBHOOK_RETRY_INTERVAL"`
+	Timeout       time.Duration         `env:"WEBHOOK_TIMEOUT"`
+	Subscriptions []WebhookSubscription `json:"webhooks,omitempty"`
+}
+
+func (cfg *WebhooksConfig) UnmarshalJSON(data []byte) error {
+	type RealCfg WebhooksConfig
+	jCfg := struct {
+		RetryInterval string `json:"webhook_retry_interval,omitempty"`
+		Timeout       string `json:"webhook_timeout,omitempty"`
+		*RealCfg
+	}{
+		RealCfg: (*RealCfg)(cfg),
+	}
+
+	err := json.Unmarshal(data, &jCfg)
+	if err != nil {
+		return err
+	}
+	if jCfg.RetryInterval != "" {
+		cfg.RetryInterval, err = time.ParseDuration(jCfg.RetryInterval)
+		if err != nil {
+			return err
+		}
+	}
+	if jCfg.Timeout != "" {
+		cfg.Timeout, err = time.ParseDuration(jCfg.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newWebhooksConfig() WebhooksConfig {
+	return WebhooksConfig{
+		QueueSize:     WebhookQueueSizeDefault,
+		Retries:       WebhookRetriesDefault,
+		RetryInterval: WebhookRetryIntervalDefault,
+		Timeout:       WebhookTimeoutDefault,
+	}
+}
+
+// Export formats.
+const (
+	GraphiteExportFormat = "graphite"
+	InfluxExportFormat   = "influx"
+)
+
+// ExportConfig describes periodic forwarding of stored metrics to external storage.
+// Address is `host:port` for Graphite plaintext and write endpoint URL for InfluxDB line protocol,
+// empty address disables exporter. Empty Patterns export all metrics.
+type ExportConfig struct {
+	Format        string        `env:"EXPORT_FORMAT" json:"export_format,omitempty"`
+	Address       string        `env:"EXPORT_ADDRESS" json:"export_address,omitempty"`
+	Patterns      []string      `env:"EXPORT_PATTERNS" envSeparator:"," json:"export_patterns,omitempty"`
+	Prefix        string        `env:"EXPORT_PREFIX" json:"export_prefix,omitempty"`
+	Interval      time.Duration `env:"EXPORT_INTERVAL"`
+	BatchSize     int           `env:"EXPORT_BATCH_SIZE" json:"export_batch_size,omitempty"`
+	BufferSize    int           `env:"EXPORT_BUFFER_SIZE" json:"export_buffer_size,omitempty"`
+	Retries       int           `env:"EXPORT_RETRIES" json:"export_retries,omitempty"`
+	RetryInterval time.Duration `env:"EXPORT_RETRY_INTERVAL"`
+	Timeout       time.Duration `env:"EXPORT_TIMEOUT"`
+}
+
+func (cfg *ExportConfig) Enabled() bool {
+	return cfg.Address != ""
+}
+
+func (cfg *ExportConfig) UnmarshalJSON(data []byte) error {
+	type RealCfg ExportConfig
+	jCfg := struct {
+		Interval      string `json:"export_interval,omitempty"`
+		RetryInterval string `json:"export_retry_interval,omitempty"`
+		Timeout       string `json:"export_timeout,omitempty"`
+		*RealCfg
+	}{
+		RealCfg: (*RealCfg)(cfg),
+	}
+
+	err := json.Unmarshal(data, &jCfg)
+	if err != nil {
+		return err
+	}
+	if jCfg.Interval != "" {
+		cfg.Interval, err = time.ParseDuration(jCfg.Interval)
+		if err != nil {
+			return err
+		}
+	}
+	if jCfg.RetryInterval != "" {
+		cfg.RetryInterval, err = time.ParseDuration(jCfg.RetryInterval)
+		if err != nil {
+			return err
+		}
+	}
+	if jCfg.Timeout != "" {
+		cfg.Timeout, err = time.ParseDuration(jCfg.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newExportConfig() ExportConfig {
+	return ExportConfig{
+		Format:        GraphiteExportFormat,
+		Interval:      ExportIntervalDefault,
+		BatchSize:     ExportBatchSizeDefault,
+		BufferSize:    ExportBufferSizeDefault,
+		Retries:       ExportRetriesDefault,
+		RetryInterval: ExportRetryIntervalDefault,
+		Timeout:       ExportTimeoutDefault,
+	}
+}
+
+// UpstreamConfig describes forwarding of accepted updates to upstream server,
+// empty address disables forwarding. Backlog keeps unsent batches, it's persisted when BacklogFile is set.
+type UpstreamConfig struct {
+	Address         string          `env:"UPSTREAM_ADDRESS" json:"upstream_address,omitempty"`
+	Protocol        string          `env:"UPSTREAM_PROTOCOL" json:"upstream_protocol,omitempty"`
+	Format          string          `env:"UPSTREAM_FORMAT" json:"upstream_format,omitempty"`
+	HashKey         string          `env:"UPSTREAM_KEY" json:"upstream_key,omitempty"`
+	PublicKeyPath   string          `env:"UPSTREAM_CRYPTO_KEY" json:"upstream_crypto_key,omitempty"`
+	CryptoKeyID     string          `env:"UPSTREAM_CRYPTO_KEY_ID" json:"upstream_crypto_key_id,omitempty"`
+	Prefix          string          `env:"UPSTREAM_PREFIX" json:"upstream_prefix,omitempty"`
+	BacklogFile     string          `env:"UPSTREAM_BACKLOG_FILE" json:"upstream_backlog_file,omitempty"`
+	BacklogSize     int             `env:"UPSTREAM_BACKLOG_SIZE" json:"upstream_backlog_size,omitempty"`
+	Interval        time.Duration   `env:"UPSTREAM_INTERVAL"`
+	Timeout         time.Duration   `env:"UPSTREAM_TIMEOUT"`
+	RateTokensCount int             `json:"upstream_rate_tokens_count,omitempty"`
+	TLS             ClientTLSConfig `envPrefix:"UPSTREAM_" json:"upstream_tls,omitempty"`
+	Token           string          `env:"UPSTREAM_TOKEN" json:"upstream_token,omitempty"`
+}
+
+func (cfg *UpstreamConfig) Enabled() bool {
+	return cfg.Address != ""
+}
+
+// Connection returns sender settings of upstream server.
+func (cfg *UpstreamConfig) Connection() ConnectionConfig {
+	return ConnectionConfig{
+		Address:         cfg.Address,
+		Protocol:        cfg.Protocol,
+		Format:          cfg.Format,
+		ClientTimeout:   cfg.Timeout,
+		ReportTimeout:   cfg.Timeout,
+		RateTokensCount: cfg.RateTokensCount,
+		TLS:             cfg.TLS,
+		Token:           cfg.Token,
+	}
+}
+
+func (cfg *UpstreamConfig) UnmarshalJSON(data []byte) error {
+	type RealCfg UpstreamConfig
+	jCfg := struct {
+		Interval string `json:"upstream_interval,omitempty"`
+		Timeout  string `json:"upstream_timeout,omitempty"`
+		*RealCfg
+	}{
+		RealCfg: (*RealCfg)(cfg),
+	}
+
+	err := json.Unmarshal(data, &jCfg)
+	if err != nil {
+		return err
+	}
+	if jCfg.Interval != "" {
+		cfg.Interval, err = time.ParseDuration(jCfg.Interval)
+		if err != nil {
+			return err
+		}
+	}
+	if jCfg.Timeout != "" {
+		cfg.Timeout, err = time.ParseDuration(jCfg.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newUpstreamConfig() UpstreamConfig {
+	return UpstreamConfig{
+		Protocol:        HTTPProtocol,
+		Format:          FormatDefault,
+		BacklogSize:     UpstreamBacklogSizeDefault,
+		Interval:        UpstreamIntervalDefault,
+		Timeout:         UpstreamTimeoutDefault,
+		RateTokensCount: RateTokensCountDefault,
+	}
+}
+
+// ClusterConfig describes static cluster of servers sharing metrics by consistent hash of names.
+// Nodes are gRPC addresses of all cluster members, Self is address of this server among them,
+// it's served by gRPC even if the main protocol is HTTP. Empty Nodes disable clustering.
+// Requests forwarded between nodes are trusted from tokens of peer scope or from PeerSubnets,
+// comma-separated CIDRs of cluster nodes.
+type ClusterConfig struct {
+	Self                string        `env:"CLUSTER_SELF" json:"cluster_self,omitempty"`
+	Nodes               []string      `env:"CLUSTER_NODES" envSeparator:"," json:"cluster_nodes,omitempty"`
+	VirtualNodes        int           `env:"CLUSTER_VIRTUAL_NODES" json:"cluster_virtual_nodes,omitempty"`
+	HealthCheckInterval time.Duration `env:"CLUSTER_HEALTH_CHECK_INTERVAL"`
+	Timeout             time.Duration `env:"CLUSTER_TIMEOUT"`
+	PeerSubnets         string        `env:"CLUSTER_PEER_SUBNETS" json:"cluster_peer_subnets,omitempty"`
+}
+
+func (cfg *ClusterConfig) Enabled() bool {
+	return len(cfg.Nodes) > 0
+}
+
+func (cfg *ClusterConfig) UnmarshalJSON(data []byte) error {
+	type RealCfg ClusterConfig
+	jCfg := struct {
+		HealthCheckInterval string `json:"cluster_health_check_interval,omitempty"`
+		Timeout             string `json:"cluster_timeout,omitempty"`
+		*RealCfg
+	}{
+		RealCfg: (*RealCfg)(cfg),
+	}
+
+	err := json.Unmarshal(data, &jCfg)
+	if err != nil {
+		return err
+	}
+	if jCfg.HealthCheckInterval != "" {
+		cfg.HealthCheckInterval, err = time.ParseDuration(jCfg.HealthCheckInterval)
+		if err != nil {
+			return err
+		}
+	}
+	if jCfg.Timeout != "" {
+		cfg.Timeout, err = time.ParseDuration(jCfg.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newClusterConfig() ClusterConfig {
+	return ClusterConfig{
+		VirtualNodes:        ClusterVirtualNodesDefault,
+		HealthCheckInterval: ClusterHealthCheckDefault,
+		Timeout:             ClusterTimeoutDefault,
+	}
+}
+
+// ReplicationConfig describes primary/replica replication of applied updates.
+// Server with Primary address set is a read-only replica of that server, it's promoted to primary by API call.
+// Primary keeps BacklogSize last updates for reconnecting replicas, farther replicas get a full snapshot.
+type ReplicationConfig struct {
+	Primary       string        `env:"REPLICATION_PRIMARY" json:"replication_primary,omitempty"`
+	BacklogSize   int           `env:"REPLICATION_BACKLOG_SIZE" json:"replication_backlog_size,omitempty"`
+	RetryInterval time.Duration `env:"REPLICATION_RETRY_INTERVAL"`
+}
+
+func (cfg *ReplicationConfig) IsReplica() bool {
+	return cfg.Primary != ""
+}
+
+func (cfg *ReplicationConfig) UnmarshalJSON(data []byte) error {
+	type RealCfg ReplicationConfig
+	jCfg := struct {
+		RetryInterval string `json:"replication_retry_interval,omitempty"`
+		*RealCfg
+	}{
+		RealCfg: (*RealCfg)(cfg),
+	}
+
+	err := json.Unmarshal(data, &jCfg)
+	if err != nil {
+		return err
+	}
+	if jCfg.RetryInterval != "" {
+		cfg.RetryInterval, err = time.ParseDuration(jCfg.RetryInterval)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newReplicationConfig() ReplicationConfig {
+	return ReplicationConfig{
+		BacklogSize:   ReplicationBacklogDefault,
+		RetryInterval: ReplicationRetryDefault,
+	}
+}
+
+// AuthConfig describes API tokens required by HTTP and gRPC requests, tokens are read from TokensFile
+// or from api_token table of Postgres repository when TokensFromDB is set. No tokens source disables auth.
+// Tokens are reloaded each ReloadInterval, so revoked tokens are rejected without restart.
+type AuthConfig struct {
+	TokensFile     string        `env:"AUTH_TOKENS_FILE" json:"auth_tokens_file,omitempty"`
+	TokensFromDB   bool          `env:"AUTH_TOKENS_DB" json:"auth_tokens_db,omitempty"`
+	ReloadInterval time.Duration `env:"AUTH_RELOAD_INTERVAL"`
+}
+
+func (cfg *AuthConfig) Enabled() bool {
+	return cfg.TokensFile != "" || cfg.TokensFromDB
+}
+
+func (cfg *AuthConfig) UnmarshalJSON(data []byte) error {
+	type RealCfg AuthConfig
+	jCfg := struct {
+		ReloadInterval string `json:"auth_reload_interval,omitempty"`
+		*RealCfg
+	}{
+		RealCfg: (*RealCfg)(cfg),
+	}
+
+	err := json.Unmarshal(data, &jCfg)
+	if err != nil {
+		return err
+	}
+	if jCfg.ReloadInterval != "" {
+		cfg.ReloadInterval, err = time.ParseDuration(jCfg.ReloadInterval)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newAuthConfig() AuthConfig {
+	return AuthConfig{ReloadInterval: AuthReloadIntervalDefault}
+}
+
+// KeyringConfig describes file of HMAC keys identified by key ID, they're accepted along with the KEY setting.
+// File is reloaded each ReloadInterval when it changes, so keys are rotated without restart.
+type KeyringConfig struct {
+	File           string        `env:"KEYRING_FILE" json:"keyring_file,omitempty"`
+	ReloadInterval time.Duration `env:"KEYRING_RELOAD_INTERVAL"`
+}
+
+func (cfg *KeyringConfig) UnmarshalJSON(data []byte) error {
+	type RealCfg KeyringConfig
+	jCfg := struct {
+		ReloadInterval string `json:"keyring_reload_interval,omitempty"`
+		*RealCfg
+	}{
+		RealCfg: (*RealCfg)(cfg),
+	}
+
+	err := json.Unmarshal(data, &jCfg)
+	if err != nil {
+		return err
+	}
+	if jCfg.ReloadInterval != "" {
+		cfg.ReloadInterval, err = time.ParseDuration(jCfg.ReloadInterval)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newKeyringConfig() KeyringConfig {
+	return KeyringConfig{ReloadInterval: KeyringReloadDefault}
+}
+
+// ReplayConfig describes replay protection of signed updates. Updates signed along with timestamp and nonce
+// are accepted within Window from their timestamp and only once. Required rejects signed updates without them.
+// Zero Window disables the protection.
+type ReplayConfig struct {
+	Window   time.Duration `env:"REPLAY_WINDOW"`
+	Required bool          `env:"REPLAY_REQUIRED" json:"replay_required,omitempty"`
+}
+
+func (cfg *ReplayConfig) UnmarshalJSON(data []byte) error {
+	type RealCfg ReplayConfig
+	jCfg := struct {
+		Window string `json:"replay_window,omitempty"`
+		*RealCfg
+	}{
+		RealCfg: (*RealCfg)(cfg),
+	}
+
+	err := json.Unmarshal(data, &jCfg)
+	if err != nil {
+		return err
+	}
+	if jCfg.Window != "" {
+		cfg.Window, err = time.ParseDuration(jCfg.Window)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newReplayConfig() ReplayConfig {
+	return ReplayConfig{Window: ReplayWindowDefault}
+}
+
+// Listener is address served by one protocol.
+type Listener struct {
+	Protocol string
+	Address  string
+}
+
 type ServerConfig struct {
 	CollectorAddress     string `env:"ADDRESS" json:"address,omitempty"`
+	HTTPAddress          string `env:"HTTP_ADDRESS" json:"http_address,omitempty"`
+	GRPCAddress          string `env:"GRPC_ADDRESS" json:"grpc_address,omitempty"`
 	HashKey              string `env:"KEY" json:"key,omitempty"`
+	Keyring              KeyringConfig
+	Replay               ReplayConfig
 	PrivateCryptoKeyPath string `env:"CRYPTO_KEY" json:"crypto_key,omitempty"`
+	CryptoKeysDir        string `env:"CRYPTO_KEYS_DIR" json:"crypto_keys_dir,omitempty"`
+	RequireEncryption    bool   `env:"REQUIRE_ENCRYPTION" json:"require_encryption,omitempty"`
 	Logger               LoggerConfig
 	Repository           RepositoryConfig
 	ProfileAddress       string `json:"profile_address,omitempty"`
 	TrustedSubnet        string `env:"TRUSTED_SUBNET" json:"trusted_subnet,omitempty"`
+	TrustedProxies       string `env:"TRUSTED_PROXIES" json:"trusted_proxies,omitempty"`
 	Protocol             string `env:"PROTOCOL" json:"protocol,omitempty"`
+	TLS                  TLSConfig
+	PeerTLS              ClientTLSConfig `envPrefix:"PEER_" json:"peer_tls,omitempty"`
+	PeerToken            string          `env:"PEER_TOKEN" json:"peer_token,omitempty"`
+	Auth                 AuthConfig
+	HistorySize          int `env:"HISTORY_SIZE" json:"history_size,omitempty"`
+	Limits               LimitsConfig
+	Quota                QuotaConfig
+	Cardinality          CardinalityConfig
+	StatsD               StatsDConfig
+	Ingest               IngestConfig
+	Scrape               ScrapeConfig
+	Alerting             AlertingConfig
+	Recording            RecordingConfig
+	Webhooks             WebhooksConfig
+	Export               ExportConfig
+	Upstream             UpstreamConfig
+	Cluster              ClusterConfig
+	Replication          ReplicationConfig
+}
+
+// Listeners returns served protocols with their addresses.
+// Address of the main Protocol is CollectorAddress unless protocol address is set,
+// other protocols are served when their addresses are set.
+func (cfg *ServerConfig) Listeners() []Listener {
+	httpAddress, grpcAddress := cfg.HTTPAddress, cfg.GRPCAddress
+	switch {
+	case cfg.Protocol == GRPCProtocol && grpcAddress == "":
+		grpcAddress = cfg.CollectorAddress
+	case cfg.Protocol != GRPCProtocol && httpAddress == "":
+		httpAddress = cfg.CollectorAddress
+	}
+
+	var listeners []Listener
+	if httpAddress != "" {
+		listeners = append(listeners, Listener{Protocol: HTTPProtocol, Address: httpAddress})
+	}
+	if grpcAddress != "" {
+		listeners = append(listeners, Listener{Protocol: GRPCProtocol, Address: grpcAddress})
+	}
+	return listeners
 }
 
 func FromEnv() ServerOption {
@@ -116,15 +906,115 @@ func FromFlags() ServerOption {
 		flag.Func("config", "path to json config", cfg.fromJSON)
 
 		flag.StringVar(&cfg.CollectorAddress, "a", cfg.CollectorAddress, "server address")
+		flag.StringVar(&cfg.HTTPAddress, "http-address", cfg.HTTPAddress, "HTTP server address, served along with main protocol")
+		flag.StringVar(&cfg.GRPCAddress, "grpc-address", cfg.GRPCAddress, "gRPC server address, served along with main protocol")
+		flag.StringVar(&cfg.TLS.CertFile, "tls-cert", cfg.TLS.CertFile, "path to server certificate, enables TLS")
+		flag.StringVar(&cfg.TLS.KeyFile, "tls-key", cfg.TLS.KeyFile, "path to server certificate key")
+		flag.StringVar(&cfg.TLS.ClientCAFile, "tls-client-ca", cfg.TLS.ClientCAFile, "path to CA bundle verifying client certificates")
 		flag.StringVar(&cfg.HashKey, "k", cfg.HashKey, "key for calculating the metric hash")
+		flag.StringVar(&cfg.Keyring.File, "keyring", cfg.Keyring.File, "path to JSON file of HMAC keys identified by key ID")
+		flag.DurationVar(&cfg.Replay.Window, "replay-window", cfg.Replay.Window, "max age of signed update timestamp, zero disables replay protection")
+		flag.BoolVar(&cfg.Replay.Required, "replay-required", cfg.Replay.Required, "reject signed updates without timestamp and nonce")
 		flag.StringVar(&cfg.PrivateCryptoKeyPath, "crypto-key", cfg.PrivateCryptoKeyPath, "path to private key file")
+		flag.StringVar(&cfg.CryptoKeysDir, "crypto-keys-dir", cfg.CryptoKeysDir, "directory of private keys <key ID>.pem, reloaded on SIGHUP")
+		flag.BoolVar(&cfg.RequireEncryption, "require-encryption", cfg.RequireEncryption, "reject gRPC updates not encrypted by crypto key")
+		flag.StringVar(&cfg.Auth.TokensFile, "auth-tokens", cfg.Auth.TokensFile, "path to JSON file of API tokens, enables auth")
+		flag.BoolVar(&cfg.Auth.TokensFromDB, "auth-tokens-db", cfg.Auth.TokensFromDB, "read API tokens from database, enables auth")
+		flag.StringVar(&cfg.PeerToken, "peer-token", cfg.PeerToken, "API token of cluster nodes and replication primary")
 		flag.BoolVar(&cfg.Repository.RAMWithBackup.Restore, "r", cfg.Repository.RAMWithBackup.Restore, "restore metrics to file")
 		flag.DurationVar(&cfg.Repository.RAMWithBackup.Interval, "i", cfg.Repository.RAMWithBackup.Interval, "store interval")
 		flag.StringVar(&cfg.Repository.RAMWithBackup.File, "f", cfg.Repository.RAMWithBackup.File, "json file path to store metrics")
 		flag.StringVar(&cfg.Logger.Level, "l", cfg.Logger.Level, "log level, allowed [info, debug]")
 		flag.StringVar(&cfg.Repository.PG.DSN, "d", cfg.Repository.PG.DSN, "Postgres data source name")
-		flag.StringVar(&cfg.TrustedSubnet, "t", cfg.TrustedSubnet, "trusted subnet")
+		flag.StringVar(&cfg.TrustedSubnet, "t", cfg.TrustedSubnet, "comma-separated CIDRs of trusted client subnets")
+		flag.StringVar(&cfg.TrustedProxies, "trusted-proxies", cfg.TrustedProxies, "comma-separated CIDRs of proxies whose X-Forwarded-For and X-Real-IP are honoured")
 		flag.StringVar(&cfg.Protocol, "p", cfg.Protocol, "server protocol, allowed [http, grpc]")
+		flag.IntVar(&cfg.HistorySize, "history-size", cfg.HistorySize, "recent values kept in memory per metric for dashboard charts")
+		flag.Int64Var(&cfg.Limits.MaxBodySize, "max-body-size", cfg.Limits.MaxBodySize, "max request body size in bytes")
+		flag.IntVar(&cfg.Limits.MaxBatchSize, "max-batch-size", cfg.Limits.MaxBatchSize, "max metrics count in one batch")
+		flag.IntVar(&cfg.Limits.MaxNameLength, "max-name-length", cfg.Limits.MaxNameLength, "max metric name length")
+		flag.Float64Var(&cfg.Quota.RequestsPerSecond, "quota-rps", cfg.Quota.RequestsPerSecond, "max update requests per second of one client")
+		flag.IntVar(&cfg.Quota.MetricsPerMinute, "quota-metrics-per-minute", cfg.Quota.MetricsPerMinute, "max updated metrics per minute of one client")
+		flag.IntVar(&cfg.Quota.MaxSeries, "quota-max-series", cfg.Quota.MaxSeries, "max series created by one client")
+		flag.IntVar(&cfg.Cardinality.MaxSeries, "cardinality-max-series", cfg.Cardinality.MaxSeries, "max series stored by server")
+		flag.Func("cardinality-prefix-limits", "comma separated max series of name prefixes, e.g. user_=1000", func(value string) error {
+			cfg.Cardinality.PrefixLimits = strings.Split(value, ",")
+			return nil
+		})
+		flag.StringVar(&cfg.StatsD.UDPAddress, "statsd-udp", cfg.StatsD.UDPAddress, "StatsD UDP listener address")
+		flag.StringVar(&cfg.StatsD.TCPAddress, "statsd-tcp", cfg.StatsD.TCPAddress, "StatsD TCP listener address")
+		flag.DurationVar(&cfg.StatsD.FlushInterval, "statsd-flush", cfg.StatsD.FlushInterval, "StatsD aggregation flush interval")
+		flag.StringVar(&cfg.Ingest.GraphiteAddress, "graphite", cfg.Ingest.GraphiteAddress, "Graphite plaintext TCP listener address")
+		flag.Func("counter-patterns", "comma separated name patterns of Graphite/InfluxDB samples stored as counters", func(value string) error {
+			cfg.Ingest.CounterPatterns = strings.Split(value, ",")
+			return nil
+		})
+		flag.Func("scrape-targets", "comma separated URLs of Prometheus format targets", func(value string) error {
+			for _, url := range strings.Split(value, ",") {
+				cfg.Scrape.Targets = append(cfg.Scrape.Targets, ScrapeTarget{Name: url, URL: url})
+			}
+			return nil
+		})
+		flag.DurationVar(&cfg.Scrape.Interval, "scrape-interval", cfg.Scrape.Interval, "default scrape interval")
+		flag.DurationVar(&cfg.Scrape.Timeout, "scrape-timeout", cfg.Scrape.Timeout, "default scrape timeout")
+		flag.DurationVar(&cfg.Alerting.Interval, "alert-interval", cfg.Alerting.Interval, "alert rules evaluation interval")
+		flag.Func("alert-rule", "alert rule in `name: expr` form, e.g. `LowMemory: gauge FreeMemory < 500MB for 2m`", func(value string) error {
+			name, expr, ok := strings.Cut(value, ":")
+			if !ok {
+				return fmt.Errorf("expected `name: expr`, got %v", value)
+			}
+			cfg.Alerting.Rules = append(cfg.Alerting.Rules, AlertRule{Name: strings.TrimSpace(name), Expr: strings.TrimSpace(expr)})
+			return nil
+		})
+		flag.Func("alert-webhooks", "comma separated alert webhook URLs", func(value string) error {
+			cfg.Alerting.Webhooks = strings.Split(value, ",")
+			return nil
+		})
+		flag.DurationVar(&cfg.Recording.Interval, "recording-interval", cfg.Recording.Interval, "recording rules evaluation interval")
+		flag.Func("record", "recording rule in `name = expr` form, e.g. `MemoryUsedRatio = 1 - FreeMemory / TotalMemory`", func(value string) error {
+			name, expr, ok := strings.Cut(value, "=")
+			if !ok {
+				return fmt.Errorf("expected `name = expr`, got %v", value)
+			}
+			cfg.Recording.Rules = append(cfg.Recording.Rules, RecordingRule{Name: strings.TrimSpace(name), Expr: strings.TrimSpace(expr)})
+			return nil
+		})
+		flag.Func("webhook", "metric change subscription in `pattern [type] [min_change] url` form", func(value string) error {
+			sub, err := ParseWebhookSubscription(value)
+			if err != nil {
+				return err
+			}
+			cfg.Webhooks.Subscriptions = append(cfg.Webhooks.Subscriptions, sub)
+			return nil
+		})
+		flag.IntVar(&cfg.Webhooks.QueueSize, "webhook-queue-size", cfg.Webhooks.QueueSize, "max pending webhook deliveries")
+		flag.IntVar(&cfg.Webhooks.Retries, "webhook-retries", cfg.Webhooks.Retries, "webhook delivery retries")
+		flag.StringVar(&cfg.Export.Format, "export-format", cfg.Export.Format, "export format, allowed [graphite, influx]")
+		flag.StringVar(&cfg.Export.Address, "export-address", cfg.Export.Address, "Graphite address or InfluxDB write URL to export metrics to")
+		flag.Func("export-patterns", "comma separated name patterns of exported metrics", func(value string) error {
+			cfg.Export.Patterns = strings.Split(value, ",")
+			return nil
+		})
+		flag.StringVar(&cfg.Export.Prefix, "export-prefix", cfg.Export.Prefix, "prefix of exported metric names")
+		flag.DurationVar(&cfg.Export.Interval, "export-interval", cfg.Export.Interval, "export interval")
+		flag.StringVar(&cfg.Upstream.Address, "upstream", cfg.Upstream.Address, "upstream server address to forward accepted updates to")
+		flag.StringVar(&cfg.Upstream.Protocol, "upstream-protocol", cfg.Upstream.Protocol, "upstream server protocol, allowed [http, grpc]")
+		flag.StringVar(&cfg.Upstream.HashKey, "upstream-key", cfg.Upstream.HashKey, "key for calculating hash of forwarded metrics")
+		flag.StringVar(&cfg.Upstream.Prefix, "upstream-prefix", cfg.Upstream.Prefix, "datacenter prefix of forwarded metric names")
+		flag.StringVar(&cfg.Upstream.BacklogFile, "upstream-backlog", cfg.Upstream.BacklogFile, "file keeping batches not sent to upstream")
+		flag.DurationVar(&cfg.Upstream.Interval, "upstream-interval", cfg.Upstream.Interval, "upstream forwarding interval")
+		flag.StringVar(&cfg.Cluster.Self, "cluster-self", cfg.Cluster.Self, "gRPC address of this server in cluster")
+		flag.Func("cluster-nodes", "comma separated gRPC addresses of all cluster servers", func(value string) error {
+			cfg.Cluster.Nodes = strings.Split(value, ",")
+			return nil
+		})
+		flag.StringVar(&cfg.Cluster.PeerSubnets, "cluster-peer-subnets", cfg.Cluster.PeerSubnets, "comma separated CIDRs of cluster nodes trusted to forward requests")
+		flag.StringVar(&cfg.Replication.Primary, "replica-of", cfg.Replication.Primary, "gRPC address of primary server, makes this server its read-only replica")
+		flag.IntVar(&cfg.Replication.BacklogSize, "replication-backlog", cfg.Replication.BacklogSize, "updates kept for reconnecting replicas")
+		flag.Func("label-tags", "comma separated Graphite/InfluxDB tags kept in metric names, * keeps all", func(value string) error {
+			cfg.Ingest.LabelTags = strings.Split(value, ",")
+			return nil
+		})
 
 		flag.Parse()
 	}
@@ -164,6 +1054,91 @@ func (cfg *ServerConfig) fromJSON(path string) error {
 	if err != nil {
 		log.Fatalf("can't unmarshal json config, reason: %v", err)
 	}
+
+	err = json.Unmarshal(data, &cfg.Limits)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg.Quota)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg.Cardinality)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg.StatsD)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg.Ingest)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg.Scrape)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg.Alerting)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg.Recording)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg.Webhooks)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg.Export)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg.TLS)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg.Upstream)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg.Cluster)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg.Replication)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg.Auth)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg.Keyring)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
+
+	err = json.Unmarshal(data, &cfg.Replay)
+	if err != nil {
+		log.Fatalf("can't unmarshal json config, reason: %v", err)
+	}
 	return nil
 }
 
@@ -171,11 +1146,27 @@ func NewServerConfig(options ...ServerOption) *ServerConfig {
 	cfg := &ServerConfig{
 		TrustedSubnet:        TrustedSubnetDefault,
 		Protocol:             ProtocolDefault,
+		HistorySize:          HistorySizeDefault,
 		CollectorAddress:     ServerAddressDefault,
 		ProfileAddress:       ProfileAddressDefault,
 		HashKey:              KeyDefault,
 		PrivateCryptoKeyPath: PrivateCryptoKeyPathDefault,
 		Logger:               newLoggerConfig(),
+		TLS:                  newTLSConfig(),
+		Limits:               newLimitsConfig(),
+		StatsD:               newStatsDConfig(),
+		Ingest:               newIngestConfig(),
+		Scrape:               newScrapeConfig(),
+		Alerting:             newAlertingConfig(),
+		Recording:            newRecordingConfig(),
+		Webhooks:             newWebhooksConfig(),
+		Export:               newExportConfig(),
+		Upstream:             newUpstreamConfig(),
+		Cluster:              newClusterConfig(),
+		Replication:          newReplicationConfig(),
+		Auth:                 newAuthConfig(),
+		Keyring:              newKeyringConfig(),
+		Replay:               newReplayConfig(),
 		Repository:           RepositoryConfig{RAMWithBackup: newBackupConfig(), PG: newPostgresConfig()},
 	}
 	for _, option := range options {
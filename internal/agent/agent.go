@@ -9,6 +9,8 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/unbeman/ya-prac-mcas/internal/agent/sender"
+	"github.com/unbeman/ya-prac-mcas/internal/cryptokeys"
+	"github.com/unbeman/ya-prac-mcas/internal/replay"
 	"github.com/unbeman/ya-prac-mcas/internal/utils"
 
 	"github.com/unbeman/ya-prac-mcas/configs"
@@ -20,15 +22,18 @@ type agentMetrics struct {
 	collection     *MetricsCollection
 	tickerPool     *utils.TickerPool
 	hashKey        []byte
+	keyID          string
+	stamped        bool
 	pollInterval   time.Duration
 	reportInterval time.Duration
 }
 
 func NewAgentMetrics(cfg *configs.AgentConfig) (*agentMetrics, error) {
-	pubKey, err := utils.GetPublicKey(cfg.PublicCryptoKeyPath)
-	if errors.Is(err, utils.ErrNoRSAKey) {
-		log.Warning("no public RSA key. Encryption disabled.")
-	} else {
+	pubKey, err := cryptokeys.LoadPublicKey(cfg.PublicCryptoKeyPath, cfg.CryptoKeyID)
+	switch {
+	case errors.Is(err, cryptokeys.ErrNoKey):
+		log.Warning("no public crypto key. Encryption disabled.")
+	case err != nil:
 		return nil, err
 	}
 
@@ -46,6 +51,8 @@ func NewAgentMetrics(cfg *configs.AgentConfig) (*agentMetrics, error) {
 		collection:     collector,
 		tickerPool:     tickerPool,
 		hashKey:        []byte(cfg.HashKey),
+		keyID:          cfg.KeyID,
+		stamped:        cfg.ReplayProtection,
 		pollInterval:   cfg.PollInterval,
 		reportInterval: cfg.ReportInterval,
 	}, nil
@@ -53,7 +60,9 @@ func NewAgentMetrics(cfg *configs.AgentConfig) (*agentMetrics, error) {
 
 func (am *agentMetrics) Report(ctx context.Context) {
 	paramSlice := am.prepareMetrics(am.collection.GetMetrics(ctx))
-	am.reporter.SendMetrics(ctx, paramSlice)
+	if err := am.reporter.SendMetrics(ctx, paramSlice); err != nil {
+		log.Error(err)
+	}
 }
 
 func (am *agentMetrics) Run(ctx context.Context) {
@@ -66,18 +75,31 @@ func (am *agentMetrics) Run(ctx context.Context) {
 	am.tickerPool.Wait()
 }
 
-func (am agentMetrics) getHash(metric metrics.Metric) string {
+func (am agentMetrics) getHash(metric metrics.Metric, timestamp int64, nonce string) string {
 	if len(am.hashKey) == 0 {
 		return ""
 	}
-	return metric.Hash(am.hashKey)
+	return replay.MetricHash(metric, am.hashKey, timestamp, nonce)
 }
 
+// prepareMetrics signs metrics, with replay protection they're signed along with timestamp and nonce of the batch.
 func (am agentMetrics) prepareMetrics(ms []metrics.Metric) metrics.ParamsSlice {
+	var (
+		timestamp int64
+		nonce     string
+	)
+	if am.stamped && len(am.hashKey) > 0 {
+		timestamp, nonce = time.Now().Unix(), replay.NewNonce()
+	}
+
 	paramSlice := make(metrics.ParamsSlice, 0, len(ms))
 	for _, metric := range ms {
 		params := metric.ToParams()
-		params.Hash = am.getHash(metric)
+		params.Hash = am.getHash(metric, timestamp, nonce)
+		if params.Hash != "" {
+			params.KeyID = am.keyID
+			params.Timestamp, params.Nonce = timestamp, nonce
+		}
 		paramSlice = append(paramSlice, params)
 	}
 	return paramSlice
@@ -2,18 +2,21 @@ package sender
 
 import (
 	"context"
-	"crypto/rsa"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/time/rate"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/encoding/gzip"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"time"
 
 	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/auth"
+	"github.com/unbeman/ya-prac-mcas/internal/cryptokeys"
 	"github.com/unbeman/ya-prac-mcas/internal/metrics"
 	"github.com/unbeman/ya-prac-mcas/internal/utils"
 	pb "github.com/unbeman/ya-prac-mcas/proto"
@@ -23,25 +26,38 @@ type GRPCSender struct {
 	client      pb.MetricsCollectorClient
 	timeout     time.Duration
 	rateLimiter *rate.Limiter
-	publicKey   *rsa.PublicKey
+	publicKey   cryptokeys.PublicKey
 }
 
-func NewGRPCSender(cfg configs.ConnectionConfig) (*GRPCSender, error) {
+func NewGRPCSender(cfg configs.ConnectionConfig, pubKey cryptokeys.PublicKey) (*GRPCSender, error) {
 	rl := rate.NewLimiter(rate.Every(defaultRate), cfg.RateTokensCount)
 
-	conn, err := grpc.Dial(cfg.Address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	tlsConfig, err := utils.GetClientTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	options := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if cfg.Token != "" {
+		options = append(options, grpc.WithPerRPCCredentials(auth.Credentials(cfg.Token)))
+	}
+
+	conn, err := grpc.Dial(cfg.Address, options...)
 	if err != nil {
 		return nil, fmt.Errorf("NewGRPCSender: can't dial to %s: %w", cfg.Address, err)
 	}
 	client := pb.NewMetricsCollectorClient(conn)
-	return &GRPCSender{client: client, timeout: cfg.ReportTimeout, rateLimiter: rl}, nil
+	return &GRPCSender{client: client, timeout: cfg.ReportTimeout, rateLimiter: rl, publicKey: pubKey}, nil
 }
 
-func (gs *GRPCSender) SendMetrics(ctx context.Context, slice metrics.ParamsSlice) {
+func (gs *GRPCSender) SendMetrics(ctx context.Context, slice metrics.ParamsSlice) error {
 	err := gs.rateLimiter.Wait(ctx)
 	if err != nil {
-		log.Error(err)
-		return
+		return err
 	}
 
 	ctx2, cancel := context.WithTimeout(ctx, gs.timeout)
@@ -49,23 +65,42 @@ func (gs *GRPCSender) SendMetrics(ctx context.Context, slice metrics.ParamsSlice
 
 	ip, err := utils.GetOutboundIP()
 	if err != nil {
-		log.Error(err)
-		return
+		return err
 	}
 
 	meta := metadata.New(map[string]string{"x-real-ip": ip})
 	ctx2 = metadata.NewOutgoingContext(ctx2, meta)
 
-	protMetrics := slice.ToProto()
+	request, err := gs.newRequest(slice)
+	if err != nil {
+		return err
+	}
 
-	_, err = gs.client.UpdateMetrics(ctx2, &pb.UpdateMetricsRequest{Metrics: protMetrics}, grpc.UseCompressor(gzip.Name))
+	_, err = gs.client.UpdateMetrics(ctx2, request, grpc.UseCompressor(gzip.Name))
 	if err != nil {
 		if e, ok := status.FromError(err); ok {
-			log.Errorf("SendMetrics: status code %d, msg: %s", e.Code(), e.Message())
-		} else {
-			log.Errorf("SendMetrics: %s", err)
+			return fmt.Errorf("SendMetrics: status code %d, msg: %s", e.Code(), e.Message())
 		}
+		return fmt.Errorf("SendMetrics: %w", err)
 	}
 
 	log.Info("Metrics send")
+	return nil
+}
+
+// newRequest returns request of metrics, they're sent as encrypted payload when public key is set.
+func (gs *GRPCSender) newRequest(slice metrics.ParamsSlice) (*pb.UpdateMetricsRequest, error) {
+	request := &pb.UpdateMetricsRequest{Metrics: slice.ToProto()}
+	if gs.publicKey == nil {
+		return request, nil
+	}
+	buf, err := proto.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("SendMetrics: %w", err)
+	}
+	data, encryptedKey, err := gs.publicKey.Encrypt(buf)
+	if err != nil {
+		return nil, fmt.Errorf("SendMetrics: %w", err)
+	}
+	return &pb.UpdateMetricsRequest{Encrypted: &pb.EncryptedPayload{Data: data, Key: encryptedKey, KeyId: gs.publicKey.ID()}}, nil
 }
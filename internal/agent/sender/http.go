@@ -4,7 +4,6 @@ package sender
 import (
 	"bytes"
 	"context"
-	"crypto/rsa"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -16,6 +15,8 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/auth"
+	"github.com/unbeman/ya-prac-mcas/internal/cryptokeys"
 	"github.com/unbeman/ya-prac-mcas/internal/utils"
 
 	"github.com/unbeman/ya-prac-mcas/internal/metrics"
@@ -23,30 +24,54 @@ import (
 
 type httpSender struct {
 	client      http.Client
-	address     string
+	baseURL     string
 	timeout     time.Duration
 	rateLimiter *rate.Limiter
-	publicKey   *rsa.PublicKey
+	publicKey   cryptokeys.PublicKey
+	contentType string
+	token       string
 }
 
-func NewHTTPSender(cfg configs.ConnectionConfig, pubKey *rsa.PublicKey) (*httpSender, error) {
+func NewHTTPSender(cfg configs.ConnectionConfig, pubKey cryptokeys.PublicKey) (*httpSender, error) {
+	tlsConfig, err := utils.GetClientTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
 	client := http.Client{Timeout: cfg.ClientTimeout}
+	scheme := "http"
+	if tlsConfig != nil {
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+		scheme = "https"
+	}
 	rl := rate.NewLimiter(rate.Every(defaultRate), cfg.RateTokensCount) // не больше RateTokensCount запросов в секунду.
 	return &httpSender{
 		client:      client,
-		address:     cfg.Address,
+		baseURL:     fmt.Sprintf("%s://%s", scheme, cfg.Address),
 		timeout:     cfg.ReportTimeout,
 		rateLimiter: rl,
 		publicKey:   pubKey,
+		contentType: getContentType(cfg.Format),
+		token:       cfg.Token,
 	}, nil
 }
 
+func getContentType(format string) string {
+	switch format {
+	case configs.ProtobufFormat:
+		return metrics.ProtobufContentType
+	case configs.NDJSONFormat:
+		return metrics.NDJSONContentType
+	default:
+		return metrics.JSONContentType
+	}
+}
+
 func (h *httpSender) SendMetric(ctx context.Context, mp metrics.Params) {
 	h.rateLimiter.Wait(ctx)
 	ctx2, cancel := context.WithTimeout(ctx, h.timeout)
 	defer cancel()
 
-	url := FormatURL(h.address, mp)
+	url := FormatURL(h.baseURL, mp)
 
 	request, err := http.NewRequestWithContext(ctx2, http.MethodPost, url, nil)
 	if err != nil {
@@ -61,6 +86,7 @@ func (h *httpSender) SendMetric(ctx context.Context, mp metrics.Params) {
 		return
 	}
 	request.Header.Set("X-Real-IP", ip)
+	h.authorize(request)
 
 	response, err := h.client.Do(request)
 	if err != nil {
@@ -83,7 +109,7 @@ func (h *httpSender) SendJSONMetric(ctx context.Context, mp metrics.Params) {
 	ctx2, cancel := context.WithTimeout(ctx, h.timeout)
 	defer cancel()
 
-	url := fmt.Sprintf("http://%s/update", h.address) //TODO: wrap
+	url := h.baseURL + "/update/"
 
 	buf, err := json.Marshal(mp)
 	if err != nil {
@@ -94,7 +120,7 @@ func (h *httpSender) SendJSONMetric(ctx context.Context, mp metrics.Params) {
 	var encryptedKey string
 
 	if h.publicKey != nil {
-		buf, encryptedKey, err = utils.GetEncryptedMessage(h.publicKey, buf)
+		buf, encryptedKey, err = h.publicKey.Encrypt(buf)
 		if err != nil {
 			log.Errorf("encryption err, %v", err)
 			return
@@ -108,7 +134,7 @@ func (h *httpSender) SendJSONMetric(ctx context.Context, mp metrics.Params) {
 	}
 	request.Header.Set("Content-Type", "text/plain")
 
-	request.Header.Set("Encrypted-Key", encryptedKey)
+	h.setEncryptionHeaders(request, encryptedKey)
 
 	ip, err := utils.GetOutboundIP()
 	if err != nil {
@@ -116,6 +142,7 @@ func (h *httpSender) SendJSONMetric(ctx context.Context, mp metrics.Params) {
 		return
 	}
 	request.Header.Set("X-Real-IP", ip)
+	h.authorize(request)
 
 	response, err := h.client.Do(request)
 	if err != nil {
@@ -133,68 +160,77 @@ func (h *httpSender) SendJSONMetric(ctx context.Context, mp metrics.Params) {
 	log.Debugf("Received status code: %v for post request to %v\n", response.StatusCode, url)
 }
 
-func (h *httpSender) SendMetrics(ctx context.Context, slice metrics.ParamsSlice) {
+func (h *httpSender) SendMetrics(ctx context.Context, slice metrics.ParamsSlice) error {
 	err := h.rateLimiter.Wait(ctx)
 	if err != nil {
-		log.Error(err)
-		return
+		return err
 	}
 
 	ctx2, cancel := context.WithTimeout(ctx, h.timeout)
 	defer cancel()
 
-	url := fmt.Sprintf("http://%s/updates/", h.address) //TODO: wrap
-	buf, err := json.Marshal(slice)
+	url := h.baseURL + "/updates/"
+	body := bytes.Buffer{}
+	err = slice.Encode(&body, h.contentType)
 	if err != nil {
-		log.Errorf("json marshal failed, %v", err)
-		return
+		return fmt.Errorf("marshal failed, %w", err)
 	}
+	buf := body.Bytes()
 
 	var encryptedKey string
 
 	if h.publicKey != nil {
-		buf, encryptedKey, err = utils.GetEncryptedMessage(h.publicKey, buf)
+		buf, encryptedKey, err = h.publicKey.Encrypt(buf)
 		if err != nil {
-			log.Errorf("encryption err, %v", err)
-			return
+			return fmt.Errorf("encryption err, %w", err)
 		}
 	}
 
 	request, err := http.NewRequestWithContext(ctx2, http.MethodPost, url, bytes.NewBuffer(buf))
 	if err != nil {
-		log.Error(err)
-		return
+		return err
 	}
-	request.Header.Set("Content-Type", "text/plain")
+	request.Header.Set("Content-Type", h.contentType)
+	request.Header.Set("Accept", h.contentType)
 
-	request.Header.Set("Encrypted-Key", encryptedKey)
+	h.setEncryptionHeaders(request, encryptedKey)
 
 	ip, err := utils.GetOutboundIP()
 	if err != nil {
-		log.Error(err)
-		return
+		return err
 	}
 	request.Header.Set("X-Real-IP", ip)
+	h.authorize(request)
 
 	response, err := h.client.Do(request)
 	if err != nil {
-		log.Error(err)
-		return
+		return err
 	}
 	defer response.Body.Close()
 
 	_, err = io.Copy(io.Discard, response.Body)
 	if err != nil {
-		log.Error(err)
-		return
+		return err
 	}
 
-	log.Info("Metrics send")
 	log.Debugf("Received status code: %v for post request to %v\n", response.StatusCode, url)
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("SendMetrics: unexpected status code %v", response.StatusCode)
+	}
+	log.Info("Metrics send")
+	return nil
+}
+
+// authorize sets bearer token of request when it's configured.
+func (h *httpSender) authorize(request *http.Request) {
+	if h.token != "" {
+		request.Header.Set("Authorization", auth.BearerHeader(h.token))
+	}
 }
 
-func FormatURL(addr string, mp metrics.Params) string {
-	url := fmt.Sprintf("http://%v/update/%v/%v/", addr, mp.Type, mp.Name)
+// FormatURL returns URL of metric update, baseURL is server scheme and address.
+func FormatURL(baseURL string, mp metrics.Params) string {
+	url := fmt.Sprintf("%v/update/%v/%v/", baseURL, mp.Type, mp.Name)
 	switch mp.Type {
 	case metrics.GaugeType:
 		url += fmt.Sprint(*mp.ValueGauge)
@@ -203,3 +239,11 @@ func FormatURL(addr string, mp metrics.Params) string {
 	}
 	return url
 }
+
+// setEncryptionHeaders sets encrypted AES key and ID of server key decrypting the body.
+func (h *httpSender) setEncryptionHeaders(request *http.Request, encryptedKey string) {
+	request.Header.Set(cryptokeys.EncryptedKeyHeader, encryptedKey)
+	if h.publicKey != nil && h.publicKey.ID() != cryptokeys.DefaultKeyID {
+		request.Header.Set(cryptokeys.KeyIDHeader, h.publicKey.ID())
+	}
+}
@@ -2,23 +2,24 @@ package sender
 
 import (
 	"context"
-	"crypto/rsa"
 	"time"
 
 	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/cryptokeys"
 	"github.com/unbeman/ya-prac-mcas/internal/metrics"
 )
 
 const defaultRate = 1 * time.Second
 
+// Sender sends metrics batch to server, error is returned when server didn't accept the batch.
 type Sender interface {
-	SendMetrics(ctx context.Context, slice metrics.ParamsSlice)
+	SendMetrics(ctx context.Context, slice metrics.ParamsSlice) error
 }
 
-func GetSender(cfg configs.ConnectionConfig, pubKey *rsa.PublicKey) (Sender, error) {
+func GetSender(cfg configs.ConnectionConfig, pubKey cryptokeys.PublicKey) (Sender, error) {
 	switch cfg.Protocol {
 	case configs.GRPCProtocol:
-		return NewGRPCSender(cfg)
+		return NewGRPCSender(cfg, pubKey)
 	default:
 		return NewHTTPSender(cfg, pubKey)
 	}
@@ -0,0 +1,173 @@
+package alerting
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+)
+
+// Alert states.
+const (
+	PendingState  = "pending"
+	FiringState   = "firing"
+	ResolvedState = "resolved"
+)
+
+// Alert describes active or just resolved alert.
+type Alert struct {
+	Rule       string     `json:"rule"`
+	Expr       string     `json:"expr"`
+	State      string     `json:"state"`
+	Value      float64    `json:"value"`
+	ActiveAt   time.Time  `json:"active_at"`
+	FiredAt    *time.Time `json:"fired_at,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// counterSample is previous counter value used for rate calculation.
+type counterSample struct {
+	value int64
+	at    time.Time
+}
+
+// Engine evaluates rules against current metrics values.
+// Notifications are sent only on transitions to firing and resolved states,
+// so a firing alert is reported once.
+type Engine struct {
+	sync.RWMutex
+	control  *controller.Controller
+	notifier Notifier
+	interval time.Duration
+	rules    []Rule
+	active   map[string]*Alert
+	previous map[string]counterSample
+	now      func() time.Time
+}
+
+// NewEngine creates Engine, returns error on invalid rules.
+func NewEngine(cfg configs.AlertingConfig, control *controller.Controller) (*Engine, error) {
+	e := &Engine{
+		control:  control,
+		notifier: NewWebhookNotifier(cfg.Webhooks, cfg.WebhookTimeout),
+		interval: cfg.Interval,
+		active:   map[string]*Alert{},
+		previous: map[string]counterSample{},
+		now:      time.Now,
+	}
+	names := map[string]struct{}{}
+	for _, ruleCfg := range cfg.Rules {
+		rule, err := ParseRule(ruleCfg.Name, ruleCfg.Expr)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := names[rule.Name]; ok {
+			return nil, errors.New("duplicate alert rule name " + rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+		e.rules = append(e.rules, rule)
+	}
+	return e, nil
+}
+
+// Start adds evaluation task to pool, nothing is started without rules.
+func (e *Engine) Start(ctx context.Context, pool *utils.TickerPool) {
+	if len(e.rules) == 0 {
+		return
+	}
+	pool.AddTask(ctx, "EvaluateAlerts", e.Evaluate, e.interval)
+}
+
+// Alerts returns pending and firing alerts sorted by rule name.
+func (e *Engine) Alerts() []Alert {
+	e.RLock()
+	defer e.RUnlock()
+	alerts := make([]Alert, 0, len(e.active))
+	for _, alert := range e.active {
+		alerts = append(alerts, *alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Rule < alerts[j].Rule })
+	return alerts
+}
+
+// Evaluate checks all rules once and notifies about state changes.
+func (e *Engine) Evaluate(ctx context.Context) {
+	var fired, resolved []Alert
+
+	e.Lock()
+	now := e.now()
+	for _, rule := range e.rules {
+		value, ok, err := e.value(ctx, rule, now)
+		if err != nil {
+			log.Errorf("alert rule %v evaluation failed: %v", rule.Name, err)
+			continue
+		}
+
+		alert, isActive := e.active[rule.Name]
+		switch {
+		case ok && rule.Matches(value):
+			if !isActive {
+				alert = &Alert{Rule: rule.Name, Expr: rule.Expr, State: PendingState, ActiveAt: now}
+				e.active[rule.Name] = alert
+			}
+			alert.Value = value
+			if alert.State == PendingState && now.Sub(alert.ActiveAt) >= rule.For {
+				firedAt := now
+				alert.State, alert.FiredAt = FiringState, &firedAt
+				fired = append(fired, *alert)
+			}
+		case isActive:
+			delete(e.active, rule.Name)
+			if alert.State == FiringState {
+				resolvedAt := now
+				alert.State, alert.ResolvedAt = ResolvedState, &resolvedAt
+				resolved = append(resolved, *alert)
+			}
+		}
+	}
+	e.Unlock()
+
+	if len(fired) > 0 {
+		e.notifier.Notify(ctx, Notification{Status: FiringState, Alerts: fired})
+	}
+	if len(resolved) > 0 {
+		e.notifier.Notify(ctx, Notification{Status: ResolvedState, Alerts: resolved})
+	}
+}
+
+// value returns current value of rule metric, false is returned when there is no data yet.
+func (e *Engine) value(ctx context.Context, rule Rule, now time.Time) (float64, bool, error) {
+	metric, err := e.control.GetMetric(ctx, metrics.Params{Name: rule.Metric, Type: rule.Type})
+	if errors.Is(err, storage.ErrNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch m := metric.(type) {
+	case metrics.Gauge:
+		return m.Value(), true, nil
+	case metrics.Counter:
+		if !rule.Rate {
+			return float64(m.Value()), true, nil
+		}
+		previous, seen := e.previous[rule.Name]
+		e.previous[rule.Name] = counterSample{value: m.Value(), at: now}
+		elapsed := now.Sub(previous.at).Seconds()
+		if !seen || elapsed <= 0 {
+			return 0, false, nil
+		}
+		return float64(m.Value()-previous.value) / elapsed, true, nil
+	}
+	return 0, false, nil
+}
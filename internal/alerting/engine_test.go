@@ -0,0 +1,124 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+)
+
+type fakeNotifier struct {
+	notifications []Notification
+}
+
+func (f *fakeNotifier) Notify(ctx context.Context, notification Notification) {
+	f.notifications = append(f.notifications, notification)
+}
+
+func TestEngine_Evaluate(t *testing.T) {
+	ctx := context.Background()
+	repository := storage.NewRAMRepository()
+	engine, err := NewEngine(configs.AlertingConfig{Rules: []configs.AlertRule{
+		{Name: "LowMemory", Expr: "gauge FreeMemory < 500MB for 2m"},
+	}}, controller.NewController(repository, ""))
+	require.NoError(t, err)
+
+	notifier := &fakeNotifier{}
+	engine.notifier = notifier
+	now := time.Now()
+	engine.now = func() time.Time { return now }
+
+	// no data
+	engine.Evaluate(ctx)
+	assert.Empty(t, engine.Alerts())
+
+	_, err = repository.SetGauge(ctx, "FreeMemory", 100<<20)
+	require.NoError(t, err)
+	engine.Evaluate(ctx)
+	require.Len(t, engine.Alerts(), 1)
+	assert.Equal(t, PendingState, engine.Alerts()[0].State)
+	assert.Empty(t, notifier.notifications)
+
+	now = now.Add(2 * time.Minute)
+	engine.Evaluate(ctx)
+	assert.Equal(t, FiringState, engine.Alerts()[0].State)
+	require.Len(t, notifier.notifications, 1)
+	assert.Equal(t, FiringState, notifier.notifications[0].Status)
+
+	// deduplication
+	now = now.Add(time.Minute)
+	engine.Evaluate(ctx)
+	assert.Len(t, notifier.notifications, 1)
+
+	_, err = repository.SetGauge(ctx, "FreeMemory", 1<<30)
+	require.NoError(t, err)
+	engine.Evaluate(ctx)
+	assert.Empty(t, engine.Alerts())
+	require.Len(t, notifier.notifications, 2)
+	assert.Equal(t, ResolvedState, notifier.notifications[1].Status)
+	assert.NotNil(t, notifier.notifications[1].Alerts[0].ResolvedAt)
+}
+
+func TestEngine_EvaluateRate(t *testing.T) {
+	ctx := context.Background()
+	repository := storage.NewRAMRepository()
+	engine, err := NewEngine(configs.AlertingConfig{Rules: []configs.AlertRule{
+		{Name: "TooManyPolls", Expr: "rate counter PollCount > 1"},
+	}}, controller.NewController(repository, ""))
+	require.NoError(t, err)
+
+	notifier := &fakeNotifier{}
+	engine.notifier = notifier
+	now := time.Now()
+	engine.now = func() time.Time { return now }
+
+	_, err = repository.AddCounter(ctx, "PollCount", 10)
+	require.NoError(t, err)
+	engine.Evaluate(ctx)
+	assert.Empty(t, engine.Alerts(), "rate needs two samples")
+
+	_, err = repository.AddCounter(ctx, "PollCount", 100)
+	require.NoError(t, err)
+	now = now.Add(10 * time.Second)
+	engine.Evaluate(ctx)
+	require.Len(t, engine.Alerts(), 1)
+	assert.Equal(t, FiringState, engine.Alerts()[0].State)
+	assert.Equal(t, 10.0, engine.Alerts()[0].Value)
+}
+
+func TestNewEngine_Invalid(t *testing.T) {
+	_, err := NewEngine(configs.AlertingConfig{Rules: []configs.AlertRule{
+		{Name: "A", Expr: "gauge FreeMemory < 1"},
+		{Name: "A", Expr: "gauge FreeMemory < 2"},
+	}}, nil)
+	assert.Error(t, err)
+
+	_, err = NewEngine(configs.AlertingConfig{Rules: []configs.AlertRule{{Name: "A", Expr: "gauge"}}}, nil)
+	assert.ErrorIs(t, err, ErrInvalidRule)
+}
+
+func TestWebhookNotifier_Notify(t *testing.T) {
+	received := make(chan Notification, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification Notification
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&notification))
+		received <- notification
+	}))
+	defer webhook.Close()
+
+	notifier := NewWebhookNotifier([]string{webhook.URL}, time.Second)
+	notifier.Notify(context.Background(), Notification{Status: FiringState, Alerts: []Alert{{Rule: "LowMemory"}}})
+
+	notification := <-received
+	assert.Equal(t, FiringState, notification.Status)
+	assert.Equal(t, "LowMemory", notification.Alerts[0].Rule)
+}
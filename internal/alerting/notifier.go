@@ -0,0 +1,69 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Notification is a JSON body POSTed to webhooks.
+type Notification struct {
+	Status string  `json:"status"`
+	Alerts []Alert `json:"alerts"`
+}
+
+// Notifier delivers notifications about alert state changes.
+type Notifier interface {
+	Notify(ctx context.Context, notification Notification)
+}
+
+// WebhookNotifier POSTs notifications as JSON to every configured URL.
+type WebhookNotifier struct {
+	client http.Client
+	urls   []string
+}
+
+// NewWebhookNotifier creates WebhookNotifier.
+func NewWebhookNotifier(urls []string, timeout time.Duration) *WebhookNotifier {
+	return &WebhookNotifier{client: http.Client{Timeout: timeout}, urls: urls}
+}
+
+// Notify sends notification, delivery errors are logged.
+func (w *WebhookNotifier) Notify(ctx context.Context, notification Notification) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		log.Errorf("alert notification marshal failed, %v", err)
+		return
+	}
+	for _, url := range w.urls {
+		if err = w.post(ctx, url, body); err != nil {
+			log.Errorf("alert webhook %v failed: %v", url, err)
+		}
+	}
+}
+
+func (w *WebhookNotifier) post(ctx context.Context, url string, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+
+	if response.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("unexpected status code %v", response.StatusCode)
+	}
+	return nil
+}
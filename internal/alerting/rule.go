@@ -0,0 +1,127 @@
+// Package alerting describes threshold alert rules evaluation and notifications.
+package alerting
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+// RateKind marks rule over per-second increase of a counter.
+const RateKind = "rate"
+
+var ErrInvalidRule = errors.New("invalid alert rule")
+
+// byte size suffixes, powers of 1024.
+var sizeUnits = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1},
+}
+
+// Rule is a parsed alert condition.
+//
+// Syntax: `[rate] <gauge|counter> <name> <op> <threshold>[unit] [for <duration>]`,
+// where op is one of <, <=, >, >=, ==, != and unit is one of B, KB, MB, GB, TB.
+// For example: `gauge FreeMemory < 500MB for 2m` or `rate counter PollCount > 10`.
+type Rule struct {
+	Name      string
+	Expr      string
+	Rate      bool
+	Type      string
+	Metric    string
+	Op        string
+	Threshold float64
+	For       time.Duration
+}
+
+// ParseRule parses rule expression.
+func ParseRule(name, expr string) (Rule, error) {
+	rule := Rule{Name: name, Expr: expr}
+	if name == "" {
+		return rule, fmt.Errorf("%w: (%v) no name", ErrInvalidRule, expr)
+	}
+
+	tokens := strings.Fields(expr)
+	if len(tokens) > 0 && tokens[0] == RateKind {
+		rule.Rate = true
+		tokens = tokens[1:]
+	}
+	if len(tokens) != 4 && len(tokens) != 6 {
+		return rule, fmt.Errorf("%w: (%v) expected `[rate] type name op threshold [for duration]`", ErrInvalidRule, expr)
+	}
+
+	rule.Type, rule.Metric, rule.Op = tokens[0], tokens[1], tokens[2]
+	if err := metrics.CheckType(rule.Type); err != nil {
+		return rule, fmt.Errorf("%w: (%v) %v", ErrInvalidRule, expr, err)
+	}
+	if rule.Rate && rule.Type != metrics.CounterType {
+		return rule, fmt.Errorf("%w: (%v) rate is allowed only for counters", ErrInvalidRule, expr)
+	}
+	if _, err := compare(rule.Op, 0, 0); err != nil {
+		return rule, fmt.Errorf("%w: (%v) %v", ErrInvalidRule, expr, err)
+	}
+
+	threshold, err := parseThreshold(tokens[3])
+	if err != nil {
+		return rule, fmt.Errorf("%w: (%v) threshold - %v", ErrInvalidRule, expr, err)
+	}
+	rule.Threshold = threshold
+
+	if len(tokens) == 6 {
+		if tokens[4] != "for" {
+			return rule, fmt.Errorf("%w: (%v) expected `for`, got %v", ErrInvalidRule, expr, tokens[4])
+		}
+		rule.For, err = time.ParseDuration(tokens[5])
+		if err != nil {
+			return rule, fmt.Errorf("%w: (%v) duration - %v", ErrInvalidRule, expr, err)
+		}
+	}
+	return rule, nil
+}
+
+// Matches checks condition for value.
+func (r Rule) Matches(value float64) bool {
+	ok, _ := compare(r.Op, value, r.Threshold)
+	return ok
+}
+
+func compare(op string, value, threshold float64) (bool, error) {
+	switch op {
+	case "<":
+		return value < threshold, nil
+	case "<=":
+		return value <= threshold, nil
+	case ">":
+		return value > threshold, nil
+	case ">=":
+		return value >= threshold, nil
+	case "==":
+		return value == threshold, nil
+	case "!=":
+		return value != threshold, nil
+	default:
+		return false, fmt.Errorf("unknown operator %v", op)
+	}
+}
+
+func parseThreshold(raw string) (float64, error) {
+	multiplier := 1.0
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(raw, unit.suffix) {
+			raw = strings.TrimSuffix(raw, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return 0, err
+	}
+	return value * multiplier, nil
+}
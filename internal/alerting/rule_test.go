@@ -0,0 +1,55 @@
+package alerting
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		want    Rule
+		wantErr bool
+	}{
+		{
+			name: "gauge with unit and duration",
+			expr: "gauge FreeMemory < 500MB for 2m",
+			want: Rule{Name: "r", Expr: "gauge FreeMemory < 500MB for 2m", Type: "gauge", Metric: "FreeMemory",
+				Op: "<", Threshold: 500 * 1024 * 1024, For: 2 * time.Minute},
+		},
+		{
+			name: "counter",
+			expr: "counter PollCount >= 1000",
+			want: Rule{Name: "r", Expr: "counter PollCount >= 1000", Type: "counter", Metric: "PollCount",
+				Op: ">=", Threshold: 1000},
+		},
+		{
+			name: "counter rate",
+			expr: "rate counter PollCount > 0.5 for 30s",
+			want: Rule{Name: "r", Expr: "rate counter PollCount > 0.5 for 30s", Rate: true, Type: "counter",
+				Metric: "PollCount", Op: ">", Threshold: 0.5, For: 30 * time.Second},
+		},
+		{name: "rate of gauge", expr: "rate gauge FreeMemory > 1", wantErr: true},
+		{name: "unknown type", expr: "fruit Apple > 1", wantErr: true},
+		{name: "unknown operator", expr: "gauge FreeMemory ~ 1", wantErr: true},
+		{name: "invalid threshold", expr: "gauge FreeMemory < lots", wantErr: true},
+		{name: "invalid duration", expr: "gauge FreeMemory < 1 for ever", wantErr: true},
+		{name: "no for keyword", expr: "gauge FreeMemory < 1 during 2m", wantErr: true},
+		{name: "too short", expr: "gauge FreeMemory <", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRule("r", tt.expr)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidRule)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
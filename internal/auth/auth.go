@@ -0,0 +1,192 @@
+// Package auth checks API tokens and their scopes.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+)
+
+// Token scopes, admin scope allows everything but peer scope.
+// Peer scope is granted to cluster nodes, it allows reading and writing,
+// and it's required to forward requests between nodes.
+const (
+	ReadScope  = "read"
+	WriteScope = "write"
+	AdminScope = "admin"
+	PeerScope  = "peer"
+)
+
+var (
+	ErrUnauthenticated = errors.New("missing or invalid API token")
+	ErrForbidden       = errors.New("API token scope is insufficient")
+	ErrInvalidScope    = errors.New("invalid token scope")
+)
+
+const bearerPrefix = "bearer "
+
+// Token describes API token, only SHA-256 hash of the secret is kept.
+type Token struct {
+	Name   string
+	Hash   string
+	Scopes []string
+}
+
+// Allows reports if token grants scope.
+func (t Token) Allows(scope string) bool {
+	for _, s := range t.Scopes {
+		switch {
+		case s == scope:
+			return true
+		case s == AdminScope && scope != PeerScope:
+			return true
+		case s == PeerScope && (scope == ReadScope || scope == WriteScope):
+			return true
+		}
+	}
+	return false
+}
+
+// HashToken returns hex encoded SHA-256 hash of token secret.
+func HashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseBearer returns token of Authorization header value, it's empty for other schemes.
+func ParseBearer(header string) string {
+	if len(header) < len(bearerPrefix) || !strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		return ""
+	}
+	return strings.TrimSpace(header[len(bearerPrefix):])
+}
+
+// BearerHeader returns Authorization header value of token.
+func BearerHeader(secret string) string {
+	return "Bearer " + secret
+}
+
+func validateScopes(scopes []string) error {
+	for _, scope := range scopes {
+		switch scope {
+		case ReadScope, WriteScope, AdminScope, PeerScope:
+		default:
+			return fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+		}
+	}
+	return nil
+}
+
+// Source loads currently valid tokens.
+type Source interface {
+	Load(ctx context.Context) ([]Token, error)
+}
+
+// Authenticator checks tokens loaded from Source, they are reloaded periodically,
+// so added and revoked tokens take effect without restart.
+type Authenticator struct {
+	mu       sync.RWMutex
+	source   Source
+	interval time.Duration
+	tokens   map[string]Token
+}
+
+// NewAuthenticator creates Authenticator and loads tokens of source.
+func NewAuthenticator(ctx context.Context, source Source, interval time.Duration) (*Authenticator, error) {
+	a := &Authenticator{source: source, interval: interval}
+	if err := a.Reload(ctx); err != nil {
+		return nil, fmt.Errorf("can't load API tokens: %w", err)
+	}
+	return a, nil
+}
+
+// Start runs periodic reload of tokens.
+func (a *Authenticator) Start(ctx context.Context, pool *utils.TickerPool) {
+	pool.AddTask(ctx, "API tokens reload", func(ctx context.Context) {
+		if err := a.Reload(ctx); err != nil {
+			log.Errorf("Can't reload API tokens, previous tokens are kept: %v", err)
+		}
+	}, a.interval)
+}
+
+// Reload replaces tokens by the ones of source, on error previous tokens are kept.
+func (a *Authenticator) Reload(ctx context.Context) error {
+	list, err := a.source.Load(ctx)
+	if err != nil {
+		return err
+	}
+	tokens := make(map[string]Token, len(list))
+	for _, token := range list {
+		if err = validateScopes(token.Scopes); err != nil {
+			return fmt.Errorf("token %v: %w", token.Name, err)
+		}
+		tokens[token.Hash] = token
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tokens = tokens
+	return nil
+}
+
+// Authorize returns token of secret if it grants scope.
+func (a *Authenticator) Authorize(secret, scope string) (Token, error) {
+	if secret == "" {
+		return Token{}, ErrUnauthenticated
+	}
+	a.mu.RLock()
+	token, ok := a.tokens[HashToken(secret)]
+	a.mu.RUnlock()
+	if !ok {
+		return Token{}, ErrUnauthenticated
+	}
+	if !token.Allows(scope) {
+		return token, fmt.Errorf("%w: %v requires %v scope", ErrForbidden, token.Name, scope)
+	}
+	return token, nil
+}
+
+// Close releases tokens source.
+func (a *Authenticator) Close() error {
+	if closer, ok := a.source.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type tokenKey struct{}
+
+// WithToken returns context of request authorized by token.
+func WithToken(ctx context.Context, token Token) context.Context {
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// FromContext returns token of authorized request.
+func FromContext(ctx context.Context) (Token, bool) {
+	token, ok := ctx.Value(tokenKey{}).(Token)
+	return token, ok
+}
+
+// Credentials attaches token to gRPC requests.
+type Credentials string
+
+// GetRequestMetadata implements credentials.PerRPCCredentials.
+func (c Credentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": BearerHeader(string(c))}, nil
+}
+
+// RequireTransportSecurity implements credentials.PerRPCCredentials,
+// tokens are sent over plaintext connections too as TLS is optional.
+func (c Credentials) RequireTransportSecurity() bool {
+	return false
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTokens(t *testing.T, path, data string) {
+	require.NoError(t, os.WriteFile(path, []byte(data), 0600))
+}
+
+func TestAuthenticator_Authorize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	writeTokens(t, path, `[
+		{"name": "dashboard", "token": "read-secret", "scopes": ["read"]},
+		{"name": "agent", "token_sha256": "`+HashToken("write-secret")+`", "scopes": ["write"]},
+		{"name": "operator", "token": "admin-secret", "scopes": ["admin"]},
+		{"name": "node", "token": "peer-secret", "scopes": ["peer"]}
+	]`)
+	authenticator, err := NewAuthenticator(context.Background(), NewFileSource(path), 0)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		secret  string
+		scope   string
+		wantErr error
+	}{
+		{name: "read token reads", secret: "read-secret", scope: ReadScope},
+		{name: "read token can't write", secret: "read-secret", scope: WriteScope, wantErr: ErrForbidden},
+		{name: "hashed write token writes", secret: "write-secret", scope: WriteScope},
+		{name: "write token can't read", secret: "write-secret", scope: ReadScope, wantErr: ErrForbidden},
+		{name: "admin token allows everything", secret: "admin-secret", scope: WriteScope},
+		{name: "admin token isn't cluster peer", secret: "admin-secret", scope: PeerScope, wantErr: ErrForbidden},
+		{name: "peer token writes", secret: "peer-secret", scope: WriteScope},
+		{name: "peer token isn't admin", secret: "peer-secret", scope: AdminScope, wantErr: ErrForbidden},
+		{name: "unknown token", secret: "guess", scope: ReadScope, wantErr: ErrUnauthenticated},
+		{name: "no token", scope: ReadScope, wantErr: ErrUnauthenticated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := authenticator.Authorize(tt.secret, tt.scope)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestAuthenticator_Reload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	writeTokens(t, path, `[{"name": "agent", "token": "secret", "scopes": ["write"]}]`)
+	authenticator, err := NewAuthenticator(context.Background(), NewFileSource(path), 0)
+	require.NoError(t, err)
+	_, err = authenticator.Authorize("secret", WriteScope)
+	require.NoError(t, err)
+
+	// broken file keeps previous tokens
+	writeTokens(t, path, `[{"name": "agent", "token": "secret", "scopes": ["everything"]}]`)
+	assert.ErrorIs(t, authenticator.Reload(context.Background()), ErrInvalidScope)
+	_, err = authenticator.Authorize("secret", WriteScope)
+	assert.NoError(t, err)
+
+	// removed token is revoked
+	writeTokens(t, path, `[{"name": "other", "token": "other-secret", "scopes": ["write"]}]`)
+	require.NoError(t, authenticator.Reload(context.Background()))
+	_, err = authenticator.Authorize("secret", WriteScope)
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+}
+
+func TestParseBearer(t *testing.T) {
+	assert.Equal(t, "secret", ParseBearer("Bearer secret"))
+	assert.Equal(t, "secret", ParseBearer("bearer  secret"))
+	assert.Empty(t, ParseBearer("Basic dXNlcjpwYXNz"))
+	assert.Empty(t, ParseBearer(""))
+}
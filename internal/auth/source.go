@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/pressly/goose/v3"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+)
+
+// GetSource returns tokens source of config, PG is used when tokens are stored in database.
+func GetSource(cfg configs.AuthConfig, pg *configs.PostgresConfig) (Source, error) {
+	switch {
+	case cfg.TokensFromDB:
+		if pg == nil {
+			return nil, errors.New("API tokens are stored in database, but database isn't configured")
+		}
+		return NewPostgresSource(*pg)
+	default:
+		return NewFileSource(cfg.TokensFile), nil
+	}
+}
+
+// fileToken is token entry of tokens file, secret is set either in plain or as SHA-256 hash.
+type fileToken struct {
+	Name   string   `json:"name"`
+	Token  string   `json:"token,omitempty"`
+	SHA256 string   `json:"token_sha256,omitempty"`
+	Scopes []string `json:"scopes"`
+}
+
+// FileSource reads tokens of JSON file, e.g.
+//
+//	[{"name": "dashboard", "token": "secret", "scopes": ["read"]},
+//	 {"name": "agent", "token_sha256": "2bb80d53...", "scopes": ["write"]}]
+//
+// Removed tokens are revoked.
+type FileSource struct {
+	path string
+}
+
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: path}
+}
+
+func (f *FileSource) Load(ctx context.Context) ([]Token, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []fileToken
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("can't parse tokens file %v: %w", f.path, err)
+	}
+
+	tokens := make([]Token, 0, len(entries))
+	for _, entry := range entries {
+		hash := strings.ToLower(entry.SHA256)
+		if entry.Token != "" {
+			hash = HashToken(entry.Token)
+		}
+		if hash == "" {
+			return nil, fmt.Errorf("token %v has no secret", entry.Name)
+		}
+		tokens = append(tokens, Token{Name: entry.Name, Hash: hash, Scopes: entry.Scopes})
+	}
+	return tokens, nil
+}
+
+// PostgresSource reads tokens of api_token table, tokens with revoked_at in the past are revoked.
+// Scopes are stored as comma separated list.
+type PostgresSource struct {
+	connection *sql.DB
+}
+
+// NewPostgresSource connects to database and applies migrations creating tokens table.
+func NewPostgresSource(cfg configs.PostgresConfig) (*PostgresSource, error) {
+	connection, err := sql.Open("pgx", cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if err = goose.SetDialect("postgres"); err != nil {
+		return nil, err
+	}
+	if err = goose.Up(connection, cfg.MigrationDir); err != nil {
+		return nil, err
+	}
+	return &PostgresSource{connection: connection}, nil
+}
+
+func (p *PostgresSource) Load(ctx context.Context) ([]Token, error) {
+	rows, err := p.connection.QueryContext(ctx,
+		"SELECT token_hash, name, scopes FROM api_token WHERE revoked_at IS NULL OR revoked_at > now()")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []Token
+	for rows.Next() {
+		var (
+			token  Token
+			scopes string
+		)
+		if err = rows.Scan(&token.Hash, &token.Name, &scopes); err != nil {
+			return nil, err
+		}
+		for _, scope := range strings.Split(scopes, ",") {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				token.Scopes = append(token.Scopes, scope)
+			}
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// Close closes database connection.
+func (p *PostgresSource) Close() error {
+	return p.connection.Close()
+}
@@ -0,0 +1,365 @@
+// Package cardinality limits count of stored series, so names embedding IDs can't grow the repository unbounded,
+// and reports how series are distributed by name prefix, type and creating client.
+package cardinality
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/quota"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+)
+
+const (
+	// GrowthWindow is the period of series growth reported by Index.
+	GrowthWindow = time.Hour
+	// DefaultReportSize is the default max entries of every report list.
+	DefaultReportSize = 20
+
+	// syncInterval is the period of loading series created bypassing controller, e.g. by replication.
+	syncInterval = 5 * time.Minute
+
+	// UnknownClient creates series found in the repository.
+	UnknownClient = "unknown"
+	// InternalClient creates series of internal sources (StatsD, scrape, etc.).
+	InternalClient = "internal"
+)
+
+var ErrLimitExceeded = errors.New("series limit exceeded")
+
+// LimitError describes exceeded series limit, Prefix is empty for the global limit.
+type LimitError struct {
+	Prefix string
+	Limit  int
+}
+
+func (e *LimitError) Error() string {
+	if e.Prefix == "" {
+		return fmt.Sprintf("%v: max %v series", ErrLimitExceeded, e.Limit)
+	}
+	return fmt.Sprintf("%v: max %v series of prefix %q", ErrLimitExceeded, e.Limit, e.Prefix)
+}
+
+func (e *LimitError) Unwrap() error {
+	return ErrLimitExceeded
+}
+
+// Source returns stored metrics.
+type Source interface {
+	GetAll(ctx context.Context) ([]metrics.Metric, error)
+}
+
+type prefixLimit struct {
+	prefix string
+	limit  int
+}
+
+type series struct {
+	prefix  string
+	typ     string
+	client  string
+	created time.Time
+}
+
+// Index keeps stored series and checks that new series fit limits, nil Index doesn't limit anything.
+type Index struct {
+	sync.Mutex
+	source          Source
+	maxSeries       int
+	maxClientSeries int
+	limits          []prefixLimit
+	series          map[string]series
+	counts          map[string]int // series of limited prefixes
+	clients         map[string]int // series created by clients
+	owns            func(name string) bool
+	now             func() time.Time
+}
+
+type Option func(x *Index)
+
+// WithClientLimit limits series created by every client, see quota.ClientIdentity.
+// Series of internal sources and series found in the repository aren't limited.
+func WithClientLimit(maxSeries int) Option {
+	return func(x *Index) {
+		x.maxClientSeries = maxSeries
+	}
+}
+
+// WithOwner reserves only series of names owned by this node, e.g. cluster node.
+// Series of other names are admitted by their owners, source keeps only owned series too.
+func WithOwner(owns func(name string) bool) Option {
+	return func(x *Index) {
+		x.owns = owns
+	}
+}
+
+// NewIndex creates Index of configured limits and loads series of source.
+func NewIndex(ctx context.Context, cfg configs.CardinalityConfig, source Source, options ...Option) (*Index, error) {
+	limits, err := parsePrefixLimits(cfg.PrefixLimits)
+	if err != nil {
+		return nil, err
+	}
+	x := &Index{
+		source:    source,
+		maxSeries: cfg.MaxSeries,
+		limits:    limits,
+		series:    map[string]series{},
+		counts:    map[string]int{},
+		clients:   map[string]int{},
+		now:       time.Now,
+	}
+	for _, option := range options {
+		option(x)
+	}
+	if err = x.Sync(ctx); err != nil {
+		return nil, fmt.Errorf("can't load series, reason: %w", err)
+	}
+	return x, nil
+}
+
+// parsePrefixLimits parses "<prefix>=<limit>" entries, limits are sorted by prefix length, the longest first.
+func parsePrefixLimits(list []string) ([]prefixLimit, error) {
+	var limits []prefixLimit
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		idx := strings.LastIndex(entry, "=")
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid prefix limit %q, expected <prefix>=<max series>", entry)
+		}
+		limit, err := strconv.Atoi(entry[idx+1:])
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid max series of prefix limit %q", entry)
+		}
+		limits = append(limits, prefixLimit{prefix: entry[:idx], limit: limit})
+	}
+	sort.SliceStable(limits, func(i, j int) bool {
+		return len(limits[i].prefix) > len(limits[j].prefix)
+	})
+	return limits, nil
+}
+
+// Start runs periodic loading of series created bypassing controller.
+func (x *Index) Start(ctx context.Context, pool *utils.TickerPool) {
+	if x == nil {
+		return
+	}
+	pool.AddTask(ctx, "cardinality sync", func(ctx context.Context) {
+		if err := x.Sync(ctx); err != nil {
+			log.Errorf("can't sync series, reason: %v", err)
+		}
+	}, syncInterval)
+}
+
+// Sync adds series of source missing in Index, they're created by UnknownClient.
+func (x *Index) Sync(ctx context.Context) error {
+	list, err := x.source.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+	x.Lock()
+	defer x.Unlock()
+	for _, metric := range list {
+		key := seriesKey(metric.GetType(), metric.GetName())
+		if _, ok := x.series[key]; !ok {
+			x.add(key, metric.GetType(), metric.GetName(), UnknownClient, time.Time{})
+		}
+	}
+	return nil
+}
+
+// Reserve adds new series of update created by client, the update is rejected when they don't fit limits.
+// Added keys are returned, so they're released when the update fails.
+func (x *Index) Reserve(client string, paramsSlice metrics.ParamsSlice) ([]string, error) {
+	if x == nil {
+		return nil, nil
+	}
+	if client == "" {
+		client = InternalClient
+	}
+	now := x.now()
+	x.Lock()
+	defer x.Unlock()
+
+	var added []string
+	for _, params := range paramsSlice {
+		key := seriesKey(params.Type, params.Name)
+		if _, ok := x.series[key]; ok {
+			continue
+		}
+		if x.owns != nil && !x.owns(params.Name) {
+			continue
+		}
+		if err := x.check(params.Name, client); err != nil {
+			x.release(added)
+			return nil, err
+		}
+		x.add(key, params.Type, params.Name, client, now)
+		added = append(added, key)
+	}
+	return added, nil
+}
+
+// Release removes series reserved by failed update.
+func (x *Index) Release(keys []string) {
+	if x == nil || len(keys) == 0 {
+		return
+	}
+	x.Lock()
+	defer x.Unlock()
+	x.release(keys)
+}
+
+// check returns error when new series of name created by client exceeds limits, caller holds the lock.
+func (x *Index) check(name, client string) error {
+	if x.maxClientSeries > 0 && client != InternalClient && x.clients[client] >= x.maxClientSeries {
+		return &quota.LimitError{Client: client, Limit: quota.SeriesLimit}
+	}
+	if x.maxSeries > 0 && len(x.series) >= x.maxSeries {
+		return &LimitError{Limit: x.maxSeries}
+	}
+	if limit, ok := x.limitOf(name); ok && x.counts[limit.prefix] >= limit.limit {
+		return &LimitError{Prefix: limit.prefix, Limit: limit.limit}
+	}
+	return nil
+}
+
+// limitOf returns limit of the longest configured prefix of name.
+func (x *Index) limitOf(name string) (prefixLimit, bool) {
+	for _, limit := range x.limits {
+		if strings.HasPrefix(name, limit.prefix) {
+			return limit, true
+		}
+	}
+	return prefixLimit{}, false
+}
+
+// add puts series to Index, caller holds the lock.
+func (x *Index) add(key, typ, name, client string, created time.Time) {
+	prefix := Prefix(name)
+	if limit, ok := x.limitOf(name); ok {
+		prefix = limit.prefix
+		x.counts[prefix]++
+	}
+	x.series[key] = series{prefix: prefix, typ: typ, client: client, created: created}
+	x.clients[client]++
+}
+
+// release removes series of keys, caller holds the lock.
+func (x *Index) release(keys []string) {
+	for _, key := range keys {
+		s, ok := x.series[key]
+		if !ok {
+			continue
+		}
+		if _, limited := x.counts[s.prefix]; limited {
+			x.counts[s.prefix]--
+		}
+		if x.clients[s.client]--; x.clients[s.client] <= 0 {
+			delete(x.clients, s.client)
+		}
+		delete(x.series, key)
+	}
+}
+
+func seriesKey(typ, name string) string {
+	return typ + ":" + name
+}
+
+// Prefix returns name part before the first separator or digit, so names embedding IDs share the prefix,
+// e.g. "user_42_requests" and "user_43_requests" are "user".
+func Prefix(name string) string {
+	idx := strings.IndexFunc(name, func(r rune) bool {
+		return strings.ContainsRune("._:-/ ", r) || r >= '0' && r <= '9'
+	})
+	if idx <= 0 {
+		return name
+	}
+	return name[:idx]
+}
+
+// Count is series count of prefix, type or client, Limit is zero when series aren't limited.
+type Count struct {
+	Name   string `json:"name"`
+	Series int    `json:"series"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+// Report describes series distribution, Growth is series created within GrowthWindow by prefix.
+type Report struct {
+	Series    int     `json:"series"`
+	MaxSeries int     `json:"max_series,omitempty"`
+	ByPrefix  []Count `json:"by_prefix"`
+	ByType    []Count `json:"by_type"`
+	ByClient  []Count `json:"by_client"`
+	Growth    []Count `json:"top_growth"`
+}
+
+// Report returns series distribution, lists are sorted by series count and cut to size entries.
+// Prefixes of configured limits are reported by the configured prefix.
+func (x *Index) Report(size int) Report {
+	now := x.now()
+	x.Lock()
+	defer x.Unlock()
+
+	byPrefix := map[string]int{}
+	for _, limit := range x.limits {
+		byPrefix[limit.prefix] = 0
+	}
+	byType, growth := map[string]int{}, map[string]int{}
+	for _, s := range x.series {
+		byPrefix[s.prefix]++
+		byType[s.typ]++
+		if !s.created.IsZero() && now.Sub(s.created) <= GrowthWindow {
+			growth[s.prefix]++
+		}
+	}
+
+	prefixes := topCounts(byPrefix, size)
+	for idx := range prefixes {
+		for _, limit := range x.limits {
+			if limit.prefix == prefixes[idx].Name {
+				prefixes[idx].Limit = limit.limit
+				break
+			}
+		}
+	}
+	return Report{
+		Series:    len(x.series),
+		MaxSeries: x.maxSeries,
+		ByPrefix:  prefixes,
+		ByType:    topCounts(byType, size),
+		ByClient:  topCounts(x.clients, size),
+		Growth:    topCounts(growth, size),
+	}
+}
+
+// topCounts returns size the largest counts, size <= 0 returns all of them.
+func topCounts(counts map[string]int, size int) []Count {
+	list := make([]Count, 0, len(counts))
+	for name, n := range counts {
+		list = append(list, Count{Name: name, Series: n})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Series != list[j].Series {
+			return list[i].Series > list[j].Series
+		}
+		return list[i].Name < list[j].Name
+	})
+	if size > 0 && len(list) > size {
+		list = list[:size]
+	}
+	return list
+}
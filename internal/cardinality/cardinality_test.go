@@ -0,0 +1,179 @@
+package cardinality
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/quota"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+)
+
+func newTestIndex(t *testing.T, cfg configs.CardinalityConfig, repo storage.Repository) (*Index, *time.Time) {
+	x, err := NewIndex(context.Background(), cfg, repo)
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	x.now = func() time.Time { return now }
+	return x, &now
+}
+
+func gauges(names ...string) metrics.ParamsSlice {
+	slice := make(metrics.ParamsSlice, 0, len(names))
+	for _, name := range names {
+		slice = append(slice, metrics.NewGauge(name, 1).ToParams())
+	}
+	return slice
+}
+
+func TestPrefix(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "user_42_requests", want: "user"},
+		{name: "runtime.Alloc", want: "runtime"},
+		{name: "CPUutilization12", want: "CPUutilization"},
+		{name: "PollCount", want: "PollCount"},
+		{name: "42", want: "42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Prefix(tt.name))
+		})
+	}
+}
+
+func TestNewIndex_InvalidPrefixLimits(t *testing.T) {
+	for _, limit := range []string{"user_", "=10", "user_=0", "user_=ten"} {
+		_, err := NewIndex(context.Background(), configs.CardinalityConfig{PrefixLimits: []string{limit}}, storage.NewRAMRepository())
+		assert.Error(t, err, limit)
+	}
+}
+
+func TestIndex_Reserve(t *testing.T) {
+	repo := storage.NewRAMRepository()
+	_, err := repo.SetGauge(context.Background(), "Alloc", 1)
+	require.NoError(t, err)
+	x, _ := newTestIndex(t, configs.CardinalityConfig{MaxSeries: 6, PrefixLimits: []string{"user_=2", "user_admin=1"}}, repo)
+
+	_, err = x.Reserve("token:agent", gauges("Alloc", "user_1", "user_2"))
+	require.NoError(t, err, "stored series are known")
+
+	_, err = x.Reserve("token:agent", gauges("user_3"))
+	var limitErr *LimitError
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, LimitError{Prefix: "user_", Limit: 2}, *limitErr)
+
+	_, err = x.Reserve("token:agent", gauges("Frees", "user_admin1", "user_admin2"))
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, "user_admin", limitErr.Prefix, "the longest prefix limits series")
+
+	created, err := x.Reserve("token:agent", gauges("Frees", "user_admin1"))
+	require.NoError(t, err, "series of rejected update aren't added")
+	assert.Len(t, created, 2)
+
+	_, err = x.Reserve("", gauges("Mallocs", "Lookups"))
+	require.ErrorIs(t, err, ErrLimitExceeded)
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, LimitError{Limit: 6}, *limitErr)
+
+	x.Release(created)
+	_, err = x.Reserve("", metrics.ParamsSlice{metrics.NewCounter("Alloc", 1).ToParams()})
+	assert.NoError(t, err, "released series free the limit")
+}
+
+func TestIndex_Report(t *testing.T) {
+	repo := storage.NewRAMRepository()
+	_, err := repo.AddCounter(context.Background(), "PollCount", 1)
+	require.NoError(t, err)
+	x, now := newTestIndex(t, configs.CardinalityConfig{MaxSeries: 10, PrefixLimits: []string{"user_=5", "job_=5"}}, repo)
+
+	_, err = x.Reserve("token:agent", gauges("user_1", "user_2", "runtime.Alloc"))
+	require.NoError(t, err)
+	*now = now.Add(2 * GrowthWindow)
+	_, err = x.Reserve("", gauges("user_3", "runtime.Frees", "runtime.Mallocs"))
+	require.NoError(t, err)
+
+	report := x.Report(0)
+	assert.Equal(t, 7, report.Series)
+	assert.Equal(t, 10, report.MaxSeries)
+	assert.Equal(t, []Count{
+		{Name: "runtime", Series: 3},
+		{Name: "user_", Series: 3, Limit: 5},
+		{Name: "PollCount", Series: 1},
+		{Name: "job_", Limit: 5},
+	}, report.ByPrefix)
+	assert.Equal(t, []Count{{Name: metrics.GaugeType, Series: 6}, {Name: metrics.CounterType, Series: 1}}, report.ByType)
+	assert.Equal(t, []Count{
+		{Name: InternalClient, Series: 3},
+		{Name: "token:agent", Series: 3},
+		{Name: UnknownClient, Series: 1},
+	}, report.ByClient)
+	assert.Equal(t, []Count{{Name: "runtime", Series: 2}, {Name: "user_", Series: 1}}, report.Growth)
+
+	assert.Len(t, x.Report(1).ByPrefix, 1)
+}
+
+func TestIndex_Sync(t *testing.T) {
+	repo := storage.NewRAMRepository()
+	x, _ := newTestIndex(t, configs.CardinalityConfig{MaxSeries: 1}, repo)
+
+	_, err := repo.SetGauge(context.Background(), "Alloc", 1)
+	require.NoError(t, err)
+	require.NoError(t, x.Sync(context.Background()))
+	assert.Equal(t, 1, x.Report(0).Series)
+	_, err = x.Reserve("", gauges("Frees"))
+	assert.ErrorIs(t, err, ErrLimitExceeded, "synced series count to limit")
+}
+
+func TestIndex_Owner(t *testing.T) {
+	x, err := NewIndex(context.Background(), configs.CardinalityConfig{MaxSeries: 1}, storage.NewRAMRepository(),
+		WithOwner(func(name string) bool { return name != "Remote" }))
+	require.NoError(t, err)
+
+	created, err := x.Reserve("", gauges("Remote", "Alloc"))
+	require.NoError(t, err, "series of other node don't count to limit")
+	assert.Equal(t, []string{seriesKey(metrics.GaugeType, "Alloc")}, created)
+	assert.Equal(t, 1, x.Report(0).Series)
+}
+
+func TestDisabledIndex(t *testing.T) {
+	var x *Index
+	created, err := x.Reserve("token:agent", gauges("A"))
+	assert.NoError(t, err)
+	x.Release(created)
+}
+
+func TestIndex_ClientLimit(t *testing.T) {
+	repo := storage.NewRAMRepository()
+	_, err := repo.SetGauge(context.Background(), "Alloc", 1)
+	require.NoError(t, err)
+	x, err := NewIndex(context.Background(), configs.CardinalityConfig{}, repo, WithClientLimit(2))
+	require.NoError(t, err)
+
+	_, err = x.Reserve("ip:10.0.0.1", gauges("Alloc", "A", "B"))
+	require.NoError(t, err, "updated stored series aren't created by client")
+	_, err = x.Reserve("ip:10.0.0.1", gauges("A", "B"))
+	require.NoError(t, err, "updated series aren't counted twice")
+
+	created, err := x.Reserve("ip:10.0.0.1", gauges("C"))
+	var limitErr *quota.LimitError
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, quota.LimitError{Client: "ip:10.0.0.1", Limit: quota.SeriesLimit}, *limitErr)
+	assert.Nil(t, created)
+
+	_, err = x.Reserve("ip:10.0.0.2", gauges("C"))
+	assert.NoError(t, err, "clients are limited separately")
+	_, err = x.Reserve("", gauges("D", "E", "F"))
+	assert.NoError(t, err, "internal sources aren't limited")
+
+	created, err = x.Reserve("ip:10.0.0.3", gauges("G", "H"))
+	require.NoError(t, err)
+	x.Release(created)
+	assert.NotContains(t, x.clients, "ip:10.0.0.3", "client of released series is forgotten")
+}
@@ -0,0 +1,113 @@
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	grpcpeer "google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/unbeman/ya-prac-mcas/internal/auth"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+	pb "github.com/unbeman/ya-prac-mcas/proto"
+)
+
+// ForwardedHeader marks gRPC requests sent by cluster node,
+// such requests are served by local repository of receiving node.
+const ForwardedHeader = "x-cluster-forwarded"
+
+type forwardedKey struct{}
+
+// IsForwarded reports if request came from another cluster node.
+func IsForwarded(ctx context.Context) bool {
+	forwarded, _ := ctx.Value(forwardedKey{}).(bool)
+	return forwarded
+}
+
+// WithForwarded marks context of request forwarded by another cluster node.
+func WithForwarded(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forwardedKey{}, true)
+}
+
+// ServerInterceptor marks contexts of requests forwarded by cluster nodes, it follows auth interceptor.
+// Forwarded requests skip client checks done by the first node, so the header is trusted only from nodes
+// authorized by token of peer scope or connected from peerSubnets, it's rejected from other clients.
+func ServerInterceptor(peerSubnets utils.Subnets) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		if meta, ok := metadata.FromIncomingContext(ctx); ok && len(meta.Get(ForwardedHeader)) > 0 {
+			if !isPeer(ctx, peerSubnets) {
+				return nil, status.Error(codes.PermissionDenied, "forwarded request of untrusted cluster peer")
+			}
+			ctx = WithForwarded(ctx)
+		}
+		return handler(ctx, req)
+	}
+}
+
+// isPeer reports if request is sent by cluster node: its token has peer scope or its transport
+// address belongs to peerSubnets. Forwarding headers aren't used as they're set by clients.
+func isPeer(ctx context.Context, peerSubnets utils.Subnets) bool {
+	if token, ok := auth.FromContext(ctx); ok && token.Allows(auth.PeerScope) {
+		return true
+	}
+	if p, ok := grpcpeer.FromContext(ctx); ok && p.Addr != nil {
+		return peerSubnets.Contains(utils.ParseHostIP(p.Addr.String()))
+	}
+	return false
+}
+
+type peer struct {
+	address string
+	conn    *grpc.ClientConn
+	client  pb.MetricsCollectorClient
+	healthy atomic.Bool
+	meta    metadata.MD
+	timeout time.Duration
+}
+
+func newPeer(address string, timeout time.Duration, token string, tlsConfig *tls.Config) (*peer, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	options := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if token != "" {
+		options = append(options, grpc.WithPerRPCCredentials(auth.Credentials(token)))
+	}
+	conn, err := grpc.Dial(address, options...)
+	if err != nil {
+		return nil, err
+	}
+	p := &peer{
+		address: address,
+		conn:    conn,
+		client:  pb.NewMetricsCollectorClient(conn),
+		meta:    metadata.New(map[string]string{ForwardedHeader: "1"}),
+		timeout: timeout,
+	}
+	p.healthy.Store(true)
+	return p, nil
+}
+
+// context returns request context with forwarding metadata and peer timeout.
+func (p *peer) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	return metadata.NewOutgoingContext(ctx, p.meta), cancel
+}
+
+func (p *peer) ping(ctx context.Context) error {
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+	_, err := p.client.Ping(ctx, &pb.PingRequest{})
+	return err
+}
@@ -0,0 +1,424 @@
+// Package cluster shards metrics between static set of servers by consistent hash of metric names.
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+	pb "github.com/unbeman/ya-prac-mcas/proto"
+)
+
+// ErrUnavailable is returned when node owning metric doesn't respond.
+var ErrUnavailable = errors.New("cluster node unavailable")
+
+// Signer signs forwarded metrics, it returns hash and ID of the signing key.
+type Signer interface {
+	Sign(metric metrics.Metric) (string, string)
+}
+
+// Repository keeps metrics owned by this node in local repository
+// and forwards reads and writes of other metrics to their owners.
+// Requests forwarded by other nodes are always served locally.
+type Repository struct {
+	local               storage.Repository
+	self                string
+	ring                *Ring
+	peers               map[string]*peer
+	signer              Signer
+	healthCheckInterval time.Duration
+}
+
+// NewRepository creates Repository of configured cluster, self address must be one of cluster nodes.
+// Nodes are connected by TLS when tlsConfig isn't nil, token authorizes requests to nodes requiring API tokens.
+func NewRepository(cfg configs.ClusterConfig, local storage.Repository, signer Signer, token string, tlsConfig *tls.Config) (*Repository, error) {
+	r := &Repository{
+		local:               local,
+		self:                cfg.Self,
+		ring:                NewRing(cfg.Nodes, cfg.VirtualNodes),
+		peers:               map[string]*peer{},
+		signer:              signer,
+		healthCheckInterval: cfg.HealthCheckInterval,
+	}
+	isMember := false
+	for _, node := range cfg.Nodes {
+		if node == cfg.Self {
+			isMember = true
+			continue
+		}
+		if _, ok := r.peers[node]; ok {
+			continue
+		}
+		p, err := newPeer(node, cfg.Timeout, token, tlsConfig)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("can't dial cluster node %v: %w", node, err)
+		}
+		r.peers[node] = p
+	}
+	if !isMember {
+		r.Close()
+		return nil, fmt.Errorf("cluster nodes %v don't contain self address %q", cfg.Nodes, cfg.Self)
+	}
+	return r, nil
+}
+
+// Start runs periodic health check of cluster nodes.
+func (r *Repository) Start(ctx context.Context, pool *utils.TickerPool) {
+	pool.AddTask(ctx, "cluster health check", r.CheckHealth, r.healthCheckInterval)
+}
+
+// CheckHealth pings cluster nodes, requests to unhealthy nodes fail fast until they respond again.
+func (r *Repository) CheckHealth(ctx context.Context) {
+	for _, p := range r.peers {
+		err := p.ping(ctx)
+		healthy := err == nil
+		if p.healthy.Swap(healthy) != healthy {
+			if healthy {
+				log.Infof("Cluster node %v is up", p.address)
+			} else {
+				log.Warnf("Cluster node %v is down: %v", p.address, err)
+			}
+		}
+	}
+}
+
+// owner returns peer owning metric name, it's nil when metric is owned by this node.
+func (r *Repository) owner(ctx context.Context, name string) (*peer, error) {
+	if IsForwarded(ctx) {
+		return nil, nil
+	}
+	address := r.ring.Owner(name)
+	if address == r.self {
+		return nil, nil
+	}
+	p := r.peers[address]
+	if !p.healthy.Load() {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, address)
+	}
+	return p, nil
+}
+
+// Owns reports if metric name is owned by this node.
+func (r *Repository) Owns(name string) bool {
+	return r.ring.Owner(name) == r.self
+}
+
+func (r *Repository) AddCounter(ctx context.Context, name string, delta int64) (metrics.Counter, error) {
+	p, err := r.owner(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return r.local.AddCounter(ctx, name, delta)
+	}
+	params, err := r.update(ctx, p, metrics.NewCounter(name, delta))
+	if err != nil {
+		return nil, err
+	}
+	return metrics.NewCounterFromParams(params), nil
+}
+
+// AddCounters updates counters of all nodes, see updateBatch. Result is in order of slice.
+func (r *Repository) AddCounters(ctx context.Context, slice []metrics.Counter) ([]metrics.Counter, error) {
+	result := make([]metrics.Counter, len(slice))
+	err := r.updateBatch(ctx, counterList(slice),
+		func(indexes []int) error {
+			counters := make([]metrics.Counter, 0, len(indexes))
+			for _, idx := range indexes {
+				counters = append(counters, slice[idx])
+			}
+			counters, err := r.local.AddCounters(ctx, counters)
+			if err != nil {
+				return err
+			}
+			for i, idx := range indexes {
+				result[idx] = counters[i]
+			}
+			return nil
+		},
+		func(idx int, params metrics.Params) {
+			result[idx] = metrics.NewCounterFromParams(params)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *Repository) GetCounter(ctx context.Context, name string) (metrics.Counter, error) {
+	p, err := r.owner(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return r.local.GetCounter(ctx, name)
+	}
+	params, err := r.get(ctx, p, name, metrics.CounterType)
+	if err != nil {
+		return nil, err
+	}
+	return metrics.NewCounterFromParams(params), nil
+}
+
+func (r *Repository) SetGauge(ctx context.Context, name string, value float64) (metrics.Gauge, error) {
+	p, err := r.owner(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return r.local.SetGauge(ctx, name, value)
+	}
+	params, err := r.update(ctx, p, metrics.NewGauge(name, value))
+	if err != nil {
+		return nil, err
+	}
+	return metrics.NewGaugeFromParams(params), nil
+}
+
+// SetGauges updates gauges of all nodes, see updateBatch. Result is in order of slice.
+func (r *Repository) SetGauges(ctx context.Context, slice []metrics.Gauge) ([]metrics.Gauge, error) {
+	result := make([]metrics.Gauge, len(slice))
+	err := r.updateBatch(ctx, gaugeList(slice),
+		func(indexes []int) error {
+			gauges := make([]metrics.Gauge, 0, len(indexes))
+			for _, idx := range indexes {
+				gauges = append(gauges, slice[idx])
+			}
+			gauges, err := r.local.SetGauges(ctx, gauges)
+			if err != nil {
+				return err
+			}
+			for i, idx := range indexes {
+				result[idx] = gauges[i]
+			}
+			return nil
+		},
+		func(idx int, params metrics.Params) {
+			result[idx] = metrics.NewGaugeFromParams(params)
+		})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *Repository) GetGauge(ctx context.Context, name string) (metrics.Gauge, error) {
+	p, err := r.owner(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return r.local.GetGauge(ctx, name)
+	}
+	params, err := r.get(ctx, p, name, metrics.GaugeType)
+	if err != nil {
+		return nil, err
+	}
+	return metrics.NewGaugeFromParams(params), nil
+}
+
+// GetAll gathers metrics of all nodes, unavailable nodes are skipped.
+func (r *Repository) GetAll(ctx context.Context) ([]metrics.Metric, error) {
+	list, err := r.local.GetAll(ctx)
+	if err != nil || IsForwarded(ctx) {
+		return list, err
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, p := range r.peers {
+		if !p.healthy.Load() {
+			log.Warnf("Metrics of cluster node %v skipped: node is down", p.address)
+			continue
+		}
+		wg.Add(1)
+		go func(p *peer) {
+			defer wg.Done()
+			rCtx, cancel := p.context(ctx)
+			defer cancel()
+			resp, err := p.client.GetMetrics(rCtx, &pb.GetMetricsRequest{})
+			if err != nil {
+				log.Warnf("Metrics of cluster node %v skipped: %v", p.address, err)
+				return
+			}
+			var paramsSlice metrics.ParamsSlice
+			if err = paramsSlice.ParseProto(resp.Metrics); err != nil {
+				log.Warnf("Metrics of cluster node %v skipped: %v", p.address, err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, params := range paramsSlice {
+				list = append(list, metrics.NewMetricFromParams(params))
+			}
+		}(p)
+	}
+	wg.Wait()
+	return list, nil
+}
+
+func (r *Repository) Ping(ctx context.Context) error {
+	return r.local.Ping(ctx)
+}
+
+// Shutdown closes connections to cluster nodes and local repository.
+func (r *Repository) Shutdown() error {
+	r.Close()
+	return r.local.Shutdown()
+}
+
+// Close closes connections to cluster nodes.
+func (r *Repository) Close() {
+	for _, p := range r.peers {
+		if err := p.conn.Close(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// updateBatch sends parts of list owned by other nodes to them, then applies local part by applyLocal,
+// results of nodes are passed to setResult along with index in list.
+// Batch isn't atomic: when a node fails, parts applied by other nodes stay applied, so counters of the parts
+// are counted twice when the batch is retried. The local part is applied only when all nodes succeed.
+func (r *Repository) updateBatch(
+	ctx context.Context,
+	list []metrics.Metric,
+	applyLocal func(indexes []int) error,
+	setResult func(idx int, params metrics.Params)) error {
+	local, remote, err := r.split(ctx, list)
+	if err != nil {
+		return err
+	}
+
+	var applied []string
+	for p, indexes := range remote {
+		part := make([]metrics.Metric, 0, len(indexes))
+		for _, idx := range indexes {
+			part = append(part, list[idx])
+		}
+		paramsSlice, err := r.updates(ctx, p, part)
+		if err == nil && len(paramsSlice) != len(part) {
+			err = fmt.Errorf("cluster node %v updated %v metrics of %v", p.address, len(paramsSlice), len(part))
+		}
+		if err != nil {
+			if len(applied) > 0 {
+				return fmt.Errorf("%w, batch is partially applied by nodes %v", err, applied)
+			}
+			return err
+		}
+		for i, idx := range indexes {
+			setResult(idx, paramsSlice[i])
+		}
+		applied = append(applied, p.address)
+	}
+	if len(local) == 0 {
+		return nil
+	}
+	if err = applyLocal(local); err != nil && len(applied) > 0 {
+		return fmt.Errorf("%w, batch is partially applied by nodes %v", err, applied)
+	}
+	return err
+}
+
+// split groups indexes of list metrics by owner, local metrics are owned by this node.
+func (r *Repository) split(ctx context.Context, list []metrics.Metric) ([]int, map[*peer][]int, error) {
+	var local []int
+	remote := map[*peer][]int{}
+	for idx, metric := range list {
+		p, err := r.owner(ctx, metric.GetName())
+		if err != nil {
+			return nil, nil, err
+		}
+		if p == nil {
+			local = append(local, idx)
+		} else {
+			remote[p] = append(remote[p], idx)
+		}
+	}
+	return local, remote, nil
+}
+
+func (r *Repository) sign(metric metrics.Metric) *pb.Metric {
+	mp := metric.ToProto()
+	mp.Hash, mp.KeyId = r.signer.Sign(metric)
+	return mp
+}
+
+func (r *Repository) update(ctx context.Context, p *peer, metric metrics.Metric) (metrics.Params, error) {
+	rCtx, cancel := p.context(ctx)
+	defer cancel()
+	resp, err := p.client.UpdateMetric(rCtx, &pb.UpdateMetricRequest{Metric: r.sign(metric)})
+	if err != nil {
+		return metrics.Params{}, peerError(p, err)
+	}
+	return metrics.ParseProto(resp.Metric)
+}
+
+func (r *Repository) updates(ctx context.Context, p *peer, list []metrics.Metric) (metrics.ParamsSlice, error) {
+	protoMetrics := make([]*pb.Metric, 0, len(list))
+	for _, metric := range list {
+		protoMetrics = append(protoMetrics, r.sign(metric))
+	}
+
+	rCtx, cancel := p.context(ctx)
+	defer cancel()
+	resp, err := p.client.UpdateMetrics(rCtx, &pb.UpdateMetricsRequest{Metrics: protoMetrics})
+	if err != nil {
+		return nil, peerError(p, err)
+	}
+	var paramsSlice metrics.ParamsSlice
+	err = paramsSlice.ParseProto(resp.Metrics)
+	return paramsSlice, err
+}
+
+func (r *Repository) get(ctx context.Context, p *peer, name, mType string) (metrics.Params, error) {
+	rCtx, cancel := p.context(ctx)
+	defer cancel()
+	resp, err := p.client.GetMetric(rCtx, &pb.GetMetricRequest{Name: name, Type: mType})
+	if err != nil {
+		return metrics.Params{}, peerError(p, err)
+	}
+	return metrics.ParseProto(resp.Metric)
+}
+
+// peerError converts gRPC status of cluster node response to repository error.
+func peerError(p *peer, err error) error {
+	switch status.Code(err) {
+	case codes.NotFound:
+		return storage.ErrNotFound
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return fmt.Errorf("%w: %v: %v", ErrUnavailable, p.address, err)
+	default:
+		return fmt.Errorf("cluster node %v: %w", p.address, err)
+	}
+}
+
+func counterList(slice []metrics.Counter) []metrics.Metric {
+	list := make([]metrics.Metric, 0, len(slice))
+	for _, counter := range slice {
+		list = append(list, counter)
+	}
+	return list
+}
+
+func gaugeList(slice []metrics.Gauge) []metrics.Metric {
+	list := make([]metrics.Metric, 0, len(slice))
+	for _, gauge := range slice {
+		list = append(list, gauge)
+	}
+	return list
+}
@@ -0,0 +1,264 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	grpcpeer "google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/auth"
+	"github.com/unbeman/ya-prac-mcas/internal/keyring"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+	pb "github.com/unbeman/ya-prac-mcas/proto"
+)
+
+// testService serves cluster requests straight from repository, like GRPCService does through controller.
+type testService struct {
+	pb.UnimplementedMetricsCollectorServer
+	repository storage.Repository
+}
+
+func (s *testService) GetMetric(ctx context.Context, in *pb.GetMetricRequest) (*pb.GetMetricResponse, error) {
+	var (
+		metric metrics.Metric
+		err    error
+	)
+	if in.Type == metrics.GaugeType {
+		metric, err = s.repository.GetGauge(ctx, in.Name)
+	} else {
+		metric, err = s.repository.GetCounter(ctx, in.Name)
+	}
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetMetricResponse{Metric: metric.ToProto()}, nil
+}
+
+func (s *testService) GetMetrics(ctx context.Context, in *pb.GetMetricsRequest) (*pb.GetMetricsResponse, error) {
+	list, err := s.repository.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := &pb.GetMetricsResponse{}
+	for _, metric := range list {
+		out.Metrics = append(out.Metrics, metric.ToProto())
+	}
+	return out, nil
+}
+
+func (s *testService) UpdateMetric(ctx context.Context, in *pb.UpdateMetricRequest) (*pb.UpdateMetricResponse, error) {
+	metric, err := s.update(ctx, in.Metric)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.UpdateMetricResponse{Metric: metric.ToProto()}, nil
+}
+
+func (s *testService) UpdateMetrics(ctx context.Context, in *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	out := &pb.UpdateMetricsResponse{}
+	for _, m := range in.Metrics {
+		metric, err := s.update(ctx, m)
+		if err != nil {
+			return nil, err
+		}
+		out.Metrics = append(out.Metrics, metric.ToProto())
+	}
+	return out, nil
+}
+
+func (s *testService) update(ctx context.Context, m *pb.Metric) (metrics.Metric, error) {
+	if m.Type == metrics.GaugeType {
+		return s.repository.SetGauge(ctx, m.Name, m.Value)
+	}
+	return s.repository.AddCounter(ctx, m.Name, m.Delta)
+}
+
+func (s *testService) Ping(ctx context.Context, in *pb.PingRequest) (*pb.PingResponse, error) {
+	return &pb.PingResponse{}, nil
+}
+
+var loopback = utils.Subnets{{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}
+
+type testNode struct {
+	local      storage.Repository
+	repository *Repository
+	server     *grpc.Server
+}
+
+func startCluster(t *testing.T, size int) []*testNode {
+	listeners := make([]net.Listener, 0, size)
+	addresses := make([]string, 0, size)
+	for i := 0; i < size; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners = append(listeners, listener)
+		addresses = append(addresses, listener.Addr().String())
+	}
+
+	nodes := make([]*testNode, 0, size)
+	for i, listener := range listeners {
+		cfg := configs.ClusterConfig{Self: addresses[i], Nodes: addresses, VirtualNodes: 64, Timeout: time.Second}
+		local := storage.NewRAMRepository()
+		repository, err := NewRepository(cfg, local, keyring.NewStatic(""), "", nil)
+		require.NoError(t, err)
+
+		server := grpc.NewServer(grpc.UnaryInterceptor(ServerInterceptor(loopback)))
+		pb.RegisterMetricsCollectorServer(server, &testService{repository: repository})
+		go server.Serve(listener)
+
+		node := &testNode{local: local, repository: repository, server: server}
+		t.Cleanup(func() {
+			node.server.Stop()
+			node.repository.Close()
+		})
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func TestRepository_Sharding(t *testing.T) {
+	ctx := context.Background()
+	nodes := startCluster(t, 3)
+
+	gauges := make([]metrics.Gauge, 0)
+	for i := 0; i < 30; i++ {
+		gauges = append(gauges, metrics.NewGauge(fmt.Sprintf("Gauge%d", i), float64(i)))
+	}
+	saved, err := nodes[0].repository.SetGauges(ctx, gauges)
+	require.NoError(t, err)
+	require.Len(t, saved, 30)
+	for idx, gauge := range saved {
+		assert.Equal(t, fmt.Sprintf("Gauge%d", idx), gauge.GetName(), "result is in order of batch")
+		assert.Equal(t, float64(idx), gauge.Value())
+	}
+
+	counters := make([]metrics.Counter, 0)
+	for i := 0; i < 10; i++ {
+		counters = append(counters, metrics.NewCounter(fmt.Sprintf("Counter%d", i), int64(i)))
+	}
+	added, err := nodes[1].repository.AddCounters(ctx, counters)
+	require.NoError(t, err)
+	require.Len(t, added, 10)
+	for idx, counter := range added {
+		assert.Equal(t, fmt.Sprintf("Counter%d", idx), counter.GetName(), "result is in order of batch")
+		assert.Equal(t, int64(idx), counter.Value())
+	}
+
+	_, err = nodes[1].repository.AddCounter(ctx, "PollCount", 2)
+	require.NoError(t, err)
+	counter, err := nodes[2].repository.AddCounter(ctx, "PollCount", 3)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), counter.Value())
+
+	// every metric is stored only by its owner
+	stored := 0
+	for _, node := range nodes {
+		list, err := node.local.GetAll(ctx)
+		require.NoError(t, err)
+		for _, metric := range list {
+			assert.True(t, node.repository.Owns(metric.GetName()))
+		}
+		stored += len(list)
+	}
+	assert.Equal(t, 41, stored)
+
+	// reads are routed to owner, GetAll gathers all nodes
+	for _, node := range nodes {
+		gauge, err := node.repository.GetGauge(ctx, "Gauge7")
+		require.NoError(t, err)
+		assert.Equal(t, float64(7), gauge.Value())
+
+		counter, err = node.repository.GetCounter(ctx, "PollCount")
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), counter.Value())
+
+		_, err = node.repository.GetGauge(ctx, "Unknown")
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+
+		list, err := node.repository.GetAll(ctx)
+		require.NoError(t, err)
+		assert.Len(t, list, 41)
+	}
+}
+
+func TestRepository_NodeDown(t *testing.T) {
+	ctx := context.Background()
+	nodes := startCluster(t, 2)
+	self, down := nodes[0], nodes[1]
+	down.server.Stop()
+
+	self.repository.CheckHealth(ctx)
+
+	name := ""
+	for i := 0; name == ""; i++ {
+		if candidate := fmt.Sprintf("Gauge%d", i); self.repository.ring.Owner(candidate) == down.repository.self {
+			name = candidate
+		}
+	}
+	_, err := self.repository.SetGauge(ctx, name, 1)
+	assert.ErrorIs(t, err, ErrUnavailable)
+
+	_, err = self.repository.SetGauge(ctx, "Local", 1)
+	if self.repository.ring.Owner("Local") == self.repository.self {
+		assert.NoError(t, err)
+	}
+
+	_, err = self.repository.GetAll(ctx)
+	assert.NoError(t, err, "unavailable nodes are skipped")
+}
+
+func TestNewRepository_NotMember(t *testing.T) {
+	cfg := configs.ClusterConfig{Self: "127.0.0.1:1", Nodes: []string{"127.0.0.1:2"}, Timeout: time.Second}
+	_, err := NewRepository(cfg, storage.NewRAMRepository(), keyring.NewStatic(""), "", nil)
+	assert.Error(t, err)
+}
+
+func TestServerInterceptor(t *testing.T) {
+	forwarded := metadata.NewIncomingContext(context.Background(), metadata.Pairs(ForwardedHeader, "1"))
+	from := func(ctx context.Context, ip string) context.Context {
+		return grpcpeer.NewContext(ctx, &grpcpeer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 5000}})
+	}
+	withScopes := func(ctx context.Context, scopes ...string) context.Context {
+		return auth.WithToken(ctx, auth.Token{Name: "node", Scopes: scopes})
+	}
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		wantForwarded bool
+		wantCode      codes.Code
+	}{
+		{name: "peer subnet", ctx: from(forwarded, "127.0.0.2"), wantForwarded: true},
+		{name: "token of peer scope", ctx: withScopes(from(forwarded, "203.0.113.5"), auth.PeerScope), wantForwarded: true},
+		{name: "untrusted client", ctx: from(forwarded, "203.0.113.5"), wantCode: codes.PermissionDenied},
+		{name: "admin token", ctx: withScopes(from(forwarded, "203.0.113.5"), auth.AdminScope), wantCode: codes.PermissionDenied},
+		{name: "no header", ctx: from(context.Background(), "203.0.113.5")},
+	}
+	interceptor := ServerInterceptor(loopback)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var isForwarded bool
+			_, err := interceptor(tt.ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+				isForwarded = IsForwarded(ctx)
+				return nil, nil
+			})
+			assert.Equal(t, tt.wantCode, status.Code(err))
+			assert.Equal(t, tt.wantForwarded, isForwarded)
+		})
+	}
+}
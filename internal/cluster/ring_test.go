@@ -0,0 +1,34 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing_Owner(t *testing.T) {
+	nodes := []string{"node1:9000", "node2:9000", "node3:9000"}
+	ring := NewRing(nodes, 128)
+
+	owned := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		owned[ring.Owner(fmt.Sprintf("metric%d", i))]++
+	}
+	for _, node := range nodes {
+		assert.Greater(t, owned[node], 500, "names are spread between nodes")
+	}
+	assert.Equal(t, ring.Owner("Alloc"), NewRing([]string{"node3:9000", "node1:9000", "node2:9000"}, 128).Owner("Alloc"),
+		"owner doesn't depend on nodes order")
+
+	// adding node moves names only to new node
+	grown := NewRing(append(nodes, "node4:9000"), 128)
+	for i := 0; i < 3000; i++ {
+		name := fmt.Sprintf("metric%d", i)
+		if owner := grown.Owner(name); owner != "node4:9000" {
+			assert.Equal(t, ring.Owner(name), owner)
+		}
+	}
+
+	assert.Equal(t, "", NewRing(nil, 128).Owner("Alloc"))
+}
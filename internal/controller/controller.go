@@ -2,24 +2,104 @@ package controller
 
 import (
 	"context"
+	"fmt"
 
+	"github.com/unbeman/ya-prac-mcas/internal/auth"
+	"github.com/unbeman/ya-prac-mcas/internal/cardinality"
+	"github.com/unbeman/ya-prac-mcas/internal/cluster"
+	"github.com/unbeman/ya-prac-mcas/internal/keyring"
 	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/query"
+	"github.com/unbeman/ya-prac-mcas/internal/quota"
+	"github.com/unbeman/ya-prac-mcas/internal/replay"
 	"github.com/unbeman/ya-prac-mcas/internal/storage"
 )
 
 type Controller struct {
 	repository storage.Repository
-	hashKey    []byte
+	keys       *keyring.Keyring
+	guard      *replay.Guard
+	quota      *quota.Limiter
+	series     *cardinality.Index
+	observers  []Observer
+	readOnly   func() bool
 }
 
-func NewController(repo storage.Repository, hashKey string) *Controller {
-	return &Controller{repository: repo, hashKey: []byte(hashKey)}
+// Observer is notified about every saved metric,
+// counterDelta is the increment applied to counter, it's zero for gauges.
+type Observer interface {
+	Observe(metric metrics.Metric, counterDelta int64)
+}
+
+type Option func(c *Controller)
+
+// WithObserver passes saved metrics to o, e.g. recent values history or webhooks.
+func WithObserver(o Observer) Option {
+	return func(c *Controller) {
+		c.observers = append(c.observers, o)
+	}
+}
+
+// WithReadOnly rejects updates while readOnly returns true, e.g. on replica server.
+func WithReadOnly(readOnly func() bool) Option {
+	return func(c *Controller) {
+		c.readOnly = readOnly
+	}
+}
+
+// WithKeyring verifies metric hashes by keys of keys instead of the single hash key.
+func WithKeyring(keys *keyring.Keyring) Option {
+	return func(c *Controller) {
+		c.keys = keys
+	}
+}
+
+// WithReplayGuard rejects stale and repeated updates signed along with timestamp and nonce.
+func WithReplayGuard(guard *replay.Guard) Option {
+	return func(c *Controller) {
+		c.guard = guard
+	}
+}
+
+// WithQuota limits metrics rate of every client.
+func WithQuota(limiter *quota.Limiter) Option {
+	return func(c *Controller) {
+		c.quota = limiter
+	}
+}
+
+// WithCardinality rejects updates creating series over global and prefix limits of index.
+func WithCardinality(index *cardinality.Index) Option {
+	return func(c *Controller) {
+		c.series = index
+	}
+}
+
+func NewController(repo storage.Repository, hashKey string, options ...Option) *Controller {
+	c := &Controller{repository: repo, keys: keyring.NewStatic(hashKey)}
+	for _, option := range options {
+		option(c)
+	}
+	return c
 }
 
 func (c Controller) GetAll(ctx context.Context) ([]metrics.Metric, error) {
 	return c.repository.GetAll(ctx)
 }
 
+// Query evaluates query language expression over current metric values.
+func (c Controller) Query(ctx context.Context, expr string) (query.Vector, error) {
+	node, err := query.Parse(expr)
+	if err != nil {
+		return nil, err
+	}
+	list, err := c.repository.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return query.Eval(node, query.NewSnapshot(list))
+}
+
 func (c Controller) Ping(ctx context.Context) error {
 	return c.repository.Ping(ctx)
 }
@@ -44,8 +124,20 @@ func (c Controller) UpdateMetric(ctx context.Context, params metrics.Params) (me
 		metric = metrics.NewMetricFromParams(params)
 	)
 
-	if !c.IsValidHash(params.Hash, metric) {
-		return nil, ErrInvalidHash
+	if c.isReadOnly() {
+		return nil, ErrReadOnly
+	}
+	nonces, err := c.checkHash(ctx, params, metric, nil)
+	if err != nil {
+		return nil, err
+	}
+	release, err := c.admit(c.client(ctx, metrics.ParamsSlice{params}), metrics.ParamsSlice{params})
+	if err != nil {
+		return nil, err
+	}
+	if err = c.guard.Use(nonces...); err != nil {
+		release()
+		return nil, err
 	}
 	switch params.Type {
 	case metrics.GaugeType:
@@ -53,41 +145,80 @@ func (c Controller) UpdateMetric(ctx context.Context, params metrics.Params) (me
 	case metrics.CounterType:
 		metric, err = c.repository.AddCounter(ctx, params.Name, *params.ValueCounter)
 	}
-	return metric, err
+	if err != nil {
+		release()
+		return metric, err
+	}
+	c.observe(ctx, metric, params.GetCounterValue())
+	return metric, nil
 }
 
 func (c Controller) UpdateMetrics(
 	ctx context.Context,
 	paramsSlice metrics.ParamsSlice) (metrics.ParamsSlice, error) {
+	if c.isReadOnly() {
+		return nil, ErrReadOnly
+	}
 
 	gauges := make([]metrics.Gauge, 0)
 	counters := make([]metrics.Counter, 0)
+	counterDeltas := make([]int64, 0)
+	var (
+		gaugeParams, counterParams metrics.ParamsSlice
+		nonces                     []replay.Nonce
+		err                        error
+	)
+	if nonce, ok := replay.BatchNonce(ctx); ok {
+		nonces = append(nonces, nonce)
+	}
 	for _, params := range paramsSlice {
 		metric := metrics.NewMetricFromParams(params)
 
-		if !c.IsValidHash(params.Hash, metric) {
-			return nil, ErrInvalidHash
+		if nonces, err = c.checkHash(ctx, params, metric, nonces); err != nil {
+			return nil, err
 		}
 
 		switch metric.GetType() {
 		case metrics.GaugeType:
 			gauges = append(gauges, metric.(metrics.Gauge))
+			gaugeParams = append(gaugeParams, params)
 		case metrics.CounterType:
 			counters = append(counters, metric.(metrics.Counter))
+			counterDeltas = append(counterDeltas, params.GetCounterValue())
+			counterParams = append(counterParams, params)
 		}
 	}
+	// gauges and counters are admitted separately, so stored gauges keep their series when counters fail
+	client := c.client(ctx, paramsSlice)
+	releaseGauges, err := c.admit(client, gaugeParams)
+	if err != nil {
+		return nil, err
+	}
+	releaseCounters, err := c.admit(client, counterParams)
+	if err != nil {
+		releaseGauges()
+		return nil, err
+	}
+	if err = c.guard.Use(nonces...); err != nil {
+		releaseGauges()
+		releaseCounters()
+		return nil, err
+	}
 
 	metricsParams := make(metrics.ParamsSlice, 0, len(gauges)+len(counters))
 
 	if len(gauges) > 0 {
 		updatedGauges, err := c.repository.SetGauges(ctx, gauges)
 		if err != nil {
+			releaseGauges()
+			releaseCounters()
 			return nil, err
 		}
 
 		for _, gauge := range updatedGauges {
+			c.observe(ctx, gauge, 0)
 			gp := gauge.ToParams()
-			gp.Hash = c.GetHash(gauge)
+			gp.Hash, gp.KeyID = c.GetHash(gauge)
 			metricsParams = append(metricsParams, gp)
 		}
 	}
@@ -95,12 +226,14 @@ func (c Controller) UpdateMetrics(
 	if len(counters) > 0 {
 		updatedCounters, err := c.repository.AddCounters(ctx, counters)
 		if err != nil {
+			releaseCounters()
 			return nil, err
 		}
 
-		for _, counter := range updatedCounters {
+		for idx, counter := range updatedCounters {
+			c.observe(ctx, counter, counterDeltas[idx])
 			cp := counter.ToParams()
-			cp.Hash = c.GetHash(counter)
+			cp.Hash, cp.KeyID = c.GetHash(counter)
 			metricsParams = append(metricsParams, cp)
 		}
 
@@ -108,28 +241,145 @@ func (c Controller) UpdateMetrics(
 	return metricsParams, nil
 }
 
-func (c Controller) IsValidHash(hash string, metric metrics.Metric) bool {
-	if !c.isKeySet() { // ключа нет, проверять не нужно
-		return true
+// VerifyBatch checks signature of request body sent with timestamp and nonce,
+// returned context marks metrics of the body as verified, so their hashes aren't checked.
+func (c Controller) VerifyBatch(
+	ctx context.Context,
+	keyID, signature string,
+	timestamp int64,
+	nonce string,
+	body []byte) (context.Context, error) {
+	if !c.keys.Enabled() {
+		return ctx, nil
 	}
-	if !isHashSet(hash) {
-		return false
+	err := c.keys.VerifySignature(agentName(ctx), keyID, signature, func(secret []byte) string {
+		return replay.BodySignature(secret, timestamp, nonce, body)
+	})
+	if err != nil {
+		return ctx, fmt.Errorf("%w: batch signature: %v", ErrInvalidHash, err)
 	}
+	var batchNonce *replay.Nonce
+	if c.guard != nil {
+		batchNonce = &replay.Nonce{Timestamp: timestamp, Value: nonce, Scope: "batch"}
+		// the nonce is used by UpdateMetrics after admission of the batch
+		if err = c.guard.Validate(*batchNonce); err != nil {
+			return ctx, err
+		}
+	}
+	if client := quota.ClientFromContext(ctx); client != "" {
+		ctx = quota.WithClient(ctx, quota.KeyIdentity(client, keyID))
+	}
+	return replay.WithVerifiedBatch(ctx, batchNonce), nil
+}
 
-	return hash == metric.Hash(c.hashKey)
+func (c Controller) isReadOnly() bool {
+	return c.readOnly != nil && c.readOnly()
 }
 
-func (c Controller) GetHash(metric metrics.Metric) string {
-	if !c.isKeySet() {
-		return ""
+// observe passes saved metric to observers.
+// Updates forwarded by cluster node are skipped, they were observed by that node.
+func (c Controller) observe(ctx context.Context, metric metrics.Metric, counterDelta int64) {
+	if cluster.IsForwarded(ctx) {
+		return
+	}
+	for _, o := range c.observers {
+		o.Observe(metric, counterDelta)
 	}
-	return metric.Hash(c.hashKey)
 }
 
-func (c Controller) isKeySet() bool {
-	return len(c.hashKey) > 0
+// checkHash verifies params hash by the key of params key ID, timestamp and nonce are signed along with metric.
+// Nonce is appended to nonces and used only after the update is admitted, so rejected update can be retried.
+// Updates of verified batch aren't checked, updates forwarded by cluster nodes were checked for replay by them.
+func (c Controller) checkHash(
+	ctx context.Context,
+	params metrics.Params,
+	metric metrics.Metric,
+	nonces []replay.Nonce) ([]replay.Nonce, error) {
+	if replay.IsVerifiedBatch(ctx) || IsTrustedSource(ctx) || !c.keys.Enabled() {
+		return nonces, nil
+	}
+	stamped := params.Timestamp != 0 || params.Nonce != ""
+	protected := c.guard != nil && !cluster.IsForwarded(ctx)
+	if protected && !stamped && c.guard.Required() {
+		return nonces, replay.ErrMissingEnvelope
+	}
+
+	err := c.keys.VerifySignature(agentName(ctx), params.KeyID, params.Hash, func(secret []byte) string {
+		return replay.MetricHash(metric, secret, params.Timestamp, params.Nonce)
+	})
+	if err != nil {
+		return nonces, fmt.Errorf("%w: %v", ErrInvalidHash, err)
+	}
+	if protected && stamped {
+		nonce := replay.Nonce{Timestamp: params.Timestamp, Value: params.Nonce, Scope: params.Type + ":" + params.Name}
+		if err = c.guard.Validate(nonce); err != nil {
+			return nonces, err
+		}
+		nonces = append(nonces, nonce)
+	}
+	return nonces, nil
+}
+
+// admit counts update of client by quota and cardinality limits,
+// returned func releases them when the update isn't stored.
+func (c Controller) admit(client string, paramsSlice metrics.ParamsSlice) (func(), error) {
+	if len(paramsSlice) == 0 {
+		return func() {}, nil
+	}
+	reservation, err := c.quota.AllowMetrics(client, len(paramsSlice))
+	if err != nil {
+		return nil, err
+	}
+	created, err := c.series.Reserve(client, paramsSlice)
+	if err != nil {
+		reservation.Cancel()
+		return nil, err
+	}
+	return func() {
+		reservation.Cancel()
+		c.series.Release(created)
+	}, nil
+}
+
+// client returns quota identity of update sender, hash key ID of verified metrics replaces IP identity.
+// Key ID of verified batch is set by VerifyBatch.
+func (c Controller) client(ctx context.Context, paramsSlice metrics.ParamsSlice) string {
+	client := quota.ClientFromContext(ctx)
+	if client == "" || len(paramsSlice) == 0 || !c.keys.Enabled() || replay.IsVerifiedBatch(ctx) || IsTrustedSource(ctx) {
+		return client
+	}
+	keyID := paramsSlice[0].KeyID
+	for _, params := range paramsSlice[1:] {
+		if params.KeyID != keyID {
+			return client
+		}
+	}
+	return quota.KeyIdentity(client, keyID)
+}
+
+type trustedSourceKey struct{}
+
+// WithTrustedSource marks context of updates received from source that can't sign metrics
+// (StatsD, Graphite, scrape, line protocol of authorized token), their hashes aren't checked.
+func WithTrustedSource(ctx context.Context) context.Context {
+	return context.WithValue(ctx, trustedSourceKey{}, true)
+}
+
+// IsTrustedSource reports if updates are received from trusted source.
+func IsTrustedSource(ctx context.Context) bool {
+	trusted, _ := ctx.Value(trustedSourceKey{}).(bool)
+	return trusted
+}
+
+// agentName returns API token name of request sender, so keys can be assigned to agents.
+func agentName(ctx context.Context) string {
+	if token, ok := auth.FromContext(ctx); ok {
+		return token.Name
+	}
+	return ""
 }
 
-func isHashSet(hash string) bool {
-	return len(hash) > 0
+// GetHash returns hash of metric and ID of the key it's signed with, hash is empty when no key is set.
+func (c Controller) GetHash(metric metrics.Metric) (string, string) {
+	return c.keys.Sign(metric)
 }
@@ -0,0 +1,239 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/cardinality"
+	"github.com/unbeman/ya-prac-mcas/internal/cluster"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/quota"
+	"github.com/unbeman/ya-prac-mcas/internal/replay"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+	mock_storage "github.com/unbeman/ya-prac-mcas/internal/storage/mock"
+)
+
+func TestController_UpdateMetrics_ReleaseFailedSeries(t *testing.T) {
+	errStorage := errors.New("storage failure")
+	tests := []struct {
+		name        string
+		gaugesErr   error
+		countersErr error
+		wantSeries  int
+	}{
+		{name: "gauges failed", gaugesErr: errStorage, wantSeries: 0},
+		{name: "counters failed", countersErr: errStorage, wantSeries: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			repo := mock_storage.NewMockRepository(mockCtrl)
+			repo.EXPECT().GetAll(gomock.Any()).Return(nil, nil)
+			repo.EXPECT().SetGauges(gomock.Any(), gomock.Any()).
+				Return([]metrics.Gauge{metrics.NewGauge("Alloc", 1)}, tt.gaugesErr)
+			if tt.gaugesErr == nil {
+				repo.EXPECT().AddCounters(gomock.Any(), gomock.Any()).Return(nil, tt.countersErr)
+			}
+			index, err := cardinality.NewIndex(context.Background(), configs.CardinalityConfig{}, repo)
+			require.NoError(t, err)
+			c := NewController(repo, "", WithCardinality(index))
+
+			_, err = c.UpdateMetrics(context.Background(), metrics.ParamsSlice{
+				metrics.NewGauge("Alloc", 1).ToParams(),
+				metrics.NewCounter("PollCount", 1).ToParams(),
+			})
+			assert.ErrorIs(t, err, errStorage)
+			assert.Equal(t, tt.wantSeries, index.Report(0).Series, "series of stored gauges are kept")
+		})
+	}
+}
+
+func signedCounter(name string, delta int64, nonce string) metrics.Params {
+	counter := metrics.NewCounter(name, delta)
+	params := counter.ToParams()
+	params.Timestamp, params.Nonce = time.Now().Unix(), nonce
+	params.Hash = replay.MetricHash(counter, []byte("secret"), params.Timestamp, params.Nonce)
+	return params
+}
+
+func TestController_UpdateMetric_NonceOfRejectedUpdate(t *testing.T) {
+	repo := storage.NewRAMRepository()
+	_, err := repo.SetGauge(context.Background(), "Alloc", 1)
+	require.NoError(t, err)
+	index, err := cardinality.NewIndex(context.Background(), configs.CardinalityConfig{MaxSeries: 1}, repo)
+	require.NoError(t, err)
+	guard := replay.NewGuard(configs.ReplayConfig{Window: time.Minute})
+	params := signedCounter("PollCount", 1, "n1")
+
+	_, err = NewController(repo, "secret", WithReplayGuard(guard), WithCardinality(index)).
+		UpdateMetric(context.Background(), params)
+	require.ErrorIs(t, err, cardinality.ErrLimitExceeded)
+
+	c := NewController(repo, "secret", WithReplayGuard(guard))
+	_, err = c.UpdateMetric(context.Background(), params)
+	require.NoError(t, err, "nonce of rejected update isn't used")
+	_, err = c.UpdateMetric(context.Background(), params)
+	assert.ErrorIs(t, err, replay.ErrReplayed)
+}
+
+type observed struct {
+	name  string
+	delta int64
+}
+
+type testObserver struct {
+	list []observed
+}
+
+func (o *testObserver) Observe(metric metrics.Metric, counterDelta int64) {
+	o.list = append(o.list, observed{name: metric.GetName(), delta: counterDelta})
+}
+
+func TestController_Observe(t *testing.T) {
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		update func(ctx context.Context, c *Controller) error
+		want   []observed
+	}{
+		{
+			name: "gauge",
+			ctx:  context.Background(),
+			update: func(ctx context.Context, c *Controller) error {
+				_, err := c.UpdateMetric(ctx, metrics.NewGauge("Alloc", 5).ToParams())
+				return err
+			},
+			want: []observed{{name: "Alloc"}},
+		},
+		{
+			name: "counter delta",
+			ctx:  context.Background(),
+			update: func(ctx context.Context, c *Controller) error {
+				_, err := c.UpdateMetric(ctx, metrics.NewCounter("PollCount", 3).ToParams())
+				return err
+			},
+			want: []observed{{name: "PollCount", delta: 3}},
+		},
+		{
+			name: "batch deltas follow counters",
+			ctx:  context.Background(),
+			update: func(ctx context.Context, c *Controller) error {
+				_, err := c.UpdateMetrics(ctx, metrics.ParamsSlice{
+					metrics.NewCounter("PollCount", 3).ToParams(),
+					metrics.NewGauge("Alloc", 5).ToParams(),
+					metrics.NewCounter("Deploys", 7).ToParams(),
+				})
+				return err
+			},
+			want: []observed{{name: "Alloc"}, {name: "PollCount", delta: 3}, {name: "Deploys", delta: 7}},
+		},
+		{
+			name: "forwarded by cluster node",
+			ctx:  cluster.WithForwarded(context.Background()),
+			update: func(ctx context.Context, c *Controller) error {
+				_, err := c.UpdateMetric(ctx, metrics.NewCounter("PollCount", 3).ToParams())
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var observer testObserver
+			repo := storage.NewRAMRepository()
+			_, err := repo.AddCounter(context.Background(), "PollCount", 10)
+			require.NoError(t, err)
+			c := NewController(repo, "", WithObserver(&observer))
+
+			require.NoError(t, tt.update(tt.ctx, c))
+			assert.Equal(t, tt.want, observer.list)
+		})
+	}
+}
+
+func TestController_UpdateMetric_Rejected(t *testing.T) {
+	now := time.Now().Unix()
+	signed := func(delta int64, timestamp int64, nonce string) metrics.Params {
+		counter := metrics.NewCounter("PollCount", delta)
+		params := counter.ToParams()
+		params.Timestamp, params.Nonce = timestamp, nonce
+		params.Hash = replay.MetricHash(counter, []byte("secret"), timestamp, nonce)
+		return params
+	}
+	tests := []struct {
+		name     string
+		required bool
+		ctx      context.Context
+		params   metrics.Params
+		wantErr  error
+	}{
+		{name: "unsigned", ctx: context.Background(), params: metrics.NewCounter("PollCount", 1).ToParams(), wantErr: ErrInvalidHash},
+		{name: "wrong hash", ctx: context.Background(), params: func() metrics.Params {
+			params := signed(1, now, "n2")
+			params.Hash = signed(2, now, "n2").Hash
+			return params
+		}(), wantErr: ErrInvalidHash},
+		{name: "replayed", ctx: context.Background(), params: signed(1, now, "n1"), wantErr: replay.ErrReplayed},
+		{name: "stale", ctx: context.Background(), params: signed(1, now-600, "n3"), wantErr: replay.ErrStale},
+		{name: "missing envelope", required: true, ctx: context.Background(), params: signed(1, 0, ""),
+			wantErr: replay.ErrMissingEnvelope},
+		{name: "trusted source", ctx: WithTrustedSource(context.Background()), params: metrics.NewCounter("PollCount", 1).ToParams()},
+		{name: "signed", ctx: context.Background(), params: signed(1, now, "n4")},
+		{name: "signed without envelope", ctx: context.Background(), params: signed(1, 0, "")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var observer testObserver
+			repo := storage.NewRAMRepository()
+			guard := replay.NewGuard(configs.ReplayConfig{Window: time.Minute, Required: tt.required})
+			require.NoError(t, guard.Check(now, "n1", "counter:PollCount"))
+			c := NewController(repo, "secret", WithReplayGuard(guard), WithObserver(&observer))
+
+			_, err := c.UpdateMetric(tt.ctx, tt.params)
+			if tt.wantErr == nil {
+				require.NoError(t, err)
+				assert.Len(t, observer.list, 1)
+				return
+			}
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Empty(t, observer.list, "rejected update isn't observed")
+			_, err = repo.GetCounter(context.Background(), "PollCount")
+			assert.ErrorIs(t, err, storage.ErrNotFound, "rejected update isn't saved")
+		})
+	}
+}
+
+func TestController_UpdateMetrics_Rollback(t *testing.T) {
+	errStorage := errors.New("storage failure")
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	repo := mock_storage.NewMockRepository(mockCtrl)
+	repo.EXPECT().GetAll(gomock.Any()).Return(nil, nil)
+	gomock.InOrder(
+		repo.EXPECT().AddCounters(gomock.Any(), gomock.Any()).Return(nil, errStorage),
+		repo.EXPECT().AddCounters(gomock.Any(), gomock.Any()).
+			Return([]metrics.Counter{metrics.NewCounter("A", 1), metrics.NewCounter("B", 1)}, nil),
+	)
+	index, err := cardinality.NewIndex(context.Background(), configs.CardinalityConfig{}, repo,
+		cardinality.WithClientLimit(2))
+	require.NoError(t, err)
+	limiter := quota.NewLimiter(configs.QuotaConfig{MetricsPerMinute: 2})
+	c := NewController(repo, "", WithQuota(limiter), WithCardinality(index))
+	ctx := quota.WithClient(context.Background(), "ip:10.0.0.1")
+	update := metrics.ParamsSlice{metrics.NewCounter("A", 1).ToParams(), metrics.NewCounter("B", 1).ToParams()}
+
+	_, err = c.UpdateMetrics(ctx, update)
+	require.ErrorIs(t, err, errStorage)
+	assert.Zero(t, index.Report(0).Series, "series of failed update are released")
+
+	_, err = c.UpdateMetrics(ctx, update)
+	require.NoError(t, err, "quota and client series of failed update are released")
+	assert.Equal(t, 2, index.Report(0).Series)
+}
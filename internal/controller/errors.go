@@ -2,4 +2,7 @@ package controller
 
 import "errors"
 
-var ErrInvalidHash = errors.New("invalid hash")
+var (
+	ErrInvalidHash = errors.New("invalid hash")
+	ErrReadOnly    = errors.New("server is read-only replica")
+)
@@ -0,0 +1,75 @@
+package cryptokeys
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Key types of GenerateKey.
+const (
+	RSAKey    = "rsa"
+	X25519Key = "x25519"
+)
+
+// GenerateKey returns new PEM encoded PKCS#8 private key and PKIX public key,
+// bits is RSA modulus size, it's ignored by X25519 keys.
+func GenerateKey(keyType string, bits int) ([]byte, []byte, error) {
+	var (
+		private, public []byte
+		err             error
+	)
+	switch keyType {
+	case RSAKey:
+		private, public, err = generateRSAKey(bits)
+	case X25519Key:
+		private, public, err = generateX25519Key()
+	default:
+		return nil, nil, fmt.Errorf("%w: %q", ErrUnsupportedKey, keyType)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: pkcs8PrivateKeyBlock, Bytes: private}),
+		pem.EncodeToMemory(&pem.Block{Type: publicKeyBlock, Bytes: public}), nil
+}
+
+func generateRSAKey(bits int) ([]byte, []byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		return nil, nil, err
+	}
+	private, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return private, public, nil
+}
+
+func generateX25519Key() ([]byte, []byte, error) {
+	scalar := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(scalar); err != nil {
+		return nil, nil, err
+	}
+	point, err := curve25519.X25519(scalar, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	private, err := marshalX25519PrivateKey(scalar)
+	if err != nil {
+		return nil, nil, err
+	}
+	public, err := marshalX25519PublicKey(point)
+	if err != nil {
+		return nil, nil, err
+	}
+	return private, public, nil
+}
@@ -0,0 +1,165 @@
+// Package cryptokeys manages asymmetric keys encrypting agent payloads:
+// agents encrypt payloads by public key, server decrypts them by private key selected by key ID.
+// RSA keys and X25519 keys (ECDH) are supported.
+package cryptokeys
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+)
+
+// HTTP headers of encrypted request.
+const (
+	EncryptedKeyHeader = "Encrypted-Key"
+	KeyIDHeader        = "Encrypted-Key-ID"
+)
+
+// PEM block types.
+const (
+	pkcs1PrivateKeyBlock = "RSA PRIVATE KEY"
+	pkcs8PrivateKeyBlock = "PRIVATE KEY"
+	publicKeyBlock       = "PUBLIC KEY"
+)
+
+var (
+	ErrNoKey          = errors.New("no key provided")
+	ErrUnknownKey     = errors.New("unknown encryption key ID")
+	ErrUnsupportedKey = errors.New("unsupported key type")
+)
+
+// PublicKey encrypts payloads, the payload is encrypted by random AES key,
+// encryptedKey lets the owner of private key restore the AES key.
+type PublicKey interface {
+	// ID identifies the private key decrypting payloads on server.
+	ID() string
+	Encrypt(data []byte) (message []byte, encryptedKey string, err error)
+}
+
+// PrivateKey decrypts payloads encrypted by its public key.
+type PrivateKey interface {
+	Decrypt(message []byte, encryptedKey string) ([]byte, error)
+}
+
+// LoadPublicKey reads PEM encoded PKIX public key of server private key with given ID.
+func LoadPublicKey(path, id string) (PublicKey, error) {
+	if len(path) == 0 {
+		return nil, ErrNoKey
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadPublicKey: %w", err)
+	}
+	key, err := ParsePublicKey(data, id)
+	if err != nil {
+		return nil, fmt.Errorf("LoadPublicKey %v: %w", path, err)
+	}
+	return key, nil
+}
+
+// ParsePublicKey parses PEM encoded PKIX public key.
+func ParsePublicKey(data []byte, id string) (PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != publicKeyBlock {
+		return nil, errors.New("failed to decode PEM block containing public key")
+	}
+
+	var info publicKeyInfo
+	if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+		return nil, err
+	}
+	if info.Algorithm.Algorithm.Equal(oidX25519) {
+		return parseX25519PublicKey(info, id)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, pub)
+	}
+	return rsaPublicKey{id: id, key: rsaKey}, nil
+}
+
+// LoadPrivateKey reads PEM encoded private key, PKCS#1 RSA keys and PKCS#8 RSA or X25519 keys are supported.
+func LoadPrivateKey(path string) (PrivateKey, error) {
+	if len(path) == 0 {
+		return nil, ErrNoKey
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadPrivateKey: %w", err)
+	}
+	key, err := ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("LoadPrivateKey %v: %w", path, err)
+	}
+	return key, nil
+}
+
+// ParsePrivateKey parses PEM encoded PKCS#1 or PKCS#8 private key.
+func ParsePrivateKey(data []byte) (PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block containing private key")
+	}
+
+	switch block.Type {
+	case pkcs1PrivateKeyBlock:
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return rsaPrivateKey{key: key}, nil
+	case pkcs8PrivateKeyBlock:
+		var info privateKeyInfo
+		if _, err := asn1.Unmarshal(block.Bytes, &info); err != nil {
+			return nil, err
+		}
+		if info.Algorithm.Algorithm.Equal(oidX25519) {
+			return parseX25519PrivateKey(info)
+		}
+
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: %T", ErrUnsupportedKey, key)
+		}
+		return rsaPrivateKey{key: rsaKey}, nil
+	default:
+		return nil, fmt.Errorf("%w: PEM block %q", ErrUnsupportedKey, block.Type)
+	}
+}
+
+type rsaPublicKey struct {
+	id  string
+	key *rsa.PublicKey
+}
+
+func (k rsaPublicKey) ID() string {
+	return k.id
+}
+
+// Encrypt encrypts AES key by RSA-OAEP.
+func (k rsaPublicKey) Encrypt(data []byte) ([]byte, string, error) {
+	return utils.GetEncryptedMessage(k.key, data)
+}
+
+type rsaPrivateKey struct {
+	key *rsa.PrivateKey
+}
+
+func (k rsaPrivateKey) Decrypt(message []byte, encryptedKey string) ([]byte, error) {
+	return utils.GetDecryptedMessage(k.key, message, encryptedKey)
+}
@@ -0,0 +1,146 @@
+package cryptokeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pkcs1Key(t *testing.T) ([]byte, []byte) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: pkcs1PrivateKeyBlock, Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		pem.EncodeToMemory(&pem.Block{Type: publicKeyBlock, Bytes: public})
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	payload := []byte(`[{"id":"PollCount","type":"counter","delta":1}]`)
+
+	tests := []struct {
+		name     string
+		generate func(t *testing.T) ([]byte, []byte)
+	}{
+		{name: "PKCS#1 RSA key", generate: pkcs1Key},
+		{name: "PKCS#8 RSA key", generate: func(t *testing.T) ([]byte, []byte) {
+			private, public, err := GenerateKey(RSAKey, 2048)
+			require.NoError(t, err)
+			return private, public
+		}},
+		{name: "X25519 key", generate: func(t *testing.T) ([]byte, []byte) {
+			private, public, err := GenerateKey(X25519Key, 0)
+			require.NoError(t, err)
+			return private, public
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			privateData, publicData := tt.generate(t)
+			private, err := ParsePrivateKey(privateData)
+			require.NoError(t, err)
+			public, err := ParsePublicKey(publicData, "2024")
+			require.NoError(t, err)
+			assert.Equal(t, "2024", public.ID())
+
+			message, encryptedKey, err := public.Encrypt(payload)
+			require.NoError(t, err)
+			decrypted, err := private.Decrypt(message, encryptedKey)
+			require.NoError(t, err)
+			assert.Equal(t, payload, decrypted)
+
+			_, otherPublic, err := GenerateKey(X25519Key, 0)
+			require.NoError(t, err)
+			other, err := ParsePublicKey(otherPublic, "")
+			require.NoError(t, err)
+			message, encryptedKey, err = other.Encrypt(payload)
+			require.NoError(t, err)
+			_, err = private.Decrypt(message, encryptedKey)
+			assert.Error(t, err, "payload of other key")
+		})
+	}
+}
+
+func TestParseUnsupportedKey(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	require.NoError(t, err)
+	_, err = ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: publicKeyBlock, Bytes: publicDER}), "")
+	assert.ErrorIs(t, err, ErrUnsupportedKey)
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	require.NoError(t, err)
+	_, err = ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: pkcs8PrivateKeyBlock, Bytes: privateDER}))
+	assert.ErrorIs(t, err, ErrUnsupportedKey)
+
+	_, err = ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte{}}))
+	assert.ErrorIs(t, err, ErrUnsupportedKey)
+
+	_, err = LoadPublicKey("", "")
+	assert.ErrorIs(t, err, ErrNoKey)
+}
+
+func TestKeyset(t *testing.T) {
+	dir := t.TempDir()
+	defaultPrivate, defaultPublic := pkcs1Key(t)
+	defaultPath := filepath.Join(t.TempDir(), "private.pem")
+	require.NoError(t, os.WriteFile(defaultPath, defaultPrivate, 0600))
+	oldPrivate, oldPublic, err := GenerateKey(X25519Key, 0)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "old.pem"), oldPrivate, 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("not a key"), 0600))
+
+	keys, err := NewKeyset(defaultPath, dir)
+	require.NoError(t, err)
+	assert.True(t, keys.Enabled())
+	assert.Equal(t, []string{DefaultKeyID, "old"}, keys.IDs())
+
+	encrypt := func(publicData []byte, id string) ([]byte, string) {
+		public, err := ParsePublicKey(publicData, id)
+		require.NoError(t, err)
+		message, encryptedKey, err := public.Encrypt([]byte("payload"))
+		require.NoError(t, err)
+		return message, encryptedKey
+	}
+	message, encryptedKey := encrypt(defaultPublic, DefaultKeyID)
+	data, err := keys.Decrypt(DefaultKeyID, message, encryptedKey)
+	require.NoError(t, err)
+	assert.Equal(t, "payload", string(data))
+
+	// new key is added without restart
+	newPrivate, newPublic, err := GenerateKey(RSAKey, 2048)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "new.pem"), newPrivate, 0600))
+	require.NoError(t, keys.Reload())
+	message, encryptedKey = encrypt(newPublic, "new")
+	_, err = keys.Decrypt("new", message, encryptedKey)
+	assert.NoError(t, err)
+	message, encryptedKey = encrypt(oldPublic, "old")
+	_, err = keys.Decrypt("old", message, encryptedKey)
+	assert.NoError(t, err, "old key is kept during rotation")
+
+	// broken key file keeps previous keys
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.pem"), []byte("broken"), 0600))
+	assert.Error(t, keys.Reload())
+	assert.Equal(t, []string{DefaultKeyID, "new", "old"}, keys.IDs())
+
+	// removed key is rejected after reload
+	require.NoError(t, os.Remove(filepath.Join(dir, "broken.pem")))
+	require.NoError(t, os.Remove(filepath.Join(dir, "old.pem")))
+	require.NoError(t, keys.Reload())
+	_, err = keys.Decrypt("old", message, encryptedKey)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	var disabled *Keyset
+	assert.False(t, disabled.Enabled())
+}
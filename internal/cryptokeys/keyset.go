@@ -0,0 +1,128 @@
+package cryptokeys
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultKeyID identifies the key of server CRYPTO_KEY setting, it decrypts payloads sent without key ID.
+const DefaultKeyID = ""
+
+// keyFileExt is extension of private key files of keys directory, file name without extension is key ID.
+const keyFileExt = ".pem"
+
+// Keyset keeps server private keys identified by key ID, so agents are moved to a new key
+// while the old one still decrypts payloads. Keys are reloaded on SIGHUP.
+type Keyset struct {
+	sync.RWMutex
+	path string
+	dir  string
+	keys map[string]PrivateKey
+}
+
+// NewKeyset loads the default private key of path and private keys of dir, both are optional.
+func NewKeyset(path, dir string) (*Keyset, error) {
+	k := &Keyset{path: path, dir: dir}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Start reloads keys on SIGHUP until context is done.
+func (k *Keyset) Start(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hangup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangup:
+				if err := k.Reload(); err != nil {
+					log.Errorf("Crypto keys not reloaded: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Reload loads all keys, previous keys are kept on error.
+func (k *Keyset) Reload() error {
+	keys := map[string]PrivateKey{}
+	if k.path != "" {
+		key, err := LoadPrivateKey(k.path)
+		if err != nil {
+			return err
+		}
+		keys[DefaultKeyID] = key
+	}
+	if k.dir != "" {
+		entries, err := os.ReadDir(k.dir)
+		if err != nil {
+			return fmt.Errorf("can't read crypto keys dir: %w", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || filepath.Ext(entry.Name()) != keyFileExt {
+				continue
+			}
+			id := strings.TrimSuffix(entry.Name(), keyFileExt)
+			key, err := LoadPrivateKey(filepath.Join(k.dir, entry.Name()))
+			if err != nil {
+				return err
+			}
+			keys[id] = key
+		}
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	if k.keys != nil {
+		log.Infof("Crypto keys reloaded, %d keys", len(keys))
+	}
+	k.keys = keys
+	return nil
+}
+
+// Enabled reports if any key is loaded, payloads are decrypted only then.
+func (k *Keyset) Enabled() bool {
+	if k == nil {
+		return false
+	}
+	k.RLock()
+	defer k.RUnlock()
+	return len(k.keys) > 0
+}
+
+// IDs returns sorted IDs of loaded keys.
+func (k *Keyset) IDs() []string {
+	k.RLock()
+	defer k.RUnlock()
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Decrypt decrypts payload by key of given ID.
+func (k *Keyset) Decrypt(keyID string, message []byte, encryptedKey string) ([]byte, error) {
+	k.RLock()
+	key, ok := k.keys[keyID]
+	k.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, keyID)
+	}
+	return key.Decrypt(message, encryptedKey)
+}
@@ -0,0 +1,130 @@
+package cryptokeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+)
+
+// oidX25519 is X25519 algorithm identifier of RFC 8410.
+var oidX25519 = asn1.ObjectIdentifier{1, 3, 101, 110}
+
+// privateKeyInfo is PKCS#8 private key structure.
+type privateKeyInfo struct {
+	Version    int
+	Algorithm  pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+// publicKeyInfo is PKIX public key structure.
+type publicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+func parseX25519PrivateKey(info privateKeyInfo) (PrivateKey, error) {
+	// private key is an octet string wrapped into another octet string
+	var scalar []byte
+	if _, err := asn1.Unmarshal(info.PrivateKey, &scalar); err != nil {
+		return nil, fmt.Errorf("invalid X25519 private key: %w", err)
+	}
+	if len(scalar) != curve25519.ScalarSize {
+		return nil, fmt.Errorf("invalid X25519 private key size %d", len(scalar))
+	}
+	public, err := curve25519.X25519(scalar, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	return x25519PrivateKey{private: scalar, public: public}, nil
+}
+
+func parseX25519PublicKey(info publicKeyInfo, id string) (PublicKey, error) {
+	if len(info.PublicKey.Bytes) != curve25519.PointSize {
+		return nil, fmt.Errorf("invalid X25519 public key size %d", len(info.PublicKey.Bytes))
+	}
+	return x25519PublicKey{id: id, public: info.PublicKey.Bytes}, nil
+}
+
+func marshalX25519PrivateKey(scalar []byte) ([]byte, error) {
+	wrapped, err := asn1.Marshal(scalar)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(privateKeyInfo{Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidX25519}, PrivateKey: wrapped})
+}
+
+func marshalX25519PublicKey(public []byte) ([]byte, error) {
+	return asn1.Marshal(publicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidX25519},
+		PublicKey: asn1.BitString{Bytes: public, BitLength: 8 * len(public)},
+	})
+}
+
+// deriveKey returns AES-256 key of ECDH shared secret bound to both public keys.
+func deriveKey(shared, ephemeral, recipient []byte) []byte {
+	h := sha256.New()
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+	return h.Sum(nil)
+}
+
+type x25519PublicKey struct {
+	id     string
+	public []byte
+}
+
+func (k x25519PublicKey) ID() string {
+	return k.id
+}
+
+// Encrypt derives AES key by ECDH of ephemeral key and recipient key,
+// encrypted key is the ephemeral public key.
+func (k x25519PublicKey) Encrypt(data []byte) ([]byte, string, error) {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return nil, "", err
+	}
+	ephemeralPublic, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, "", err
+	}
+	shared, err := curve25519.X25519(ephemeral, k.public)
+	if err != nil {
+		return nil, "", fmt.Errorf("ecdh failed, %w", err)
+	}
+
+	msg, err := utils.SealMessage(deriveKey(shared, ephemeralPublic, k.public), data)
+	if err != nil {
+		return nil, "", err
+	}
+	return msg, base64.RawStdEncoding.EncodeToString(ephemeralPublic), nil
+}
+
+type x25519PrivateKey struct {
+	private []byte
+	public  []byte
+}
+
+func (k x25519PrivateKey) Decrypt(message []byte, encryptedKey string) ([]byte, error) {
+	ephemeralPublic, err := base64.RawStdEncoding.DecodeString(encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(ephemeralPublic) != curve25519.PointSize {
+		return nil, errors.New("invalid ephemeral key size")
+	}
+	shared, err := curve25519.X25519(k.private, ephemeralPublic)
+	if err != nil {
+		return nil, fmt.Errorf("ecdh failed, %w", err)
+	}
+	return utils.OpenMessage(deriveKey(shared, ephemeralPublic, k.public), message)
+}
@@ -0,0 +1,211 @@
+// Package export forwards stored metrics to external time series storages.
+package export
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/history"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+// sink writes encoded batch to external storage.
+type sink func(ctx context.Context, batch []point) error
+
+// Exporter periodically takes snapshot of stored metrics and forwards it in batches.
+// Points that can't be delivered stay in bounded buffer until the next export,
+// the oldest points are dropped when buffer is full.
+type Exporter struct {
+	control       *controller.Controller
+	write         sink
+	patterns      []string
+	prefix        string
+	interval      time.Duration
+	batchSize     int
+	bufferSize    int
+	retries       int
+	retryInterval time.Duration
+	buffer        []point
+	now           func() time.Time
+}
+
+// NewExporter creates Exporter, returns error on unknown format or invalid pattern.
+func NewExporter(cfg configs.ExportConfig, control *controller.Controller) (*Exporter, error) {
+	e := &Exporter{
+		control:       control,
+		patterns:      cfg.Patterns,
+		prefix:        cfg.Prefix,
+		interval:      cfg.Interval,
+		batchSize:     cfg.BatchSize,
+		bufferSize:    cfg.BufferSize,
+		retries:       cfg.Retries,
+		retryInterval: cfg.RetryInterval,
+		now:           time.Now,
+	}
+	for _, pattern := range cfg.Patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid export pattern %v: %w", pattern, err)
+		}
+	}
+	switch cfg.Format {
+	case configs.GraphiteExportFormat:
+		e.write = graphiteSink(cfg.Address, cfg.Timeout)
+	case configs.InfluxExportFormat:
+		e.write = influxSink(cfg.Address, cfg.Timeout)
+	default:
+		return nil, fmt.Errorf("unknown export format %v", cfg.Format)
+	}
+	if e.batchSize <= 0 {
+		e.batchSize = configs.ExportBatchSizeDefault
+	}
+	return e, nil
+}
+
+// Run exports metrics every interval until ctx is done.
+func (e *Exporter) Run(ctx context.Context) {
+	log.Info("starting exporter")
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.Export(ctx)
+		}
+	}
+}
+
+// Export adds current values to buffer and sends buffer batch by batch.
+func (e *Exporter) Export(ctx context.Context) {
+	if err := e.collect(ctx); err != nil {
+		log.Error("export: can't get metrics: ", err)
+	}
+
+	for len(e.buffer) > 0 {
+		size := e.batchSize
+		if size > len(e.buffer) {
+			size = len(e.buffer)
+		}
+		if err := e.send(ctx, e.buffer[:size]); err != nil {
+			log.Errorf("export: %d points postponed: %v", len(e.buffer), err)
+			return
+		}
+		e.buffer = e.buffer[size:]
+	}
+	e.buffer = nil
+}
+
+func (e *Exporter) collect(ctx context.Context) error {
+	list, err := e.control.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+	now := e.now()
+	for _, metric := range list {
+		if !e.matches(metric.GetName()) {
+			continue
+		}
+		name := metric.GetName()
+		if e.prefix != "" {
+			name = e.prefix + "." + name
+		}
+		e.buffer = append(e.buffer, point{
+			name:    name,
+			value:   history.Value(metric),
+			counter: metric.GetType() == metrics.CounterType,
+			time:    now,
+		})
+	}
+	if e.bufferSize > 0 && len(e.buffer) > e.bufferSize {
+		dropped := len(e.buffer) - e.bufferSize
+		e.buffer = e.buffer[dropped:]
+		log.Warnf("export: buffer is full, %d oldest points dropped", dropped)
+	}
+	return nil
+}
+
+func (e *Exporter) matches(name string) bool {
+	if len(e.patterns) == 0 {
+		return true
+	}
+	for _, pattern := range e.patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// send writes batch retrying with exponential backoff.
+func (e *Exporter) send(ctx context.Context, batch []point) error {
+	wait := e.retryInterval
+	for attempt := 0; ; attempt++ {
+		err := e.write(ctx, batch)
+		if err == nil || attempt >= e.retries {
+			return err
+		}
+		log.Debugf("export: attempt %d failed: %v", attempt+1, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// graphiteSink sends batch over new TCP connection.
+func graphiteSink(address string, timeout time.Duration) sink {
+	dialer := net.Dialer{Timeout: timeout}
+	return func(ctx context.Context, batch []point) error {
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if timeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(timeout))
+		}
+		_, err = conn.Write(formatGraphite(batch))
+		return err
+	}
+}
+
+// influxSink posts batch to InfluxDB write endpoint, e.g. `http://influx:8086/write?db=metrics`.
+func influxSink(url string, timeout time.Duration) sink {
+	client := http.Client{Timeout: timeout}
+	return func(ctx context.Context, batch []point) error {
+		body := formatInflux(batch)
+		if len(body) == 0 {
+			return nil
+		}
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+		response, err := client.Do(request)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		io.Copy(io.Discard, response.Body)
+		if response.StatusCode < 200 || response.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status code %v", response.StatusCode)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,160 @@
+package export
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+)
+
+var exportTime = time.Unix(1700000000, 0)
+
+func newTestController(t *testing.T) *controller.Controller {
+	repository := storage.NewRAMRepository()
+	ctx := context.Background()
+	_, err := repository.SetGauge(ctx, "cpu.usage;host=web 1", 0.5)
+	require.NoError(t, err)
+	_, err = repository.AddCounter(ctx, "PollCount", 3)
+	require.NoError(t, err)
+	_, err = repository.SetGauge(ctx, "Alloc", 10)
+	require.NoError(t, err)
+	return controller.NewController(repository, "")
+}
+
+func TestFormat(t *testing.T) {
+	points := []point{
+		{name: "cpu.usage;host=web 1", value: 0.5, time: exportTime},
+		{name: "PollCount", value: 3, counter: true, time: exportTime},
+	}
+	assert.Equal(t, "cpu.usage;host=web_1 0.5 1700000000\nPollCount 3 1700000000\n", string(formatGraphite(points)))
+	assert.Equal(t, "cpu.usage,host=web\\ 1,metric_type=gauge value=0.5 1700000000000000000\n"+
+		"PollCount,metric_type=counter value=3i 1700000000000000000\n",
+		string(formatInflux(points)))
+
+	points = append(points,
+		point{name: "PollCount", value: 2.5, time: exportTime},
+		point{name: "Ratio", value: math.NaN(), time: exportTime},
+		point{name: "Rate", value: math.Inf(1), time: exportTime},
+	)
+	assert.Contains(t, string(formatInflux(points)), "PollCount,metric_type=gauge value=2.5 1700000000000000000\n",
+		"gauge and counter of the same name are kept apart")
+	assert.NotContains(t, string(formatInflux(points)), "Ra", "non-finite points are skipped")
+}
+
+func TestExporter_Graphite(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	lines := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				lines <- scanner.Text()
+			}
+			conn.Close()
+		}
+	}()
+
+	cfg := configs.ExportConfig{
+		Format:    configs.GraphiteExportFormat,
+		Address:   listener.Addr().String(),
+		Patterns:  []string{"cpu.*", "Poll*"},
+		Prefix:    "dc1",
+		BatchSize: 1,
+		Timeout:   time.Second,
+	}
+	exporter, err := NewExporter(cfg, newTestController(t))
+	require.NoError(t, err)
+	exporter.now = func() time.Time { return exportTime }
+
+	exporter.Export(context.Background())
+
+	got := []string{<-lines, <-lines}
+	assert.ElementsMatch(t, []string{"dc1.cpu.usage;host=web_1 0.5 1700000000", "dc1.PollCount 3 1700000000"}, got)
+	assert.Empty(t, exporter.buffer)
+}
+
+func TestExporter_InfluxRetries(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		bodies   []string
+		failures = 2
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	cfg := configs.ExportConfig{
+		Format:        configs.InfluxExportFormat,
+		Address:       server.URL + "/write?db=metrics",
+		Patterns:      []string{"Alloc"},
+		BatchSize:     10,
+		Retries:       1,
+		RetryInterval: time.Millisecond,
+		Timeout:       time.Second,
+	}
+	exporter, err := NewExporter(cfg, newTestController(t))
+	require.NoError(t, err)
+	exporter.now = func() time.Time { return exportTime }
+
+	// both attempts fail, point stays in buffer
+	exporter.Export(context.Background())
+	assert.Len(t, exporter.buffer, 1)
+
+	// buffered and new points are sent together
+	exporter.Export(context.Background())
+	assert.Empty(t, exporter.buffer)
+	require.Len(t, bodies, 1)
+	assert.Equal(t, 2, strings.Count(bodies[0], "Alloc,metric_type=gauge value=10 1700000000000000000\n"))
+}
+
+func TestExporter_BufferLimit(t *testing.T) {
+	cfg := configs.ExportConfig{
+		Format:     configs.InfluxExportFormat,
+		Address:    "http://127.0.0.1:0/write",
+		BufferSize: 2,
+		BatchSize:  10,
+	}
+	exporter, err := NewExporter(cfg, newTestController(t))
+	require.NoError(t, err)
+
+	exporter.Export(context.Background())
+	assert.Len(t, exporter.buffer, 2)
+}
+
+func TestNewExporter(t *testing.T) {
+	_, err := NewExporter(configs.ExportConfig{Format: "opentsdb", Address: "localhost:4242"}, nil)
+	assert.Error(t, err)
+	_, err = NewExporter(configs.ExportConfig{Format: configs.GraphiteExportFormat, Address: "localhost:2003", Patterns: []string{"["}}, nil)
+	assert.Error(t, err)
+}
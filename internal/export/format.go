@@ -0,0 +1,81 @@
+package export
+
+import (
+	"bytes"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+// point is a metric value at export moment.
+type point struct {
+	name    string
+	value   float64
+	counter bool
+	time    time.Time
+}
+
+var (
+	graphiteReplacer         = strings.NewReplacer(" ", "_", "\n", "_")
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// formatGraphite encodes points as Graphite plaintext lines `name value timestamp`.
+// Labeled names `name;key=value` are already in Graphite tags format.
+func formatGraphite(points []point) []byte {
+	buf := bytes.Buffer{}
+	for _, p := range points {
+		buf.WriteString(graphiteReplacer.Replace(p.name))
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatFloat(p.value, 'f', -1, 64))
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(p.time.Unix(), 10))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// formatInflux encodes points as InfluxDB line protocol with single `value` field,
+// labels of labeled names become tags. Counters are written as integers, `metric_type` tag
+// keeps gauge and counter of the same name apart. InfluxDB rejects NaN and Inf, such points are skipped.
+func formatInflux(points []point) []byte {
+	buf := bytes.Buffer{}
+	for _, p := range points {
+		if math.IsNaN(p.value) || math.IsInf(p.value, 0) {
+			continue
+		}
+		parts := strings.Split(p.name, ";")
+		buf.WriteString(influxMeasurementEscaper.Replace(parts[0]))
+		for _, label := range parts[1:] {
+			key, value, ok := strings.Cut(label, "=")
+			if !ok || key == "" || value == "" {
+				continue
+			}
+			buf.WriteByte(',')
+			buf.WriteString(influxTagEscaper.Replace(key))
+			buf.WriteByte('=')
+			buf.WriteString(influxTagEscaper.Replace(value))
+		}
+		buf.WriteString(",metric_type=")
+		if p.counter {
+			buf.WriteString(metrics.CounterType)
+		} else {
+			buf.WriteString(metrics.GaugeType)
+		}
+		buf.WriteString(" value=")
+		if p.counter {
+			buf.WriteString(strconv.FormatInt(int64(p.value), 10))
+			buf.WriteByte('i')
+		} else {
+			buf.WriteString(strconv.FormatFloat(p.value, 'g', -1, 64))
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatInt(p.time.UnixNano(), 10))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,109 @@
+package federation
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+// backlog keeps batches not accepted by upstream yet, oldest first.
+// Batches are saved to file as JSON arrays, one per line, when path is set.
+type backlog struct {
+	path    string
+	size    int
+	batches []metrics.ParamsSlice
+}
+
+// newBacklog creates backlog and loads batches left by previous run.
+func newBacklog(path string, size int) (*backlog, error) {
+	b := &backlog{path: path, size: size}
+	if path == "" {
+		return b, nil
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't open upstream backlog: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var batch metrics.ParamsSlice
+		if err = json.Unmarshal(scanner.Bytes(), &batch); err != nil {
+			return nil, fmt.Errorf("can't read upstream backlog: %w", err)
+		}
+		b.push(batch)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read upstream backlog: %w", err)
+	}
+	return b, nil
+}
+
+// push appends batch, the oldest batches are dropped when backlog is full.
+func (b *backlog) push(batch metrics.ParamsSlice) {
+	b.batches = append(b.batches, batch)
+	if b.size > 0 && len(b.batches) > b.size {
+		b.batches = b.batches[len(b.batches)-b.size:]
+	}
+}
+
+func (b *backlog) front() (metrics.ParamsSlice, bool) {
+	if len(b.batches) == 0 {
+		return nil, false
+	}
+	return b.batches[0], true
+}
+
+func (b *backlog) pop() {
+	if len(b.batches) > 0 {
+		b.batches = b.batches[1:]
+	}
+}
+
+func (b *backlog) len() int {
+	return len(b.batches)
+}
+
+// save rewrites backlog file, so it always keeps complete batches.
+func (b *backlog) save() error {
+	if b.path == "" {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+".*")
+	if err != nil {
+		return fmt.Errorf("can't save upstream backlog: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, batch := range b.batches {
+		if err = encoder.Encode(batch); err != nil {
+			tmp.Close()
+			return fmt.Errorf("can't save upstream backlog: %w", err)
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("can't save upstream backlog: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("can't save upstream backlog: %w", err)
+	}
+	if err = os.Rename(tmp.Name(), b.path); err != nil {
+		return fmt.Errorf("can't save upstream backlog: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+// Package federation forwards updates accepted by edge server to upstream server.
+package federation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/agent/sender"
+	"github.com/unbeman/ya-prac-mcas/internal/cryptokeys"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+)
+
+// Forwarder aggregates saved metrics between flushes: counters are summed,
+// only the last gauge values are kept. Aggregated batch is signed with upstream key,
+// and kept in backlog until upstream accepts it, so updates survive upstream outages.
+// Mutex guards aggregated metrics only, so Observe isn't blocked while upstream is slow.
+type Forwarder struct {
+	sync.Mutex
+	sender   sender.Sender
+	hashKey  []byte
+	prefix   string
+	interval time.Duration
+	gauges   map[string]float64
+	counters map[string]int64
+	// flushLock serializes flushes and guards backlog
+	flushLock sync.Mutex
+	backlog   *backlog
+}
+
+// NewForwarder creates Forwarder sending to configured upstream server.
+func NewForwarder(cfg configs.UpstreamConfig) (*Forwarder, error) {
+	pubKey, err := cryptokeys.LoadPublicKey(cfg.PublicKeyPath, cfg.CryptoKeyID)
+	if err != nil && !errors.Is(err, cryptokeys.ErrNoKey) {
+		return nil, fmt.Errorf("can't get upstream public key: %w", err)
+	}
+	s, err := sender.GetSender(cfg.Connection(), pubKey)
+	if err != nil {
+		return nil, err
+	}
+	return newForwarder(cfg, s)
+}
+
+func newForwarder(cfg configs.UpstreamConfig, s sender.Sender) (*Forwarder, error) {
+	b, err := newBacklog(cfg.BacklogFile, cfg.BacklogSize)
+	if err != nil {
+		return nil, err
+	}
+	if b.len() > 0 {
+		log.Infof("Loaded %d batches of upstream backlog", b.len())
+	}
+	return &Forwarder{
+		sender:   s,
+		hashKey:  []byte(cfg.HashKey),
+		prefix:   cfg.Prefix,
+		interval: cfg.Interval,
+		gauges:   map[string]float64{},
+		counters: map[string]int64{},
+		backlog:  b,
+	}, nil
+}
+
+// Observe aggregates saved metric, it implements controller.Observer.
+func (f *Forwarder) Observe(metric metrics.Metric, counterDelta int64) {
+	f.Lock()
+	defer f.Unlock()
+	switch m := metric.(type) {
+	case metrics.Gauge:
+		f.gauges[metric.GetName()] = m.Value()
+	case metrics.Counter:
+		f.counters[metric.GetName()] += counterDelta
+	}
+}
+
+// Start runs periodic forwarding.
+func (f *Forwarder) Start(ctx context.Context, pool *utils.TickerPool) {
+	pool.AddTask(ctx, "upstream forwarding", f.Flush, f.interval)
+}
+
+// Flush moves aggregated metrics to backlog and sends backlog batches, oldest first.
+// Sending stops on the first error, the rest is retried on the next flush.
+func (f *Forwarder) Flush(ctx context.Context) {
+	f.flushLock.Lock()
+	defer f.flushLock.Unlock()
+
+	changed := f.collect()
+	for {
+		batch, ok := f.backlog.front()
+		if !ok {
+			break
+		}
+		if err := f.sender.SendMetrics(ctx, batch); err != nil {
+			log.Warnf("Upstream unavailable, %d batches kept in backlog: %v", f.backlog.len(), err)
+			break
+		}
+		f.backlog.pop()
+		changed = true
+	}
+	if changed {
+		if err := f.backlog.save(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// Close moves aggregated metrics to backlog, so they are sent after restart.
+func (f *Forwarder) Close() error {
+	f.flushLock.Lock()
+	defer f.flushLock.Unlock()
+	f.collect()
+	return f.backlog.save()
+}
+
+// collect pushes aggregated metrics to backlog as a new batch, returns false if there was nothing to push.
+// It's called holding flushLock.
+func (f *Forwarder) collect() bool {
+	f.Lock()
+	gauges, counters := f.gauges, f.counters
+	f.gauges = map[string]float64{}
+	f.counters = map[string]int64{}
+	f.Unlock()
+	if len(gauges) == 0 && len(counters) == 0 {
+		return false
+	}
+
+	batch := make(metrics.ParamsSlice, 0, len(gauges)+len(counters))
+	for name, value := range gauges {
+		batch = append(batch, f.sign(metrics.NewGauge(f.name(name), value)))
+	}
+	for name, delta := range counters {
+		batch = append(batch, f.sign(metrics.NewCounter(f.name(name), delta)))
+	}
+	sort.Slice(batch, func(i, j int) bool {
+		if batch[i].Type != batch[j].Type {
+			return batch[i].Type > batch[j].Type
+		}
+		return batch[i].Name < batch[j].Name
+	})
+
+	f.backlog.push(batch)
+	return true
+}
+
+func (f *Forwarder) sign(metric metrics.Metric) metrics.Params {
+	params := metric.ToParams()
+	if len(f.hashKey) > 0 {
+		params.Hash = metric.Hash(f.hashKey)
+	}
+	return params
+}
+
+func (f *Forwarder) name(name string) string {
+	if f.prefix == "" {
+		return name
+	}
+	return f.prefix + "." + name
+}
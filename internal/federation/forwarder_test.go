@@ -0,0 +1,139 @@
+package federation
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+type fakeSender struct {
+	fail    bool
+	batches []metrics.ParamsSlice
+}
+
+func (s *fakeSender) SendMetrics(_ context.Context, slice metrics.ParamsSlice) error {
+	if s.fail {
+		return errors.New("connection refused")
+	}
+	s.batches = append(s.batches, slice)
+	return nil
+}
+
+func gaugeParams(name string, value float64) metrics.Params {
+	return metrics.Params{Name: name, Type: metrics.GaugeType, ValueGauge: &value}
+}
+
+func counterParams(name string, delta int64) metrics.Params {
+	return metrics.Params{Name: name, Type: metrics.CounterType, ValueCounter: &delta}
+}
+
+func TestForwarder_Flush(t *testing.T) {
+	s := &fakeSender{}
+	f, err := newForwarder(configs.UpstreamConfig{Prefix: "dc1", BacklogSize: 10}, s)
+	require.NoError(t, err)
+
+	f.Observe(metrics.NewGauge("Alloc", 1), 0)
+	f.Observe(metrics.NewGauge("Alloc", 2), 0)
+	f.Observe(metrics.NewCounter("PollCount", 10), 3)
+	f.Observe(metrics.NewCounter("PollCount", 15), 5)
+
+	f.Flush(context.Background())
+	require.Len(t, s.batches, 1)
+	assert.Equal(t, metrics.ParamsSlice{gaugeParams("dc1.Alloc", 2), counterParams("dc1.PollCount", 8)}, s.batches[0])
+
+	f.Flush(context.Background())
+	assert.Len(t, s.batches, 1, "nothing to send")
+}
+
+// blockingSender holds SendMetrics until release is closed.
+type blockingSender struct {
+	sending chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSender) SendMetrics(ctx context.Context, _ metrics.ParamsSlice) error {
+	close(s.sending)
+	<-s.release
+	return nil
+}
+
+func TestForwarder_FlushDoesNotBlockObserve(t *testing.T) {
+	s := &blockingSender{sending: make(chan struct{}), release: make(chan struct{})}
+	f, err := newForwarder(configs.UpstreamConfig{}, s)
+	require.NoError(t, err)
+	f.Observe(metrics.NewGauge("Alloc", 1), 0)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.Flush(context.Background())
+	}()
+	<-s.sending
+
+	observed := make(chan struct{})
+	go func() {
+		defer close(observed)
+		f.Observe(metrics.NewGauge("Alloc", 2), 0)
+	}()
+	select {
+	case <-observed:
+	case <-time.After(time.Second):
+		t.Fatal("Observe is blocked by sending")
+	}
+	close(s.release)
+	<-done
+
+	f.Lock()
+	defer f.Unlock()
+	assert.Equal(t, map[string]float64{"Alloc": 2}, f.gauges, "metrics observed while sending wait for the next flush")
+}
+
+func TestForwarder_Sign(t *testing.T) {
+	s := &fakeSender{}
+	f, err := newForwarder(configs.UpstreamConfig{HashKey: "upstream"}, s)
+	require.NoError(t, err)
+
+	f.Observe(metrics.NewGauge("Alloc", 1), 0)
+	f.Flush(context.Background())
+
+	require.Len(t, s.batches, 1)
+	assert.Equal(t, metrics.NewGauge("Alloc", 1).Hash([]byte("upstream")), s.batches[0][0].Hash)
+}
+
+func TestForwarder_UpstreamOutage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backlog.ndjson")
+	cfg := configs.UpstreamConfig{BacklogFile: path, BacklogSize: 2}
+	s := &fakeSender{fail: true}
+	f, err := newForwarder(cfg, s)
+	require.NoError(t, err)
+
+	for i := int64(1); i <= 3; i++ {
+		f.Observe(metrics.NewCounter("PollCount", i), i)
+		f.Flush(context.Background())
+	}
+	f.Observe(metrics.NewCounter("PollCount", 10), 10)
+	require.NoError(t, f.Close())
+	assert.Empty(t, s.batches)
+
+	// restarted forwarder sends persisted batches, the oldest ones are dropped by backlog size
+	s = &fakeSender{}
+	f, err = newForwarder(cfg, s)
+	require.NoError(t, err)
+	f.Flush(context.Background())
+	assert.Equal(t, []metrics.ParamsSlice{
+		{counterParams("PollCount", 3)},
+		{counterParams("PollCount", 10)},
+	}, s.batches)
+
+	b, err := newBacklog(path, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, b.len())
+}
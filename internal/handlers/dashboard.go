@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/unbeman/ya-prac-mcas/internal/history"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+const (
+	dashboardRefreshSeconds = 10
+	sparklineWidth          = 600
+	sparklineHeight         = 120
+)
+
+//go:embed web
+var webFS embed.FS
+
+var dashboardTemplates = template.Must(template.ParseFS(webFS, "web/templates/*.html"))
+
+// staticHandler serves dashboard scripts and styles, so no external CDN is needed.
+func staticHandler() http.Handler {
+	static, err := fs.Sub(webFS, "web/static")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/static/", http.FileServer(http.FS(static)))
+}
+
+type dashboardRow struct {
+	Name        string
+	Type        string
+	Value       string
+	Link        string
+	Updated     string
+	UpdatedUnix int64
+}
+
+type dashboardPage struct {
+	Title          string
+	RefreshSeconds int
+	Rows           []dashboardRow
+}
+
+type pointView struct {
+	Time  string
+	Value string
+}
+
+type metricPage struct {
+	Title          string
+	RefreshSeconds int
+	Name           string
+	Type           string
+	Value          string
+	Updated        string
+	Points         []pointView
+	Min            string
+	Max            string
+	Width          int
+	Height         int
+	Sparkline      string
+}
+
+// GetMetricsHandler renders dashboard with all metrics sorted by name.
+func (ch *CollectorHandler) GetMetricsHandler(writer http.ResponseWriter, request *http.Request) {
+	metricSlice, err := ch.controller.GetAll(request.Context())
+	if err != nil {
+		ch.processError(writer, err)
+		return
+	}
+
+	rows := make([]dashboardRow, 0, len(metricSlice))
+	for _, metric := range metricSlice {
+		row := dashboardRow{
+			Name:  metric.GetName(),
+			Type:  metric.GetType(),
+			Value: metric.GetValue(),
+			Link:  "/metric/" + metric.GetType() + "/" + url.PathEscape(metric.GetName()),
+		}
+		if updated, ok := ch.lastUpdate(metric.GetType(), metric.GetName()); ok {
+			row.Updated, row.UpdatedUnix = formatTime(updated), updated.Unix()
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Name != rows[j].Name {
+			return rows[i].Name < rows[j].Name
+		}
+		return rows[i].Type < rows[j].Type
+	})
+
+	ch.render(writer, "index.html", dashboardPage{
+		Title:          "Dashboard",
+		RefreshSeconds: dashboardRefreshSeconds,
+		Rows:           rows,
+	})
+}
+
+// GetMetricPageHandler renders metric details with chart of recent values.
+func (ch *CollectorHandler) GetMetricPageHandler(writer http.ResponseWriter, request *http.Request) {
+	params, err := metrics.ParseURI(request, metrics.PType, metrics.PName)
+	if err != nil {
+		ch.processError(writer, err)
+		return
+	}
+
+	metric, err := ch.controller.GetMetric(request.Context(), params)
+	if err != nil {
+		ch.processError(writer, err)
+		return
+	}
+
+	page := metricPage{
+		Title:          metric.GetName(),
+		RefreshSeconds: dashboardRefreshSeconds,
+		Name:           metric.GetName(),
+		Type:           metric.GetType(),
+		Value:          metric.GetValue(),
+		Width:          sparklineWidth,
+		Height:         sparklineHeight,
+	}
+	if updated, ok := ch.lastUpdate(metric.GetType(), metric.GetName()); ok {
+		page.Updated = formatTime(updated)
+	}
+	if ch.history != nil {
+		points := ch.history.Points(metric.GetType(), metric.GetName())
+		page.Sparkline, page.Min, page.Max = sparkline(points, sparklineWidth, sparklineHeight)
+		for i := len(points) - 1; i >= 0; i-- {
+			page.Points = append(page.Points, pointView{Time: formatTime(points[i].Time), Value: formatValue(points[i].Value)})
+		}
+	}
+
+	ch.render(writer, "metric.html", page)
+}
+
+func (ch *CollectorHandler) render(writer http.ResponseWriter, name string, data interface{}) {
+	writer.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	if err := dashboardTemplates.ExecuteTemplate(writer, name, data); err != nil {
+		log.Errorf("Write failed, %v", err)
+	}
+}
+
+func (ch *CollectorHandler) lastUpdate(mType, name string) (time.Time, bool) {
+	if ch.history == nil {
+		return time.Time{}, false
+	}
+	return ch.history.LastUpdate(mType, name)
+}
+
+// sparkline returns SVG polyline points of values scaled to width and height, also min and max values.
+func sparkline(points []history.Point, width, height int) (string, string, string) {
+	if len(points) == 0 {
+		return "", "", ""
+	}
+	minValue, maxValue := math.Inf(1), math.Inf(-1)
+	for _, point := range points {
+		minValue, maxValue = math.Min(minValue, point.Value), math.Max(maxValue, point.Value)
+	}
+
+	coords := make([]string, 0, len(points)+1)
+	for i, point := range points {
+		x := 0.0
+		if len(points) > 1 {
+			x = float64(i) * float64(width) / float64(len(points)-1)
+		}
+		y := float64(height) / 2
+		if maxValue > minValue {
+			y = float64(height) - (point.Value-minValue)/(maxValue-minValue)*float64(height)
+		}
+		coords = append(coords, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	if len(points) == 1 {
+		coords = append(coords, fmt.Sprintf("%d,%.1f", width, float64(height)/2))
+	}
+	return strings.Join(coords, " "), formatValue(minValue), formatValue(maxValue)
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/history"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+)
+
+func TestCollectorHandler_Dashboard(t *testing.T) {
+	recentValues := history.NewHistory(10)
+	control := controller.NewController(storage.NewRAMRepository(), "", controller.WithObserver(recentValues))
+	ch := NewCollectorHandler(control, nil, nil, WithHistory(recentValues))
+
+	ctx := context.Background()
+	for _, value := range []float64{1, 3, 2} {
+		value := value
+		_, err := control.UpdateMetric(ctx, metrics.Params{Name: "Alloc", Type: metrics.GaugeType, ValueGauge: &value})
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		name        string
+		target      string
+		want        int
+		contentType string
+		contains    []string
+	}{
+		{
+			name:        "index",
+			target:      "/",
+			want:        http.StatusOK,
+			contentType: "text/html",
+			contains:    []string{`href="/metric/gauge/Alloc"`, "<time datetime="},
+		},
+		{
+			name:        "metric page",
+			target:      "/metric/gauge/Alloc",
+			want:        http.StatusOK,
+			contentType: "text/html",
+			contains:    []string{"<polyline points=\"0.0,120.0 300.0,0.0 600.0,60.0\"", "<dd>1</dd>", "<dd>3</dd>"},
+		},
+		{
+			name:   "unknown metric",
+			target: "/metric/gauge/Unknown",
+			want:   http.StatusNotFound,
+		},
+		{
+			name:        "static",
+			target:      "/static/dashboard.js",
+			want:        http.StatusOK,
+			contentType: "javascript",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			w := httptest.NewRecorder()
+			ch.ServeHTTP(w, request)
+
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tt.want, result.StatusCode)
+			assert.Contains(t, result.Header.Get("Content-Type"), tt.contentType)
+
+			body, err := io.ReadAll(result.Body)
+			require.NoError(t, err)
+			for _, part := range tt.contains {
+				assert.Contains(t, string(body), part)
+			}
+		})
+	}
+}
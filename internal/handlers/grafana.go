@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/unbeman/ya-prac-mcas/internal/alerting"
+	"github.com/unbeman/ya-prac-mcas/internal/history"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+// Grafana JSON datasource target types.
+const (
+	grafanaTimeSeries = "timeserie"
+	grafanaTable      = "table"
+)
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+type grafanaSearchRequest struct {
+	Target string `json:"target"`
+}
+
+type grafanaTarget struct {
+	Target string `json:"target"`
+	RefID  string `json:"refId"`
+	Type   string `json:"type"`
+}
+
+type grafanaQueryRequest struct {
+	Range         grafanaRange    `json:"range"`
+	Targets       []grafanaTarget `json:"targets"`
+	MaxDataPoints int             `json:"maxDataPoints"`
+}
+
+type grafanaTimeSeriesResponse struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type grafanaTableResponse struct {
+	Type    string          `json:"type"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+type grafanaAnnotationRequest struct {
+	Range      grafanaRange `json:"range"`
+	Annotation struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	} `json:"annotation"`
+}
+
+type grafanaAnnotation struct {
+	Annotation interface{} `json:"annotation"`
+	Time       int64       `json:"time"`
+	Title      string      `json:"title"`
+	Text       string      `json:"text"`
+	Tags       []string    `json:"tags"`
+}
+
+// grafanaRoutes describes Grafana JSON (SimpleJSON) datasource contract.
+// Time series points are taken from recent values history,
+// metrics without history are reported with the current value only.
+func (ch *CollectorHandler) grafanaRoutes(r chi.Router) {
+	r.Get("/", ch.PingHandler)
+	r.Post("/search", ch.GrafanaSearchHandler)
+	r.Post("/query", ch.GrafanaQueryHandler)
+	r.Post("/annotations", ch.GrafanaAnnotationsHandler)
+}
+
+// GrafanaSearchHandler returns sorted unique metric names matching target substring or glob pattern.
+func (ch *CollectorHandler) GrafanaSearchHandler(writer http.ResponseWriter, request *http.Request) {
+	var searchRequest grafanaSearchRequest
+	if err := decodeGrafanaRequest(request, &searchRequest); err != nil {
+		ch.processError(writer, err)
+		return
+	}
+
+	metricSlice, err := ch.controller.GetAll(request.Context())
+	if err != nil {
+		ch.processError(writer, err)
+		return
+	}
+
+	names := make([]string, 0, len(metricSlice))
+	seen := map[string]struct{}{}
+	for _, metric := range metricSlice {
+		name := metric.GetName()
+		if _, ok := seen[name]; ok || !matchesGrafanaTarget(searchRequest.Target, name) {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	writeGrafanaResponse(writer, names)
+}
+
+// GrafanaQueryHandler returns points of metrics matching targets within requested range.
+func (ch *CollectorHandler) GrafanaQueryHandler(writer http.ResponseWriter, request *http.Request) {
+	var queryRequest grafanaQueryRequest
+	if err := decodeGrafanaRequest(request, &queryRequest); err != nil {
+		ch.processError(writer, err)
+		return
+	}
+
+	metricSlice, err := ch.controller.GetAll(request.Context())
+	if err != nil {
+		ch.processError(writer, err)
+		return
+	}
+	sort.Slice(metricSlice, func(i, j int) bool { return metricSlice[i].GetName() < metricSlice[j].GetName() })
+
+	response := make([]interface{}, 0, len(queryRequest.Targets))
+	for _, target := range queryRequest.Targets {
+		matched := make([]metrics.Metric, 0)
+		for _, metric := range metricSlice {
+			if target.Target == metric.GetName() || isGlob(target.Target) && matchesGrafanaTarget(target.Target, metric.GetName()) {
+				matched = append(matched, metric)
+			}
+		}
+
+		if target.Type == grafanaTable {
+			response = append(response, ch.grafanaTable(matched))
+			continue
+		}
+		for _, metric := range matched {
+			response = append(response, grafanaTimeSeriesResponse{
+				Target:     metric.GetName(),
+				Datapoints: ch.grafanaDatapoints(metric, queryRequest.Range, queryRequest.MaxDataPoints),
+			})
+		}
+	}
+
+	writeGrafanaResponse(writer, response)
+}
+
+// GrafanaAnnotationsHandler returns alerts fired within requested range,
+// annotation query filters alerts by rule name pattern.
+func (ch *CollectorHandler) GrafanaAnnotationsHandler(writer http.ResponseWriter, request *http.Request) {
+	var annotationRequest grafanaAnnotationRequest
+	if err := decodeGrafanaRequest(request, &annotationRequest); err != nil {
+		ch.processError(writer, err)
+		return
+	}
+
+	annotations := make([]grafanaAnnotation, 0)
+	if ch.alerts != nil {
+		for _, alert := range ch.alerts.Alerts() {
+			if alert.FiredAt == nil || !inGrafanaRange(*alert.FiredAt, annotationRequest.Range) {
+				continue
+			}
+			if !matchesGrafanaTarget(annotationRequest.Annotation.Query, alert.Rule) {
+				continue
+			}
+			annotations = append(annotations, grafanaAnnotation{
+				Annotation: annotationRequest.Annotation,
+				Time:       alert.FiredAt.UnixMilli(),
+				Title:      alert.Rule,
+				Text:       alert.Expr,
+				Tags:       []string{alerting.FiringState},
+			})
+		}
+	}
+
+	writeGrafanaResponse(writer, annotations)
+}
+
+func (ch *CollectorHandler) grafanaDatapoints(metric metrics.Metric, timeRange grafanaRange, maxDataPoints int) [][2]float64 {
+	var points []history.Point
+	if ch.history != nil {
+		points = ch.history.Points(metric.GetType(), metric.GetName())
+	}
+	if len(points) == 0 {
+		points = []history.Point{{Time: time.Now(), Value: history.Value(metric)}}
+	}
+
+	datapoints := make([][2]float64, 0, len(points))
+	for _, point := range points {
+		// JSON has no NaN and Inf numbers, such datapoints are gaps of series
+		if inGrafanaRange(point.Time, timeRange) && isFinite(point.Value) {
+			datapoints = append(datapoints, [2]float64{point.Value, float64(point.Time.UnixMilli())})
+		}
+	}
+	if maxDataPoints > 0 && len(datapoints) > maxDataPoints {
+		datapoints = datapoints[len(datapoints)-maxDataPoints:]
+	}
+	return datapoints
+}
+
+func (ch *CollectorHandler) grafanaTable(matched []metrics.Metric) grafanaTableResponse {
+	table := grafanaTableResponse{
+		Type: grafanaTable,
+		Columns: []grafanaColumn{
+			{Text: "Name", Type: "string"},
+			{Text: "Type", Type: "string"},
+			{Text: "Value", Type: "number"},
+			{Text: "Last update", Type: "time"},
+		},
+		Rows: make([][]interface{}, 0, len(matched)),
+	}
+	for _, metric := range matched {
+		var updated, value interface{}
+		if last, ok := ch.lastUpdate(metric.GetType(), metric.GetName()); ok {
+			updated = last.UnixMilli()
+		}
+		if v := history.Value(metric); isFinite(v) {
+			value = v
+		}
+		table.Rows = append(table.Rows, []interface{}{metric.GetName(), metric.GetType(), value, updated})
+	}
+	return table
+}
+
+func decodeGrafanaRequest(request *http.Request, v interface{}) error {
+	if err := json.NewDecoder(request.Body).Decode(v); err != nil {
+		return metrics.ErrParseJSON
+	}
+	return nil
+}
+
+func writeGrafanaResponse(writer http.ResponseWriter, v interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(v); err != nil {
+		log.Errorf("Write failed, %v", err)
+	}
+}
+
+// matchesGrafanaTarget reports whether name matches glob pattern or contains target, empty target matches all.
+func matchesGrafanaTarget(target, name string) bool {
+	if isGlob(target) {
+		ok, _ := path.Match(target, name)
+		return ok
+	}
+	return strings.Contains(name, target)
+}
+
+func isGlob(target string) bool {
+	return strings.ContainsAny(target, "*?[")
+}
+
+// inGrafanaRange reports whether t is within range, zero bounds aren't checked.
+func inGrafanaRange(t time.Time, timeRange grafanaRange) bool {
+	if !timeRange.From.IsZero() && t.Before(timeRange.From) {
+		return false
+	}
+	return timeRange.To.IsZero() || !t.After(timeRange.To)
+}
@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/internal/alerting"
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/history"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+)
+
+type staticAlerts []alerting.Alert
+
+func (a staticAlerts) Alerts() []alerting.Alert {
+	return a
+}
+
+func TestCollectorHandler_Grafana(t *testing.T) {
+	firedAt := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	recentValues := history.NewHistory(10)
+	repository := storage.NewRAMRepository()
+	control := controller.NewController(repository, "", controller.WithObserver(recentValues))
+	ch := NewCollectorHandler(control, nil, nil,
+		WithHistory(recentValues),
+		WithAlerts(staticAlerts{{Rule: "LowMemory", Expr: "gauge FreeMemory < 1", State: alerting.FiringState, FiredAt: &firedAt}}),
+	)
+
+	ctx := context.Background()
+	for _, value := range []float64{1, 2} {
+		value := value
+		_, err := control.UpdateMetric(ctx, metrics.Params{Name: "CPUutilization1", Type: metrics.GaugeType, ValueGauge: &value})
+		require.NoError(t, err)
+	}
+	_, err := repository.AddCounter(ctx, "PollCount", 5)
+	require.NoError(t, err)
+	_, err = repository.SetGauge(ctx, "Ratio", math.NaN())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		body     string
+		want     int
+		wantBody string
+		contains []string
+	}{
+		{
+			name:   "test connection",
+			method: http.MethodGet,
+			target: "/grafana/",
+			want:   http.StatusOK,
+		},
+		{
+			name:     "search all",
+			method:   http.MethodPost,
+			target:   "/grafana/search",
+			body:     `{"target":""}`,
+			want:     http.StatusOK,
+			wantBody: `["CPUutilization1","PollCount","Ratio"]`,
+		},
+		{
+			name:     "search glob",
+			method:   http.MethodPost,
+			target:   "/grafana/search",
+			body:     `{"target":"CPU*"}`,
+			want:     http.StatusOK,
+			wantBody: `["CPUutilization1"]`,
+		},
+		{
+			name:     "query time series",
+			method:   http.MethodPost,
+			target:   "/grafana/query",
+			body:     `{"targets":[{"target":"CPU*","refId":"A","type":"timeserie"}],"maxDataPoints":100}`,
+			want:     http.StatusOK,
+			contains: []string{`"target":"CPUutilization1"`, `[1,`, `[2,`},
+		},
+		{
+			name:     "query metric without history",
+			method:   http.MethodPost,
+			target:   "/grafana/query",
+			body:     `{"targets":[{"target":"PollCount","refId":"A","type":"timeserie"}]}`,
+			want:     http.StatusOK,
+			contains: []string{`"target":"PollCount","datapoints":[[5,`},
+		},
+		{
+			name:     "query table",
+			method:   http.MethodPost,
+			target:   "/grafana/query",
+			body:     `{"targets":[{"target":"PollCount","refId":"A","type":"table"}]}`,
+			want:     http.StatusOK,
+			contains: []string{`"type":"table"`, `"rows":[["PollCount","counter",5,null]]`},
+		},
+		{
+			name:     "query not a number",
+			method:   http.MethodPost,
+			target:   "/grafana/query",
+			body:     `{"targets":[{"target":"Ratio","refId":"A","type":"timeserie"},{"target":"Ratio","refId":"B","type":"table"}]}`,
+			want:     http.StatusOK,
+			contains: []string{`{"target":"Ratio","datapoints":[]}`, `"rows":[["Ratio","gauge",null,null]]`},
+		},
+		{
+			name:     "query out of range",
+			method:   http.MethodPost,
+			target:   "/grafana/query",
+			body:     `{"range":{"from":"2000-01-01T00:00:00Z","to":"2000-01-02T00:00:00Z"},"targets":[{"target":"CPUutilization1","type":"timeserie"}]}`,
+			want:     http.StatusOK,
+			wantBody: `[{"target":"CPUutilization1","datapoints":[]}]`,
+		},
+		{
+			name:     "annotations",
+			method:   http.MethodPost,
+			target:   "/grafana/annotations",
+			body:     `{"range":{"from":"2023-01-01T00:00:00Z","to":"2023-01-02T00:00:00Z"},"annotation":{"name":"alerts","query":"Low*"}}`,
+			want:     http.StatusOK,
+			contains: []string{`"time":1672574400000`, `"title":"LowMemory"`},
+		},
+		{
+			name:   "invalid json",
+			method: http.MethodPost,
+			target: "/grafana/query",
+			body:   `{"targets":`,
+			want:   http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			ch.ServeHTTP(w, request)
+
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tt.want, result.StatusCode)
+
+			body, err := io.ReadAll(result.Body)
+			require.NoError(t, err)
+			if tt.wantBody != "" {
+				assert.JSONEq(t, tt.wantBody, string(body))
+			}
+			for _, part := range tt.contains {
+				assert.Contains(t, string(body), part)
+			}
+		})
+	}
+}
@@ -5,20 +5,55 @@ import (
 	"errors"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 
+	"github.com/unbeman/ya-prac-mcas/internal/cardinality"
+	"github.com/unbeman/ya-prac-mcas/internal/cluster"
 	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/cryptokeys"
 	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/query"
+	"github.com/unbeman/ya-prac-mcas/internal/quota"
+	"github.com/unbeman/ya-prac-mcas/internal/replay"
+	"github.com/unbeman/ya-prac-mcas/internal/replication"
 	"github.com/unbeman/ya-prac-mcas/internal/storage"
 	pb "github.com/unbeman/ya-prac-mcas/proto"
 )
 
 type GRPCService struct {
 	pb.UnimplementedMetricsCollectorServer
-	control *controller.Controller
+	control            *controller.Controller
+	limits             metrics.Limits
+	replication        *replication.Primary
+	cryptoKeys         *cryptokeys.Keyset
+	encryptionRequired bool
 }
 
-func NewGRPCService(control *controller.Controller) *GRPCService {
-	return &GRPCService{control: control}
+// GRPCOption configures optional GRPCService settings.
+type GRPCOption func(g *GRPCService)
+
+// WithReplicationSource enables streaming of applied updates to replicas.
+func WithReplicationSource(primary *replication.Primary) GRPCOption {
+	return func(g *GRPCService) {
+		g.replication = primary
+	}
+}
+
+// WithDecryption enables encrypted updates, plaintext updates are rejected when encryption is required.
+// Updates forwarded by cluster nodes are accepted in plaintext, they're protected by peer TLS.
+func WithDecryption(keys *cryptokeys.Keyset, required bool) GRPCOption {
+	return func(g *GRPCService) {
+		g.cryptoKeys = keys
+		g.encryptionRequired = required
+	}
+}
+
+func NewGRPCService(control *controller.Controller, limits metrics.Limits, options ...GRPCOption) *GRPCService {
+	g := &GRPCService{control: control, limits: limits}
+	for _, option := range options {
+		option(g)
+	}
+	return g
 }
 
 func (g *GRPCService) GetMetric(ctx context.Context, in *pb.GetMetricRequest) (*pb.GetMetricResponse, error) {
@@ -30,7 +65,7 @@ func (g *GRPCService) GetMetric(ctx context.Context, in *pb.GetMetricRequest) (*
 	}
 
 	out := &pb.GetMetricResponse{Metric: m.ToProto()}
-	out.Metric.Hash = g.control.GetHash(m)
+	out.Metric.Hash, out.Metric.KeyId = g.control.GetHash(m)
 	return out, nil
 }
 func (g *GRPCService) GetMetrics(ctx context.Context, in *pb.GetMetricsRequest) (*pb.GetMetricsResponse, error) {
@@ -42,7 +77,7 @@ func (g *GRPCService) GetMetrics(ctx context.Context, in *pb.GetMetricsRequest)
 	protoMetrics := make([]*pb.Metric, 0, len(ms))
 	for _, m := range ms {
 		mp := m.ToProto()
-		mp.Hash = g.control.GetHash(m)
+		mp.Hash, mp.KeyId = g.control.GetHash(m)
 		protoMetrics = append(protoMetrics, mp)
 	}
 
@@ -50,10 +85,16 @@ func (g *GRPCService) GetMetrics(ctx context.Context, in *pb.GetMetricsRequest)
 	return out, nil
 }
 func (g *GRPCService) UpdateMetric(ctx context.Context, in *pb.UpdateMetricRequest) (*pb.UpdateMetricResponse, error) {
+	if g.encryptionRequired && !cluster.IsForwarded(ctx) {
+		return nil, status.Error(codes.FailedPrecondition, "encryption required, send updates as encrypted batch")
+	}
 	params, err := metrics.ParseProto(in.Metric, metrics.PName, metrics.PType, metrics.PValue)
 	if err != nil {
 		return nil, g.processedError(err)
 	}
+	if err = g.limits.CheckNameLength(params.Name); err != nil {
+		return nil, g.processedError(err)
+	}
 
 	m, err := g.control.UpdateMetric(ctx, params)
 	if err != nil {
@@ -61,12 +102,25 @@ func (g *GRPCService) UpdateMetric(ctx context.Context, in *pb.UpdateMetricReque
 	}
 
 	out := &pb.UpdateMetricResponse{Metric: m.ToProto()}
-	out.Metric.Hash = g.control.GetHash(m)
+	out.Metric.Hash, out.Metric.KeyId = g.control.GetHash(m)
 	return out, nil
 }
 func (g *GRPCService) UpdateMetrics(ctx context.Context, in *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	in, err := g.decrypt(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.limits.CheckBatchSize(len(in.Metrics)); err != nil {
+		return nil, g.processedError(err)
+	}
+	for _, m := range in.Metrics {
+		if err := g.limits.CheckNameLength(m.Name); err != nil {
+			return nil, g.processedError(err)
+		}
+	}
+
 	var metricsParams metrics.ParamsSlice
-	err := metricsParams.ParseProto(in.Metrics)
+	err = metricsParams.ParseProto(in.Metrics)
 	if err != nil {
 		return nil, g.processedError(err)
 	}
@@ -79,6 +133,58 @@ func (g *GRPCService) UpdateMetrics(ctx context.Context, in *pb.UpdateMetricsReq
 	out := &pb.UpdateMetricsResponse{Metrics: metricsParams.ToProto()}
 	return out, nil
 }
+
+// decrypt returns request of encrypted payload, plaintext request is returned as is unless encryption is required.
+func (g *GRPCService) decrypt(ctx context.Context, in *pb.UpdateMetricsRequest) (*pb.UpdateMetricsRequest, error) {
+	payload := in.GetEncrypted()
+	if payload == nil {
+		if g.encryptionRequired && !cluster.IsForwarded(ctx) {
+			return nil, status.Error(codes.FailedPrecondition, "encryption required")
+		}
+		return in, nil
+	}
+	if !g.cryptoKeys.Enabled() {
+		return nil, status.Error(codes.FailedPrecondition, "encryption isn't supported by server")
+	}
+	data, err := g.cryptoKeys.Decrypt(payload.KeyId, payload.Data, payload.Key)
+	if errors.Is(err, cryptokeys.ErrUnknownKey) {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "can't decrypt payload: %v", err)
+	}
+	decrypted := &pb.UpdateMetricsRequest{}
+	if err = proto.Unmarshal(data, decrypted); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "can't parse decrypted payload: %v", err)
+	}
+	if decrypted.Encrypted != nil {
+		return nil, status.Error(codes.InvalidArgument, "nested encrypted payload")
+	}
+	return decrypted, nil
+}
+
+func (g *GRPCService) Query(ctx context.Context, in *pb.QueryRequest) (*pb.QueryResponse, error) {
+	vector, err := g.control.Query(ctx, in.Expr)
+	if err != nil {
+		return nil, g.processedError(err)
+	}
+
+	samples := make([]*pb.Sample, 0, len(vector))
+	for _, sample := range vector {
+		samples = append(samples, &pb.Sample{Name: sample.Name, Value: sample.Value})
+	}
+	return &pb.QueryResponse{Samples: samples}, nil
+}
+func (g *GRPCService) Replicate(in *pb.ReplicateRequest, stream pb.MetricsCollector_ReplicateServer) error {
+	if g.replication == nil {
+		return g.UnimplementedMetricsCollectorServer.Replicate(in, stream)
+	}
+	err := g.replication.Stream(stream.Context(), in.Epoch, in.Sequence, stream.Send)
+	if err != nil && stream.Context().Err() == nil {
+		return g.processedError(err)
+	}
+	return nil
+}
 func (g *GRPCService) Ping(ctx context.Context, in *pb.PingRequest) (*pb.PingResponse, error) {
 	err := g.control.Ping(ctx)
 	if err != nil {
@@ -90,14 +196,30 @@ func (g *GRPCService) Ping(ctx context.Context, in *pb.PingRequest) (*pb.PingRes
 func (g *GRPCService) processedError(err error) error {
 	var grpcCode codes.Code
 	switch {
+	case errors.Is(err, quota.ErrQuotaExceeded):
+		return quotaStatus(err)
+	case errors.Is(err, cardinality.ErrLimitExceeded):
+		grpcCode = codes.ResourceExhausted
 	case errors.Is(err, controller.ErrInvalidHash):
 		grpcCode = codes.InvalidArgument
+	case errors.Is(err, controller.ErrReadOnly):
+		grpcCode = codes.FailedPrecondition
+	case errors.Is(err, replay.ErrReplayed):
+		grpcCode = codes.AlreadyExists
+	case errors.Is(err, replay.ErrStale), errors.Is(err, replay.ErrMissingEnvelope):
+		grpcCode = codes.InvalidArgument
 	case errors.Is(err, metrics.ErrInvalidType):
 		grpcCode = codes.Unimplemented
 	case errors.Is(err, metrics.ErrInvalidValue):
 		grpcCode = codes.InvalidArgument
+	case errors.Is(err, metrics.ErrTooLarge):
+		grpcCode = codes.ResourceExhausted
+	case errors.Is(err, query.ErrSyntax), errors.Is(err, query.ErrEval):
+		grpcCode = codes.InvalidArgument
 	case errors.Is(err, storage.ErrNotFound):
 		grpcCode = codes.NotFound
+	case errors.Is(err, cluster.ErrUnavailable):
+		grpcCode = codes.Unavailable
 	default:
 		grpcCode = codes.Internal
 	}
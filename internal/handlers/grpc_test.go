@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/cluster"
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/cryptokeys"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/quota"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+	pb "github.com/unbeman/ya-prac-mcas/proto"
+)
+
+// newTestKey writes generated private key to dir and returns its public key.
+func newTestKey(t *testing.T, dir, keyType, id string) cryptokeys.PublicKey {
+	private, public, err := cryptokeys.GenerateKey(keyType, 2048)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, id+".pem"), private, 0600))
+	key, err := cryptokeys.ParsePublicKey(public, id)
+	require.NoError(t, err)
+	return key
+}
+
+func encryptRequest(t *testing.T, key cryptokeys.PublicKey, request *pb.UpdateMetricsRequest) *pb.UpdateMetricsRequest {
+	buf, err := proto.Marshal(request)
+	require.NoError(t, err)
+	data, encryptedKey, err := key.Encrypt(buf)
+	require.NoError(t, err)
+	return &pb.UpdateMetricsRequest{Encrypted: &pb.EncryptedPayload{Data: data, Key: encryptedKey, KeyId: key.ID()}}
+}
+
+func TestGRPCService_UpdateMetricsEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey := newTestKey(t, dir, cryptokeys.RSAKey, "2024-rsa")
+	x25519Key := newTestKey(t, dir, cryptokeys.X25519Key, "2025-x25519")
+	unknownKey := newTestKey(t, t.TempDir(), cryptokeys.X25519Key, "other")
+	keys, err := cryptokeys.NewKeyset("", dir)
+	require.NoError(t, err)
+	plain := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{metrics.NewCounter("PollCount", 3).ToProto()}}
+
+	tests := []struct {
+		name     string
+		keys     *cryptokeys.Keyset
+		required bool
+		ctx      context.Context
+		request  *pb.UpdateMetricsRequest
+		wantCode codes.Code
+	}{
+		{name: "batch encrypted by RSA key", keys: keys, required: true, ctx: context.Background(), request: encryptRequest(t, rsaKey, plain)},
+		{name: "batch encrypted by X25519 key", keys: keys, required: true, ctx: context.Background(), request: encryptRequest(t, x25519Key, plain)},
+		{name: "plaintext is accepted when encryption is optional", keys: keys, ctx: context.Background(), request: plain},
+		{name: "plaintext is rejected when encryption is required", keys: keys, required: true, ctx: context.Background(), request: plain, wantCode: codes.FailedPrecondition},
+		{name: "plaintext forwarded by cluster node", keys: keys, required: true, ctx: cluster.WithForwarded(context.Background()), request: plain},
+		{name: "unknown key ID", keys: keys, ctx: context.Background(), request: encryptRequest(t, unknownKey, plain), wantCode: codes.FailedPrecondition},
+		{name: "key ID of other key", keys: keys, ctx: context.Background(), request: func() *pb.UpdateMetricsRequest {
+			request := encryptRequest(t, x25519Key, plain)
+			request.Encrypted.KeyId = rsaKey.ID()
+			return request
+		}(), wantCode: codes.InvalidArgument},
+		{name: "server without key", ctx: context.Background(), request: encryptRequest(t, rsaKey, plain), wantCode: codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			control := controller.NewController(storage.NewRAMRepository(), "")
+			service := NewGRPCService(control, metrics.Limits{}, WithDecryption(tt.keys, tt.required))
+
+			out, err := service.UpdateMetrics(tt.ctx, tt.request)
+			if tt.wantCode != codes.OK {
+				assert.Equal(t, tt.wantCode, status.Code(err))
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, out.Metrics, 1)
+			assert.Equal(t, int64(3), out.Metrics[0].Delta)
+		})
+	}
+}
+
+func TestIPCheckerServerInterceptor(t *testing.T) {
+	ipFilter, err := utils.NewIPFilter("10.0.0.0/8", "192.0.2.1")
+	require.NoError(t, err)
+	interceptor := IPCheckerServerInterceptor(ipFilter)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+	withPeer := func(addr string, meta metadata.MD) context.Context {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 5000}})
+		if meta != nil {
+			ctx = metadata.NewIncomingContext(ctx, meta)
+		}
+		return ctx
+	}
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		wantCode codes.Code
+	}{
+		{name: "trusted peer", ctx: withPeer("10.0.0.5", nil)},
+		{name: "untrusted peer without metadata", ctx: withPeer("203.0.113.5", metadata.MD{}), wantCode: codes.PermissionDenied},
+		{name: "spoofed real IP", ctx: withPeer("203.0.113.5", metadata.Pairs("x-real-ip", "10.0.0.5")), wantCode: codes.PermissionDenied},
+		{name: "client behind trusted proxy", ctx: withPeer("192.0.2.1", metadata.Pairs("x-forwarded-for", "10.0.0.5"))},
+		{name: "no peer", ctx: context.Background(), wantCode: codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := interceptor(tt.ctx, nil, &grpc.UnaryServerInfo{}, handler)
+			assert.Equal(t, tt.wantCode, status.Code(err))
+		})
+	}
+}
+
+func TestQuotaUnaryServerInterceptor(t *testing.T) {
+	limiter := quota.NewLimiter(configs.QuotaConfig{RequestsPerSecond: 1, RequestsBurst: 1})
+	interceptor := QuotaUnaryServerInterceptor(limiter, nil)
+	var client string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		client = quota.ClientFromContext(ctx)
+		return "ok", nil
+	}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}})
+	update := &grpc.UnaryServerInfo{FullMethod: pb.MetricsCollector_UpdateMetrics_FullMethodName}
+
+	_, err := interceptor(ctx, nil, update, handler)
+	require.NoError(t, err)
+	assert.Equal(t, "ip:10.0.0.1", client)
+
+	_, err = interceptor(ctx, nil, update, handler)
+	st := status.Convert(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code())
+	var retryInfo *errdetails.RetryInfo
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			retryInfo = info
+		}
+	}
+	require.NotNil(t, retryInfo)
+	assert.InDelta(t, time.Second, retryInfo.RetryDelay.AsDuration(), float64(100*time.Millisecond))
+
+	_, err = interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: pb.MetricsCollector_GetMetrics_FullMethodName}, handler)
+	assert.NoError(t, err, "reads aren't limited")
+	_, err = interceptor(cluster.WithForwarded(ctx), nil, update, handler)
+	assert.NoError(t, err, "forwarded updates are limited by the receiving node")
+}
@@ -2,58 +2,209 @@
 package handlers
 
 import (
-	"crypto/rsa"
 	"encoding/json"
 	"errors"
-	"fmt"
-	"net"
+	"math"
 	"net/http"
-	"strings"
+	"strconv"
 
 	logger "github.com/chi-middleware/logrus-logger"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/unbeman/ya-prac-mcas/internal/alerting"
+	"github.com/unbeman/ya-prac-mcas/internal/auth"
+	"github.com/unbeman/ya-prac-mcas/internal/cardinality"
+	"github.com/unbeman/ya-prac-mcas/internal/cluster"
 	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/cryptokeys"
+	"github.com/unbeman/ya-prac-mcas/internal/history"
+	"github.com/unbeman/ya-prac-mcas/internal/ingest"
+	"github.com/unbeman/ya-prac-mcas/internal/keyring"
 	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/query"
+	"github.com/unbeman/ya-prac-mcas/internal/quota"
+	"github.com/unbeman/ya-prac-mcas/internal/replay"
+	"github.com/unbeman/ya-prac-mcas/internal/replication"
 	"github.com/unbeman/ya-prac-mcas/internal/storage"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
 )
 
 type CollectorHandler struct {
 	*chi.Mux
-	controller *controller.Controller
+	controller  *controller.Controller
+	limits      metrics.Limits
+	maxBodySize int64
+	mapper      *ingest.Mapper
+	alerts      AlertsProvider
+	history     *history.History
+	replication ReplicationProvider
+	auth        *auth.Authenticator
+	keyring     KeyringProvider
+	quota       *quota.Limiter
+	cardinality *cardinality.Index
 }
 
-func NewCollectorHandler(controller *controller.Controller, privateRSAKey *rsa.PrivateKey, trustedSubnet *net.IPNet) *CollectorHandler {
+// AlertsProvider returns active alerts.
+type AlertsProvider interface {
+	Alerts() []alerting.Alert
+}
+
+// ReplicationProvider returns replication state and promotes replica to primary.
+type ReplicationProvider interface {
+	Status() replication.Status
+	Promote() error
+}
+
+// KeyringProvider returns hash keys validity and usage.
+type KeyringProvider interface {
+	Status() keyring.Status
+}
+
+// HandlerOption configures optional CollectorHandler settings.
+type HandlerOption func(ch *CollectorHandler)
+
+// WithLimits sets max request body size and metrics batch limits.
+func WithLimits(maxBodySize int64, limits metrics.Limits) HandlerOption {
+	return func(ch *CollectorHandler) {
+		ch.maxBodySize = maxBodySize
+		ch.limits = limits
+	}
+}
+
+// WithIngestMapper sets mapping rules of InfluxDB line protocol samples.
+func WithIngestMapper(mapper *ingest.Mapper) HandlerOption {
+	return func(ch *CollectorHandler) {
+		ch.mapper = mapper
+	}
+}
+
+// WithHistory enables recent values on dashboard pages.
+func WithHistory(h *history.History) HandlerOption {
+	return func(ch *CollectorHandler) {
+		ch.history = h
+	}
+}
+
+// WithAlerts enables active alerts API.
+func WithAlerts(alerts AlertsProvider) HandlerOption {
+	return func(ch *CollectorHandler) {
+		ch.alerts = alerts
+	}
+}
+
+// WithReplication enables replication status and promotion API.
+func WithReplication(r ReplicationProvider) HandlerOption {
+	return func(ch *CollectorHandler) {
+		ch.replication = r
+	}
+}
+
+// WithKeyring enables hash keys status API.
+func WithKeyring(k KeyringProvider) HandlerOption {
+	return func(ch *CollectorHandler) {
+		ch.keyring = k
+	}
+}
+
+// WithQuota limits updates of every client.
+func WithQuota(limiter *quota.Limiter) HandlerOption {
+	return func(ch *CollectorHandler) {
+		ch.quota = limiter
+	}
+}
+
+// WithCardinality enables series cardinality explorer API.
+func WithCardinality(index *cardinality.Index) HandlerOption {
+	return func(ch *CollectorHandler) {
+		ch.cardinality = index
+	}
+}
+
+// WithAuth requires API tokens: reading needs read scope, updates need write scope
+// and replica promotion needs admin scope. Static files and ping are public.
+func WithAuth(authenticator *auth.Authenticator) HandlerOption {
+	return func(ch *CollectorHandler) {
+		ch.auth = authenticator
+	}
+}
+
+func NewCollectorHandler(
+	controller *controller.Controller,
+	cryptoKeys *cryptokeys.Keyset,
+	ipFilter *utils.IPFilter,
+	options ...HandlerOption) *CollectorHandler {
 	ch := &CollectorHandler{
 		Mux:        chi.NewMux(),
 		controller: controller,
 	}
+	for _, option := range options {
+		option(ch)
+	}
+	if ch.mapper == nil {
+		ch.mapper, _ = ingest.NewMapper(nil, []string{ingest.AllTags})
+	}
 
 	ch.Use(middleware.RequestID)
-	ch.Use(middleware.RealIP)
+	ch.Use(ClientIPMiddleware(ipFilter))
 	ch.Use(logger.Logger("router", log.New()))
 	ch.Use(middleware.Recoverer)
-	ch.Use(IPCheckerMiddleware(trustedSubnet))
+	ch.Use(IPCheckerMiddleware(ipFilter))
+	ch.Use(BodyLimitMiddleware(ch.maxBodySize)) // limits compressed body
 	ch.Use(GZipMiddleware)
+	ch.Use(BodyLimitMiddleware(ch.maxBodySize)) // limits decompressed body
 	ch.Route("/", func(router chi.Router) {
-		router.Get("/", ch.GetMetricsHandler)
-
-		router.Post("/update/{type}/{name}/{value}", ch.UpdateMetricHandler)
+		router.Handle("/static/*", staticHandler())
+		router.Get("/ping", ch.PingHandler)
 
 		router.Group(func(r chi.Router) {
-			r.Use(DecryptMiddleware(privateRSAKey))
-			r.Post("/updates/", ch.UpdateJSONMetricsHandler)
-			r.Post("/update/", ch.UpdateJSONMetricHandler)
+			r.Use(AuthMiddleware(ch.auth, auth.ReadScope))
+			r.Get("/", ch.GetMetricsHandler)
+			r.Get("/metric/{type}/{name}", ch.GetMetricPageHandler)
+
+			r.Route("/value", func(r chi.Router) {
+				r.Get("/{type}/{name}", ch.GetMetricHandler)
+				r.Post("/", ch.GetJSONMetricHandler)
+			})
+
+			r.Get("/api/v1/query", ch.QueryHandler)
+			if ch.alerts != nil {
+				r.Get("/api/v1/alerts", ch.GetAlertsHandler)
+			}
+			if ch.replication != nil {
+				r.Get("/api/v1/replication", ch.GetReplicationHandler)
+			}
+
+			r.Route("/grafana", ch.grafanaRoutes)
 		})
 
-		router.Route("/value", func(r chi.Router) {
-			r.Get("/{type}/{name}", ch.GetMetricHandler)
-			r.Post("/", ch.GetJSONMetricHandler)
+		router.Group(func(r chi.Router) {
+			r.Use(AuthMiddleware(ch.auth, auth.WriteScope))
+			r.Use(QuotaMiddleware(ch.quota))
+			r.Post("/update/{type}/{name}/{value}", ch.UpdateMetricHandler)
+
+			r.Group(func(r chi.Router) {
+				r.Use(DecryptMiddleware(cryptoKeys))
+				r.With(BatchSignatureMiddleware(ch.controller)).Post("/updates/", ch.UpdateJSONMetricsHandler)
+				r.Post("/update/", ch.UpdateJSONMetricHandler)
+			})
+
+			r.With(BatchSignatureMiddleware(ch.controller)).Post("/api/v1/write", ch.WriteLineProtocolHandler)
 		})
 
-		router.Get("/ping", ch.PingHandler)
+		router.Group(func(r chi.Router) {
+			r.Use(AuthMiddleware(ch.auth, auth.AdminScope))
+			if ch.replication != nil {
+				r.Post("/api/v1/replication/promote", ch.PromoteHandler)
+			}
+			if ch.keyring != nil {
+				r.Get("/api/v1/keyring", ch.GetKeyringHandler)
+			}
+			if ch.cardinality != nil {
+				r.Get("/api/v1/cardinality", ch.GetCardinalityHandler)
+			}
+		})
 	})
 	return ch
 }
@@ -80,32 +231,6 @@ func (ch *CollectorHandler) GetMetricHandler(writer http.ResponseWriter, request
 	writer.WriteHeader(http.StatusOK)
 }
 
-func (ch *CollectorHandler) GetMetricsHandler(writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Content-Type", "text/html; charset=UTF-8")
-
-	var b strings.Builder
-
-	metricSlice, err := ch.controller.GetAll(request.Context())
-	if err != nil {
-		ch.processError(writer, err)
-		return
-	}
-
-	for _, metric := range metricSlice {
-		_, err = fmt.Fprintf(&b, "%v: %v\n", metric.GetName(), metric.GetValue())
-		if err != nil {
-			log.Errorf("GetMetricsHandler: can't build metrics list with values %v %v, reason: %v",
-				metric.GetName(), metric.GetValue(), err)
-		}
-	}
-	_, err = writer.Write([]byte(b.String()))
-	if err != nil {
-		log.Errorf("Write failed, %v", err)
-		return
-	}
-	writer.WriteHeader(http.StatusOK)
-}
-
 func (ch *CollectorHandler) UpdateMetricHandler(writer http.ResponseWriter, request *http.Request) {
 	writer.Header().Set("Content-Type", "text/plain")
 	params, err := metrics.ParseURI(request, metrics.PType, metrics.PName, metrics.PValue)
@@ -113,6 +238,10 @@ func (ch *CollectorHandler) UpdateMetricHandler(writer http.ResponseWriter, requ
 		ch.processError(writer, err)
 		return
 	}
+	if err = ch.limits.CheckNameLength(params.Name); err != nil {
+		ch.processError(writer, err)
+		return
+	}
 
 	_, err = ch.controller.UpdateMetric(request.Context(), params)
 	if err != nil {
@@ -138,7 +267,7 @@ func (ch *CollectorHandler) GetJSONMetricHandler(writer http.ResponseWriter, req
 	}
 
 	params = metric.ToParams()
-	params.Hash = ch.controller.GetHash(metric)
+	params.Hash, params.KeyID = ch.controller.GetHash(metric)
 	if err := json.NewEncoder(writer).Encode(params); err != nil {
 		log.Errorf("Write failed, %v", err)
 		return
@@ -153,6 +282,14 @@ func (ch *CollectorHandler) UpdateJSONMetricHandler(writer http.ResponseWriter,
 		ch.processError(writer, err)
 		return
 	}
+	if err = ch.limits.CheckNameLength(params.Name); err != nil {
+		ch.processError(writer, err)
+		return
+	}
+	if err = envelopeFromHeaders(request, &params); err != nil {
+		ch.processError(writer, err)
+		return
+	}
 
 	metric, err := ch.controller.UpdateMetric(request.Context(), params)
 	if err != nil {
@@ -161,7 +298,7 @@ func (ch *CollectorHandler) UpdateJSONMetricHandler(writer http.ResponseWriter,
 	}
 
 	params = metric.ToParams()
-	params.Hash = ch.controller.GetHash(metric)
+	params.Hash, params.KeyID = ch.controller.GetHash(metric)
 	if err := json.NewEncoder(writer).Encode(&params); err != nil {
 		log.Errorf("Write failed, %v\n", err)
 		return
@@ -170,10 +307,11 @@ func (ch *CollectorHandler) UpdateJSONMetricHandler(writer http.ResponseWriter,
 }
 
 func (ch *CollectorHandler) UpdateJSONMetricsHandler(writer http.ResponseWriter, request *http.Request) {
-	writer.Header().Set("Content-Type", "application/json")
+	responseType := metrics.NegotiateContentType(request.Header.Get("Accept"))
+	writer.Header().Set("Content-Type", responseType)
 
 	paramsSlice := metrics.ParamsSlice{}
-	err := paramsSlice.ParseJSON(request.Body)
+	err := paramsSlice.Parse(request.Body, metrics.ParseContentType(request.Header.Get("Content-Type")), ch.limits)
 
 	if err != nil {
 		ch.processError(writer, err)
@@ -189,13 +327,141 @@ func (ch *CollectorHandler) UpdateJSONMetricsHandler(writer http.ResponseWriter,
 		return
 	}
 
-	if err := json.NewEncoder(writer).Encode(&metricsParams); err != nil {
+	if err := metricsParams.Encode(writer, responseType); err != nil {
+		log.Errorf("Write failed, %v\n", err)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+// WriteLineProtocolHandler saves metrics written in InfluxDB line protocol.
+// Lines can't be signed, so when hash keys are set the body must be signed by batch signature
+// or the request must be authorized by API token, unsigned writes of unknown clients are rejected.
+func (ch *CollectorHandler) WriteLineProtocolHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain")
+
+	paramsSlice, err := ch.mapper.ParseInflux(request.Body, ch.limits)
+	if err != nil {
+		ch.processError(writer, err)
+		return
+	}
+
+	if len(paramsSlice) > 0 {
+		ctx := request.Context()
+		if _, ok := auth.FromContext(ctx); ok {
+			ctx = controller.WithTrustedSource(ctx)
+		}
+		if _, err = ch.controller.UpdateMetrics(ctx, paramsSlice); err != nil {
+			ch.processError(writer, err)
+			return
+		}
+	}
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// QueryHandler evaluates query language expression from `expr` parameter.
+func (ch *CollectorHandler) QueryHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	vector, err := ch.controller.Query(request.Context(), request.URL.Query().Get("expr"))
+	if err != nil {
+		ch.processError(writer, err)
+		return
+	}
+
+	if err = json.NewEncoder(writer).Encode(newQuerySamples(vector)); err != nil {
 		log.Errorf("Write failed, %v\n", err)
 		return
 	}
 	writer.WriteHeader(http.StatusOK)
 }
 
+// querySample is query.Sample of JSON response, non-finite value like x/0 is encoded as null.
+type querySample struct {
+	Name  string   `json:"name"`
+	Value *float64 `json:"value"`
+}
+
+func newQuerySamples(vector query.Vector) []querySample {
+	samples := make([]querySample, 0, len(vector))
+	for _, sample := range vector {
+		value := sample.Value
+		s := querySample{Name: sample.Name}
+		if isFinite(value) {
+			s.Value = &value
+		}
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+// isFinite reports whether value can be encoded as JSON number.
+func isFinite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+// GetAlertsHandler returns pending and firing alerts.
+func (ch *CollectorHandler) GetAlertsHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(writer).Encode(ch.alerts.Alerts()); err != nil {
+		log.Errorf("Write failed, %v\n", err)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+// GetReplicationHandler returns replication role and lag.
+func (ch *CollectorHandler) GetReplicationHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(writer).Encode(ch.replication.Status()); err != nil {
+		log.Errorf("Write failed, %v\n", err)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+// PromoteHandler promotes replica to primary.
+func (ch *CollectorHandler) PromoteHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	if err := ch.replication.Promote(); err != nil {
+		ch.processError(writer, err)
+		return
+	}
+	if err := json.NewEncoder(writer).Encode(ch.replication.Status()); err != nil {
+		log.Errorf("Write failed, %v\n", err)
+		return
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+// GetKeyringHandler returns hash keys validity, their usage and the last key of each agent.
+func (ch *CollectorHandler) GetKeyringHandler(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(ch.keyring.Status()); err != nil {
+		log.Errorf("Write failed, %v", err)
+	}
+}
+
+// GetCardinalityHandler returns series count by name prefix, type and creating client and the top growth
+// of the last hour, `limit` parameter sets max entries of every list.
+func (ch *CollectorHandler) GetCardinalityHandler(writer http.ResponseWriter, request *http.Request) {
+	size := cardinality.DefaultReportSize
+	if value := request.URL.Query().Get("limit"); value != "" {
+		var err error
+		if size, err = strconv.Atoi(value); err != nil || size < 0 {
+			http.Error(writer, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(ch.cardinality.Report(size)); err != nil {
+		log.Errorf("Write failed, %v", err)
+	}
+}
+
 func (ch *CollectorHandler) PingHandler(writer http.ResponseWriter, request *http.Request) {
 	writer.Header().Set("Content-Type", "text/plain")
 
@@ -210,8 +476,21 @@ func (ch *CollectorHandler) PingHandler(writer http.ResponseWriter, request *htt
 func (ch *CollectorHandler) processError(w http.ResponseWriter, err error) {
 	var httpCode int
 	switch {
+	case errors.Is(err, quota.ErrQuotaExceeded):
+		writeQuotaError(w, err)
+		return
+	case errors.Is(err, cardinality.ErrLimitExceeded):
+		httpCode = http.StatusTooManyRequests
 	case errors.Is(err, controller.ErrInvalidHash):
 		httpCode = http.StatusBadRequest
+	case errors.Is(err, controller.ErrReadOnly):
+		httpCode = http.StatusForbidden
+	case errors.Is(err, replication.ErrNotReplica):
+		httpCode = http.StatusConflict
+	case errors.Is(err, replay.ErrReplayed):
+		httpCode = http.StatusConflict
+	case errors.Is(err, replay.ErrStale), errors.Is(err, replay.ErrMissingEnvelope):
+		httpCode = http.StatusBadRequest
 	case errors.Is(err, metrics.ErrInvalidType):
 		httpCode = http.StatusNotImplemented
 	case errors.Is(err, metrics.ErrInvalidValue):
@@ -220,8 +499,16 @@ func (ch *CollectorHandler) processError(w http.ResponseWriter, err error) {
 		httpCode = http.StatusMethodNotAllowed
 	case errors.Is(err, metrics.ErrParseJSON):
 		httpCode = http.StatusBadRequest
+	case errors.Is(err, metrics.ErrTooLarge):
+		httpCode = http.StatusRequestEntityTooLarge
+	case errors.Is(err, ingest.ErrInvalidLine):
+		httpCode = http.StatusBadRequest
+	case errors.Is(err, query.ErrSyntax), errors.Is(err, query.ErrEval):
+		httpCode = http.StatusBadRequest
 	case errors.Is(err, storage.ErrNotFound):
 		httpCode = http.StatusNotFound
+	case errors.Is(err, cluster.ErrUnavailable):
+		httpCode = http.StatusServiceUnavailable
 	default:
 		httpCode = http.StatusInternalServerError
 	}
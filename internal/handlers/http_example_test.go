@@ -48,14 +48,11 @@ func ExampleCollectorHandler_GetMetricsHandler() {
 	defer result.Body.Close()
 
 	fmt.Println(result.StatusCode)
-
-	value, _ := io.ReadAll(result.Body)
-	fmt.Println(string(value))
+	fmt.Println(result.Header.Get("Content-Type"))
 
 	// Output:
 	// 200
-	// Dog: 10
-	// WaterPercent: 0.8
+	// text/html; charset=UTF-8
 }
 
 func ExampleCollectorHandler_GetJSONMetricHandler() {
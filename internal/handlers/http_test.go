@@ -2,19 +2,30 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/auth"
+	"github.com/unbeman/ya-prac-mcas/internal/cardinality"
 	"github.com/unbeman/ya-prac-mcas/internal/controller"
 	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/quota"
+	"github.com/unbeman/ya-prac-mcas/internal/replay"
 	"github.com/unbeman/ya-prac-mcas/internal/storage"
 	mock_storage "github.com/unbeman/ya-prac-mcas/internal/storage/mock"
 	"github.com/unbeman/ya-prac-mcas/internal/utils"
@@ -163,7 +174,7 @@ func TestCollectorHandler_GetMetricsHandler(t *testing.T) {
 	type want struct {
 		code          int
 		checkResponse bool
-		response      string
+		response      []string
 		contentType   string
 	}
 
@@ -177,12 +188,8 @@ func TestCollectorHandler_GetMetricsHandler(t *testing.T) {
 			want: want{
 				code:          http.StatusOK,
 				checkResponse: true,
-				response: `GaugeA: 1.35
-GaugeD: 0.001
-CounterB: 10
-CounterC: 12345
-`,
-				contentType: htmlContentType,
+				response:      []string{"CounterB", "10", "CounterC", "12345", "GaugeA", "1.35", "GaugeD", "0.001"},
+				contentType:   htmlContentType,
 			},
 			setup: func(mR *mock_storage.MockRepository) {
 				mR.EXPECT().GetAll(gomock.Any()).Return([]metrics.Metric{
@@ -231,7 +238,13 @@ CounterC: 12345
 			err = result.Body.Close()
 			require.NoError(t, err)
 			if tt.want.checkResponse {
-				assert.Equal(t, tt.want.response, string(answer))
+				// rows are sorted by name
+				position := 0
+				for _, part := range tt.want.response {
+					idx := strings.Index(string(answer[position:]), ">"+part+"<")
+					require.GreaterOrEqual(t, idx, 0, part)
+					position += idx
+				}
 			}
 		})
 	}
@@ -961,3 +974,451 @@ func BenchmarkUpdateHandlers(b *testing.B) {
 		}
 	})
 }
+
+func TestCollectorHandler_Limits(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{
+			name: "OK",
+			body: `[{"id":"Dog","type":"counter","delta":5}]`,
+			want: http.StatusOK,
+		},
+		{
+			name: "body too large",
+			body: `[{"id":"Dog","type":"counter","delta":5},` + strings.Repeat(" ", 256) + `{"id":"Cat","type":"counter","delta":5}]`,
+			want: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "batch too large",
+			body: `[{"id":"Dog","type":"counter","delta":5},{"id":"Cat","type":"counter","delta":5},{"id":"Ant","type":"counter","delta":5}]`,
+			want: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name: "name too long",
+			body: `[{"id":"VeryVeryLongName","type":"counter","delta":5}]`,
+			want: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := NewCollectorHandler(controller.NewController(storage.NewRAMRepository(), ""), nil, nil,
+				WithLimits(256, metrics.Limits{MaxBatchSize: 2, MaxNameLength: 8}))
+
+			request := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			ch.ServeHTTP(w, request)
+
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tt.want, result.StatusCode)
+		})
+	}
+}
+
+func TestCollectorHandler_WriteLineProtocolHandler(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{
+			name: "OK",
+			body: "cpu,host=web1 usage=0.5 1700000000000000000\nmem free=1024i\n",
+			want: http.StatusNoContent,
+		},
+		{
+			name: "invalid line",
+			body: "cpu usage",
+			want: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := storage.NewRAMRepository()
+			ch := NewCollectorHandler(controller.NewController(repository, ""), nil, nil)
+
+			request := httptest.NewRequest(http.MethodPost, "/api/v1/write", strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			ch.ServeHTTP(w, request)
+
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tt.want, result.StatusCode)
+
+			if tt.want == http.StatusNoContent {
+				gauge, err := repository.GetGauge(request.Context(), "cpu.usage;host=web1")
+				require.NoError(t, err)
+				assert.Equal(t, 0.5, gauge.Value())
+			}
+		})
+	}
+}
+
+func TestCollectorHandler_WriteLineProtocolHashKey(t *testing.T) {
+	key := []byte("secret")
+	now := time.Now().Unix()
+	body := "cpu,host=web1 usage=0.5\n"
+	authenticator, err := auth.NewAuthenticator(context.Background(), staticTokens{
+		{Name: "telegraf", Hash: auth.HashToken("write-secret"), Scopes: []string{auth.WriteScope}},
+	}, 0)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		auth   *auth.Authenticator
+		header map[string]string
+		want   int
+	}{
+		{name: "unsigned write", want: http.StatusBadRequest},
+		{name: "signed body", header: map[string]string{
+			replay.TimestampHeader: strconv.FormatInt(now, 10),
+			replay.NonceHeader:     "n1",
+			replay.SignatureHeader: replay.BodySignature(key, now, "n1", []byte(body)),
+		}, want: http.StatusNoContent},
+		{name: "authorized token", auth: authenticator, header: map[string]string{
+			"Authorization": auth.BearerHeader("write-secret"),
+		}, want: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := storage.NewRAMRepository()
+			ch := NewCollectorHandler(controller.NewController(repository, string(key)), nil, nil, WithAuth(tt.auth))
+
+			request := httptest.NewRequest(http.MethodPost, "/api/v1/write", strings.NewReader(body))
+			for name, value := range tt.header {
+				request.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			ch.ServeHTTP(w, request)
+
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tt.want, result.StatusCode)
+
+			_, err := repository.GetGauge(request.Context(), "cpu.usage;host=web1")
+			assert.Equal(t, tt.want == http.StatusNoContent, err == nil)
+		})
+	}
+}
+
+func TestCollectorHandler_QueryHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		expr     string
+		want     int
+		wantBody string
+	}{
+		{
+			name:     "OK",
+			expr:     "sum(CPUutilization*) / 2",
+			want:     http.StatusOK,
+			wantBody: `[{"name":"","value":20}]`,
+		},
+		{
+			name:     "topk",
+			expr:     "topk(1, CPUutilization*)",
+			want:     http.StatusOK,
+			wantBody: `[{"name":"CPUutilization2","value":30}]`,
+		},
+		{
+			name:     "division by zero",
+			expr:     "CPUutilization* / 0",
+			want:     http.StatusOK,
+			wantBody: `[{"name":"CPUutilization1","value":null},{"name":"CPUutilization2","value":null}]`,
+		},
+		{
+			name:     "not a number",
+			expr:     "0 / 0",
+			want:     http.StatusOK,
+			wantBody: `[{"name":"","value":null}]`,
+		},
+		{
+			name: "syntax error",
+			expr: "sum(",
+			want: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := storage.NewRAMRepository()
+			ctx := context.Background()
+			_, err := repository.SetGauge(ctx, "CPUutilization1", 10)
+			require.NoError(t, err)
+			_, err = repository.SetGauge(ctx, "CPUutilization2", 30)
+			require.NoError(t, err)
+			ch := NewCollectorHandler(controller.NewController(repository, ""), nil, nil)
+
+			request := httptest.NewRequest(http.MethodGet, "/api/v1/query?expr="+url.QueryEscape(tt.expr), nil)
+			w := httptest.NewRecorder()
+			ch.ServeHTTP(w, request)
+
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tt.want, result.StatusCode)
+			if tt.wantBody != "" {
+				body, err := io.ReadAll(result.Body)
+				require.NoError(t, err)
+				assert.JSONEq(t, tt.wantBody, string(body))
+			}
+		})
+	}
+}
+
+type staticTokens []auth.Token
+
+func (s staticTokens) Load(ctx context.Context) ([]auth.Token, error) {
+	return s, nil
+}
+
+func TestCollectorHandler_Auth(t *testing.T) {
+	authenticator, err := auth.NewAuthenticator(context.Background(), staticTokens{
+		{Name: "dashboard", Hash: auth.HashToken("read-secret"), Scopes: []string{auth.ReadScope}},
+		{Name: "agent", Hash: auth.HashToken("write-secret"), Scopes: []string{auth.WriteScope}},
+	}, 0)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		want   int
+	}{
+		{name: "agent updates", method: http.MethodPost, target: "/update/counter/Dog/1", token: "write-secret", want: http.StatusOK},
+		{name: "dashboard can't update", method: http.MethodPost, target: "/update/counter/Dog/1", token: "read-secret", want: http.StatusForbidden},
+		{name: "dashboard reads", method: http.MethodGet, target: "/api/v1/query?expr=1", token: "read-secret", want: http.StatusOK},
+		{name: "agent can't read", method: http.MethodGet, target: "/api/v1/query?expr=1", token: "write-secret", want: http.StatusForbidden},
+		{name: "no token", method: http.MethodGet, target: "/api/v1/query?expr=1", want: http.StatusUnauthorized},
+		{name: "unknown token", method: http.MethodPost, target: "/update/counter/Dog/1", token: "guess", want: http.StatusUnauthorized},
+		{name: "public ping", method: http.MethodGet, target: "/ping", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := NewCollectorHandler(controller.NewController(storage.NewRAMRepository(), ""), nil, nil,
+				WithAuth(authenticator))
+
+			request := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.token != "" {
+				request.Header.Set("Authorization", auth.BearerHeader(tt.token))
+			}
+			w := httptest.NewRecorder()
+			ch.ServeHTTP(w, request)
+
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tt.want, result.StatusCode)
+		})
+	}
+}
+
+func TestCollectorHandler_ReplayProtection(t *testing.T) {
+	key := []byte("secret")
+	now := time.Now().Unix()
+	newHandler := func(required bool) *CollectorHandler {
+		control := controller.NewController(storage.NewRAMRepository(), string(key),
+			controller.WithReplayGuard(replay.NewGuard(configs.ReplayConfig{Window: time.Minute, Required: required})))
+		return NewCollectorHandler(control, nil, nil)
+	}
+	post := func(ch *CollectorHandler, target, body string, header http.Header) int {
+		request := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		for name, values := range header {
+			request.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		ch.ServeHTTP(w, request)
+		result := w.Result()
+		defer result.Body.Close()
+		return result.StatusCode
+	}
+	counter := metrics.NewCounter("PollCount", 1)
+
+	t.Run("stamped metric is accepted once", func(t *testing.T) {
+		ch := newHandler(false)
+		body := fmt.Sprintf(`{"id":"PollCount","type":"counter","delta":1,"timestamp":%d,"nonce":"n1","hash":%q}`,
+			now, replay.MetricHash(counter, key, now, "n1"))
+		assert.Equal(t, http.StatusOK, post(ch, "/update/", body, nil))
+		assert.Equal(t, http.StatusConflict, post(ch, "/update/", body, nil))
+	})
+	t.Run("envelope in headers", func(t *testing.T) {
+		ch := newHandler(true)
+		body := fmt.Sprintf(`{"id":"PollCount","type":"counter","delta":1,"hash":%q}`, replay.MetricHash(counter, key, now, "n1"))
+		header := http.Header{}
+		header.Set(replay.TimestampHeader, strconv.FormatInt(now, 10))
+		header.Set(replay.NonceHeader, "n1")
+		assert.Equal(t, http.StatusOK, post(ch, "/update/", body, header))
+		assert.Equal(t, http.StatusConflict, post(ch, "/update/", body, header))
+	})
+	t.Run("stale timestamp", func(t *testing.T) {
+		ch := newHandler(false)
+		stale := now - 3600
+		body := fmt.Sprintf(`{"id":"PollCount","type":"counter","delta":1,"timestamp":%d,"nonce":"n1","hash":%q}`,
+			stale, replay.MetricHash(counter, key, stale, "n1"))
+		assert.Equal(t, http.StatusBadRequest, post(ch, "/update/", body, nil))
+	})
+	t.Run("required envelope", func(t *testing.T) {
+		body := fmt.Sprintf(`{"id":"PollCount","type":"counter","delta":1,"hash":%q}`, counter.Hash(key))
+		assert.Equal(t, http.StatusOK, post(newHandler(false), "/update/", body, nil))
+		assert.Equal(t, http.StatusBadRequest, post(newHandler(true), "/update/", body, nil))
+	})
+	t.Run("batch signature", func(t *testing.T) {
+		ch := newHandler(true)
+		body := `[{"id":"PollCount","type":"counter","delta":1},{"id":"Alloc","type":"gauge","value":5}]`
+		header := http.Header{}
+		header.Set(replay.TimestampHeader, strconv.FormatInt(now, 10))
+		header.Set(replay.NonceHeader, "batch-1")
+		header.Set(replay.SignatureHeader, replay.BodySignature(key, now, "batch-1", []byte(body)))
+		assert.Equal(t, http.StatusOK, post(ch, "/updates/", body, header))
+		assert.Equal(t, http.StatusConflict, post(ch, "/updates/", body, header))
+
+		header.Set(replay.NonceHeader, "batch-2")
+		assert.Equal(t, http.StatusBadRequest, post(ch, "/updates/", body, header), "signature of other nonce")
+	})
+}
+
+func TestCollectorHandler_TrustedSubnet(t *testing.T) {
+	ipFilter, err := utils.NewIPFilter("10.0.0.0/8,2001:db8::/32", "192.0.2.1")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    int
+	}{
+		{name: "trusted client", remote: "10.0.0.5:5000", want: http.StatusOK},
+		{name: "trusted IPv6 client", remote: "[2001:db8::5]:5000", want: http.StatusOK},
+		{name: "spoofed real IP", remote: "203.0.113.5:5000", headers: map[string]string{"X-Real-IP": "10.0.0.5"}, want: http.StatusForbidden},
+		{name: "spoofed forwarded for", remote: "203.0.113.5:5000", headers: map[string]string{"X-Forwarded-For": "10.0.0.5"}, want: http.StatusForbidden},
+		{name: "client behind trusted proxy", remote: "192.0.2.1:443", headers: map[string]string{"X-Forwarded-For": "10.0.0.5"}, want: http.StatusOK},
+		{name: "untrusted client behind trusted proxy", remote: "192.0.2.1:443", headers: map[string]string{"X-Forwarded-For": "203.0.113.5"}, want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := NewCollectorHandler(controller.NewController(storage.NewRAMRepository(), ""), nil, ipFilter)
+
+			request := httptest.NewRequest(http.MethodPost, "/update/counter/Dog/1", nil)
+			request.RemoteAddr = tt.remote
+			for header, value := range tt.headers {
+				request.Header.Set(header, value)
+			}
+			w := httptest.NewRecorder()
+			ch.ServeHTTP(w, request)
+
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tt.want, result.StatusCode)
+		})
+	}
+}
+
+func TestCollectorHandler_InvalidForwardedAddress(t *testing.T) {
+	// trusted proxy is in trusted subnet, its address mustn't replace invalid client address
+	ipFilter, err := utils.NewIPFilter("10.0.0.0/8", "10.0.0.1")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    int
+	}{
+		{name: "forwarded for", headers: map[string]string{"X-Forwarded-For": "10.0.0.5"}, want: http.StatusOK},
+		{name: "invalid forwarded for", headers: map[string]string{"X-Forwarded-For": "unknown"}, want: http.StatusBadRequest},
+		{name: "invalid hop of forwarded for", headers: map[string]string{"X-Forwarded-For": "10.0.0.5, unknown"}, want: http.StatusBadRequest},
+		{name: "invalid real IP", headers: map[string]string{"X-Real-IP": "unknown"}, want: http.StatusBadRequest},
+		{name: "not forwarded", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := NewCollectorHandler(controller.NewController(storage.NewRAMRepository(), ""), nil, ipFilter)
+
+			request := httptest.NewRequest(http.MethodPost, "/update/counter/Dog/1", nil)
+			request.RemoteAddr = "10.0.0.1:443"
+			for header, value := range tt.headers {
+				request.Header.Set(header, value)
+			}
+			w := httptest.NewRecorder()
+			ch.ServeHTTP(w, request)
+
+			result := w.Result()
+			defer result.Body.Close()
+			assert.Equal(t, tt.want, result.StatusCode)
+		})
+	}
+}
+
+func TestCollectorHandler_Quota(t *testing.T) {
+	repo := storage.NewRAMRepository()
+	limiter := quota.NewLimiter(configs.QuotaConfig{RequestsPerSecond: 1, RequestsBurst: 1})
+	index, err := cardinality.NewIndex(context.Background(), configs.CardinalityConfig{}, repo, cardinality.WithClientLimit(1))
+	require.NoError(t, err)
+	ch := NewCollectorHandler(controller.NewController(repo, "", controller.WithQuota(limiter), controller.WithCardinality(index)), nil, nil,
+		WithQuota(limiter))
+	send := func(remote, target string) *http.Response {
+		request := httptest.NewRequest(http.MethodPost, target, nil)
+		request.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		ch.ServeHTTP(w, request)
+		return w.Result()
+	}
+
+	result := send("10.0.0.1:5000", "/update/counter/Dog/1")
+	result.Body.Close()
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+
+	result = send("10.0.0.1:5000", "/update/counter/Dog/1")
+	result.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, result.StatusCode)
+	assert.Equal(t, "1", result.Header.Get("Retry-After"))
+
+	result = send("10.0.0.2:5000", "/update/counter/Dog/1")
+	result.Body.Close()
+	assert.Equal(t, http.StatusOK, result.StatusCode, "clients are limited separately, updated series isn't created")
+
+	time.Sleep(time.Second)
+	result = send("10.0.0.1:5000", "/update/counter/Cat/1")
+	result.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, result.StatusCode, "created series limit")
+	assert.Empty(t, result.Header.Get("Retry-After"))
+}
+
+func TestCollectorHandler_Cardinality(t *testing.T) {
+	repo := storage.NewRAMRepository()
+	index, err := cardinality.NewIndex(context.Background(), configs.CardinalityConfig{PrefixLimits: []string{"user_=1"}}, repo)
+	require.NoError(t, err)
+	ch := NewCollectorHandler(controller.NewController(repo, "", controller.WithCardinality(index)), nil, nil,
+		WithCardinality(index))
+	send := func(method, target string) *http.Response {
+		request := httptest.NewRequest(method, target, nil)
+		request.RemoteAddr = "10.0.0.1:5000"
+		w := httptest.NewRecorder()
+		ch.ServeHTTP(w, request)
+		return w.Result()
+	}
+
+	result := send(http.MethodPost, "/update/gauge/user_1/1")
+	result.Body.Close()
+	assert.Equal(t, http.StatusOK, result.StatusCode)
+
+	result = send(http.MethodPost, "/update/gauge/user_2/1")
+	result.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, result.StatusCode, "prefix series limit")
+	_, err = repo.GetGauge(context.Background(), "user_2")
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+
+	result = send(http.MethodGet, "/api/v1/cardinality?limit=5")
+	defer result.Body.Close()
+	require.Equal(t, http.StatusOK, result.StatusCode)
+	var report cardinality.Report
+	require.NoError(t, json.NewDecoder(result.Body).Decode(&report))
+	assert.Equal(t, 1, report.Series)
+	assert.Equal(t, []cardinality.Count{{Name: "user_", Series: 1, Limit: 1}}, report.ByPrefix)
+	assert.Equal(t, []cardinality.Count{{Name: "ip:10.0.0.1", Series: 1}}, report.ByClient)
+	assert.Equal(t, []cardinality.Count{{Name: "user_", Series: 1}}, report.Growth)
+
+	result = send(http.MethodGet, "/api/v1/cardinality?limit=all")
+	result.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, result.StatusCode)
+}
@@ -2,34 +2,192 @@ package handlers
 
 import (
 	"context"
-	log "github.com/sirupsen/logrus"
+	"errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/runtime/protoiface"
+	"google.golang.org/protobuf/types/known/durationpb"
 	"net"
 
+	"github.com/unbeman/ya-prac-mcas/internal/auth"
+	"github.com/unbeman/ya-prac-mcas/internal/cluster"
+	"github.com/unbeman/ya-prac-mcas/internal/quota"
 	"github.com/unbeman/ya-prac-mcas/internal/utils"
+	pb "github.com/unbeman/ya-prac-mcas/proto"
 )
 
 //todo: add logging interceptor
 
-func IPCheckerServerInterceptor(trustedSubnet *net.IPNet) grpc.UnaryServerInterceptor {
+// clientIP returns IP of gRPC client, forwarding metadata is honoured only when the peer is a trusted proxy.
+func clientIP(ctx context.Context, ipFilter *utils.IPFilter) net.IP {
+	var peerAddr string
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		peerAddr = p.Addr.String()
+	}
+	meta, _ := metadata.FromIncomingContext(ctx)
+	return ipFilter.ClientIP(peerAddr, meta.Get("x-forwarded-for"), meta.Get("x-real-ip"))
+}
+
+// checkClientIP returns PermissionDenied error for clients out of trusted subnets.
+func checkClientIP(ctx context.Context, ipFilter *utils.IPFilter) error {
+	if !ipFilter.Enabled() {
+		return nil
+	}
+	if err := ipFilter.Check(clientIP(ctx, ipFilter)); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
+
+func IPCheckerServerInterceptor(ipFilter *utils.IPFilter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		if err := checkClientIP(ctx, ipFilter); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// IPCheckerStreamServerInterceptor checks client IP of streaming calls.
+func IPCheckerStreamServerInterceptor(ipFilter *utils.IPFilter) grpc.StreamServerInterceptor {
+	return func(srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		if err := checkClientIP(stream.Context(), ipFilter); err != nil {
+			return err
+		}
+		return handler(srv, stream)
+	}
+}
+
+// updateMethods are limited by client quota.
+var updateMethods = map[string]bool{
+	pb.MetricsCollector_UpdateMetric_FullMethodName:  true,
+	pb.MetricsCollector_UpdateMetrics_FullMethodName: true,
+}
+
+// QuotaUnaryServerInterceptor rejects updates of clients exceeding requests rate and passes client identity
+// to controller limiting metrics and attributing created series. Updates forwarded by cluster nodes are limited by the receiving node.
+func QuotaUnaryServerInterceptor(limiter *quota.Limiter, ipFilter *utils.IPFilter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context,
+		req interface{},
+		info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		if !updateMethods[info.FullMethod] || cluster.IsForwarded(ctx) {
+			return handler(ctx, req)
+		}
+		client := quota.ClientIdentity(ctx, clientIP(ctx, ipFilter))
+		if err := limiter.AllowRequest(client); err != nil {
+			return nil, quotaStatus(err)
+		}
+		return handler(quota.WithClient(ctx, client), req)
+	}
+}
+
+// quotaStatus returns ResourceExhausted status, RetryInfo detail tells when the limit allows the request.
+func quotaStatus(err error) error {
+	st := status.New(codes.ResourceExhausted, err.Error())
+	var limitErr *quota.LimitError
+	if !errors.As(err, &limitErr) {
+		return st.Err()
+	}
+	details := []protoiface.MessageV1{&errdetails.QuotaFailure{Violations: []*errdetails.QuotaFailure_Violation{
+		{Subject: limitErr.Client, Description: limitErr.Limit},
+	}}}
+	if limitErr.RetryAfter > 0 {
+		details = append(details, &errdetails.RetryInfo{RetryDelay: durationpb.New(limitErr.RetryAfter)})
+	}
+	if detailed, detailsErr := st.WithDetails(details...); detailsErr == nil {
+		return detailed.Err()
+	}
+	return st.Err()
+}
+
+// methodScopes are token scopes required by gRPC methods, methods not listed here need admin scope.
+var methodScopes = map[string]string{
+	pb.MetricsCollector_GetMetric_FullMethodName:     auth.ReadScope,
+	pb.MetricsCollector_GetMetrics_FullMethodName:    auth.ReadScope,
+	pb.MetricsCollector_Query_FullMethodName:         auth.ReadScope,
+	pb.MetricsCollector_Replicate_FullMethodName:     auth.ReadScope,
+	pb.MetricsCollector_UpdateMetric_FullMethodName:  auth.WriteScope,
+	pb.MetricsCollector_UpdateMetrics_FullMethodName: auth.WriteScope,
+}
+
+// publicMethods don't require token.
+var publicMethods = map[string]bool{
+	pb.MetricsCollector_Ping_FullMethodName: true,
+}
+
+// authorize returns context of request authorized by bearer token of its metadata.
+func authorize(ctx context.Context, authenticator *auth.Authenticator, method string) (context.Context, error) {
+	if authenticator == nil || publicMethods[method] {
+		return ctx, nil
+	}
+	scope, ok := methodScopes[method]
+	if !ok {
+		scope = auth.AdminScope
+	}
+
+	var secret string
+	if meta, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := meta.Get("authorization"); len(values) > 0 {
+			secret = auth.ParseBearer(values[0])
+		}
+	}
+	token, err := authenticator.Authorize(secret, scope)
+	switch {
+	case errors.Is(err, auth.ErrUnauthenticated):
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	return auth.WithToken(ctx, token), nil
+}
+
+// AuthUnaryServerInterceptor rejects unary requests without bearer token granting method scope,
+// nil authenticator disables the check.
+func AuthUnaryServerInterceptor(authenticator *auth.Authenticator) grpc.UnaryServerInterceptor {
 	return func(ctx context.Context,
 		req interface{},
 		info *grpc.UnaryServerInfo,
 		handler grpc.UnaryHandler) (interface{}, error) {
-		if trustedSubnet != nil {
-			meta, ok := metadata.FromIncomingContext(ctx)
-			log.Info(meta)
-			if ok {
-				clientIP := meta.Get("X-Real-IP")[0]
-
-				if err := utils.CheckIPBelongsNetwork(clientIP, trustedSubnet); err != nil {
-					return nil, status.Error(codes.PermissionDenied, err.Error())
-				}
-			}
+		ctx, err := authorize(ctx, authenticator, info.FullMethod)
+		if err != nil {
+			return nil, err
 		}
 		return handler(ctx, req)
 	}
 }
+
+// AuthStreamServerInterceptor rejects streams without bearer token granting method scope,
+// nil authenticator disables the check.
+func AuthStreamServerInterceptor(authenticator *auth.Authenticator) grpc.StreamServerInterceptor {
+	return func(srv interface{},
+		stream grpc.ServerStream,
+		info *grpc.StreamServerInfo,
+		handler grpc.StreamHandler) error {
+		ctx, err := authorize(stream.Context(), authenticator, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authorizedStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// authorizedStream replaces context of server stream.
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
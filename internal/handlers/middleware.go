@@ -3,13 +3,21 @@ package handlers
 import (
 	"bytes"
 	"compress/gzip"
-	"crypto/rsa"
+	"errors"
+	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
-	"net"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 
+	"github.com/unbeman/ya-prac-mcas/internal/auth"
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/cryptokeys"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/quota"
+	"github.com/unbeman/ya-prac-mcas/internal/replay"
 	"github.com/unbeman/ya-prac-mcas/internal/utils"
 )
 
@@ -59,17 +67,45 @@ func GZipMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func DecryptMiddleware(privateKey *rsa.PrivateKey) func(next http.Handler) http.Handler {
+// BodyLimitMiddleware rejects requests with declared body larger than maxBodySize
+// and stops reading of the body when the limit is reached. Zero maxBodySize disables the check.
+func BodyLimitMiddleware(maxBodySize int64) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(writer http.ResponseWriter, request *http.Request) {
-			if privateKey != nil {
+			if maxBodySize > 0 {
+				if request.ContentLength > maxBodySize {
+					http.Error(writer, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+					return
+				}
+				request.Body = http.MaxBytesReader(writer, request.Body, maxBodySize)
+			}
+			next.ServeHTTP(writer, request)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// DecryptMiddleware decrypts request body by server key of key ID header.
+func DecryptMiddleware(keys *cryptokeys.Keyset) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(writer http.ResponseWriter, request *http.Request) {
+			if keys.Enabled() {
 				chyper, err := io.ReadAll(request.Body)
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					http.Error(writer, err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
 				if err != nil {
 					http.Error(writer, err.Error(), http.StatusInternalServerError)
 					return
 				}
 				request.Body.Close()
-				data, err := utils.GetDecryptedMessage(privateKey, chyper, request.Header.Get("Encrypted-Key"))
+				data, err := keys.Decrypt(request.Header.Get(cryptokeys.KeyIDHeader), chyper, request.Header.Get(cryptokeys.EncryptedKeyHeader))
+				if errors.Is(err, cryptokeys.ErrUnknownKey) {
+					http.Error(writer, err.Error(), http.StatusBadRequest)
+					return
+				}
 				if err != nil {
 					log.Error(err)
 					http.Error(writer, err.Error(), http.StatusInternalServerError)
@@ -85,13 +121,32 @@ func DecryptMiddleware(privateKey *rsa.PrivateKey) func(next http.Handler) http.
 	}
 }
 
-func IPCheckerMiddleware(trustedSubnet *net.IPNet) func(next http.Handler) http.Handler {
+// ClientIPMiddleware replaces remote address of request by client IP,
+// forwarding headers are honoured only when the peer is a trusted proxy.
+// Request is rejected when trusted proxy forwards invalid client address, the proxy address isn't used instead.
+func ClientIPMiddleware(ipFilter *utils.IPFilter) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(writer http.ResponseWriter, request *http.Request) {
-			if trustedSubnet != nil {
-				clientIP := request.Header.Get("X-Real-IP")
+			clientIP := ipFilter.ClientIP(request.RemoteAddr, request.Header.Values("X-Forwarded-For"), request.Header.Values("X-Real-IP"))
+			if clientIP == nil && utils.ParseHostIP(request.RemoteAddr) != nil {
+				http.Error(writer, "invalid forwarded client address", http.StatusBadRequest)
+				return
+			}
+			if clientIP != nil {
+				request.RemoteAddr = clientIP.String()
+			}
+			next.ServeHTTP(writer, request)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
 
-				if err := utils.CheckIPBelongsNetwork(clientIP, trustedSubnet); err != nil {
+// IPCheckerMiddleware rejects requests of clients out of trusted subnets, it follows ClientIPMiddleware.
+func IPCheckerMiddleware(ipFilter *utils.IPFilter) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(writer http.ResponseWriter, request *http.Request) {
+			if ipFilter.Enabled() {
+				if err := ipFilter.Check(utils.ParseHostIP(request.RemoteAddr)); err != nil {
 					http.Error(writer, err.Error(), http.StatusForbidden)
 					return
 				}
@@ -101,3 +156,125 @@ func IPCheckerMiddleware(trustedSubnet *net.IPNet) func(next http.Handler) http.
 		return http.HandlerFunc(fn)
 	}
 }
+
+// QuotaMiddleware rejects requests of clients exceeding requests rate and passes client identity
+// to controller limiting metrics and attributing created series, it follows AuthMiddleware.
+func QuotaMiddleware(limiter *quota.Limiter) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(writer http.ResponseWriter, request *http.Request) {
+			client := quota.ClientIdentity(request.Context(), utils.ParseHostIP(request.RemoteAddr))
+			if err := limiter.AllowRequest(client); err != nil {
+				writeQuotaError(writer, err)
+				return
+			}
+			next.ServeHTTP(writer, request.WithContext(quota.WithClient(request.Context(), client)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// writeQuotaError responds Too Many Requests, Retry-After tells when the limit allows the request.
+func writeQuotaError(writer http.ResponseWriter, err error) {
+	var limitErr *quota.LimitError
+	if errors.As(err, &limitErr) && limitErr.RetryAfter > 0 {
+		writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limitErr.RetryAfter.Seconds()))))
+	}
+	http.Error(writer, err.Error(), http.StatusTooManyRequests)
+}
+
+// AuthMiddleware rejects requests without bearer token granting scope, nil authenticator disables the check.
+func AuthMiddleware(authenticator *auth.Authenticator, scope string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(writer http.ResponseWriter, request *http.Request) {
+			if authenticator != nil {
+				token, err := authenticator.Authorize(auth.ParseBearer(request.Header.Get("Authorization")), scope)
+				if errors.Is(err, auth.ErrUnauthenticated) {
+					writer.Header().Set("WWW-Authenticate", `Bearer realm="mcas"`)
+					http.Error(writer, err.Error(), http.StatusUnauthorized)
+					return
+				}
+				if err != nil {
+					http.Error(writer, err.Error(), http.StatusForbidden)
+					return
+				}
+				request = request.WithContext(auth.WithToken(request.Context(), token))
+			}
+			next.ServeHTTP(writer, request)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// parseTimestamp parses unix seconds of request envelope header.
+func parseTimestamp(value string) (int64, error) {
+	timestamp, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v header: %v", replay.ErrMissingEnvelope, replay.TimestampHeader, err)
+	}
+	return timestamp, nil
+}
+
+// envelopeFromHeaders sets timestamp and nonce of params signed along with them, unless they're set in body.
+func envelopeFromHeaders(request *http.Request, params *metrics.Params) error {
+	if params.Timestamp != 0 || params.Nonce != "" {
+		return nil
+	}
+	value := request.Header.Get(replay.TimestampHeader)
+	if value == "" {
+		return nil
+	}
+	timestamp, err := parseTimestamp(value)
+	if err != nil {
+		return err
+	}
+	params.Timestamp, params.Nonce = timestamp, request.Header.Get(replay.NonceHeader)
+	return nil
+}
+
+// BatchSignatureMiddleware verifies signature of request body sent in headers along with timestamp and nonce,
+// metrics of signed body don't need own hashes. Requests without signature are passed as is.
+func BatchSignatureMiddleware(control *controller.Controller) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(writer http.ResponseWriter, request *http.Request) {
+			signature := request.Header.Get(replay.SignatureHeader)
+			if signature == "" {
+				next.ServeHTTP(writer, request)
+				return
+			}
+			timestamp, err := parseTimestamp(request.Header.Get(replay.TimestampHeader))
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			body, err := io.ReadAll(request.Body)
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(writer, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			request.Body.Close()
+
+			ctx, err := control.VerifyBatch(request.Context(), request.Header.Get(replay.KeyIDHeader), signature,
+				timestamp, request.Header.Get(replay.NonceHeader), body)
+			switch {
+			case errors.Is(err, replay.ErrReplayed):
+				http.Error(writer, err.Error(), http.StatusConflict)
+				return
+			case err != nil:
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			request = request.WithContext(ctx)
+			request.Body = io.NopCloser(bytes.NewReader(body))
+			request.ContentLength = int64(len(body))
+			next.ServeHTTP(writer, request)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
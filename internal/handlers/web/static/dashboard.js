@@ -0,0 +1,104 @@
+(function () {
+  "use strict";
+
+  var content = document.getElementById("content");
+  var refreshSeconds = parseInt(content.dataset.refreshInterval, 10) || 10;
+  var sortColumn = -1;
+  var sortDescending = false;
+
+  function cellValue(row, column, numeric) {
+    var value = row.cells[column].dataset.value;
+    return numeric ? parseFloat(value) || 0 : value.toLowerCase();
+  }
+
+  function applySort() {
+    var table = document.getElementById("metrics");
+    if (!table || sortColumn < 0) {
+      return;
+    }
+    var header = table.tHead.rows[0].cells[sortColumn];
+    var numeric = header.dataset.sort === "number";
+    var body = table.tBodies[0];
+    var rows = Array.prototype.filter.call(body.rows, function (row) {
+      return row.dataset.name !== undefined;
+    });
+    rows.sort(function (a, b) {
+      var left = cellValue(a, sortColumn, numeric);
+      var right = cellValue(b, sortColumn, numeric);
+      var result = left < right ? -1 : left > right ? 1 : 0;
+      return sortDescending ? -result : result;
+    });
+    rows.forEach(function (row) {
+      body.appendChild(row);
+    });
+  }
+
+  function applyFilter() {
+    var search = document.getElementById("search");
+    var table = document.getElementById("metrics");
+    if (!search || !table) {
+      return;
+    }
+    var query = search.value.trim().toLowerCase();
+    Array.prototype.forEach.call(table.tBodies[0].rows, function (row) {
+      if (row.dataset.name === undefined) {
+        return;
+      }
+      row.hidden = query !== "" && row.dataset.name.toLowerCase().indexOf(query) < 0;
+    });
+  }
+
+  function applyView() {
+    applySort();
+    applyFilter();
+  }
+
+  var table = document.getElementById("metrics");
+  if (table) {
+    Array.prototype.forEach.call(table.tHead.rows[0].cells, function (header, column) {
+      header.addEventListener("click", function () {
+        sortDescending = sortColumn === column ? !sortDescending : false;
+        sortColumn = column;
+        Array.prototype.forEach.call(table.tHead.rows[0].cells, function (other) {
+          other.classList.remove("asc", "desc");
+        });
+        header.classList.add(sortDescending ? "desc" : "asc");
+        applySort();
+      });
+    });
+  }
+
+  var search = document.getElementById("search");
+  if (search) {
+    search.addEventListener("input", applyFilter);
+  }
+
+  // refresh replaces parts marked with data-refresh, so sorting, search and scroll position are kept.
+  function refresh() {
+    var autoRefresh = document.getElementById("auto-refresh");
+    if (autoRefresh && !autoRefresh.checked) {
+      return;
+    }
+    fetch(window.location.href, {headers: {"Accept": "text/html"}})
+      .then(function (response) {
+        return response.ok ? response.text() : Promise.reject(response.status);
+      })
+      .then(function (html) {
+        var fresh = new DOMParser().parseFromString(html, "text/html");
+        var current = document.querySelectorAll("[data-refresh]");
+        var updated = fresh.querySelectorAll("[data-refresh]");
+        for (var i = 0; i < current.length && i < updated.length; i++) {
+          current[i].innerHTML = updated[i].innerHTML;
+        }
+        var count = fresh.querySelector(".count");
+        if (count && document.querySelector(".count")) {
+          document.querySelector(".count").textContent = count.textContent;
+        }
+        applyView();
+      })
+      .catch(function () {
+      });
+  }
+
+  window.setInterval(refresh, refreshSeconds * 1000);
+})();
@@ -0,0 +1,119 @@
+// Package history keeps a few recent values of every metric in memory.
+package history
+
+import (
+	"sync"
+	"time"
+
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+// Point is a metric value at the moment of update.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+type key struct {
+	mType string
+	name  string
+}
+
+// series is a ring buffer of points.
+type series struct {
+	points []Point
+	next   int
+}
+
+func (s *series) add(point Point, size int) {
+	if len(s.points) < size {
+		s.points = append(s.points, point)
+		return
+	}
+	s.points[s.next] = point
+	s.next = (s.next + 1) % size
+}
+
+// ordered returns copy of points from the oldest to the newest.
+func (s *series) ordered() []Point {
+	points := make([]Point, 0, len(s.points))
+	points = append(points, s.points[s.next:]...)
+	return append(points, s.points[:s.next]...)
+}
+
+func (s *series) last() Point {
+	if s.next == 0 {
+		return s.points[len(s.points)-1]
+	}
+	return s.points[s.next-1]
+}
+
+// History keeps up to size recent values of every metric.
+// Points are kept only in memory, so history is empty after restart.
+type History struct {
+	sync.RWMutex
+	size   int
+	series map[key]*series
+	now    func() time.Time
+}
+
+func NewHistory(size int) *History {
+	return &History{size: size, series: map[key]*series{}, now: time.Now}
+}
+
+// Add saves current values of updated metrics.
+func (h *History) Add(list ...metrics.Metric) {
+	if h.size <= 0 {
+		return
+	}
+	now := h.now()
+	h.Lock()
+	defer h.Unlock()
+	for _, metric := range list {
+		k := key{mType: metric.GetType(), name: metric.GetName()}
+		s, ok := h.series[k]
+		if !ok {
+			s = &series{points: make([]Point, 0, 1)}
+			h.series[k] = s
+		}
+		s.add(Point{Time: now, Value: Value(metric)}, h.size)
+	}
+}
+
+// Observe saves value of updated metric, it implements controller.Observer.
+func (h *History) Observe(metric metrics.Metric, _ int64) {
+	h.Add(metric)
+}
+
+// Points returns recent values of metric from the oldest to the newest.
+func (h *History) Points(mType, name string) []Point {
+	h.RLock()
+	defer h.RUnlock()
+	s, ok := h.series[key{mType: mType, name: name}]
+	if !ok {
+		return nil
+	}
+	return s.ordered()
+}
+
+// LastUpdate returns time of the latest metric update, false is returned if metric wasn't updated since start.
+func (h *History) LastUpdate(mType, name string) (time.Time, bool) {
+	h.RLock()
+	defer h.RUnlock()
+	s, ok := h.series[key{mType: mType, name: name}]
+	if !ok {
+		return time.Time{}, false
+	}
+	return s.last().Time, true
+}
+
+// Value returns metric value as float.
+func Value(metric metrics.Metric) float64 {
+	switch m := metric.(type) {
+	case metrics.Gauge:
+		return m.Value()
+	case metrics.Counter:
+		return float64(m.Value())
+	}
+	return 0
+}
@@ -0,0 +1,45 @@
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+func TestHistory(t *testing.T) {
+	h := NewHistory(3)
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	tick := 0
+	h.now = func() time.Time {
+		tick++
+		return start.Add(time.Duration(tick) * time.Second)
+	}
+
+	for i := 1; i <= 4; i++ {
+		h.Add(metrics.NewGauge("Alloc", float64(i)), metrics.NewCounter("PollCount", int64(i*10)))
+	}
+
+	assert.Equal(t, []Point{
+		{Time: start.Add(2 * time.Second), Value: 2},
+		{Time: start.Add(3 * time.Second), Value: 3},
+		{Time: start.Add(4 * time.Second), Value: 4},
+	}, h.Points(metrics.GaugeType, "Alloc"))
+	assert.Len(t, h.Points(metrics.CounterType, "PollCount"), 3)
+	assert.Nil(t, h.Points(metrics.CounterType, "Alloc"))
+
+	last, ok := h.LastUpdate(metrics.CounterType, "PollCount")
+	assert.True(t, ok)
+	assert.Equal(t, start.Add(4*time.Second), last)
+
+	_, ok = h.LastUpdate(metrics.GaugeType, "Unknown")
+	assert.False(t, ok)
+}
+
+func TestHistory_Disabled(t *testing.T) {
+	h := NewHistory(0)
+	h.Add(metrics.NewGauge("Alloc", 1))
+	assert.Nil(t, h.Points(metrics.GaugeType, "Alloc"))
+}
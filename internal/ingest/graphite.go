@@ -0,0 +1,43 @@
+package ingest
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+// ParseGraphiteLine parses Graphite plaintext line `path[;tag=value...] value [timestamp]`.
+// Timestamp is ignored, because only current values are stored.
+func (m *Mapper) ParseGraphiteLine(line string) (metrics.Params, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return metrics.Params{}, fmt.Errorf("%w: (%v) expected `path value timestamp`", ErrInvalidLine, line)
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return metrics.Params{}, fmt.Errorf("%w: (%v) invalid value", ErrInvalidLine, line)
+	}
+
+	name, rawTags, _ := strings.Cut(fields[0], ";")
+	if name == "" {
+		return metrics.Params{}, fmt.Errorf("%w: (%v) empty path", ErrInvalidLine, line)
+	}
+
+	var tags map[string]string
+	if rawTags != "" {
+		tags = map[string]string{}
+		for _, tag := range strings.Split(rawTags, ";") {
+			key, tagValue, ok := strings.Cut(tag, "=")
+			if !ok || key == "" {
+				return metrics.Params{}, fmt.Errorf("%w: (%v) invalid tag %v", ErrInvalidLine, line, tag)
+			}
+			tags[key] = tagValue
+		}
+	}
+
+	return m.Params(name, tags, value), nil
+}
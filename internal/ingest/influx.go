@@ -0,0 +1,189 @@
+package ingest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+// influxValueField is the field name that is not appended to measurement name.
+const influxValueField = "value"
+
+// ParseInfluxLine parses InfluxDB line protocol line
+// `measurement[,tag=value...] field=value[,field=value...] [timestamp]`.
+// Every numeric or boolean field becomes a separate metric named `measurement.field`
+// (or just `measurement` for field "value"), string fields are skipped.
+func (m *Mapper) ParseInfluxLine(line string) (metrics.ParamsSlice, error) {
+	sections := splitUnescaped(line, ' ')
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, fmt.Errorf("%w: (%v) expected `measurement fields timestamp`", ErrInvalidLine, line)
+	}
+
+	series := splitUnescaped(sections[0], ',')
+	measurement := unescape(series[0])
+	if measurement == "" {
+		return nil, fmt.Errorf("%w: (%v) empty measurement", ErrInvalidLine, line)
+	}
+	tags := make(map[string]string, len(series)-1)
+	for _, tag := range series[1:] {
+		key, value, ok := cutUnescaped(tag, '=')
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%w: (%v) invalid tag %v", ErrInvalidLine, line, tag)
+		}
+		tags[unescape(key)] = unescape(value)
+	}
+
+	fields := splitUnescaped(sections[1], ',')
+	slice := make(metrics.ParamsSlice, 0, len(fields))
+	for _, field := range fields {
+		key, rawValue, ok := cutUnescaped(field, '=')
+		if !ok || key == "" {
+			return nil, fmt.Errorf("%w: (%v) invalid field %v", ErrInvalidLine, line, field)
+		}
+		value, ok, err := parseInfluxValue(rawValue)
+		if err != nil {
+			return nil, fmt.Errorf("%w: (%v) field %v - %v", ErrInvalidLine, line, key, err)
+		}
+		if !ok {
+			continue
+		}
+
+		name := measurement
+		if key = unescape(key); key != influxValueField {
+			name += "." + key
+		}
+		slice = append(slice, m.Params(name, tags, value))
+	}
+	return slice, nil
+}
+
+// ParseInflux reads line protocol lines from reader, empty lines and comments are skipped.
+func (m *Mapper) ParseInflux(reader io.Reader, limits metrics.Limits) (metrics.ParamsSlice, error) {
+	var slice metrics.ParamsSlice
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lineSlice, err := m.ParseInfluxLine(line)
+		if err != nil {
+			return nil, err
+		}
+		for _, params := range lineSlice {
+			if err = limits.CheckNameLength(params.Name); err != nil {
+				return nil, err
+			}
+		}
+		slice = append(slice, lineSlice...)
+		if err = limits.CheckBatchSize(len(slice)); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) || errors.Is(err, bufio.ErrTooLong) {
+			return nil, fmt.Errorf("%w - %v", metrics.ErrTooLarge, err)
+		}
+		return nil, err
+	}
+	return slice, nil
+}
+
+// parseInfluxValue returns numeric representation of field value,
+// false is returned for string fields.
+func parseInfluxValue(raw string) (float64, bool, error) {
+	if raw == "" {
+		return 0, false, fmt.Errorf("empty value")
+	}
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	if raw[0] == '"' {
+		return 0, false, nil
+	}
+
+	var (
+		value float64
+		err   error
+	)
+	switch raw[len(raw)-1] {
+	case 'i':
+		var v int64
+		v, err = strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		value = float64(v)
+	case 'u':
+		var v uint64
+		v, err = strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		value = float64(v)
+	default:
+		value, err = strconv.ParseFloat(raw, 64)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false, fmt.Errorf("not finite value %v", raw)
+	}
+	return value, true, nil
+}
+
+// splitUnescaped splits s by sep, ignoring backslash escaped separators and ones inside double quotes.
+func splitUnescaped(s string, sep byte) []string {
+	var (
+		parts    []string
+		start    int
+		inQuotes bool
+	)
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			inQuotes = !inQuotes
+		case sep:
+			if !inQuotes {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// cutUnescaped slices s around the first unescaped sep.
+func cutUnescaped(s string, sep byte) (string, string, bool) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case sep:
+			return s[:i], s[i+1:], true
+		}
+	}
+	return s, "", false
+}
+
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,83 @@
+package ingest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+func TestMapper_ParseInfluxLine(t *testing.T) {
+	m, err := NewMapper([]string{"http.requests"}, []string{"host"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		line    string
+		want    map[string]float64
+		wantErr bool
+	}{
+		{
+			name: "fields and tags",
+			line: `cpu,host=web1,dc=eu usage=0.5,idle=99.5 1700000000000000000`,
+			want: map[string]float64{"cpu.usage;host=web1": 0.5, "cpu.idle;host=web1": 99.5},
+		},
+		{
+			name: "value field, integer and boolean",
+			line: `mem value=1024i,ok=t`,
+			want: map[string]float64{"mem": 1024, "mem.ok": 1},
+		},
+		{
+			name: "counter, string field skipped",
+			line: `http,host=web1 requests=10i,path="/a b,c"`,
+			want: map[string]float64{"http.requests;host=web1": 10},
+		},
+		{
+			name: "escaped characters",
+			line: `disk\ io,host=web\,1 read\=bytes=5`,
+			want: map[string]float64{"disk io.read=bytes;host=web,1": 5},
+		},
+		{name: "no fields", line: `cpu,host=web1`, wantErr: true},
+		{name: "invalid field", line: `cpu usage`, wantErr: true},
+		{name: "invalid value", line: `cpu usage=abc`, wantErr: true},
+		{name: "invalid tag", line: `cpu,host usage=1`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slice, err := m.ParseInfluxLine(tt.line)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidLine)
+				return
+			}
+			require.NoError(t, err)
+			got := map[string]float64{}
+			for idx := range slice {
+				if slice[idx].Type == metrics.CounterType {
+					got[slice[idx].Name] = float64(slice[idx].GetCounterValue())
+					continue
+				}
+				got[slice[idx].Name] = slice[idx].GetGaugeValue()
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestMapper_ParseInflux(t *testing.T) {
+	m, err := NewMapper(nil, nil)
+	require.NoError(t, err)
+
+	body := "# comment\ncpu usage=1\n\nmem free=2,used=3\n"
+	slice, err := m.ParseInflux(strings.NewReader(body), metrics.Limits{})
+	require.NoError(t, err)
+	assert.Len(t, slice, 3)
+
+	_, err = m.ParseInflux(strings.NewReader(body), metrics.Limits{MaxBatchSize: 2})
+	assert.ErrorIs(t, err, metrics.ErrTooLarge)
+
+	_, err = m.ParseInflux(strings.NewReader(body), metrics.Limits{MaxNameLength: 5})
+	assert.ErrorIs(t, err, metrics.ErrTooLarge)
+}
@@ -0,0 +1,105 @@
+// Package ingest describes translation of third-party line formats
+// (Graphite plaintext, InfluxDB line protocol) to metrics.Params.
+package ingest
+
+import (
+	"errors"
+	"math"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+// AllTags keeps every tag of incoming sample as a label.
+const AllTags = "*"
+
+var ErrInvalidLine = errors.New("invalid line")
+
+// Mapper translates incoming samples to metrics.Params.
+//
+// Name patterns are matched with path.Match, matched names are stored as counters
+// (value is added as delta), the others are stored as gauges.
+// Tags listed in labelTags are kept in metric name as `name;key=value` sorted by key,
+// the rest are dropped.
+type Mapper struct {
+	counterPatterns []string
+	labelTags       map[string]struct{}
+	allTags         bool
+}
+
+// NewMapper creates Mapper, returns error on malformed patterns.
+func NewMapper(counterPatterns []string, labelTags []string) (*Mapper, error) {
+	m := &Mapper{counterPatterns: counterPatterns, labelTags: map[string]struct{}{}}
+	for _, pattern := range counterPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+	for _, tag := range labelTags {
+		if tag == AllTags {
+			m.allTags = true
+		}
+		m.labelTags[tag] = struct{}{}
+	}
+	return m, nil
+}
+
+// Params returns metrics.Params for the sample.
+func (m *Mapper) Params(name string, tags map[string]string, value float64) metrics.Params {
+	name = m.labeledName(name, tags)
+	if m.isCounter(name) {
+		delta := int64(math.Round(value))
+		return metrics.Params{Name: name, Type: metrics.CounterType, ValueCounter: &delta}
+	}
+	return metrics.Params{Name: name, Type: metrics.GaugeType, ValueGauge: &value}
+}
+
+func (m *Mapper) isCounter(name string) bool {
+	// patterns are matched against name without labels
+	if idx := strings.IndexByte(name, ';'); idx >= 0 {
+		name = name[:idx]
+	}
+	for _, pattern := range m.counterPatterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Mapper) labeledName(name string, tags map[string]string) string {
+	if m.allTags {
+		return LabeledName(name, tags)
+	}
+	labels := make(map[string]string, len(m.labelTags))
+	for key, value := range tags {
+		if _, ok := m.labelTags[key]; ok {
+			labels[key] = value
+		}
+	}
+	return LabeledName(name, labels)
+}
+
+// LabeledName returns metric name with labels in `name;key=value` form sorted by key.
+func LabeledName(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	for _, key := range keys {
+		b.WriteByte(';')
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(labels[key])
+	}
+	return b.String()
+}
@@ -0,0 +1,125 @@
+package ingest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+func TestMapper_Params(t *testing.T) {
+	tests := []struct {
+		name            string
+		counterPatterns []string
+		labelTags       []string
+		metricName      string
+		tags            map[string]string
+		wantName        string
+		wantType        string
+	}{
+		{
+			name:       "gauge by default",
+			metricName: "servers.web1.cpu",
+			wantName:   "servers.web1.cpu",
+			wantType:   metrics.GaugeType,
+		},
+		{
+			name:            "counter by pattern",
+			counterPatterns: []string{"deploys.*"},
+			metricName:      "deploys.web",
+			wantName:        "deploys.web",
+			wantType:        metrics.CounterType,
+		},
+		{
+			name:       "all tags",
+			labelTags:  []string{AllTags},
+			metricName: "cpu",
+			tags:       map[string]string{"host": "web1", "dc": "eu"},
+			wantName:   "cpu;dc=eu;host=web1",
+			wantType:   metrics.GaugeType,
+		},
+		{
+			name:            "selected tags and counter pattern ignores labels",
+			counterPatterns: []string{"requests"},
+			labelTags:       []string{"host"},
+			metricName:      "requests",
+			tags:            map[string]string{"host": "web1", "dc": "eu"},
+			wantName:        "requests;host=web1",
+			wantType:        metrics.CounterType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewMapper(tt.counterPatterns, tt.labelTags)
+			require.NoError(t, err)
+
+			got := m.Params(tt.metricName, tt.tags, 2)
+			assert.Equal(t, tt.wantName, got.Name)
+			assert.Equal(t, tt.wantType, got.Type)
+		})
+	}
+}
+
+func TestNewMapper_InvalidPattern(t *testing.T) {
+	_, err := NewMapper([]string{"[a-"}, nil)
+	assert.Error(t, err)
+}
+
+func TestMapper_ParseGraphiteLine(t *testing.T) {
+	m, err := NewMapper([]string{"*.count"}, []string{AllTags})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		line      string
+		wantName  string
+		wantType  string
+		wantValue float64
+		wantErr   bool
+	}{
+		{
+			name:      "gauge",
+			line:      "servers.web1.load 0.75 1700000000",
+			wantName:  "servers.web1.load",
+			wantType:  metrics.GaugeType,
+			wantValue: 0.75,
+		},
+		{
+			name:      "counter without timestamp",
+			line:      "deploys.count 2",
+			wantName:  "deploys.count",
+			wantType:  metrics.CounterType,
+			wantValue: 2,
+		},
+		{
+			name:      "tagged",
+			line:      "disk.used;host=web1;mount=/ 512 1700000000",
+			wantName:  "disk.used;host=web1;mount=/",
+			wantType:  metrics.GaugeType,
+			wantValue: 512,
+		},
+		{name: "no value", line: "servers.web1.load", wantErr: true},
+		{name: "invalid value", line: "servers.web1.load abc 1700000000", wantErr: true},
+		{name: "nan value", line: "servers.web1.load nan 1700000000", wantErr: true},
+		{name: "invalid tag", line: "disk.used;host 512", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := m.ParseGraphiteLine(tt.line)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidLine)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantName, got.Name)
+			assert.Equal(t, tt.wantType, got.Type)
+			if tt.wantType == metrics.GaugeType {
+				assert.Equal(t, tt.wantValue, got.GetGaugeValue())
+			} else {
+				assert.Equal(t, int64(tt.wantValue), got.GetCounterValue())
+			}
+		})
+	}
+}
@@ -0,0 +1,337 @@
+// Package keyring keeps HMAC keys signing metrics, keys are identified by ID,
+// so agents are moved to a new key gradually while the old one is still accepted.
+package keyring
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+)
+
+// DefaultKeyID identifies the key of server KEY setting, it verifies hashes sent without key ID.
+const DefaultKeyID = ""
+
+var (
+	ErrUnknownKey     = errors.New("unknown key ID")
+	ErrKeyNotActive   = errors.New("key isn't active")
+	ErrKeyNotAssigned = errors.New("key isn't assigned to agent")
+	ErrHashMismatch   = errors.New("hash mismatch")
+	ErrMissingHash    = errors.New("hash required")
+)
+
+// Key is HMAC key valid from NotBefore till NotAfter, zero time means no bound.
+// Overlapping validity of the old and the new key is the rotation window.
+type Key struct {
+	ID        string    `json:"id"`
+	Secret    string    `json:"secret"`
+	NotBefore time.Time `json:"not_before,omitempty"`
+	NotAfter  time.Time `json:"not_after,omitempty"`
+}
+
+func (k Key) activeAt(now time.Time) bool {
+	return (k.NotBefore.IsZero() || !now.Before(k.NotBefore)) && (k.NotAfter.IsZero() || now.Before(k.NotAfter))
+}
+
+// file is keyring file content, e.g.
+//
+//	{"signing_key": "2024-06",
+//	 "keys": [{"id": "2024-01", "secret": "old", "not_after": "2024-07-01T00:00:00Z"},
+//	          {"id": "2024-06", "secret": "new", "not_before": "2024-06-01T00:00:00Z"}],
+//	 "agents": {"edge-agent": ["2024-06"]}}
+//
+// Agents are names of API tokens, an agent with assigned keys can't use other keys.
+type file struct {
+	SigningKey string              `json:"signing_key,omitempty"`
+	Keys       []Key               `json:"keys"`
+	Agents     map[string][]string `json:"agents,omitempty"`
+}
+
+// KeyStatus describes key validity and its usage, secret isn't exposed.
+type KeyStatus struct {
+	ID        string     `json:"id"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	Active    bool       `json:"active"`
+	Updates   uint64     `json:"updates"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+}
+
+// AgentStatus describes the key that signed the last update of agent.
+type AgentStatus struct {
+	Name         string    `json:"name"`
+	KeyID        string    `json:"key_id"`
+	LastUsed     time.Time `json:"last_used"`
+	AssignedKeys []string  `json:"assigned_keys,omitempty"`
+}
+
+// Status lists keys and agents, old key can be removed once no agent uses it.
+type Status struct {
+	SigningKey string        `json:"signing_key"`
+	Keys       []KeyStatus   `json:"keys"`
+	Agents     []AgentStatus `json:"agents"`
+}
+
+type usage struct {
+	updates  uint64
+	lastUsed time.Time
+}
+
+// Keyring verifies metric hashes by any active key and signs metrics by the signing key.
+// Keys of file are reloaded when it changes, so keys are rotated without restart.
+type Keyring struct {
+	sync.RWMutex
+	path           string
+	reloadInterval time.Duration
+	modTime        time.Time
+	defaultSecret  string
+	keys           map[string]Key
+	signingKey     string
+	agents         map[string][]string
+	keyUsage       map[string]*usage
+	agentKeys      map[string]AgentStatus
+	now            func() time.Time
+}
+
+// NewStatic creates Keyring of the single default key, empty secret disables hash checks.
+func NewStatic(secret string) *Keyring {
+	k := newKeyring(secret)
+	k.apply(file{})
+	return k
+}
+
+// NewKeyring creates Keyring of configured keys file and default secret.
+func NewKeyring(cfg configs.KeyringConfig, defaultSecret string) (*Keyring, error) {
+	k := newKeyring(defaultSecret)
+	k.path, k.reloadInterval = cfg.File, cfg.ReloadInterval
+	if k.path == "" {
+		k.apply(file{})
+		return k, nil
+	}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func newKeyring(defaultSecret string) *Keyring {
+	return &Keyring{
+		defaultSecret: defaultSecret,
+		keyUsage:      map[string]*usage{},
+		agentKeys:     map[string]AgentStatus{},
+		now:           time.Now,
+	}
+}
+
+// Start runs periodic check of keys file.
+func (k *Keyring) Start(ctx context.Context, pool *utils.TickerPool) {
+	if k.path == "" {
+		return
+	}
+	pool.AddTask(ctx, "keyring reload", func(ctx context.Context) {
+		if err := k.Reload(); err != nil {
+			log.Errorf("Keyring not reloaded: %v", err)
+		}
+	}, k.reloadInterval)
+}
+
+// Reload loads keys file if it changed since previous load, previous keys are kept on error.
+func (k *Keyring) Reload() error {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	k.RLock()
+	unchanged := k.keys != nil && !info.ModTime().After(k.modTime)
+	k.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+	var content file
+	if err = json.Unmarshal(data, &content); err != nil {
+		return fmt.Errorf("can't parse keyring %v: %w", k.path, err)
+	}
+	if err = content.validate(); err != nil {
+		return fmt.Errorf("invalid keyring %v: %w", k.path, err)
+	}
+
+	k.Lock()
+	defer k.Unlock()
+	if k.keys != nil {
+		log.Infof("Keyring reloaded, %d keys", len(content.Keys))
+	}
+	k.modTime = info.ModTime()
+	k.apply(content)
+	return nil
+}
+
+func (f file) validate() error {
+	ids := map[string]bool{}
+	for _, key := range f.Keys {
+		if key.ID == DefaultKeyID {
+			return errors.New("key without ID")
+		}
+		if key.Secret == "" {
+			return fmt.Errorf("key %v has no secret", key.ID)
+		}
+		if ids[key.ID] {
+			return fmt.Errorf("duplicate key %v", key.ID)
+		}
+		ids[key.ID] = true
+	}
+	if f.SigningKey != DefaultKeyID && !ids[f.SigningKey] {
+		return fmt.Errorf("%w: signing key %v", ErrUnknownKey, f.SigningKey)
+	}
+	for agent, keyIDs := range f.Agents {
+		for _, id := range keyIDs {
+			if id != DefaultKeyID && !ids[id] {
+				return fmt.Errorf("%w: %v of agent %v", ErrUnknownKey, id, agent)
+			}
+		}
+	}
+	return nil
+}
+
+// apply replaces keys by file content, caller holds the lock.
+func (k *Keyring) apply(content file) {
+	k.keys = make(map[string]Key, len(content.Keys)+1)
+	if k.defaultSecret != "" {
+		k.keys[DefaultKeyID] = Key{ID: DefaultKeyID, Secret: k.defaultSecret}
+	}
+	for _, key := range content.Keys {
+		k.keys[key.ID] = key
+	}
+	k.signingKey = content.SigningKey
+	k.agents = content.Agents
+}
+
+// Enabled reports if metrics hashes are checked.
+func (k *Keyring) Enabled() bool {
+	k.RLock()
+	defer k.RUnlock()
+	return len(k.keys) > 0
+}
+
+// Signature returns signature of message by key secret.
+type Signature func(secret []byte) string
+
+// Verify checks hash of metric signed by key, agent is the sender name, it's empty for anonymous senders.
+// Successful checks are counted in key usage.
+func (k *Keyring) Verify(agent, keyID, hash string, metric metrics.Metric) error {
+	return k.VerifySignature(agent, keyID, hash, metric.Hash)
+}
+
+// VerifySignature checks signature of message signed by key, e.g. whole request body.
+func (k *Keyring) VerifySignature(agent, keyID, signature string, sign Signature) error {
+	k.RLock()
+	if len(k.keys) == 0 {
+		k.RUnlock()
+		return nil
+	}
+	key, ok := k.keys[keyID]
+	assigned, restricted := k.agents[agent]
+	k.RUnlock()
+
+	switch {
+	case signature == "":
+		return ErrMissingHash
+	case !ok:
+		return fmt.Errorf("%w: %q", ErrUnknownKey, keyID)
+	case !key.activeAt(k.now()):
+		return fmt.Errorf("%w: %q", ErrKeyNotActive, keyID)
+	case restricted && !contains(assigned, keyID):
+		return fmt.Errorf("%w: %q of %v", ErrKeyNotAssigned, keyID, agent)
+	case !hmac.Equal([]byte(signature), []byte(sign([]byte(key.Secret)))):
+		return ErrHashMismatch
+	}
+	k.record(agent, keyID)
+	return nil
+}
+
+// record counts update signed by key.
+func (k *Keyring) record(agent, keyID string) {
+	now := k.now()
+	k.Lock()
+	defer k.Unlock()
+	u, ok := k.keyUsage[keyID]
+	if !ok {
+		u = &usage{}
+		k.keyUsage[keyID] = u
+	}
+	u.updates++
+	u.lastUsed = now
+	if agent != "" {
+		k.agentKeys[agent] = AgentStatus{Name: agent, KeyID: keyID, LastUsed: now}
+	}
+}
+
+// Sign returns hash of metric and ID of the signing key, hash is empty when no key is set.
+func (k *Keyring) Sign(metric metrics.Metric) (string, string) {
+	return k.SignWith(metric.Hash)
+}
+
+// SignWith returns signature of message by the signing key and the key ID.
+func (k *Keyring) SignWith(sign Signature) (string, string) {
+	k.RLock()
+	key, ok := k.keys[k.signingKey]
+	k.RUnlock()
+	if !ok {
+		return "", ""
+	}
+	return sign([]byte(key.Secret)), key.ID
+}
+
+// Status returns keys validity and usage.
+func (k *Keyring) Status() Status {
+	now := k.now()
+	k.RLock()
+	defer k.RUnlock()
+
+	status := Status{SigningKey: k.signingKey, Keys: []KeyStatus{}, Agents: []AgentStatus{}}
+	for _, key := range k.keys {
+		ks := KeyStatus{ID: key.ID, Active: key.activeAt(now)}
+		if notBefore := key.NotBefore; !notBefore.IsZero() {
+			ks.NotBefore = &notBefore
+		}
+		if notAfter := key.NotAfter; !notAfter.IsZero() {
+			ks.NotAfter = &notAfter
+		}
+		if u, ok := k.keyUsage[key.ID]; ok {
+			lastUsed := u.lastUsed
+			ks.Updates, ks.LastUsed = u.updates, &lastUsed
+		}
+		status.Keys = append(status.Keys, ks)
+	}
+	for _, agent := range k.agentKeys {
+		agent.AssignedKeys = k.agents[agent.Name]
+		status.Agents = append(status.Agents, agent)
+	}
+	sort.Slice(status.Keys, func(i, j int) bool { return status.Keys[i].ID < status.Keys[j].ID })
+	sort.Slice(status.Agents, func(i, j int) bool { return status.Agents[i].Name < status.Agents[j].Name })
+	return status
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package keyring
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+var rotationTime = time.Date(2024, 6, 15, 0, 0, 0, 0, time.UTC)
+
+const rotationKeyring = `{
+	"signing_key": "new",
+	"keys": [
+		{"id": "old", "secret": "old-secret", "not_after": "2024-07-01T00:00:00Z"},
+		{"id": "new", "secret": "new-secret", "not_before": "2024-06-01T00:00:00Z"},
+		{"id": "next", "secret": "next-secret", "not_before": "2024-08-01T00:00:00Z"}
+	],
+	"agents": {"edge": ["new"]}
+}`
+
+func newTestKeyring(t *testing.T, data, defaultSecret string) (*Keyring, string) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	require.NoError(t, os.WriteFile(path, []byte(data), 0600))
+	k, err := NewKeyring(configs.KeyringConfig{File: path}, defaultSecret)
+	require.NoError(t, err)
+	k.now = func() time.Time { return rotationTime }
+	return k, path
+}
+
+func TestKeyring_Verify(t *testing.T) {
+	k, _ := newTestKeyring(t, rotationKeyring, "default-secret")
+	metric := metrics.NewCounter("PollCount", 5)
+
+	tests := []struct {
+		name    string
+		agent   string
+		keyID   string
+		secret  string
+		wantErr error
+	}{
+		{name: "old key in overlap window", keyID: "old", secret: "old-secret"},
+		{name: "new key in overlap window", keyID: "new", secret: "new-secret"},
+		{name: "default key without ID", keyID: DefaultKeyID, secret: "default-secret"},
+		{name: "key isn't active yet", keyID: "next", secret: "next-secret", wantErr: ErrKeyNotActive},
+		{name: "unknown key", keyID: "other", secret: "new-secret", wantErr: ErrUnknownKey},
+		{name: "wrong secret", keyID: "new", secret: "old-secret", wantErr: ErrHashMismatch},
+		{name: "assigned key of agent", agent: "edge", keyID: "new", secret: "new-secret"},
+		{name: "key isn't assigned to agent", agent: "edge", keyID: "old", secret: "old-secret", wantErr: ErrKeyNotAssigned},
+		{name: "missing hash", keyID: "new", wantErr: ErrMissingHash},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hash string
+			if tt.secret != "" {
+				hash = metric.Hash([]byte(tt.secret))
+			}
+			err := k.Verify(tt.agent, tt.keyID, hash, metric)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+
+	hash, keyID := k.Sign(metric)
+	assert.Equal(t, "new", keyID)
+	assert.Equal(t, metric.Hash([]byte("new-secret")), hash)
+}
+
+func TestKeyring_Rotation(t *testing.T) {
+	k, path := newTestKeyring(t, rotationKeyring, "")
+	metric := metrics.NewGauge("Alloc", 1)
+
+	// old key expires after overlap window
+	k.now = func() time.Time { return rotationTime.AddDate(0, 1, 0) }
+	assert.ErrorIs(t, k.Verify("", "old", metric.Hash([]byte("old-secret")), metric), ErrKeyNotActive)
+
+	// removed key is rejected after reload
+	require.NoError(t, os.WriteFile(path, []byte(`{"signing_key": "new", "keys": [{"id": "new", "secret": "new-secret"}]}`), 0600))
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(path, later, later))
+	require.NoError(t, k.Reload())
+	assert.ErrorIs(t, k.Verify("", "next", metric.Hash([]byte("next-secret")), metric), ErrUnknownKey)
+
+	// invalid file keeps previous keys
+	require.NoError(t, os.WriteFile(path, []byte(`{"signing_key": "missing", "keys": []}`), 0600))
+	require.NoError(t, os.Chtimes(path, later.Add(time.Minute), later.Add(time.Minute)))
+	assert.ErrorIs(t, k.Reload(), ErrUnknownKey)
+	assert.NoError(t, k.Verify("", "new", metric.Hash([]byte("new-secret")), metric))
+}
+
+func TestKeyring_Status(t *testing.T) {
+	k, _ := newTestKeyring(t, rotationKeyring, "")
+	metric := metrics.NewGauge("Alloc", 1)
+	require.NoError(t, k.Verify("edge", "new", metric.Hash([]byte("new-secret")), metric))
+	require.NoError(t, k.Verify("", "new", metric.Hash([]byte("new-secret")), metric))
+	require.NoError(t, k.Verify("legacy", "old", metric.Hash([]byte("old-secret")), metric))
+
+	status := k.Status()
+	assert.Equal(t, "new", status.SigningKey)
+	require.Len(t, status.Keys, 3)
+	assert.Equal(t, "new", status.Keys[0].ID)
+	assert.Equal(t, uint64(2), status.Keys[0].Updates)
+	assert.Equal(t, "next", status.Keys[1].ID)
+	assert.False(t, status.Keys[1].Active)
+	assert.Equal(t, uint64(1), status.Keys[2].Updates)
+	assert.Equal(t, []AgentStatus{
+		{Name: "edge", KeyID: "new", LastUsed: rotationTime, AssignedKeys: []string{"new"}},
+		{Name: "legacy", KeyID: "old", LastUsed: rotationTime},
+	}, status.Agents)
+}
+
+func TestNewStatic(t *testing.T) {
+	metric := metrics.NewGauge("Alloc", 1)
+
+	disabled := NewStatic("")
+	assert.False(t, disabled.Enabled())
+	assert.NoError(t, disabled.Verify("", "", "", metric))
+	hash, _ := disabled.Sign(metric)
+	assert.Empty(t, hash)
+
+	k := NewStatic("secret")
+	assert.True(t, k.Enabled())
+	hash, keyID := k.Sign(metric)
+	assert.Equal(t, DefaultKeyID, keyID)
+	assert.NoError(t, k.Verify("", keyID, hash, metric))
+}
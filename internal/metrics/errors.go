@@ -7,4 +7,5 @@ var (
 	ErrInvalidValue = errors.New("invalid value")
 	ErrParseJSON    = errors.New("can't parse")
 	ErrParseURI     = errors.New("can't parse")
+	ErrTooLarge     = errors.New("too large")
 )
@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/unbeman/ya-prac-mcas/proto"
+)
+
+// Supported content types of metrics batches.
+const (
+	JSONContentType     = "application/json"
+	ProtobufContentType = "application/x-protobuf"
+	NDJSONContentType   = "application/x-ndjson"
+)
+
+// ParseContentType returns supported media type from Content-Type header value,
+// JSONContentType is used for empty or unknown values.
+func ParseContentType(header string) string {
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return JSONContentType
+	}
+	switch mediaType {
+	case ProtobufContentType, NDJSONContentType:
+		return mediaType
+	default:
+		return JSONContentType
+	}
+}
+
+// NegotiateContentType chooses supported media type of the highest quality from Accept header value,
+// media types of zero quality aren't accepted. Equal qualities are resolved by header order,
+// then JSONContentType is preferred. If nothing matches JSONContentType is returned.
+func NegotiateContentType(accept string) string {
+	best, bestQuality, bestPosition := JSONContentType, 0.0, 0
+	for _, mediaType := range []string{JSONContentType, NDJSONContentType, ProtobufContentType} {
+		quality, position, ok := acceptQuality(accept, mediaType)
+		if !ok || quality <= 0 {
+			continue
+		}
+		if quality > bestQuality || quality == bestQuality && position < bestPosition {
+			best, bestQuality, bestPosition = mediaType, quality, position
+		}
+	}
+	return best
+}
+
+// acceptQuality returns quality of mediaType given by the most specific media range of Accept header value
+// matching it and position of the range, false is returned when no range matches.
+func acceptQuality(accept, mediaType string) (float64, int, bool) {
+	typeRange := mediaType[:strings.IndexByte(mediaType, '/')] + "/*"
+	quality, position, specificity := 0.0, 0, -1
+	for idx, part := range strings.Split(accept, ",") {
+		mediaRange, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		rangeSpecificity := -1
+		switch mediaRange {
+		case mediaType:
+			rangeSpecificity = 2
+		case typeRange:
+			rangeSpecificity = 1
+		case "*/*":
+			rangeSpecificity = 0
+		}
+		if rangeSpecificity <= specificity {
+			continue
+		}
+		rangeQuality := 1.0
+		if value, ok := params["q"]; ok {
+			rangeQuality, err = strconv.ParseFloat(value, 64)
+			if err != nil || rangeQuality < 0 || rangeQuality > 1 {
+				continue
+			}
+		}
+		quality, position, specificity = rangeQuality, idx, rangeSpecificity
+	}
+	return quality, position, specificity >= 0
+}
+
+// Parse decodes metrics batch from reader depending on content type,
+// decoding stops as soon as limits are exceeded.
+func (ps *ParamsSlice) Parse(reader io.Reader, contentType string, limits Limits) error {
+	switch contentType {
+	case ProtobufContentType:
+		return ps.parseProtobuf(reader, limits)
+	case NDJSONContentType:
+		return ps.parseNDJSON(reader, limits)
+	default:
+		return ps.parseJSON(reader, limits)
+	}
+}
+
+// parseProtobuf decodes metrics batch from serialized pb.UpdateMetricsRequest.
+func (ps *ParamsSlice) parseProtobuf(reader io.Reader, limits Limits) error {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return decodeError(err)
+	}
+	var request pb.UpdateMetricsRequest
+	if err = proto.Unmarshal(data, &request); err != nil {
+		return decodeError(err)
+	}
+	if err = limits.CheckBatchSize(len(request.Metrics)); err != nil {
+		return err
+	}
+	for _, m := range request.Metrics {
+		if err = limits.CheckNameLength(m.Name); err != nil {
+			return err
+		}
+	}
+	return ps.ParseProto(request.Metrics)
+}
+
+// parseNDJSON decodes newline delimited JSON objects one by one,
+// so the whole batch is never buffered.
+func (ps *ParamsSlice) parseNDJSON(reader io.Reader, limits Limits) error {
+	decoder := json.NewDecoder(reader)
+	for {
+		var params Params
+		err := decoder.Decode(&params)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return decodeError(err)
+		}
+		if err = limits.CheckBatchSize(len(*ps) + 1); err != nil {
+			return err
+		}
+		if err = limits.CheckNameLength(params.Name); err != nil {
+			return err
+		}
+		if err = checkParams(params); err != nil {
+			return err
+		}
+		*ps = append(*ps, params)
+	}
+}
+
+// Encode writes metrics batch to writer depending on content type.
+func (ps *ParamsSlice) Encode(writer io.Writer, contentType string) error {
+	switch contentType {
+	case ProtobufContentType:
+		data, err := proto.Marshal(&pb.UpdateMetricsRequest{Metrics: ps.ToProto()})
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(data)
+		return err
+	case NDJSONContentType:
+		encoder := json.NewEncoder(writer)
+		for _, params := range *ps {
+			if err := encoder.Encode(params); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return json.NewEncoder(writer).Encode(ps)
+	}
+}
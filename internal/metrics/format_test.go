@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseContentType(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "empty", header: "", want: JSONContentType},
+		{name: "json", header: "application/json; charset=utf-8", want: JSONContentType},
+		{name: "protobuf", header: "application/x-protobuf", want: ProtobufContentType},
+		{name: "ndjson", header: "application/x-ndjson", want: NDJSONContentType},
+		{name: "unknown", header: "text/plain", want: JSONContentType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, ParseContentType(tt.header))
+		})
+	}
+}
+
+func TestNegotiateContentType(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		want   string
+	}{
+		{name: "empty", accept: "", want: JSONContentType},
+		{name: "any", accept: "*/*", want: JSONContentType},
+		{name: "protobuf", accept: "application/x-protobuf", want: ProtobufContentType},
+		{name: "first supported", accept: "text/html, application/x-ndjson, application/json", want: NDJSONContentType},
+		{name: "highest quality", accept: "text/html, application/x-ndjson;q=0.9, application/json", want: JSONContentType},
+		{name: "quality order", accept: "application/json;q=0.5, application/x-protobuf;q=0.8", want: ProtobufContentType},
+		{name: "zero quality", accept: "application/json;q=0, application/x-ndjson;q=0.1", want: NDJSONContentType},
+		{name: "specific range wins", accept: "application/*;q=0.2, application/x-ndjson", want: NDJSONContentType},
+		{name: "excluded by specific range", accept: "*/*, application/json;q=0", want: NDJSONContentType},
+		{name: "invalid quality", accept: "application/x-protobuf;q=high, application/x-ndjson", want: NDJSONContentType},
+		{name: "nothing acceptable", accept: "text/html", want: JSONContentType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, NegotiateContentType(tt.accept))
+		})
+	}
+}
+
+func TestParamsSlice_ParseNDJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    ParamsSlice
+		wantErr bool
+	}{
+		{
+			name: "good",
+			input: `{"id":"Dog","type":"counter","delta":5}
+{"id":"WaterPercent","type":"gauge","value":0.8}
+`,
+			want: ParamsSlice{
+				{Name: "Dog", Type: CounterType, ValueCounter: ptrCounterValue(5)},
+				{Name: "WaterPercent", Type: GaugeType, ValueGauge: ptrGaugeValue(0.8)},
+			},
+		},
+		{
+			name:  "empty",
+			input: "",
+			want:  nil,
+		},
+		{
+			name:    "invalid json",
+			input:   `{"id":"Dog","type":"counter",`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid type",
+			input:   `{"id":"Dog","type":"fruit","delta":5}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ps ParamsSlice
+			err := ps.Parse(strings.NewReader(tt.input), NDJSONContentType, Limits{})
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, ps)
+		})
+	}
+}
+
+func TestParamsSlice_EncodeParse(t *testing.T) {
+	slice := ParamsSlice{
+		{Name: "Dog", Type: CounterType, ValueCounter: ptrCounterValue(5)},
+		{Name: "WaterPercent", Type: GaugeType, ValueGauge: ptrGaugeValue(0.8)},
+	}
+	for _, contentType := range []string{JSONContentType, ProtobufContentType, NDJSONContentType} {
+		t.Run(contentType, func(t *testing.T) {
+			buf := bytes.Buffer{}
+			require.NoError(t, slice.Encode(&buf, contentType))
+
+			var got ParamsSlice
+			require.NoError(t, got.Parse(&buf, contentType, Limits{}))
+			require.Len(t, got, len(slice))
+			for i := range slice {
+				assert.Equal(t, slice[i].Name, got[i].Name)
+				assert.Equal(t, slice[i].Type, got[i].Type)
+				assert.Equal(t, slice[i].GetCounterValue(), got[i].GetCounterValue())
+				assert.Equal(t, slice[i].GetGaugeValue(), got[i].GetGaugeValue())
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Limits restricts decoded metrics batches, zero value of each field means no limit.
+type Limits struct {
+	MaxBatchSize  int
+	MaxNameLength int
+}
+
+// CheckBatchSize returns ErrTooLarge if batch contains more than MaxBatchSize metrics.
+func (l Limits) CheckBatchSize(size int) error {
+	if l.MaxBatchSize > 0 && size > l.MaxBatchSize {
+		return fmt.Errorf("checkBatchSize: %d metrics, max %d - %w", size, l.MaxBatchSize, ErrTooLarge)
+	}
+	return nil
+}
+
+// CheckNameLength returns ErrTooLarge if metric name is longer than MaxNameLength.
+func (l Limits) CheckNameLength(name string) error {
+	if l.MaxNameLength > 0 && len(name) > l.MaxNameLength {
+		return fmt.Errorf("checkNameLength: name length %d, max %d - %w", len(name), l.MaxNameLength, ErrTooLarge)
+	}
+	return nil
+}
+
+// decodeError wraps body decoding error, exceeding of body size limit is reported as ErrTooLarge.
+func decodeError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return fmt.Errorf("%w - %v", ErrTooLarge, err)
+	}
+	return fmt.Errorf("%w - %v", ErrParseJSON, err)
+}
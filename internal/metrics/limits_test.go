@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParamsSlice_ParseLimits(t *testing.T) {
+	limits := Limits{MaxBatchSize: 2, MaxNameLength: 8}
+	tests := []struct {
+		name        string
+		input       string
+		contentType string
+		wantErr     error
+	}{
+		{
+			name:        "json fits",
+			input:       `[{"id":"Dog","type":"counter","delta":5},{"id":"Cat","type":"counter","delta":1}]`,
+			contentType: JSONContentType,
+		},
+		{
+			name: "json too many metrics",
+			input: `[{"id":"Dog","type":"counter","delta":5},{"id":"Cat","type":"counter","delta":1},
+{"id":"Ant","type":"counter","delta":1}]`,
+			contentType: JSONContentType,
+			wantErr:     ErrTooLarge,
+		},
+		{
+			name:        "json too long name",
+			input:       `[{"id":"VeryLongName","type":"counter","delta":5}]`,
+			contentType: JSONContentType,
+			wantErr:     ErrTooLarge,
+		},
+		{
+			name:        "json not array",
+			input:       `{"id":"Dog","type":"counter","delta":5}`,
+			contentType: JSONContentType,
+			wantErr:     ErrParseJSON,
+		},
+		{
+			name: "ndjson too many metrics",
+			input: `{"id":"Dog","type":"counter","delta":5}
+{"id":"Cat","type":"counter","delta":1}
+{"id":"Ant","type":"counter","delta":1}`,
+			contentType: NDJSONContentType,
+			wantErr:     ErrTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ps ParamsSlice
+			err := ps.Parse(strings.NewReader(tt.input), tt.contentType, limits)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestParamsSlice_ParseMaxBytes(t *testing.T) {
+	input := `[{"id":"Dog","type":"counter","delta":5},{"id":"Cat","type":"counter","delta":1}]`
+	body := http.MaxBytesReader(httptest.NewRecorder(), io.NopCloser(strings.NewReader(input)), 16)
+
+	var ps ParamsSlice
+	err := ps.Parse(body, JSONContentType, Limits{})
+	assert.ErrorIs(t, err, ErrTooLarge)
+}
@@ -24,24 +24,63 @@ type Params struct { //TODO: make builder .TypeAndName() .Value()
 	ValueCounter *int64   `json:"delta,omitempty"`
 	ValueGauge   *float64 `json:"value,omitempty"`
 	Hash         string   `json:"hash,omitempty"`
+	KeyID        string   `json:"key_id,omitempty"`
+	Timestamp    int64    `json:"timestamp,omitempty"`
+	Nonce        string   `json:"nonce,omitempty"`
 }
 
 type ParamsSlice []Params
 
+// ParseJSON decodes JSON array of metrics without size limits.
 func (ps *ParamsSlice) ParseJSON(reader io.Reader) error {
-	if err := json.NewDecoder(reader).Decode(ps); err != nil {
-		return fmt.Errorf("%w - %v", ErrParseJSON, err)
+	return ps.parseJSON(reader, Limits{})
+}
+
+// parseJSON decodes JSON array element by element,
+// so limits are checked before the whole batch is read.
+func (ps *ParamsSlice) parseJSON(reader io.Reader, limits Limits) error {
+	decoder := json.NewDecoder(reader)
+	token, err := decoder.Token()
+	if err != nil {
+		return decodeError(err)
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("%w - expected array, got %v", ErrParseJSON, token)
+	}
+	if *ps == nil {
+		*ps = ParamsSlice{}
 	}
-	for _, params := range *ps {
-		if err := CheckType(params.Type); err != nil {
+	for decoder.More() {
+		if err = limits.CheckBatchSize(len(*ps) + 1); err != nil {
 			return err
 		}
-		if err := CheckName(params.Name); err != nil {
+		var params Params
+		if err = decoder.Decode(&params); err != nil {
+			return decodeError(err)
+		}
+		if err = limits.CheckNameLength(params.Name); err != nil {
 			return err
 		}
-		if err := CheckValues(params.ValueGauge, params.ValueCounter); err != nil {
-			return ErrInvalidValue
+		if err = checkParams(params); err != nil {
+			return err
 		}
+		*ps = append(*ps, params)
+	}
+	if _, err = decoder.Token(); err != nil {
+		return decodeError(err)
+	}
+	return nil
+}
+
+func checkParams(params Params) error {
+	if err := CheckType(params.Type); err != nil {
+		return err
+	}
+	if err := CheckName(params.Name); err != nil {
+		return err
+	}
+	if err := CheckValues(params.ValueGauge, params.ValueCounter); err != nil {
+		return ErrInvalidValue
 	}
 	return nil
 }
@@ -64,6 +103,9 @@ func (ps *ParamsSlice) ParseProto(mps []*pb.Metric) error {
 			ValueGauge:   &m.Value,
 			ValueCounter: &m.Delta,
 			Hash:         m.Hash,
+			KeyID:        m.KeyId,
+			Timestamp:    m.Timestamp,
+			Nonce:        m.Nonce,
 		}
 		*ps = append(*ps, p)
 	}
@@ -74,11 +116,14 @@ func (ps *ParamsSlice) ToProto() []*pb.Metric {
 	protoMetrics := make([]*pb.Metric, 0, len(*ps))
 	for _, p := range *ps {
 		pm := pb.Metric{
-			Name:  p.Name,
-			Type:  p.Type,
-			Delta: p.GetCounterValue(),
-			Value: p.GetGaugeValue(),
-			Hash:  p.Hash,
+			Name:      p.Name,
+			Type:      p.Type,
+			Delta:     p.GetCounterValue(),
+			Value:     p.GetGaugeValue(),
+			Hash:      p.Hash,
+			KeyId:     p.KeyID,
+			Timestamp: p.Timestamp,
+			Nonce:     p.Nonce,
 		}
 		protoMetrics = append(protoMetrics, &pm)
 	}
@@ -151,7 +196,7 @@ func ParseURI(request *http.Request, requiredKeys ...string) (Params, error) {
 func ParseJSON(data io.Reader, requiredKeys ...string) (Params, error) {
 	var params Params
 	if err := json.NewDecoder(data).Decode(&params); err != nil {
-		return params, fmt.Errorf("%w - %v", ErrParseJSON, err)
+		return params, decodeError(err)
 	}
 	for _, key := range requiredKeys {
 		switch key {
@@ -180,6 +225,9 @@ func ParseProto(metric *pb.Metric, requiredKeys ...string) (Params, error) {
 		ValueCounter: &metric.Delta,
 		ValueGauge:   &metric.Value,
 		Hash:         metric.Hash,
+		KeyID:        metric.KeyId,
+		Timestamp:    metric.Timestamp,
+		Nonce:        metric.Nonce,
 	}
 	for _, key := range requiredKeys {
 		switch key {
@@ -0,0 +1,319 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+var ErrEval = errors.New("evaluation error")
+
+// Sample is a named value of expression result.
+// Scalars and aggregation results have empty name.
+type Sample struct {
+	Name  string  `json:"name"`
+	Value float64 `json:"value"`
+}
+
+// Vector is expression result sorted by sample names.
+type Vector []Sample
+
+// Snapshot holds current metric values by name.
+type Snapshot map[string]float64
+
+// NewSnapshot builds Snapshot from repository metrics,
+// gauge value is preferred when counter has the same name.
+func NewSnapshot(list []metrics.Metric) Snapshot {
+	snapshot := make(Snapshot, len(list))
+	for _, metric := range list {
+		switch m := metric.(type) {
+		case metrics.Gauge:
+			snapshot[m.GetName()] = m.Value()
+		case metrics.Counter:
+			if _, ok := snapshot[m.GetName()]; !ok {
+				snapshot[m.GetName()] = float64(m.Value())
+			}
+		}
+	}
+	return snapshot
+}
+
+// result is intermediate value, scalar results aren't bound to series.
+type result struct {
+	scalar bool
+	value  float64
+	vector Vector
+}
+
+type aggregation struct {
+	init func(value float64) float64
+	next func(acc, value float64) float64
+	done func(acc float64, count int) float64
+}
+
+var aggregations = map[string]aggregation{
+	"sum": {
+		next: func(acc, value float64) float64 { return acc + value },
+	},
+	"avg": {
+		next: func(acc, value float64) float64 { return acc + value },
+		done: func(acc float64, count int) float64 { return acc / float64(count) },
+	},
+	"min": {
+		next: math.Min,
+	},
+	"max": {
+		next: math.Max,
+	},
+	"count": {
+		init: func(float64) float64 { return 1 },
+		next: func(acc, _ float64) float64 { return acc + 1 },
+	},
+}
+
+// checkCall validates function name and arguments:
+// aggregations take series and optional count of name segments to group by,
+// topk takes count and series.
+func checkCall(call *Call) error {
+	switch _, isAggregation := aggregations[call.Func]; {
+	case isAggregation:
+		if len(call.Args) < 1 || len(call.Args) > 2 {
+			return fmt.Errorf("%v expects 1 or 2 arguments, got %d", call.Func, len(call.Args))
+		}
+		if len(call.Args) == 2 {
+			if _, err := intArg(call.Args[1]); err != nil {
+				return fmt.Errorf("%v segments: %w", call.Func, err)
+			}
+		}
+	case call.Func == "topk":
+		if len(call.Args) != 2 {
+			return fmt.Errorf("topk expects 2 arguments, got %d", len(call.Args))
+		}
+		if _, err := intArg(call.Args[0]); err != nil {
+			return fmt.Errorf("topk count: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown function %v", call.Func)
+	}
+	return nil
+}
+
+// intArg returns value of positive integer literal.
+func intArg(node Node) (int, error) {
+	number, ok := node.(*NumberLiteral)
+	if !ok || number.Value < 1 || number.Value != math.Trunc(number.Value) {
+		return 0, fmt.Errorf("positive integer expected, got %v", node)
+	}
+	return int(number.Value), nil
+}
+
+// Eval evaluates parsed expression over snapshot.
+// Scalar result is returned as single unnamed sample.
+func Eval(node Node, snapshot Snapshot) (Vector, error) {
+	res, err := eval(node, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if res.scalar {
+		return Vector{{Value: res.value}}, nil
+	}
+	return res.vector, nil
+}
+
+func eval(node Node, snapshot Snapshot) (result, error) {
+	switch n := node.(type) {
+	case *NumberLiteral:
+		return result{scalar: true, value: n.Value}, nil
+	case *Selector:
+		return result{vector: selectSeries(n, snapshot)}, nil
+	case *UnaryExpr:
+		operand, err := eval(n.Expr, snapshot)
+		if err != nil {
+			return result{}, err
+		}
+		return apply(operand, func(value float64) float64 { return -value }), nil
+	case *BinaryExpr:
+		left, err := eval(n.Left, snapshot)
+		if err != nil {
+			return result{}, err
+		}
+		right, err := eval(n.Right, snapshot)
+		if err != nil {
+			return result{}, err
+		}
+		return binary(n.Op, left, right)
+	case *Call:
+		return evalCall(n, snapshot)
+	}
+	return result{}, fmt.Errorf("%w: unsupported node %v", ErrEval, node)
+}
+
+func selectSeries(selector *Selector, snapshot Snapshot) Vector {
+	vector := Vector{}
+	if !selector.IsGlob() {
+		if value, ok := snapshot[selector.Pattern]; ok {
+			vector = append(vector, Sample{Name: selector.Pattern, Value: value})
+		}
+		return vector
+	}
+	for name, value := range snapshot {
+		if ok, _ := path.Match(selector.Pattern, name); ok {
+			vector = append(vector, Sample{Name: name, Value: value})
+		}
+	}
+	sort.Slice(vector, func(i, j int) bool { return vector[i].Name < vector[j].Name })
+	return vector
+}
+
+func apply(operand result, fn func(value float64) float64) result {
+	if operand.scalar {
+		return result{scalar: true, value: fn(operand.value)}
+	}
+	vector := make(Vector, 0, len(operand.vector))
+	for _, sample := range operand.vector {
+		vector = append(vector, Sample{Name: sample.Name, Value: fn(sample.Value)})
+	}
+	return result{vector: vector}
+}
+
+func operate(op string, left, right float64) float64 {
+	switch op {
+	case "+":
+		return left + right
+	case "-":
+		return left - right
+	case "*":
+		return left * right
+	default:
+		return left / right
+	}
+}
+
+// binary combines operands. Vector and scalar are combined sample by sample,
+// two single-sample vectors are combined regardless of names (left name is kept),
+// other vectors are matched by sample names.
+func binary(op string, left, right result) (result, error) {
+	switch {
+	case left.scalar && right.scalar:
+		return result{scalar: true, value: operate(op, left.value, right.value)}, nil
+	case right.scalar:
+		return apply(left, func(value float64) float64 { return operate(op, value, right.value) }), nil
+	case left.scalar:
+		return apply(right, func(value float64) float64 { return operate(op, left.value, value) }), nil
+	case len(left.vector) == 1 && len(right.vector) == 1:
+		return result{vector: Vector{{
+			Name:  left.vector[0].Name,
+			Value: operate(op, left.vector[0].Value, right.vector[0].Value),
+		}}}, nil
+	}
+
+	values := make(map[string]float64, len(right.vector))
+	for _, sample := range right.vector {
+		values[sample.Name] = sample.Value
+	}
+	vector := Vector{}
+	for _, sample := range left.vector {
+		if value, ok := values[sample.Name]; ok {
+			vector = append(vector, Sample{Name: sample.Name, Value: operate(op, sample.Value, value)})
+		}
+	}
+	return result{vector: vector}, nil
+}
+
+func evalCall(call *Call, snapshot Snapshot) (result, error) {
+	seriesArg, countArg := call.Args[0], Node(nil)
+	if call.Func == "topk" {
+		seriesArg, countArg = call.Args[1], call.Args[0]
+	} else if len(call.Args) == 2 {
+		countArg = call.Args[1]
+	}
+	arg, err := eval(seriesArg, snapshot)
+	if err != nil {
+		return result{}, err
+	}
+	if arg.scalar {
+		return result{}, fmt.Errorf("%w: %v expects series, got scalar", ErrEval, call.Func)
+	}
+	count := 0
+	if countArg != nil {
+		count, _ = intArg(countArg)
+	}
+
+	if call.Func == "topk" {
+		return result{vector: topk(count, arg.vector)}, nil
+	}
+	if len(arg.vector) == 0 {
+		return result{vector: Vector{}}, nil
+	}
+	agg := aggregations[call.Func]
+	if count == 0 {
+		return result{vector: Vector{{Value: aggregate(agg, arg.vector)}}}, nil
+	}
+
+	groups := map[string]Vector{}
+	for _, sample := range arg.vector {
+		key := GroupName(sample.Name, count)
+		groups[key] = append(groups[key], sample)
+	}
+	vector := make(Vector, 0, len(groups))
+	for name, group := range groups {
+		vector = append(vector, Sample{Name: name, Value: aggregate(agg, group)})
+	}
+	sort.Slice(vector, func(i, j int) bool { return vector[i].Name < vector[j].Name })
+	return result{vector: vector}, nil
+}
+
+func aggregate(agg aggregation, vector Vector) float64 {
+	acc := vector[0].Value
+	if agg.init != nil {
+		acc = agg.init(acc)
+	}
+	for _, sample := range vector[1:] {
+		acc = agg.next(acc, sample.Value)
+	}
+	if agg.done != nil {
+		acc = agg.done(acc, len(vector))
+	}
+	return acc
+}
+
+// topk returns k samples with the largest values in descending order.
+func topk(k int, vector Vector) Vector {
+	sorted := make(Vector, len(vector))
+	copy(sorted, vector)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Value > sorted[j].Value })
+	if len(sorted) > k {
+		sorted = sorted[:k]
+	}
+	return sorted
+}
+
+// GroupName returns name prefix of the first segments.
+// Segments are separated by dots, label delimiter `;` and letter/digit boundaries,
+// e.g. the first segment of both `CPUutilization1` and `CPUutilization2` is `CPUutilization`,
+// the first two segments of `cpu.0.user` are `cpu.0`.
+func GroupName(name string, segments int) string {
+	runes := []rune(name)
+	for i := 0; i < len(runes); i++ {
+		switch {
+		case runes[i] == '.' || runes[i] == ';':
+			segments--
+		case i > 0 && isDigit(runes[i]) != isDigit(runes[i-1]) && runes[i-1] != '.' && runes[i-1] != ';':
+			segments--
+		default:
+			continue
+		}
+		if segments == 0 {
+			return string(runes[:i])
+		}
+	}
+	return name
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
@@ -0,0 +1,129 @@
+// Package query describes expression language over current metric values.
+package query
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+var ErrSyntax = errors.New("syntax error")
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenName
+	tokenOperator
+	tokenLeftParen
+	tokenRightParen
+	tokenComma
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+// isNameRune defines characters allowed in unquoted metric names and glob patterns.
+func isNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.:*?;=", r)
+}
+
+// ambiguousStar returns index of `*` in unquoted name which can be read as multiplication,
+// i.e. it's followed by a letter or digit, e.g. `a*b`. -1 is returned when there is no such `*`.
+// Leading `*` is always a glob, the lexer reads it as multiplication after an operand.
+func ambiguousStar(name []rune) int {
+	for i := 1; i+1 < len(name); i++ {
+		if name[i] == '*' && (unicode.IsLetter(name[i+1]) || unicode.IsDigit(name[i+1])) {
+			return i
+		}
+	}
+	return -1
+}
+
+// expectsOperand reports whether the next token can't be an operator,
+// so `*` there starts a glob pattern, e.g. `sum(*)`.
+func expectsOperand(tokens []token) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+	switch tokens[len(tokens)-1].kind {
+	case tokenOperator, tokenLeftParen, tokenComma:
+		return true
+	}
+	return false
+}
+
+// lex splits expression into tokens. Metric names with other characters can be quoted with double quotes.
+// Unquoted names can't contain `*` followed by a letter or digit, it's ambiguous with multiplication:
+// `a * b` is multiplication, `"a*b"` is a glob pattern.
+func lex(input string) ([]token, error) {
+	var tokens []token
+	runes := []rune(input)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenLeftParen, value: "(", pos: i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenRightParen, value: ")", pos: i})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{kind: tokenComma, value: ",", pos: i})
+			i++
+		case strings.ContainsRune("+-*/", r) && !(r == '*' && expectsOperand(tokens)):
+			tokens = append(tokens, token{kind: tokenOperator, value: string(r), pos: i})
+			i++
+		case r == '"':
+			start := i
+			i++
+			var b strings.Builder
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				b.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("%w: unclosed quote at %d", ErrSyntax, start)
+			}
+			i++
+			tokens = append(tokens, token{kind: tokenName, value: b.String(), pos: start})
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			if i < len(runes) && (runes[i] == 'e' || runes[i] == 'E') {
+				i++
+				if i < len(runes) && (runes[i] == '+' || runes[i] == '-') {
+					i++
+				}
+				for i < len(runes) && unicode.IsDigit(runes[i]) {
+					i++
+				}
+			}
+			tokens = append(tokens, token{kind: tokenNumber, value: string(runes[start:i]), pos: start})
+		case isNameRune(r):
+			start := i
+			for i < len(runes) && isNameRune(runes[i]) {
+				i++
+			}
+			if star := ambiguousStar(runes[start:i]); star >= 0 {
+				return nil, fmt.Errorf("%w: ambiguous %q at %d, separate multiplication by spaces or quote the pattern",
+					ErrSyntax, string(runes[start:i]), start+star)
+			}
+			tokens = append(tokens, token{kind: tokenName, value: string(runes[start:i]), pos: start})
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, r, i)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(runes)}), nil
+}
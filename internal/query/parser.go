@@ -0,0 +1,215 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Node is a parsed expression.
+type Node interface {
+	String() string
+}
+
+// NumberLiteral is a scalar constant.
+type NumberLiteral struct {
+	Value float64
+}
+
+func (n *NumberLiteral) String() string {
+	return strconv.FormatFloat(n.Value, 'g', -1, 64)
+}
+
+// Selector selects series by exact name or glob pattern.
+type Selector struct {
+	Pattern string
+}
+
+func (s *Selector) String() string {
+	if strings.IndexFunc(s.Pattern, func(r rune) bool { return !isNameRune(r) }) >= 0 || ambiguousStar([]rune(s.Pattern)) >= 0 {
+		return strconv.Quote(s.Pattern)
+	}
+	return s.Pattern
+}
+
+// IsGlob reports whether selector can match several series.
+func (s *Selector) IsGlob() bool {
+	return strings.ContainsAny(s.Pattern, "*?[")
+}
+
+// UnaryExpr is a negation.
+type UnaryExpr struct {
+	Expr Node
+}
+
+func (u *UnaryExpr) String() string {
+	return "-" + u.Expr.String()
+}
+
+// BinaryExpr is an arithmetic operation.
+type BinaryExpr struct {
+	Op    string
+	Left  Node
+	Right Node
+}
+
+func (b *BinaryExpr) String() string {
+	return "(" + b.Left.String() + " " + b.Op + " " + b.Right.String() + ")"
+}
+
+// Call is a function call.
+type Call struct {
+	Func string
+	Args []Node
+}
+
+func (c *Call) String() string {
+	args := make([]string, 0, len(c.Args))
+	for _, arg := range c.Args {
+		args = append(args, arg.String())
+	}
+	return c.Func + "(" + strings.Join(args, ", ") + ")"
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Parse parses expression and validates function calls.
+//
+// Grammar:
+//
+//	expr    = term { ("+" | "-") term }
+//	term    = unary { ("*" | "/") unary }
+//	unary   = "-" unary | primary
+//	primary = number | name | name "(" [ expr { "," expr } ] ")" | "(" expr ")"
+//
+// Names may contain glob characters (`*`, `?`), so multiplication after a name should be separated by spaces,
+// unquoted `*` followed by a letter or digit is rejected as ambiguous.
+func Parse(input string) (Node, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	node, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, tok.value, tok.pos)
+	}
+	return node, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) parseExpr() (Node, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok.kind == tokenOperator && (tok.value == "+" || tok.value == "-"); tok = p.peek() {
+		p.next()
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: tok.value, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseTerm() (Node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok.kind == tokenOperator && (tok.value == "*" || tok.value == "/"); tok = p.peek() {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &BinaryExpr{Op: tok.value, Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (Node, error) {
+	if tok := p.peek(); tok.kind == tokenOperator && tok.value == "-" {
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &UnaryExpr{Expr: expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Node, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokenNumber:
+		value, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid number %q at %d", ErrSyntax, tok.value, tok.pos)
+		}
+		return &NumberLiteral{Value: value}, nil
+	case tokenLeftParen:
+		expr, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenRightParen {
+			return nil, fmt.Errorf("%w: expected ) at %d", ErrSyntax, closing.pos)
+		}
+		return expr, nil
+	case tokenName:
+		if p.peek().kind == tokenLeftParen {
+			return p.parseCall(tok)
+		}
+		return &Selector{Pattern: tok.value}, nil
+	case tokenEOF:
+		return nil, fmt.Errorf("%w: unexpected end of expression", ErrSyntax)
+	default:
+		return nil, fmt.Errorf("%w: unexpected %q at %d", ErrSyntax, tok.value, tok.pos)
+	}
+}
+
+func (p *parser) parseCall(name token) (Node, error) {
+	p.next() // (
+	call := &Call{Func: name.value}
+	if p.peek().kind != tokenRightParen {
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			call.Args = append(call.Args, arg)
+			if p.peek().kind != tokenComma {
+				break
+			}
+			p.next()
+		}
+	}
+	if closing := p.next(); closing.kind != tokenRightParen {
+		return nil, fmt.Errorf("%w: expected ) at %d", ErrSyntax, closing.pos)
+	}
+	if err := checkCall(call); err != nil {
+		return nil, fmt.Errorf("%w: %v at %d", ErrSyntax, err, name.pos)
+	}
+	return call, nil
+}
@@ -0,0 +1,145 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{name: "precedence", input: "1 - FreeMemory/TotalMemory", want: "(1 - (FreeMemory / TotalMemory))"},
+		{name: "parens", input: "(a + b) * 2", want: "((a + b) * 2)"},
+		{name: "unary", input: "-a - -2", want: "(-a - -2)"},
+		{name: "glob call", input: "sum(CPUutilization*)", want: "sum(CPUutilization*)"},
+		{name: "quoted name", input: `"disk used" / 1e3`, want: `("disk used" / 1000)`},
+		{name: "labeled name", input: "scrape_up;target=node", want: "scrape_up;target=node"},
+		{name: "unknown function", input: "median(a)", wantErr: true},
+		{name: "grouping", input: "avg(cpu.*, 2)", want: "avg(cpu.*, 2)"},
+		{name: "topk", input: "topk(3, a*)", want: "topk(3, a*)"},
+		{name: "spaced multiplication", input: "a * b", want: "(a * b)"},
+		{name: "ambiguous star", input: "a*b", wantErr: true},
+		{name: "ambiguous star before number", input: "CPUutilization*2", wantErr: true},
+		{name: "quoted glob", input: `sum("cpu*load")`, want: `sum("cpu*load")`},
+		{name: "glob segments", input: "sum(cpu.*.load, 1)", want: "sum(cpu.*.load, 1)"},
+		{name: "leading star", input: "sum(*load)", want: "sum(*load)"},
+		{name: "wrong arguments count", input: "sum(a, 1, 2)", wantErr: true},
+		{name: "non literal segments", input: "sum(a, b)", wantErr: true},
+		{name: "fractional topk count", input: "topk(1.5, a)", wantErr: true},
+		{name: "unclosed paren", input: "(a + b", wantErr: true},
+		{name: "unclosed quote", input: `"a`, wantErr: true},
+		{name: "trailing operator", input: "a +", wantErr: true},
+		{name: "trailing token", input: "a b", wantErr: true},
+		{name: "empty", input: "", wantErr: true},
+		{name: "bad rune", input: "a % b", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.input)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrSyntax)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.String())
+		})
+	}
+}
+
+func TestEval(t *testing.T) {
+	snapshot := NewSnapshot([]metrics.Metric{
+		metrics.NewGauge("FreeMemory", 25),
+		metrics.NewGauge("TotalMemory", 100),
+		metrics.NewGauge("CPUutilization1", 10),
+		metrics.NewGauge("CPUutilization2", 30),
+		metrics.NewCounter("PollCount", 7),
+		metrics.NewGauge("cpu.0.user", 5),
+		metrics.NewGauge("cpu.0.system", 1),
+		metrics.NewGauge("cpu.1.user", 3),
+		metrics.NewCounter("TotalMemory", 1),
+	})
+	tests := []struct {
+		name  string
+		input string
+		want  Vector
+	}{
+		{name: "ratio", input: "1 - FreeMemory / TotalMemory", want: Vector{{Name: "FreeMemory", Value: 0.75}}},
+		{name: "scalar", input: "2 * (3 + 1)", want: Vector{{Value: 8}}},
+		{name: "counter", input: "PollCount", want: Vector{{Name: "PollCount", Value: 7}}},
+		{name: "glob", input: "CPUutilization* / 10", want: Vector{
+			{Name: "CPUutilization1", Value: 1},
+			{Name: "CPUutilization2", Value: 3},
+		}},
+		{name: "match by name", input: "CPUutilization* + CPUutilization*", want: Vector{
+			{Name: "CPUutilization1", Value: 20},
+			{Name: "CPUutilization2", Value: 60},
+		}},
+		{name: "sum", input: "sum(CPUutilization*)", want: Vector{{Value: 40}}},
+		{name: "avg", input: "avg(CPUutilization*)", want: Vector{{Value: 20}}},
+		{name: "min", input: "min(CPUutilization*)", want: Vector{{Value: 10}}},
+		{name: "max", input: "max(CPUutilization*)", want: Vector{{Value: 30}}},
+		{name: "count", input: "count(CPUutilization*)", want: Vector{{Value: 2}}},
+		{name: "group by first segment", input: "sum(*, 1)", want: Vector{
+			{Name: "CPUutilization", Value: 40},
+			{Name: "FreeMemory", Value: 25},
+			{Name: "PollCount", Value: 7},
+			{Name: "TotalMemory", Value: 100},
+			{Name: "cpu", Value: 9},
+		}},
+		{name: "group by two segments", input: "max(cpu.*, 2)", want: Vector{
+			{Name: "cpu.0", Value: 5},
+			{Name: "cpu.1", Value: 3},
+		}},
+		{name: "topk", input: "topk(2, cpu.*)", want: Vector{
+			{Name: "cpu.0.user", Value: 5},
+			{Name: "cpu.1.user", Value: 3},
+		}},
+		{name: "topk more than exists", input: "topk(5, CPUutilization*)", want: Vector{
+			{Name: "CPUutilization2", Value: 30},
+			{Name: "CPUutilization1", Value: 10},
+		}},
+		{name: "missing", input: "Unknown + 1", want: Vector{}},
+		{name: "aggregate missing", input: "sum(Unknown*)", want: Vector{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := Parse(tt.input)
+			require.NoError(t, err)
+			got, err := Eval(node, snapshot)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	node, err := Parse("sum(1)")
+	require.NoError(t, err)
+	_, err = Eval(node, snapshot)
+	assert.ErrorIs(t, err, ErrEval)
+}
+
+func TestGroupName(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments int
+		want     string
+	}{
+		{name: "CPUutilization1", segments: 1, want: "CPUutilization"},
+		{name: "cpu.0.user", segments: 1, want: "cpu"},
+		{name: "cpu.0.user", segments: 2, want: "cpu.0"},
+		{name: "cpu.0.user", segments: 5, want: "cpu.0.user"},
+		{name: "scrape_up;target=node", segments: 1, want: "scrape_up"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, GroupName(tt.name, tt.segments))
+		})
+	}
+}
@@ -0,0 +1,204 @@
+// Package quota limits updates of every client: requests rate and metrics rate,
+// so a runaway agent can't flood the repository. Series created by client are limited by cardinality index.
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/auth"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+)
+
+// Limit names of LimitError.
+const (
+	RequestsLimit = "requests per second"
+	MetricsLimit  = "metrics per minute"
+	SeriesLimit   = "created series"
+)
+
+// idleTimeout is the time after which rate state of inactive client is forgotten.
+const idleTimeout = 10 * time.Minute
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// LimitError describes exceeded limit, RetryAfter is zero when waiting doesn't help.
+type LimitError struct {
+	Client     string
+	Limit      string
+	RetryAfter time.Duration
+}
+
+func (e *LimitError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("%v: %v of %v, retry after %v", ErrQuotaExceeded, e.Limit, e.Client, e.RetryAfter)
+	}
+	return fmt.Sprintf("%v: %v of %v", ErrQuotaExceeded, e.Limit, e.Client)
+}
+
+func (e *LimitError) Unwrap() error {
+	return ErrQuotaExceeded
+}
+
+type clientKey struct{}
+
+// WithClient returns context of request sent by client.
+func WithClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// ClientFromContext returns client of request, it's empty for internal sources (StatsD, scrape, etc.).
+func ClientFromContext(ctx context.Context) string {
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
+
+// ClientIdentity returns identity of request sender: the API token name of authorized request, the IP otherwise.
+// Hash key ID identifies client once metrics signed by the key are verified, see KeyIdentity.
+func ClientIdentity(ctx context.Context, ip net.IP) string {
+	if token, ok := auth.FromContext(ctx); ok {
+		return "token:" + token.Name
+	}
+	if ip == nil {
+		return "ip:unknown"
+	}
+	return "ip:" + ip.String()
+}
+
+// KeyIdentity returns identity of client sending metrics signed by hash key of keyID,
+// it replaces IP identity as key is more specific, token identity is kept.
+func KeyIdentity(client, keyID string) string {
+	if keyID == "" || strings.HasPrefix(client, "token:") {
+		return client
+	}
+	return "key:" + keyID
+}
+
+type client struct {
+	requests *rate.Limiter
+	metrics  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Limiter keeps limits state of clients, nil Limiter doesn't limit anything.
+type Limiter struct {
+	sync.Mutex
+	cfg     configs.QuotaConfig
+	clients map[string]*client
+	now     func() time.Time
+}
+
+// NewLimiter creates Limiter of configured rate limits, nil is returned when no rate is limited.
+func NewLimiter(cfg configs.QuotaConfig) *Limiter {
+	if cfg.RequestsPerSecond <= 0 && cfg.MetricsPerMinute <= 0 {
+		return nil
+	}
+	return &Limiter{cfg: cfg, clients: map[string]*client{}, now: time.Now}
+}
+
+// Start runs periodic removal of inactive clients rate state.
+func (l *Limiter) Start(ctx context.Context, pool *utils.TickerPool) {
+	if l == nil {
+		return
+	}
+	pool.AddTask(ctx, "quota cleanup", func(ctx context.Context) {
+		l.Purge()
+	}, idleTimeout)
+}
+
+// Purge forgets inactive clients, their limiters are full again after idleTimeout anyway.
+func (l *Limiter) Purge() {
+	now := l.now()
+	l.Lock()
+	defer l.Unlock()
+	for id, c := range l.clients {
+		if now.Sub(c.lastSeen) > idleTimeout {
+			delete(l.clients, id)
+		}
+	}
+}
+
+// getClient returns state of client, caller holds the lock.
+func (l *Limiter) getClient(id string, now time.Time) *client {
+	c, ok := l.clients[id]
+	if !ok {
+		c = &client{}
+		if l.cfg.RequestsPerSecond > 0 {
+			burst := l.cfg.RequestsBurst
+			if burst <= 0 {
+				burst = int(l.cfg.RequestsPerSecond) + 1
+			}
+			c.requests = rate.NewLimiter(rate.Limit(l.cfg.RequestsPerSecond), burst)
+		}
+		if l.cfg.MetricsPerMinute > 0 {
+			c.metrics = rate.NewLimiter(rate.Every(time.Minute/time.Duration(l.cfg.MetricsPerMinute)), l.cfg.MetricsPerMinute)
+		}
+		l.clients[id] = c
+	}
+	c.lastSeen = now
+	return c
+}
+
+// AllowRequest counts request of client.
+func (l *Limiter) AllowRequest(id string) error {
+	if l == nil || id == "" || l.cfg.RequestsPerSecond <= 0 {
+		return nil
+	}
+	now := l.now()
+	l.Lock()
+	defer l.Unlock()
+	_, err := reserve(l.getClient(id, now).requests, now, 1, id, RequestsLimit)
+	return err
+}
+
+// Reservation is metrics counted by AllowMetrics, it's cancelled when update fails.
+type Reservation struct {
+	reservation *rate.Reservation
+	at          time.Time
+}
+
+// Cancel returns counted metrics to client limit.
+// Reservation is cancelled at the time it's made, rate.Reservation isn't cancelled when its time is passed.
+func (r Reservation) Cancel() {
+	if r.reservation != nil {
+		r.reservation.CancelAt(r.at)
+	}
+}
+
+// AllowMetrics counts n metrics of client update, returned reservation is cancelled when the update fails.
+// Metrics aren't counted when update is rejected.
+func (l *Limiter) AllowMetrics(id string, n int) (Reservation, error) {
+	if l == nil || id == "" || l.cfg.MetricsPerMinute <= 0 {
+		return Reservation{}, nil
+	}
+	now := l.now()
+	l.Lock()
+	defer l.Unlock()
+	r, err := reserve(l.getClient(id, now).metrics, now, n, id, MetricsLimit)
+	if err != nil {
+		return Reservation{}, err
+	}
+	return Reservation{reservation: r, at: now}, nil
+}
+
+// reserve takes n tokens of limiter, error tells when they're available.
+// Rejected update doesn't reserve tokens, so cancellation of the earlier reservations isn't affected.
+func reserve(limiter *rate.Limiter, now time.Time, n int, id, limit string) (*rate.Reservation, error) {
+	if n > limiter.Burst() {
+		// n exceeds burst, it's never allowed
+		return nil, &LimitError{Client: id, Limit: limit}
+	}
+	if tokens := limiter.TokensAt(now); tokens < float64(n) {
+		seconds := (float64(n) - tokens) / float64(limiter.Limit())
+		return nil, &LimitError{Client: id, Limit: limit, RetryAfter: time.Duration(seconds * float64(time.Second))}
+	}
+	return limiter.ReserveN(now, n), nil
+}
@@ -0,0 +1,112 @@
+package quota
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/auth"
+)
+
+func newTestLimiter(cfg configs.QuotaConfig) (*Limiter, *time.Time) {
+	now := time.Unix(1700000000, 0)
+	l := NewLimiter(cfg)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestLimiter_AllowRequest(t *testing.T) {
+	l, now := newTestLimiter(configs.QuotaConfig{RequestsPerSecond: 2, RequestsBurst: 2})
+
+	require.NoError(t, l.AllowRequest("ip:10.0.0.1"))
+	require.NoError(t, l.AllowRequest("ip:10.0.0.1"))
+	err := l.AllowRequest("ip:10.0.0.1")
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	var limitErr *LimitError
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, RequestsLimit, limitErr.Limit)
+	assert.Equal(t, 500*time.Millisecond, limitErr.RetryAfter)
+
+	assert.NoError(t, l.AllowRequest("ip:10.0.0.2"), "clients are limited separately")
+	assert.NoError(t, l.AllowRequest(""), "internal sources aren't limited")
+
+	*now = now.Add(limitErr.RetryAfter)
+	assert.NoError(t, l.AllowRequest("ip:10.0.0.1"), "retry after hint")
+}
+
+func TestLimiter_AllowMetrics(t *testing.T) {
+	l, now := newTestLimiter(configs.QuotaConfig{MetricsPerMinute: 4})
+
+	_, err := l.AllowMetrics("token:agent", 3)
+	require.NoError(t, err)
+	_, err = l.AllowMetrics("token:agent", 2)
+	var limitErr *LimitError
+	require.ErrorAs(t, err, &limitErr)
+	assert.Equal(t, MetricsLimit, limitErr.Limit)
+	assert.Equal(t, 15*time.Second, limitErr.RetryAfter)
+	_, err = l.AllowMetrics("token:agent", 1)
+	require.NoError(t, err, "rejected batch isn't counted")
+
+	_, err = l.AllowMetrics("token:agent", 5)
+	require.ErrorAs(t, err, &limitErr)
+	assert.Zero(t, limitErr.RetryAfter, "batch exceeding limit is never allowed")
+
+	*now = now.Add(time.Minute)
+	_, err = l.AllowMetrics("token:agent", 4)
+	assert.NoError(t, err)
+}
+
+func TestReservation_Cancel(t *testing.T) {
+	l, now := newTestLimiter(configs.QuotaConfig{MetricsPerMinute: 4})
+
+	reservation, err := l.AllowMetrics("token:agent", 4)
+	require.NoError(t, err)
+	*now = now.Add(time.Millisecond)
+	_, err = l.AllowMetrics("token:agent", 1)
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+
+	*now = now.Add(time.Millisecond)
+	reservation.Cancel()
+	_, err = l.AllowMetrics("token:agent", 4)
+	assert.NoError(t, err, "metrics of failed update aren't counted")
+}
+
+func TestLimiter_Purge(t *testing.T) {
+	l, now := newTestLimiter(configs.QuotaConfig{RequestsPerSecond: 1})
+
+	require.NoError(t, l.AllowRequest("ip:10.0.0.1"))
+	*now = now.Add(idleTimeout / 2)
+	require.NoError(t, l.AllowRequest("ip:10.0.0.2"))
+	*now = now.Add(idleTimeout)
+	l.Purge()
+	assert.Len(t, l.clients, 1, "idle client is forgotten")
+	assert.Contains(t, l.clients, "ip:10.0.0.2")
+}
+
+func TestDisabledLimiter(t *testing.T) {
+	l := NewLimiter(configs.QuotaConfig{MaxSeries: 10})
+	assert.Nil(t, l, "series are limited by cardinality index")
+	assert.NoError(t, l.AllowRequest("ip:10.0.0.1"))
+	reservation, err := l.AllowMetrics("ip:10.0.0.1", 1)
+	assert.NoError(t, err)
+	reservation.Cancel()
+}
+
+func TestKeyIdentity(t *testing.T) {
+	assert.Equal(t, "key:edge", KeyIdentity("ip:10.0.0.1", "edge"))
+	assert.Equal(t, "ip:10.0.0.1", KeyIdentity("ip:10.0.0.1", ""), "default key doesn't identify client")
+	assert.Equal(t, "token:edge", KeyIdentity("token:edge", "agent"), "token identifies client")
+}
+
+func TestClientIdentity(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	assert.Equal(t, "ip:2001:db8::1", ClientIdentity(context.Background(), ip))
+	assert.Equal(t, "ip:unknown", ClientIdentity(context.Background(), nil))
+	ctx := auth.WithToken(context.Background(), auth.Token{Name: "edge"})
+	assert.Equal(t, "token:edge", ClientIdentity(ctx, ip))
+}
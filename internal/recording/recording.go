@@ -0,0 +1,129 @@
+// Package recording evaluates recording rules and stores their results as gauges.
+package recording
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/query"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+)
+
+var ErrInvalidRule = errors.New("invalid recording rule")
+
+// Rule is a validated recording rule.
+type Rule struct {
+	Name string
+	Expr query.Node
+}
+
+// Recorder periodically evaluates rules in config order,
+// so a rule can use results of the previous ones.
+// Results are saved through controller.Controller, so they're observed and aren't saved by read-only replica.
+type Recorder struct {
+	control  *controller.Controller
+	interval time.Duration
+	rules    []Rule
+}
+
+// NewRecorder creates Recorder, returns error on invalid rules.
+func NewRecorder(cfg configs.RecordingConfig, control *controller.Controller) (*Recorder, error) {
+	r := &Recorder{control: control, interval: cfg.Interval}
+	names := map[string]struct{}{}
+	for _, ruleCfg := range cfg.Rules {
+		rule, err := ParseRule(ruleCfg.Name, ruleCfg.Expr)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := names[rule.Name]; ok {
+			return nil, fmt.Errorf("%w: duplicate name %v", ErrInvalidRule, rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// ParseRule validates rule name and parses its expression.
+func ParseRule(name, expr string) (Rule, error) {
+	if err := metrics.CheckName(name); err != nil {
+		return Rule{}, fmt.Errorf("%w: %v", ErrInvalidRule, err)
+	}
+	if (&query.Selector{Pattern: name}).IsGlob() {
+		return Rule{}, fmt.Errorf("%w: name %v is a pattern", ErrInvalidRule, name)
+	}
+	node, err := query.Parse(expr)
+	if err != nil {
+		return Rule{}, fmt.Errorf("%w %v: %v", ErrInvalidRule, name, err)
+	}
+	return Rule{Name: name, Expr: node}, nil
+}
+
+// Start adds evaluation task to pool, nothing is started without rules.
+func (r *Recorder) Start(ctx context.Context, pool *utils.TickerPool) {
+	if len(r.rules) == 0 {
+		return
+	}
+	pool.AddTask(ctx, "EvaluateRecordingRules", r.Evaluate, r.interval)
+}
+
+// Evaluate calculates all rules once and saves results with one UpdateMetrics call.
+// Rules without data or with non-finite result are skipped.
+func (r *Recorder) Evaluate(ctx context.Context) {
+	list, err := r.control.GetAll(ctx)
+	if err != nil {
+		log.Error("recording rules: can't get metrics: ", err)
+		return
+	}
+	snapshot := query.NewSnapshot(list)
+
+	slice := make(metrics.ParamsSlice, 0, len(r.rules))
+	for _, rule := range r.rules {
+		value, ok, err := evaluate(rule, snapshot)
+		if err != nil {
+			log.Errorf("recording rule %v evaluation failed: %v", rule.Name, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		snapshot[rule.Name] = value
+		slice = append(slice, metrics.NewGauge(rule.Name, value).ToParams())
+	}
+
+	if len(slice) == 0 {
+		return
+	}
+	_, err = r.control.UpdateMetrics(controller.WithTrustedSource(ctx), slice)
+	switch {
+	case errors.Is(err, controller.ErrReadOnly):
+		log.Debug("recording rules: results aren't saved by read-only replica")
+	case err != nil:
+		log.Error("recording rules: can't save gauges: ", err)
+	}
+}
+
+// evaluate returns single value of rule expression, false is returned when there is no data.
+func evaluate(rule Rule, snapshot query.Snapshot) (float64, bool, error) {
+	vector, err := query.Eval(rule.Expr, snapshot)
+	if err != nil {
+		return 0, false, err
+	}
+	switch len(vector) {
+	case 0:
+		return 0, false, nil
+	case 1:
+		value := vector[0].Value
+		return value, !math.IsNaN(value) && !math.IsInf(value, 0), nil
+	default:
+		return 0, false, fmt.Errorf("expected single value, got %d series", len(vector))
+	}
+}
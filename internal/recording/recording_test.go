@@ -0,0 +1,98 @@
+package recording
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+)
+
+func TestNewRecorder(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []configs.RecordingRule
+		wantErr bool
+	}{
+		{name: "good", rules: []configs.RecordingRule{{Name: "Ratio", Expr: "1 - FreeMemory / TotalMemory"}}},
+		{name: "empty name", rules: []configs.RecordingRule{{Name: "", Expr: "FreeMemory"}}, wantErr: true},
+		{name: "pattern name", rules: []configs.RecordingRule{{Name: "Ratio*", Expr: "FreeMemory"}}, wantErr: true},
+		{name: "syntax error", rules: []configs.RecordingRule{{Name: "Ratio", Expr: "1 -"}}, wantErr: true},
+		{name: "duplicate", rules: []configs.RecordingRule{{Name: "A", Expr: "1"}, {Name: "A", Expr: "2"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRecorder(configs.RecordingConfig{Rules: tt.rules}, controller.NewController(storage.NewRAMRepository(), ""))
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidRule)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+type testObserver struct {
+	names []string
+}
+
+func (o *testObserver) Observe(metric metrics.Metric, _ int64) {
+	o.names = append(o.names, metric.GetName())
+}
+
+func TestRecorder_Evaluate(t *testing.T) {
+	var observer testObserver
+	ctx := context.Background()
+	repository := storage.NewRAMRepository()
+	_, err := repository.SetGauge(ctx, "FreeMemory", 25)
+	require.NoError(t, err)
+	_, err = repository.SetGauge(ctx, "TotalMemory", 100)
+	require.NoError(t, err)
+	_, err = repository.SetGauge(ctx, "CPUutilization1", 10)
+	require.NoError(t, err)
+	_, err = repository.SetGauge(ctx, "CPUutilization2", 30)
+	require.NoError(t, err)
+
+	recorder, err := NewRecorder(configs.RecordingConfig{Rules: []configs.RecordingRule{
+		{Name: "MemoryUsedRatio", Expr: "1 - FreeMemory / TotalMemory"},
+		{Name: "CPUTotal", Expr: "sum(CPUutilization*)"},
+		{Name: "CPUTotalPercent", Expr: "CPUTotal / 100"},
+		{Name: "NoData", Expr: "Unknown * 2"},
+		{Name: "DivByZero", Expr: "FreeMemory / 0"},
+		{Name: "Ambiguous", Expr: "CPUutilization*"},
+	}}, controller.NewController(repository, "", controller.WithObserver(&observer)))
+	require.NoError(t, err)
+
+	recorder.Evaluate(ctx)
+	assert.ElementsMatch(t, []string{"MemoryUsedRatio", "CPUTotal", "CPUTotalPercent"}, observer.names)
+
+	expected := map[string]float64{"MemoryUsedRatio": 0.75, "CPUTotal": 40, "CPUTotalPercent": 0.4}
+	for name, value := range expected {
+		gauge, err := repository.GetGauge(ctx, name)
+		require.NoError(t, err, name)
+		assert.Equal(t, value, gauge.Value(), name)
+	}
+	for _, name := range []string{"NoData", "DivByZero", "Ambiguous"} {
+		_, err = repository.GetGauge(ctx, name)
+		assert.ErrorIs(t, err, storage.ErrNotFound, name)
+	}
+}
+
+func TestRecorder_EvaluateReadOnly(t *testing.T) {
+	ctx := context.Background()
+	repository := storage.NewRAMRepository()
+	_, err := repository.SetGauge(ctx, "FreeMemory", 25)
+	require.NoError(t, err)
+	control := controller.NewController(repository, "", controller.WithReadOnly(func() bool { return true }))
+	recorder, err := NewRecorder(configs.RecordingConfig{Rules: []configs.RecordingRule{{Name: "FreeMemoryMB", Expr: "FreeMemory / 1024"}}}, control)
+	require.NoError(t, err)
+
+	recorder.Evaluate(ctx)
+	_, err = repository.GetGauge(ctx, "FreeMemoryMB")
+	assert.ErrorIs(t, err, storage.ErrNotFound, "replica doesn't record")
+}
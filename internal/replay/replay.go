@@ -0,0 +1,201 @@
+// Package replay protects signed updates from being replayed by signed timestamp and nonce.
+package replay
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+)
+
+// HTTP headers of signed request envelope.
+const (
+	TimestampHeader = "X-Timestamp"
+	NonceHeader     = "X-Nonce"
+	KeyIDHeader     = "X-Key-ID"
+	SignatureHeader = "X-Signature"
+)
+
+var (
+	ErrStale           = errors.New("timestamp is out of freshness window")
+	ErrReplayed        = errors.New("nonce is already used")
+	ErrMissingEnvelope = errors.New("timestamp and nonce required")
+)
+
+// MetricHash returns hash of metric signed along with timestamp and nonce,
+// it's the plain metric hash when they're not set.
+func MetricHash(metric metrics.Metric, secret []byte, timestamp int64, nonce string) string {
+	hash := metric.Hash(secret)
+	if timestamp == 0 && nonce == "" {
+		return hash
+	}
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(fmt.Sprintf("%s:%d:%s", hash, timestamp, nonce)))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// BodySignature returns signature of request body sent with timestamp and nonce.
+func BodySignature(secret []byte, timestamp int64, nonce string, body []byte) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(strconv.FormatInt(timestamp, 10) + ":" + nonce + ":"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// NewNonce returns random nonce.
+func NewNonce() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+type verifiedKey struct{}
+
+// WithVerifiedBatch marks context of request which body signature is verified,
+// hashes of its metrics aren't checked. Nonce of the body is used along with its metrics, nil nonce isn't checked.
+func WithVerifiedBatch(ctx context.Context, nonce *Nonce) context.Context {
+	return context.WithValue(ctx, verifiedKey{}, nonce)
+}
+
+// IsVerifiedBatch reports if body signature of request is verified.
+func IsVerifiedBatch(ctx context.Context) bool {
+	_, verified := ctx.Value(verifiedKey{}).(*Nonce)
+	return verified
+}
+
+// BatchNonce returns nonce of verified request body.
+func BatchNonce(ctx context.Context) (Nonce, bool) {
+	nonce, _ := ctx.Value(verifiedKey{}).(*Nonce)
+	if nonce == nil {
+		return Nonce{}, false
+	}
+	return *nonce, true
+}
+
+// Nonce is nonce of signed update, Scope separates nonces of metrics and request body signed together.
+type Nonce struct {
+	Timestamp int64
+	Value     string
+	Scope     string
+}
+
+// Guard accepts timestamps within freshness window and remembers nonces until their timestamps get stale,
+// so every nonce is accepted once. Nonces are remembered after signature check and admission of update,
+// so only key owners fill the cache and rejected updates can be retried. Nil Guard doesn't protect anything.
+type Guard struct {
+	sync.Mutex
+	window   time.Duration
+	required bool
+	nonces   map[string]time.Time
+	now      func() time.Time
+}
+
+// NewGuard creates Guard of configured window, nil is returned when window isn't positive.
+func NewGuard(cfg configs.ReplayConfig) *Guard {
+	if cfg.Window <= 0 {
+		return nil
+	}
+	return &Guard{
+		window:   cfg.Window,
+		required: cfg.Required,
+		nonces:   map[string]time.Time{},
+		now:      time.Now,
+	}
+}
+
+// Start runs periodic removal of stale nonces.
+func (g *Guard) Start(ctx context.Context, pool *utils.TickerPool) {
+	if g == nil {
+		return
+	}
+	pool.AddTask(ctx, "replay nonces cleanup", func(ctx context.Context) {
+		g.Purge()
+	}, g.window)
+}
+
+// Required reports if signed updates must have timestamp and nonce.
+func (g *Guard) Required() bool {
+	return g != nil && g.required
+}
+
+// Check accepts fresh timestamp in unix seconds and nonce not used before in scope.
+func (g *Guard) Check(timestamp int64, nonce, scope string) error {
+	return g.Use(Nonce{Timestamp: timestamp, Value: nonce, Scope: scope})
+}
+
+// Validate checks that nonce is set and its timestamp is fresh, the nonce isn't remembered.
+func (g *Guard) Validate(n Nonce) error {
+	if g == nil {
+		return nil
+	}
+	if n.Timestamp == 0 || n.Value == "" {
+		return ErrMissingEnvelope
+	}
+	now := g.now()
+	signedAt := time.Unix(n.Timestamp, 0)
+	if signedAt.Before(now.Add(-g.window)) || signedAt.After(now.Add(g.window)) {
+		return fmt.Errorf("%w: %v", ErrStale, signedAt.UTC())
+	}
+	return nil
+}
+
+// Use accepts fresh nonces not used before in their scopes and remembers them,
+// nothing is remembered when any of nonces is rejected.
+func (g *Guard) Use(nonces ...Nonce) error {
+	if g == nil {
+		return nil
+	}
+	for _, n := range nonces {
+		if err := g.Validate(n); err != nil {
+			return err
+		}
+	}
+	g.Lock()
+	defer g.Unlock()
+	used := make(map[string]time.Time, len(nonces))
+	for _, n := range nonces {
+		key := n.key()
+		if _, ok := g.nonces[key]; ok {
+			return ErrReplayed
+		}
+		if _, ok := used[key]; ok {
+			return ErrReplayed
+		}
+		used[key] = time.Unix(n.Timestamp, 0).Add(g.window)
+	}
+	for key, expiry := range used {
+		g.nonces[key] = expiry
+	}
+	return nil
+}
+
+func (n Nonce) key() string {
+	return n.Scope + "|" + n.Value
+}
+
+// Purge forgets nonces of stale timestamps.
+func (g *Guard) Purge() {
+	if g == nil {
+		return
+	}
+	now := g.now()
+	g.Lock()
+	defer g.Unlock()
+	for key, expiry := range g.nonces {
+		if expiry.Before(now) {
+			delete(g.nonces, key)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package replay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+func TestGuard_Check(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	guard := NewGuard(configs.ReplayConfig{Window: time.Minute})
+	guard.now = func() time.Time { return now }
+
+	assert.NoError(t, guard.Check(now.Unix(), "n1", "counter:PollCount"))
+	assert.ErrorIs(t, guard.Check(now.Unix(), "n1", "counter:PollCount"), ErrReplayed)
+	assert.NoError(t, guard.Check(now.Unix(), "n1", "gauge:Alloc"), "nonce is shared by metrics of one batch")
+	assert.NoError(t, guard.Check(now.Add(30*time.Second).Unix(), "n2", "counter:PollCount"), "small clock skew")
+	assert.ErrorIs(t, guard.Check(now.Add(-2*time.Minute).Unix(), "n3", "counter:PollCount"), ErrStale)
+	assert.ErrorIs(t, guard.Check(now.Add(2*time.Minute).Unix(), "n4", "counter:PollCount"), ErrStale)
+	assert.ErrorIs(t, guard.Check(0, "n5", "counter:PollCount"), ErrMissingEnvelope)
+	assert.ErrorIs(t, guard.Check(now.Unix(), "", "counter:PollCount"), ErrMissingEnvelope)
+
+	// stale nonces are forgotten, their timestamps are rejected anyway
+	now = now.Add(3 * time.Minute)
+	guard.Purge()
+	assert.Empty(t, guard.nonces)
+	assert.ErrorIs(t, guard.Check(now.Add(-3*time.Minute).Unix(), "n1", "counter:PollCount"), ErrStale)
+}
+
+func TestGuard_Use(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	guard := NewGuard(configs.ReplayConfig{Window: time.Minute})
+	guard.now = func() time.Time { return now }
+
+	stale := Nonce{Timestamp: now.Add(-2 * time.Minute).Unix(), Value: "n0", Scope: "batch"}
+	require.ErrorIs(t, guard.Validate(stale), ErrStale)
+	batch := Nonce{Timestamp: now.Unix(), Value: "n1", Scope: "batch"}
+	require.NoError(t, guard.Validate(batch))
+	require.NoError(t, guard.Validate(batch), "validated nonce isn't remembered")
+
+	counter := Nonce{Timestamp: now.Unix(), Value: "n1", Scope: "counter:PollCount"}
+	assert.ErrorIs(t, guard.Use(batch, counter, counter), ErrReplayed, "nonce is used once in batch")
+	assert.ErrorIs(t, guard.Use(batch, stale), ErrStale)
+	require.NoError(t, guard.Use(batch, counter), "nonces of rejected updates aren't remembered")
+	assert.ErrorIs(t, guard.Use(counter), ErrReplayed)
+}
+
+func TestDisabledGuard(t *testing.T) {
+	guard := NewGuard(configs.ReplayConfig{Required: true})
+	assert.Nil(t, guard, "zero window disables replay protection")
+	assert.False(t, guard.Required())
+	assert.NoError(t, guard.Use(Nonce{}))
+	guard.Purge()
+}
+
+func TestMetricHash(t *testing.T) {
+	key := []byte("secret")
+	metric := metrics.NewCounter("PollCount", 1)
+
+	assert.Equal(t, metric.Hash(key), MetricHash(metric, key, 0, ""), "plain hash without envelope")
+	stamped := MetricHash(metric, key, 1700000000, "n1")
+	assert.NotEqual(t, metric.Hash(key), stamped)
+	assert.NotEqual(t, stamped, MetricHash(metric, key, 1700000001, "n1"))
+	assert.NotEqual(t, stamped, MetricHash(metric, key, 1700000000, "n2"))
+}
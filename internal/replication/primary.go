@@ -0,0 +1,212 @@
+// Package replication streams updates applied by primary server to its read-only replicas.
+package replication
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+	pb "github.com/unbeman/ya-prac-mcas/proto"
+)
+
+// Server roles.
+const (
+	PrimaryRole = "primary"
+	ReplicaRole = "replica"
+)
+
+// maxEventSize is max metrics count in one replication event.
+const maxEventSize = 1000
+
+// ErrNotReplica is returned on promotion of server which is already primary.
+var ErrNotReplica = errors.New("server is not a replica")
+
+// Status describes replication state of server.
+// Lag is the count of primary updates not applied yet,
+// Delay is the time between applying update on primary and on replica.
+type Status struct {
+	Role            string  `json:"role"`
+	Primary         string  `json:"primary,omitempty"`
+	Connected       bool    `json:"connected"`
+	Sequence        uint64  `json:"sequence"`
+	PrimarySequence uint64  `json:"primary_sequence,omitempty"`
+	Lag             uint64  `json:"lag"`
+	DelaySeconds    float64 `json:"delay_seconds"`
+	Replicas        int     `json:"replicas"`
+}
+
+type entry struct {
+	sequence uint64
+	time     time.Time
+	metric   *pb.Metric
+}
+
+type subscriber struct {
+	notify  chan struct{}
+	pending []entry
+	// resync is set when replica needs full snapshot.
+	resync bool
+}
+
+// Primary numbers saved metrics and streams them to subscribed replicas.
+// The last updates are kept in backlog, so reconnected replica continues from its sequence.
+// Replica which is too far behind, or connected to restarted primary, gets a full snapshot first.
+type Primary struct {
+	sync.Mutex
+	epoch       string
+	sequence    uint64
+	backlog     []entry
+	size        int
+	subscribers map[*subscriber]struct{}
+	repository  storage.Repository
+	now         func() time.Time
+}
+
+// NewPrimary creates Primary keeping size last updates, snapshots are read from repository.
+func NewPrimary(size int, repository storage.Repository) *Primary {
+	epoch := make([]byte, 8)
+	_, _ = rand.Read(epoch)
+	return &Primary{
+		epoch:       hex.EncodeToString(epoch),
+		size:        size,
+		subscribers: map[*subscriber]struct{}{},
+		repository:  repository,
+		now:         time.Now,
+	}
+}
+
+// Observe appends saved metric to replication stream, it implements controller.Observer.
+func (p *Primary) Observe(metric metrics.Metric, _ int64) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.sequence++
+	e := entry{sequence: p.sequence, time: p.now(), metric: metric.ToProto()}
+	p.backlog = append(p.backlog, e)
+	if len(p.backlog) > p.size {
+		p.backlog = p.backlog[len(p.backlog)-p.size:]
+	}
+
+	for s := range p.subscribers {
+		if s.resync {
+			continue
+		}
+		if len(s.pending) >= p.size {
+			s.pending = nil
+			s.resync = true
+		} else {
+			s.pending = append(s.pending, e)
+		}
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Status returns primary replication state.
+func (p *Primary) Status() Status {
+	p.Lock()
+	defer p.Unlock()
+	return Status{Role: PrimaryRole, Connected: true, Sequence: p.sequence, Replicas: len(p.subscribers)}
+}
+
+// Stream sends updates following sequence of epoch until ctx is done or send fails.
+func (p *Primary) Stream(ctx context.Context, epoch string, sequence uint64, send func(*pb.ReplicationEvent) error) error {
+	s := &subscriber{notify: make(chan struct{}, 1)}
+
+	p.Lock()
+	switch {
+	case epoch != p.epoch || sequence > p.sequence:
+		s.resync = true
+	case sequence < p.sequence:
+		if len(p.backlog) == 0 || p.backlog[0].sequence > sequence+1 {
+			s.resync = true
+		} else {
+			from := len(p.backlog) - int(p.sequence-sequence)
+			s.pending = append(s.pending, p.backlog[from:]...)
+		}
+	}
+	p.subscribers[s] = struct{}{}
+	p.Unlock()
+
+	defer func() {
+		p.Lock()
+		delete(p.subscribers, s)
+		p.Unlock()
+	}()
+
+	s.notify <- struct{}{}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-s.notify:
+		}
+
+		p.Lock()
+		pending, resync, head := s.pending, s.resync, p.sequence
+		s.pending, s.resync = nil, false
+		p.Unlock()
+
+		if resync {
+			// updates applied while snapshot is read are streamed after it
+			event, err := p.snapshot(ctx, head)
+			if err != nil {
+				return err
+			}
+			if err = send(event); err != nil {
+				return err
+			}
+		}
+		for len(pending) > 0 {
+			n := len(pending)
+			if n > maxEventSize {
+				n = maxEventSize
+			}
+			if err := send(p.event(pending[:n], head)); err != nil {
+				return err
+			}
+			pending = pending[n:]
+		}
+	}
+}
+
+func (p *Primary) snapshot(ctx context.Context, head uint64) (*pb.ReplicationEvent, error) {
+	list, err := p.repository.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+	event := &pb.ReplicationEvent{
+		Epoch:    p.epoch,
+		Sequence: head,
+		Head:     head,
+		Time:     p.now().UnixNano(),
+		Snapshot: true,
+		Metrics:  make([]*pb.Metric, 0, len(list)),
+	}
+	for _, metric := range list {
+		event.Metrics = append(event.Metrics, metric.ToProto())
+	}
+	return event, nil
+}
+
+func (p *Primary) event(entries []entry, head uint64) *pb.ReplicationEvent {
+	last := entries[len(entries)-1]
+	event := &pb.ReplicationEvent{
+		Epoch:    p.epoch,
+		Sequence: last.sequence,
+		Head:     head,
+		Time:     last.time.UnixNano(),
+		Metrics:  make([]*pb.Metric, 0, len(entries)),
+	}
+	for _, e := range entries {
+		event.Metrics = append(event.Metrics, e.metric)
+	}
+	return event
+}
@@ -0,0 +1,207 @@
+package replication
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/auth"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+	pb "github.com/unbeman/ya-prac-mcas/proto"
+)
+
+// Replica applies primary updates to its repository until it's promoted.
+// Applied values are absolute, so replaying updates after reconnect is harmless.
+type Replica struct {
+	sync.Mutex
+	primary       string
+	conn          *grpc.ClientConn
+	client        pb.MetricsCollectorClient
+	repository    storage.Repository
+	retryInterval time.Duration
+	epoch         string
+	sequence      uint64
+	head          uint64
+	delay         time.Duration
+	connected     bool
+	promoted      bool
+	cancel        context.CancelFunc
+	now           func() time.Time
+}
+
+// NewReplica creates Replica of configured primary server, it's connected by TLS when tlsConfig isn't nil.
+// Token authorizes replication when primary requires API tokens.
+func NewReplica(cfg configs.ReplicationConfig, repository storage.Repository, token string, tlsConfig *tls.Config) (*Replica, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	options := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if token != "" {
+		options = append(options, grpc.WithPerRPCCredentials(auth.Credentials(token)))
+	}
+	conn, err := grpc.Dial(cfg.Primary, options...)
+	if err != nil {
+		return nil, fmt.Errorf("can't dial primary %s: %w", cfg.Primary, err)
+	}
+	return &Replica{
+		primary:       cfg.Primary,
+		conn:          conn,
+		client:        pb.NewMetricsCollectorClient(conn),
+		repository:    repository,
+		retryInterval: cfg.RetryInterval,
+		now:           time.Now,
+	}, nil
+}
+
+// Run subscribes to primary updates and reconnects on errors until ctx is done or replica is promoted.
+func (r *Replica) Run(ctx context.Context) {
+	r.Lock()
+	if r.promoted {
+		r.Unlock()
+		return
+	}
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.Unlock()
+
+	for {
+		err := r.replicate(ctx)
+		r.Lock()
+		r.connected = false
+		r.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warnf("Replication from %v interrupted: %v", r.primary, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(r.retryInterval):
+		}
+	}
+}
+
+func (r *Replica) replicate(ctx context.Context) error {
+	r.Lock()
+	request := &pb.ReplicateRequest{Epoch: r.epoch, Sequence: r.sequence}
+	r.Unlock()
+
+	stream, err := r.client.Replicate(ctx, request)
+	if err != nil {
+		return err
+	}
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if err = r.Apply(ctx, event); err != nil {
+			return err
+		}
+	}
+}
+
+// Apply saves metrics of replication event to repository.
+func (r *Replica) Apply(ctx context.Context, event *pb.ReplicationEvent) error {
+	if event.Snapshot {
+		log.Infof("Replica resync from snapshot of %d metrics", len(event.Metrics))
+	}
+
+	var (
+		gauges   []metrics.Gauge
+		counters []metrics.Counter
+	)
+	for _, m := range event.Metrics {
+		switch m.Type {
+		case metrics.GaugeType:
+			gauges = append(gauges, metrics.NewGauge(m.Name, m.Value))
+		case metrics.CounterType:
+			// counters are streamed by value, repository is changed by difference
+			current, err := r.repository.GetCounter(ctx, m.Name)
+			if err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return err
+			}
+			delta := m.Delta
+			if current != nil {
+				delta -= current.Value()
+			}
+			if delta != 0 {
+				counters = append(counters, metrics.NewCounter(m.Name, delta))
+			}
+		}
+	}
+	if len(gauges) > 0 {
+		if _, err := r.repository.SetGauges(ctx, gauges); err != nil {
+			return err
+		}
+	}
+	if len(counters) > 0 {
+		if _, err := r.repository.AddCounters(ctx, counters); err != nil {
+			return err
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.epoch = event.Epoch
+	r.sequence = event.Sequence
+	r.head = event.Head
+	r.delay = r.now().Sub(time.Unix(0, event.Time))
+	r.connected = true
+	return nil
+}
+
+// ReadOnly reports if replica isn't promoted yet.
+func (r *Replica) ReadOnly() bool {
+	r.Lock()
+	defer r.Unlock()
+	return !r.promoted
+}
+
+// Promote stops replication, so server accepts updates as primary.
+func (r *Replica) Promote() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.promoted {
+		return ErrNotReplica
+	}
+	r.promoted = true
+	r.connected = false
+	if r.cancel != nil {
+		r.cancel()
+	}
+	log.Infof("Replica of %v promoted to primary", r.primary)
+	return r.conn.Close()
+}
+
+// Status returns replication state, after promotion it's the state of the last applied update.
+func (r *Replica) Status() Status {
+	r.Lock()
+	defer r.Unlock()
+	status := Status{
+		Role:            ReplicaRole,
+		Primary:         r.primary,
+		Connected:       r.connected,
+		Sequence:        r.sequence,
+		PrimarySequence: r.head,
+		DelaySeconds:    r.delay.Seconds(),
+	}
+	if r.promoted {
+		status.Role = PrimaryRole
+	}
+	if r.head > r.sequence {
+		status.Lag = r.head - r.sequence
+	}
+	return status
+}
@@ -0,0 +1,134 @@
+package replication
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+	pb "github.com/unbeman/ya-prac-mcas/proto"
+)
+
+// update saves metric on primary as controller does.
+func update(t *testing.T, primary *Primary, metric metrics.Metric) {
+	ctx := context.Background()
+	var (
+		saved metrics.Metric
+		err   error
+	)
+	switch m := metric.(type) {
+	case metrics.Gauge:
+		saved, err = primary.repository.SetGauge(ctx, m.GetName(), m.Value())
+	case metrics.Counter:
+		saved, err = primary.repository.AddCounter(ctx, m.GetName(), m.Value())
+	}
+	require.NoError(t, err)
+	primary.Observe(saved, 0)
+}
+
+func newTestReplica(t *testing.T) *Replica {
+	replica, err := NewReplica(configs.ReplicationConfig{Primary: "127.0.0.1:1"}, storage.NewRAMRepository(), "", nil)
+	require.NoError(t, err)
+	return replica
+}
+
+func collect(t *testing.T, primary *Primary, epoch string, sequence uint64) []*pb.ReplicationEvent {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var events []*pb.ReplicationEvent
+	err := primary.Stream(ctx, epoch, sequence, func(event *pb.ReplicationEvent) error {
+		events = append(events, event)
+		return nil
+	})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	return events
+}
+
+func TestPrimary_Stream(t *testing.T) {
+	primary := NewPrimary(3, storage.NewRAMRepository())
+	for i := 1; i <= 5; i++ {
+		update(t, primary, metrics.NewCounter("PollCount", 1))
+	}
+
+	t.Run("continue from backlog", func(t *testing.T) {
+		events := collect(t, primary, primary.epoch, 3)
+		require.Len(t, events, 1)
+		assert.False(t, events[0].Snapshot)
+		assert.Equal(t, uint64(5), events[0].Sequence)
+		require.Len(t, events[0].Metrics, 2)
+		assert.Equal(t, int64(4), events[0].Metrics[0].Delta)
+		assert.Equal(t, int64(5), events[0].Metrics[1].Delta)
+	})
+	t.Run("up to date", func(t *testing.T) {
+		assert.Empty(t, collect(t, primary, primary.epoch, 5))
+	})
+	t.Run("too far behind", func(t *testing.T) {
+		events := collect(t, primary, primary.epoch, 1)
+		require.Len(t, events, 1)
+		assert.True(t, events[0].Snapshot)
+		assert.Equal(t, uint64(5), events[0].Sequence)
+	})
+	t.Run("restarted primary", func(t *testing.T) {
+		events := collect(t, primary, "previous", 4)
+		require.Len(t, events, 1)
+		assert.True(t, events[0].Snapshot)
+	})
+}
+
+func TestReplica_Replicate(t *testing.T) {
+	primary := NewPrimary(100, storage.NewRAMRepository())
+	replica := newTestReplica(t)
+	update(t, primary, metrics.NewCounter("PollCount", 3))
+	update(t, primary, metrics.NewGauge("Alloc", 1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = primary.Stream(ctx, "", 0, func(event *pb.ReplicationEvent) error {
+			return replica.Apply(ctx, event)
+		})
+	}()
+
+	update(t, primary, metrics.NewCounter("PollCount", 2))
+	update(t, primary, metrics.NewGauge("Alloc", 7))
+
+	require.Eventually(t, func() bool {
+		return replica.Status().Sequence == 4
+	}, time.Second, 5*time.Millisecond)
+
+	counter, err := replica.repository.GetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), counter.Value())
+	gauge, err := replica.repository.GetGauge(ctx, "Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, float64(7), gauge.Value())
+
+	status := replica.Status()
+	assert.Equal(t, ReplicaRole, status.Role)
+	assert.True(t, status.Connected)
+	assert.Equal(t, uint64(0), status.Lag)
+	assert.Equal(t, 1, primary.Status().Replicas)
+
+	cancel()
+	<-done
+	assert.Equal(t, 0, primary.Status().Replicas)
+}
+
+func TestReplica_Promote(t *testing.T) {
+	replica := newTestReplica(t)
+	assert.True(t, replica.ReadOnly())
+
+	require.NoError(t, replica.Promote())
+	assert.False(t, replica.ReadOnly())
+	assert.Equal(t, PrimaryRole, replica.Status().Role)
+
+	assert.ErrorIs(t, replica.Promote(), ErrNotReplica)
+}
@@ -0,0 +1,167 @@
+// Package scrape describes pull mode: periodic scraping of targets exposing Prometheus text format.
+package scrape
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Prometheus metric family types.
+const (
+	CounterType   = "counter"
+	GaugeType     = "gauge"
+	HistogramType = "histogram"
+	SummaryType   = "summary"
+	UntypedType   = "untyped"
+)
+
+// NameLabel holds metric name during relabeling.
+const NameLabel = "__name__"
+
+var ErrInvalidFormat = errors.New("invalid exposition format")
+
+// Sample is a single scraped series value.
+type Sample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+	// Cumulative is true for counter-like series (counters, histogram buckets and counts, summary counts).
+	Cumulative bool
+}
+
+// Parse reads Prometheus text exposition format. Samples with non-finite values are skipped.
+func Parse(reader io.Reader) ([]Sample, error) {
+	var (
+		samples []Sample
+		types   = map[string]string{}
+	)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[1] == "TYPE" {
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+
+		sample, err := parseSampleLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+			continue
+		}
+		sample.Cumulative = isCumulative(sample.Name, types)
+		samples = append(samples, sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// isCumulative defines series kind by its family type, families are looked up by name and name without suffix.
+func isCumulative(name string, types map[string]string) bool {
+	if types[name] == CounterType {
+		return true
+	}
+	for _, suffix := range []string{"_bucket", "_count", "_sum"} {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		switch types[strings.TrimSuffix(name, suffix)] {
+		case HistogramType, SummaryType:
+			return suffix != "_sum"
+		}
+	}
+	return false
+}
+
+// parseSampleLine parses `name{label="value",...} value [timestamp]`.
+func parseSampleLine(line string) (Sample, error) {
+	sample := Sample{Labels: map[string]string{}}
+
+	nameEnd := strings.IndexAny(line, "{ \t")
+	if nameEnd <= 0 {
+		return sample, fmt.Errorf("%w: (%v) no value", ErrInvalidFormat, line)
+	}
+	sample.Name = line[:nameEnd]
+	rest := line[nameEnd:]
+
+	if rest[0] == '{' {
+		var err error
+		rest, err = parseLabels(rest[1:], sample.Labels)
+		if err != nil {
+			return sample, fmt.Errorf("%w: (%v) %v", ErrInvalidFormat, line, err)
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return sample, fmt.Errorf("%w: (%v) expected value and optional timestamp", ErrInvalidFormat, line)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return sample, fmt.Errorf("%w: (%v) invalid value", ErrInvalidFormat, line)
+	}
+	sample.Value = value
+	return sample, nil
+}
+
+// parseLabels reads labels until closing brace and returns the rest of the line.
+func parseLabels(s string, labels map[string]string) (string, error) {
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if strings.HasPrefix(s, "}") {
+			return s[1:], nil
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return "", fmt.Errorf("invalid label")
+		}
+		key := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if !strings.HasPrefix(s, `"`) {
+			return "", fmt.Errorf("label %v value is not quoted", key)
+		}
+
+		var (
+			value  strings.Builder
+			closed bool
+			i      = 1
+		)
+		for ; i < len(s); i++ {
+			if s[i] == '"' {
+				closed = true
+				break
+			}
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(s[i])
+				}
+				continue
+			}
+			value.WriteByte(s[i])
+		}
+		if !closed {
+			return "", fmt.Errorf("label %v value is not closed", key)
+		}
+		labels[key] = value.String()
+		s = s[i+1:]
+	}
+}
@@ -0,0 +1,79 @@
+package scrape
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const exposition = `# HELP http_requests_total The total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} 1027 1395066363000
+http_requests_total{method="post",code="400"}    3 1395066363000
+
+# TYPE memory_free gauge
+memory_free 1024.5
+escaped{path="C:\\DIR\\",quote="say \"hi\""} 1
+nan_value NaN
+
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 4773
+rpc_duration_seconds_sum 1.7560473e+07
+rpc_duration_seconds_count 2693
+
+# TYPE request_duration histogram
+request_duration_bucket{le="0.1"} 33444
+request_duration_bucket{le="+Inf"} 144320
+request_duration_sum 53423
+request_duration_count 144320
+`
+
+func TestParse(t *testing.T) {
+	samples, err := Parse(strings.NewReader(exposition))
+	require.NoError(t, err)
+	require.Len(t, samples, 11)
+
+	type kind struct {
+		value      float64
+		cumulative bool
+	}
+	got := map[string]kind{}
+	for _, sample := range samples {
+		got[sample.Name+sample.Labels["code"]+sample.Labels["le"]+sample.Labels["quantile"]] = kind{sample.Value, sample.Cumulative}
+	}
+	assert.Equal(t, kind{1027, true}, got["http_requests_total200"])
+	assert.Equal(t, kind{3, true}, got["http_requests_total400"])
+	assert.Equal(t, kind{1024.5, false}, got["memory_free"])
+	assert.Equal(t, kind{4773, false}, got["rpc_duration_seconds0.5"])
+	assert.Equal(t, kind{1.7560473e+07, false}, got["rpc_duration_seconds_sum"])
+	assert.Equal(t, kind{2693, true}, got["rpc_duration_seconds_count"])
+	assert.Equal(t, kind{33444, true}, got["request_duration_bucket0.1"])
+	assert.Equal(t, kind{53423, false}, got["request_duration_sum"])
+	assert.Equal(t, kind{144320, true}, got["request_duration_count"])
+
+	for _, sample := range samples {
+		if sample.Name == "escaped" {
+			assert.Equal(t, map[string]string{"path": `C:\DIR\`, "quote": `say "hi"`}, sample.Labels)
+		}
+	}
+}
+
+func TestParse_Invalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{name: "no value", input: "memory_free\n"},
+		{name: "invalid value", input: "memory_free abc\n"},
+		{name: "unquoted label", input: "memory_free{host=a} 1\n"},
+		{name: "unclosed label", input: "memory_free{host=\"a} 1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tt.input))
+			assert.ErrorIs(t, err, ErrInvalidFormat)
+		})
+	}
+}
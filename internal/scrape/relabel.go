@@ -0,0 +1,124 @@
+package scrape
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+)
+
+// Relabel actions.
+const (
+	ReplaceAction   = "replace"
+	KeepAction      = "keep"
+	DropAction      = "drop"
+	LabelDropAction = "labeldrop"
+	LabelKeepAction = "labelkeep"
+)
+
+const (
+	defaultSeparator   = ";"
+	defaultRegex       = "(.*)"
+	defaultReplacement = "$1"
+)
+
+type relabelRule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	action       string
+}
+
+// compileRelabelRules validates rules and fills defaults.
+func compileRelabelRules(cfg []configs.RelabelRule) ([]relabelRule, error) {
+	rules := make([]relabelRule, 0, len(cfg))
+	for idx, c := range cfg {
+		r := relabelRule{
+			sourceLabels: c.SourceLabels,
+			separator:    c.Separator,
+			targetLabel:  c.TargetLabel,
+			replacement:  defaultReplacement,
+			action:       c.Action,
+		}
+		if r.separator == "" {
+			r.separator = defaultSeparator
+		}
+		if c.Replacement != nil {
+			r.replacement = *c.Replacement
+		}
+		if r.action == "" {
+			r.action = ReplaceAction
+		}
+
+		expr := c.Regex
+		if expr == "" {
+			expr = defaultRegex
+		}
+		regex, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: %w", idx, err)
+		}
+		r.regex = regex
+
+		switch r.action {
+		case ReplaceAction:
+			if r.targetLabel == "" {
+				return nil, fmt.Errorf("relabel rule %d: target_label is required for replace", idx)
+			}
+		case KeepAction, DropAction, LabelDropAction, LabelKeepAction:
+		default:
+			return nil, fmt.Errorf("relabel rule %d: unknown action %v", idx, r.action)
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// relabel applies rules to labels in place, false is returned if sample should be dropped.
+func relabel(labels map[string]string, rules []relabelRule) bool {
+	for _, r := range rules {
+		values := make([]string, 0, len(r.sourceLabels))
+		for _, label := range r.sourceLabels {
+			values = append(values, labels[label])
+		}
+		source := strings.Join(values, r.separator)
+
+		switch r.action {
+		case KeepAction:
+			if !r.regex.MatchString(source) {
+				return false
+			}
+		case DropAction:
+			if r.regex.MatchString(source) {
+				return false
+			}
+		case LabelDropAction:
+			for label := range labels {
+				if label != NameLabel && r.regex.MatchString(label) {
+					delete(labels, label)
+				}
+			}
+		case LabelKeepAction:
+			for label := range labels {
+				if label != NameLabel && !r.regex.MatchString(label) {
+					delete(labels, label)
+				}
+			}
+		case ReplaceAction:
+			match := r.regex.FindStringSubmatchIndex(source)
+			if match == nil {
+				continue
+			}
+			value := string(r.regex.ExpandString(nil, r.replacement, source, match))
+			if value == "" {
+				delete(labels, r.targetLabel)
+				continue
+			}
+			labels[r.targetLabel] = value
+		}
+	}
+	return true
+}
@@ -0,0 +1,90 @@
+package scrape
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+)
+
+func TestRelabel(t *testing.T) {
+	empty := ""
+	prefixed := "node_$1"
+	tests := []struct {
+		name   string
+		rules  []configs.RelabelRule
+		labels map[string]string
+		want   map[string]string
+		keep   bool
+	}{
+		{
+			name:   "keep by name",
+			rules:  []configs.RelabelRule{{SourceLabels: []string{NameLabel}, Regex: "go_.*", Action: KeepAction}},
+			labels: map[string]string{NameLabel: "process_cpu"},
+			keep:   false,
+		},
+		{
+			name:   "drop by label",
+			rules:  []configs.RelabelRule{{SourceLabels: []string{"code"}, Regex: "5..", Action: DropAction}},
+			labels: map[string]string{NameLabel: "requests", "code": "200"},
+			want:   map[string]string{NameLabel: "requests", "code": "200"},
+			keep:   true,
+		},
+		{
+			name:   "rename metric",
+			rules:  []configs.RelabelRule{{SourceLabels: []string{NameLabel}, Regex: "(.*)", TargetLabel: NameLabel, Replacement: &prefixed}},
+			labels: map[string]string{NameLabel: "load"},
+			want:   map[string]string{NameLabel: "node_load"},
+			keep:   true,
+		},
+		{
+			name: "static label and label removal",
+			rules: []configs.RelabelRule{
+				{TargetLabel: "dc", Replacement: func(s string) *string { return &s }("eu")},
+				{Regex: "method", Action: LabelDropAction},
+				{SourceLabels: []string{"code"}, TargetLabel: "code", Replacement: &empty},
+			},
+			labels: map[string]string{NameLabel: "requests", "code": "200", "method": "get"},
+			want:   map[string]string{NameLabel: "requests", "dc": "eu"},
+			keep:   true,
+		},
+		{
+			name:   "label keep",
+			rules:  []configs.RelabelRule{{Regex: "code", Action: LabelKeepAction}},
+			labels: map[string]string{NameLabel: "requests", "code": "200", "method": "get"},
+			want:   map[string]string{NameLabel: "requests", "code": "200"},
+			keep:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := compileRelabelRules(tt.rules)
+			require.NoError(t, err)
+
+			keep := relabel(tt.labels, rules)
+			assert.Equal(t, tt.keep, keep)
+			if keep {
+				assert.Equal(t, tt.want, tt.labels)
+			}
+		})
+	}
+}
+
+func TestCompileRelabelRules_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		rule configs.RelabelRule
+	}{
+		{name: "invalid regex", rule: configs.RelabelRule{Regex: "(", Action: KeepAction}},
+		{name: "no target label", rule: configs.RelabelRule{Action: ReplaceAction}},
+		{name: "unknown action", rule: configs.RelabelRule{Action: "hashmod"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileRelabelRules([]configs.RelabelRule{tt.rule})
+			assert.Error(t, err)
+		})
+	}
+}
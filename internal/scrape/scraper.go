@@ -0,0 +1,225 @@
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/ingest"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+)
+
+// Health metrics saved after each scrape, labeled with target name.
+const (
+	UpMetric       = "scrape_up"
+	DurationMetric = "scrape_duration_seconds"
+	SamplesMetric  = "scrape_samples"
+	TargetLabel    = "target"
+)
+
+const acceptHeader = "text/plain;version=0.0.4;q=1,*/*;q=0.1"
+
+type target struct {
+	name     string
+	url      string
+	interval time.Duration
+	client   http.Client
+	rules    []relabelRule
+	// counters keeps state of counter-like series saved by previous scrapes, it's used for deltas calculation.
+	// Target is scraped by one goroutine, so no lock is needed.
+	counters map[string]counter
+}
+
+// counter is state of cumulative series, remainder is fractional increment which isn't saved yet.
+type counter struct {
+	last      float64
+	remainder float64
+}
+
+// Scraper periodically scrapes targets and saves samples through controller.Controller.
+// Cumulative series are saved as counter increments since previous scrape,
+// the others are saved as gauges.
+// Response body is limited by maxBodySize, samples are limited by limits as pushed metrics are.
+type Scraper struct {
+	control     *controller.Controller
+	maxBodySize int64
+	limits      metrics.Limits
+	targets     []*target
+}
+
+// NewScraper creates Scraper, returns error on invalid target config.
+func NewScraper(
+	cfg configs.ScrapeConfig,
+	control *controller.Controller,
+	maxBodySize int64,
+	limits metrics.Limits) (*Scraper, error) {
+	s := &Scraper{control: control, maxBodySize: maxBodySize, limits: limits}
+	for _, tCfg := range cfg.Targets {
+		if tCfg.URL == "" {
+			return nil, fmt.Errorf("scrape target %v: no url", tCfg.Name)
+		}
+		rules, err := compileRelabelRules(tCfg.Relabel)
+		if err != nil {
+			return nil, fmt.Errorf("scrape target %v: %w", tCfg.Name, err)
+		}
+		t := &target{
+			name:     tCfg.Name,
+			url:      tCfg.URL,
+			interval: tCfg.Interval,
+			client:   http.Client{Timeout: tCfg.Timeout},
+			rules:    rules,
+			counters: map[string]counter{},
+		}
+		if t.name == "" {
+			t.name = t.url
+		}
+		if t.interval == 0 {
+			t.interval = cfg.Interval
+		}
+		if t.client.Timeout == 0 {
+			t.client.Timeout = cfg.Timeout
+		}
+		s.targets = append(s.targets, t)
+	}
+	return s, nil
+}
+
+// Start adds scrape task of every target to pool.
+func (s *Scraper) Start(ctx context.Context, pool *utils.TickerPool) {
+	for _, t := range s.targets {
+		t := t
+		pool.AddTask(ctx, "Scrape "+t.name, func(ctx context.Context) { s.scrape(ctx, t) }, t.interval)
+	}
+}
+
+// scrape saves samples of target, counters state is updated only when they're saved.
+func (s *Scraper) scrape(ctx context.Context, t *target) {
+	start := time.Now()
+	slice, counters, err := s.fetch(ctx, t)
+	duration := time.Since(start).Seconds()
+
+	up := 1.0
+	if err != nil {
+		up = 0
+		log.Errorf("Scrape %v failed: %v", t.name, err)
+	}
+	samplesCount := float64(len(slice))
+	health := map[string]string{TargetLabel: t.name}
+	slice = append(slice,
+		metrics.Params{Name: ingest.LabeledName(UpMetric, health), Type: metrics.GaugeType, ValueGauge: &up},
+		metrics.Params{Name: ingest.LabeledName(DurationMetric, health), Type: metrics.GaugeType, ValueGauge: &duration},
+		metrics.Params{Name: ingest.LabeledName(SamplesMetric, health), Type: metrics.GaugeType, ValueGauge: &samplesCount},
+	)
+
+	if _, err = s.control.UpdateMetrics(controller.WithTrustedSource(ctx), slice); err != nil {
+		log.Errorf("Scrape %v: can't save metrics: %v", t.name, err)
+		return
+	}
+	for name, state := range counters {
+		t.counters[name] = state
+	}
+}
+
+// fetch requests target and converts its samples to metrics.Params,
+// the next state of target counters is returned along with them.
+func (s *Scraper) fetch(ctx context.Context, t *target) (metrics.ParamsSlice, map[string]counter, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, t.url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	request.Header.Set("Accept", acceptHeader)
+
+	response, err := t.client.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, response.Body)
+		return nil, nil, fmt.Errorf("unexpected status code %v", response.StatusCode)
+	}
+
+	var (
+		body    io.Reader = response.Body
+		limited *io.LimitedReader
+	)
+	if s.maxBodySize > 0 {
+		// one more byte is read to tell the limit is exceeded
+		limited = &io.LimitedReader{R: response.Body, N: s.maxBodySize + 1}
+		body = limited
+	}
+	samples, err := Parse(body)
+	if limited != nil && limited.N <= 0 {
+		return nil, nil, fmt.Errorf("%w: response body exceeds %d bytes", metrics.ErrTooLarge, s.maxBodySize)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	slice, counters := t.toParams(samples, s.limits)
+	if err = s.limits.CheckBatchSize(len(slice)); err != nil {
+		return nil, nil, err
+	}
+	return slice, counters, nil
+}
+
+// toParams converts samples to metrics.Params, samples of too long names are skipped.
+func (t *target) toParams(samples []Sample, limits metrics.Limits) (metrics.ParamsSlice, map[string]counter) {
+	slice := make(metrics.ParamsSlice, 0, len(samples))
+	counters := make(map[string]counter)
+	for _, sample := range samples {
+		sample.Labels[NameLabel] = sample.Name
+		if !relabel(sample.Labels, t.rules) {
+			continue
+		}
+		name := sample.Labels[NameLabel]
+		delete(sample.Labels, NameLabel)
+		if name == "" {
+			continue
+		}
+		name = ingest.LabeledName(name, sample.Labels)
+		if err := limits.CheckNameLength(name); err != nil {
+			log.Debugf("Scrape %v: %v", t.name, err)
+			continue
+		}
+
+		if !sample.Cumulative {
+			value := sample.Value
+			slice = append(slice, metrics.Params{Name: name, Type: metrics.GaugeType, ValueGauge: &value})
+			continue
+		}
+
+		delta, state := t.counterDelta(name, sample.Value)
+		counters[name] = state
+		if delta == 0 {
+			continue
+		}
+		slice = append(slice, metrics.Params{Name: name, Type: metrics.CounterType, ValueCounter: &delta})
+	}
+	return slice, counters
+}
+
+// counterDelta returns whole increment of cumulative series since previous scrape and the next state of series.
+// First scrape is a baseline with zero increment, so restarted server doesn't count the whole value again,
+// counter reset counts the whole value. Fractional part of increment is carried over
+// to the next scrape, so float counters, e.g. *_seconds_total, don't lose their increments.
+func (t *target) counterDelta(name string, value float64) (int64, counter) {
+	state, seen := t.counters[name]
+	if !seen {
+		return 0, counter{last: value}
+	}
+	increment := value
+	if value >= state.last {
+		increment = value - state.last
+	}
+	increment += state.remainder
+	delta := int64(math.Trunc(increment))
+	return delta, counter{last: value, remainder: increment - float64(delta)}
+}
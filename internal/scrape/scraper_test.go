@@ -0,0 +1,139 @@
+package scrape
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+)
+
+func TestScraper_scrape(t *testing.T) {
+	requests := 0
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, "# TYPE jobs_total counter\njobs_total{queue=\"a\"} %d\nqueue_size 7\n", requests*10)
+	}))
+	defer target.Close()
+
+	repository := storage.NewRAMRepository()
+	scraper, err := NewScraper(configs.ScrapeConfig{
+		Interval: time.Minute,
+		Timeout:  time.Second,
+		Targets:  []configs.ScrapeTarget{{Name: "worker", URL: target.URL}},
+	}, controller.NewController(repository, "key"), configs.MaxBodySizeDefault, metrics.Limits{})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	scraper.scrape(ctx, scraper.targets[0])
+	scraper.scrape(ctx, scraper.targets[0])
+
+	counter, err := repository.GetCounter(ctx, "jobs_total;queue=a")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), counter.Value(), "counter should follow cumulative value since the first scrape")
+
+	gauge, err := repository.GetGauge(ctx, "queue_size")
+	require.NoError(t, err)
+	assert.Equal(t, 7.0, gauge.Value())
+
+	up, err := repository.GetGauge(ctx, "scrape_up;target=worker")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, up.Value())
+
+	target.Close()
+	scraper.scrape(ctx, scraper.targets[0])
+	up, err = repository.GetGauge(ctx, "scrape_up;target=worker")
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, up.Value())
+}
+
+func TestTarget_counterDelta(t *testing.T) {
+	tg := &target{counters: map[string]counter{}}
+	next := func(value float64) int64 {
+		delta, state := tg.counterDelta("a", value)
+		tg.counters["a"] = state
+		return delta
+	}
+
+	assert.Zero(t, next(10), "the first scrape is a baseline")
+	assert.Zero(t, next(10))
+	assert.Equal(t, int64(5), next(15.5))
+	assert.Zero(t, next(15.75))
+	assert.Equal(t, int64(1), next(16.25), "fractional increments are carried over")
+	assert.Equal(t, int64(2), next(2), "reset")
+}
+
+func TestScraper_scrapeLimits(t *testing.T) {
+	body := "# TYPE jobs_total counter\njobs_total 10\nvery_long_metric_name 1\nqueue_size 7\n"
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer target.Close()
+
+	tests := []struct {
+		name        string
+		maxBodySize int64
+		limits      metrics.Limits
+		wantSaved   []string
+		wantUp      float64
+	}{
+		{name: "no limits", wantSaved: []string{"queue_size", "very_long_metric_name"}, wantUp: 1},
+		{name: "name length", limits: metrics.Limits{MaxNameLength: 12}, wantSaved: []string{"queue_size"}, wantUp: 1},
+		{name: "body size", maxBodySize: int64(len(body) - 1)},
+		{name: "samples count", limits: metrics.Limits{MaxBatchSize: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := storage.NewRAMRepository()
+			scraper, err := NewScraper(configs.ScrapeConfig{
+				Targets: []configs.ScrapeTarget{{Name: "worker", URL: target.URL, Timeout: time.Second}},
+			}, controller.NewController(repository, ""), tt.maxBodySize, tt.limits)
+			require.NoError(t, err)
+
+			ctx := context.Background()
+			scraper.scrape(ctx, scraper.targets[0])
+			for _, name := range tt.wantSaved {
+				_, err = repository.GetGauge(ctx, name)
+				assert.NoError(t, err, name)
+			}
+			up, err := repository.GetGauge(ctx, "scrape_up;target=worker")
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantUp, up.Value())
+		})
+	}
+}
+
+func TestScraper_scrapeFailedSave(t *testing.T) {
+	value := 10
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "# TYPE jobs_total counter\njobs_total %d\n", value)
+	}))
+	defer target.Close()
+
+	readOnly := false
+	repository := storage.NewRAMRepository()
+	scraper, err := NewScraper(configs.ScrapeConfig{
+		Targets: []configs.ScrapeTarget{{Name: "worker", URL: target.URL, Timeout: time.Second}},
+	}, controller.NewController(repository, "", controller.WithReadOnly(func() bool { return readOnly })), 0, metrics.Limits{})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	scraper.scrape(ctx, scraper.targets[0])
+	readOnly, value = true, 15
+	scraper.scrape(ctx, scraper.targets[0])
+	readOnly, value = false, 20
+	scraper.scrape(ctx, scraper.targets[0])
+
+	counter, err := repository.GetCounter(ctx, "jobs_total")
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), counter.Value(), "increment of failed save is saved by the next scrape")
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/ingest"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+)
+
+// graphiteMaxLineLength limits length of Graphite line, connection sending longer line is closed.
+const graphiteMaxLineLength = 4096
+
+// GraphiteServer receives Graphite plaintext lines over TCP
+// and saves them through controller.Controller.
+// Lines are saved in batches: whatever is already read from connection, but not more than MaxBatchSize.
+// Graphite can't sign metrics, so connections are accepted only from trusted subnets when they're set.
+type GraphiteServer struct {
+	sync.Mutex
+	address  string
+	control  *controller.Controller
+	mapper   *ingest.Mapper
+	limits   metrics.Limits
+	ipFilter *utils.IPFilter
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closing  chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewGraphiteServer(
+	addr string,
+	control *controller.Controller,
+	mapper *ingest.Mapper,
+	limits metrics.Limits,
+	ipFilter *utils.IPFilter) *GraphiteServer {
+	return &GraphiteServer{
+		address:  addr,
+		control:  control,
+		mapper:   mapper,
+		limits:   limits,
+		ipFilter: ipFilter,
+		conns:    map[net.Conn]struct{}{},
+		closing:  make(chan struct{}),
+	}
+}
+
+func (g *GraphiteServer) GetAddress() string {
+	return g.address
+}
+
+func (g *GraphiteServer) Run() error {
+	g.Lock()
+	select {
+	case <-g.closing:
+		g.Unlock()
+		return nil
+	default:
+	}
+	listener, err := net.Listen("tcp", g.address)
+	if err != nil {
+		g.Unlock()
+		return fmt.Errorf("can't bind Graphite address: %w", err)
+	}
+	g.listener = listener
+	g.Unlock()
+
+	log.Info("starting Graphite server")
+	defer g.wg.Wait()
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			log.Error("Graphite accept failed: ", err)
+			continue
+		}
+		if err = g.ipFilter.Check(utils.ParseHostIP(conn.RemoteAddr().String())); err != nil {
+			log.Warn("Graphite connection rejected: ", err)
+			conn.Close()
+			continue
+		}
+
+		g.Lock()
+		select {
+		case <-g.closing:
+			// Close has already closed tracked connections
+			g.Unlock()
+			conn.Close()
+			return nil
+		default:
+		}
+		g.conns[conn] = struct{}{}
+		g.wg.Add(1)
+		g.Unlock()
+
+		go g.serveConn(conn)
+	}
+}
+
+func (g *GraphiteServer) Close() error {
+	g.Lock()
+	defer g.Unlock()
+	select {
+	case <-g.closing:
+		return nil
+	default:
+		close(g.closing)
+	}
+
+	var err error
+	if g.listener != nil {
+		err = g.listener.Close()
+	}
+	for conn := range g.conns {
+		conn.Close()
+	}
+	return err
+}
+
+func (g *GraphiteServer) serveConn(conn net.Conn) {
+	defer g.wg.Done()
+	defer func() {
+		g.Lock()
+		delete(g.conns, conn)
+		g.Unlock()
+		conn.Close()
+	}()
+
+	// scanner reads through reader, so empty reader means nothing more is received yet
+	reader := bufio.NewReader(conn)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 1024), graphiteMaxLineLength)
+	batch := metrics.ParamsSlice{}
+	for {
+		more := scanner.Scan()
+		if line := strings.TrimSpace(scanner.Text()); more && line != "" {
+			if params, parseErr := g.parseLine(line); parseErr != nil {
+				log.Debug(parseErr)
+			} else {
+				batch = append(batch, params)
+			}
+		}
+
+		full := g.limits.CheckBatchSize(len(batch)+1) != nil
+		if len(batch) > 0 && (!more || full || reader.Buffered() == 0) {
+			g.save(batch)
+			batch = metrics.ParamsSlice{}
+		}
+
+		if !more {
+			if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+				log.Error("Graphite read failed: ", err)
+			}
+			return
+		}
+	}
+}
+
+func (g *GraphiteServer) parseLine(line string) (metrics.Params, error) {
+	params, err := g.mapper.ParseGraphiteLine(line)
+	if err != nil {
+		return params, err
+	}
+	return params, g.limits.CheckNameLength(params.Name)
+}
+
+func (g *GraphiteServer) save(batch metrics.ParamsSlice) {
+	if _, err := g.control.UpdateMetrics(controller.WithTrustedSource(context.Background()), batch); err != nil {
+		log.Error("Graphite: can't save metrics: ", err)
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/ingest"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+)
+
+// freeAddress returns local address of unused TCP port.
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// dial connects to server started in background.
+func dial(t *testing.T, address string) net.Conn {
+	var (
+		conn net.Conn
+		err  error
+	)
+	require.Eventually(t, func() bool {
+		conn, err = net.Dial("tcp", address)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	return conn
+}
+
+func TestGraphiteServer_TrustedSubnet(t *testing.T) {
+	tests := []struct {
+		name      string
+		subnet    string
+		wantSaved bool
+	}{
+		{name: "trusted client", subnet: "127.0.0.0/8", wantSaved: true},
+		{name: "untrusted client", subnet: "10.0.0.0/8"},
+		{name: "no trusted subnet", wantSaved: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipFilter, err := utils.NewIPFilter(tt.subnet, "")
+			require.NoError(t, err)
+			mapper, err := ingest.NewMapper(nil, nil)
+			require.NoError(t, err)
+			repository := storage.NewRAMRepository()
+			address := freeAddress(t)
+			server := NewGraphiteServer(address, controller.NewController(repository, "secret"), mapper, metrics.Limits{}, ipFilter)
+			go server.Run()
+			defer server.Close()
+
+			conn := dial(t, address)
+			fmt.Fprint(conn, "servers.web1.load 0.5 1700000000\n")
+			conn.Close()
+
+			saved := func() bool {
+				_, err := repository.GetGauge(context.Background(), "servers.web1.load")
+				return err == nil
+			}
+			if tt.wantSaved {
+				assert.Eventually(t, saved, time.Second, 10*time.Millisecond, "unsigned Graphite metrics are trusted")
+				return
+			}
+			assert.Never(t, saved, 200*time.Millisecond, 10*time.Millisecond)
+		})
+	}
+}
+
+func TestGraphiteServer_LongLine(t *testing.T) {
+	mapper, err := ingest.NewMapper(nil, nil)
+	require.NoError(t, err)
+	repository := storage.NewRAMRepository()
+	address := freeAddress(t)
+	server := NewGraphiteServer(address, controller.NewController(repository, ""), mapper, metrics.Limits{}, nil)
+	go server.Run()
+	defer server.Close()
+
+	conn := dial(t, address)
+	defer conn.Close()
+	fmt.Fprint(conn, "servers.web1.load 0.5 1700000000\n")
+	fmt.Fprintf(conn, "servers.%s 1 1700000000\n", strings.Repeat("x", graphiteMaxLineLength))
+
+	require.Eventually(t, func() bool {
+		_, err := repository.GetGauge(context.Background(), "servers.web1.load")
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	// unread data of closed connection may reset it instead of EOF
+	require.Error(t, err, "connection sending too long line is closed")
+	assert.False(t, errors.Is(err, os.ErrDeadlineExceeded), "connection sending too long line is closed")
+}
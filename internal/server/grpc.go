@@ -4,10 +4,11 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	_ "google.golang.org/grpc/encoding/gzip"
 	"net"
 
-	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/cluster"
 	"github.com/unbeman/ya-prac-mcas/internal/handlers"
 	pb "github.com/unbeman/ya-prac-mcas/proto"
 )
@@ -18,9 +19,33 @@ type GRPCServer struct {
 	service *handlers.GRPCService
 }
 
-func NewGRPCServer(addr string, control *controller.Controller, trustedSubnet *net.IPNet) *GRPCServer {
-	server := grpc.NewServer(grpc.UnaryInterceptor(handlers.IPCheckerServerInterceptor(trustedSubnet)))
-	service := handlers.NewGRPCService(control)
+func NewGRPCServer(addr string, opts Options) *GRPCServer {
+	unary := []grpc.UnaryServerInterceptor{
+		handlers.IPCheckerServerInterceptor(opts.IPFilter),
+		handlers.AuthUnaryServerInterceptor(opts.Authenticator),
+	}
+	if opts.Cluster {
+		unary = append(unary, cluster.ServerInterceptor(opts.PeerSubnets))
+	}
+	unary = append(unary, handlers.QuotaUnaryServerInterceptor(opts.Limiter, opts.IPFilter))
+	options := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(
+			handlers.IPCheckerStreamServerInterceptor(opts.IPFilter),
+			handlers.AuthStreamServerInterceptor(opts.Authenticator),
+		),
+	}
+	if opts.TLSConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(opts.TLSConfig)))
+	}
+	if opts.Limits.MaxBodySize > 0 {
+		options = append(options, grpc.MaxRecvMsgSize(int(opts.Limits.MaxBodySize)))
+	}
+	server := grpc.NewServer(options...)
+	serviceOptions := append([]handlers.GRPCOption{
+		handlers.WithDecryption(opts.CryptoKeys, opts.RequireEncryption),
+	}, opts.GRPCOptions...)
+	service := handlers.NewGRPCService(opts.Control, getMetricsLimits(opts.Limits), serviceOptions...)
 
 	return &GRPCServer{address: addr, server: server, service: service}
 }
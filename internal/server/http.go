@@ -2,11 +2,8 @@ package server
 
 import (
 	"context"
-	"crypto/rsa"
-	"net"
 	"net/http"
 
-	"github.com/unbeman/ya-prac-mcas/internal/controller"
 	"github.com/unbeman/ya-prac-mcas/internal/handlers"
 )
 
@@ -14,9 +11,13 @@ type HTTPServer struct {
 	server *http.Server
 }
 
-func NewHTTPServer(addr string, control *controller.Controller, privateKey *rsa.PrivateKey, trustedSubnet *net.IPNet) *HTTPServer {
-	handler := handlers.NewCollectorHandler(control, privateKey, trustedSubnet)
-	return &HTTPServer{server: &http.Server{Addr: addr, Handler: handler}}
+func NewHTTPServer(addr string, opts Options) *HTTPServer {
+	options := append([]handlers.HandlerOption{
+		handlers.WithAuth(opts.Authenticator),
+		handlers.WithQuota(opts.Limiter),
+	}, opts.HTTPOptions...)
+	handler := handlers.NewCollectorHandler(opts.Control, opts.CryptoKeys, opts.IPFilter, options...)
+	return &HTTPServer{server: &http.Server{Addr: addr, Handler: handler, TLSConfig: opts.TLSConfig}}
 }
 
 func (h *HTTPServer) GetAddress() string {
@@ -24,6 +25,10 @@ func (h *HTTPServer) GetAddress() string {
 }
 
 func (h *HTTPServer) Run() error {
+	if h.server.TLSConfig != nil {
+		// certificates are provided by TLSConfig
+		return h.server.ListenAndServeTLS("", "")
+	}
 	return h.server.ListenAndServe()
 }
 
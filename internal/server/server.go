@@ -3,10 +3,9 @@ package server
 
 import (
 	"context"
-	"crypto/rsa"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"sync"
@@ -14,9 +13,27 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/alerting"
+	"github.com/unbeman/ya-prac-mcas/internal/auth"
+	"github.com/unbeman/ya-prac-mcas/internal/cardinality"
+	"github.com/unbeman/ya-prac-mcas/internal/cluster"
 	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/cryptokeys"
+	"github.com/unbeman/ya-prac-mcas/internal/export"
+	"github.com/unbeman/ya-prac-mcas/internal/federation"
+	"github.com/unbeman/ya-prac-mcas/internal/handlers"
+	"github.com/unbeman/ya-prac-mcas/internal/history"
+	"github.com/unbeman/ya-prac-mcas/internal/ingest"
+	"github.com/unbeman/ya-prac-mcas/internal/keyring"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/quota"
+	"github.com/unbeman/ya-prac-mcas/internal/recording"
+	"github.com/unbeman/ya-prac-mcas/internal/replay"
+	"github.com/unbeman/ya-prac-mcas/internal/replication"
+	"github.com/unbeman/ya-prac-mcas/internal/scrape"
 	"github.com/unbeman/ya-prac-mcas/internal/storage"
 	"github.com/unbeman/ya-prac-mcas/internal/utils"
+	"github.com/unbeman/ya-prac-mcas/internal/webhook"
 )
 
 type Server interface {
@@ -25,22 +42,58 @@ type Server interface {
 	Close() error
 }
 
-func GetServer(
-	protocol string,
-	addr string,
-	control *controller.Controller,
-	key *rsa.PrivateKey, trustedSubnet *net.IPNet) Server {
+// Options are dependencies of HTTP and gRPC servers, both transports apply the same
+// client IP check, authentication, quota and limits. Nil fields disable the feature.
+type Options struct {
+	Control           *controller.Controller
+	CryptoKeys        *cryptokeys.Keyset
+	RequireEncryption bool
+	IPFilter          *utils.IPFilter
+	TLSConfig         *tls.Config
+	Authenticator     *auth.Authenticator
+	Limiter           *quota.Limiter
+	Limits            configs.LimitsConfig
+	Cluster           bool          // accept requests forwarded by cluster nodes
+	PeerSubnets       utils.Subnets // cluster nodes trusted without token of peer scope
+	GRPCOptions       []handlers.GRPCOption
+	HTTPOptions       []handlers.HandlerOption
+}
+
+func GetServer(protocol string, addr string, opts Options) Server {
 	switch protocol {
 	case configs.GRPCProtocol:
-		return NewGRPCServer(addr, control, trustedSubnet)
+		return NewGRPCServer(addr, opts)
 	default:
-		return NewHTTPServer(addr, control, key, trustedSubnet)
+		return NewHTTPServer(addr, opts)
 	}
 }
 
+func getMetricsLimits(cfg configs.LimitsConfig) metrics.Limits {
+	return metrics.Limits{MaxBatchSize: cfg.MaxBatchSize, MaxNameLength: cfg.MaxNameLength}
+}
+
 type application struct {
 	repository    storage.Repository
-	server        Server
+	servers       []Server
+	ingesters     []Server
+	scraper       *scrape.Scraper
+	alerts        *alerting.Engine
+	recorder      *recording.Recorder
+	webhooks      *webhook.Dispatcher
+	exporter      *export.Exporter
+	forwarder     *federation.Forwarder
+	cluster       *cluster.Repository
+	replica       *replication.Replica
+	certificates  *utils.CertReloader
+	authenticator *auth.Authenticator
+	keyring       *keyring.Keyring
+	cryptoKeys    *cryptokeys.Keyset
+	replayGuard   *replay.Guard
+	limiter       *quota.Limiter
+	series        *cardinality.Index
+	tickerPool    *utils.TickerPool
+	ctx           context.Context
+	cancel        context.CancelFunc
 	profileServer *http.Server
 }
 
@@ -49,24 +102,237 @@ func GetApplication(cfg configs.ServerConfig) (*application, error) {
 	if err != nil {
 		return nil, fmt.Errorf("сan't create repository, reason: %w", err)
 	}
-	privateKey, err := utils.GetPrivateKey(cfg.PrivateCryptoKeyPath)
-	if errors.Is(err, utils.ErrNoRSAKey) {
-		log.Warning("no private RSA key. Decryption disabled.")
-	} else {
+	cryptoKeys, err := cryptokeys.NewKeyset(cfg.PrivateCryptoKeyPath, cfg.CryptoKeysDir)
+	if err != nil {
 		return nil, fmt.Errorf("сan't get private key, reason: %w", err)
 	}
+	if !cryptoKeys.Enabled() {
+		if cfg.RequireEncryption {
+			return nil, errors.New("encryption required, but no private key provided")
+		}
+		log.Warning("no private crypto key. Decryption disabled.")
+	}
+
+	ipFilter, err := utils.NewIPFilter(cfg.TrustedSubnet, cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		certificates *utils.CertReloader
+		tlsConfig    *tls.Config
+	)
+	if cfg.TLS.Enabled() {
+		certificates, err = utils.NewCertReloader(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = certificates.Config()
+	}
+	peerTLSConfig, err := utils.GetClientTLSConfig(cfg.PeerTLS)
+	if err != nil {
+		return nil, err
+	}
+
+	var authenticator *auth.Authenticator
+	if cfg.Auth.Enabled() {
+		source, err := auth.GetSource(cfg.Auth, cfg.Repository.PG)
+		if err != nil {
+			return nil, err
+		}
+		authenticator, err = auth.NewAuthenticator(context.Background(), source, cfg.Auth.ReloadInterval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keys, err := keyring.NewKeyring(cfg.Keyring, cfg.HashKey)
+	if err != nil {
+		return nil, err
+	}
+	// StatsD and Graphite metrics can't be signed, only trusted subnets may send them when hash keys are set
+	if keys.Enabled() && !ipFilter.Enabled() {
+		if cfg.StatsD.Enabled() {
+			return nil, errors.New("StatsD listener requires trusted subnet when hash keys are set")
+		}
+		if cfg.Ingest.GraphiteAddress != "" {
+			return nil, errors.New("Graphite listener requires trusted subnet when hash keys are set")
+		}
+	}
+	replayGuard := replay.NewGuard(cfg.Replay)
+	if replayGuard == nil {
+		log.Warning("replay window isn't positive, replay protection disabled")
+	}
+	limiter := quota.NewLimiter(cfg.Quota)
+
+	// metrics store used by controller, it's sharded between nodes in cluster mode
+	var (
+		store             storage.Repository = repository
+		clusterRepository *cluster.Repository
+	)
+	var peerSubnets utils.Subnets
+	if cfg.Cluster.Enabled() {
+		peerSubnets, err = utils.ParseSubnets(cfg.Cluster.PeerSubnets)
+		if err != nil {
+			return nil, fmt.Errorf("can't parse cluster peer subnets, reason: %w", err)
+		}
+		if len(peerSubnets) == 0 && (authenticator == nil || cfg.PeerToken == "") {
+			return nil, errors.New("cluster requires peer subnets or peer token of peer scope")
+		}
+		clusterRepository, err = cluster.NewRepository(cfg.Cluster, repository, keys, cfg.PeerToken, peerTLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		store = clusterRepository
+	}
 
-	trustedSubnet, err := utils.GetTrustedSubnet(cfg.TrustedSubnet)
+	// series of the local repository, cluster nodes limit series they own, other series are admitted by their owners
+	seriesOptions := []cardinality.Option{cardinality.WithClientLimit(cfg.Quota.MaxSeries)}
+	if clusterRepository != nil {
+		seriesOptions = append(seriesOptions, cardinality.WithOwner(clusterRepository.Owns))
+	}
+	series, err := cardinality.NewIndex(context.Background(), cfg.Cardinality, repository, seriesOptions...)
 	if err != nil {
 		return nil, err
 	}
 
-	control := controller.NewController(repository, cfg.HashKey)
+	webhooks, err := webhook.NewDispatcher(cfg.Webhooks, cfg.HashKey)
+	if err != nil {
+		return nil, err
+	}
+
+	recentValues := history.NewHistory(cfg.HistorySize)
+	primary := replication.NewPrimary(cfg.Replication.BacklogSize, repository)
+	observers := []controller.Option{
+		controller.WithKeyring(keys),
+		controller.WithReplayGuard(replayGuard),
+		controller.WithQuota(limiter),
+		controller.WithCardinality(series),
+		controller.WithObserver(recentValues),
+		controller.WithObserver(webhooks),
+		controller.WithObserver(primary),
+	}
 
-	server := GetServer(cfg.Protocol, cfg.CollectorAddress, control, privateKey, trustedSubnet)
+	var (
+		replica           *replication.Replica
+		replicationStatus handlers.ReplicationProvider = primaryStatus{primary}
+	)
+	if cfg.Replication.IsReplica() {
+		replica, err = replication.NewReplica(cfg.Replication, repository, cfg.PeerToken, peerTLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		observers = append(observers, controller.WithReadOnly(replica.ReadOnly))
+		replicationStatus = replica
+	}
+
+	var forwarder *federation.Forwarder
+	if cfg.Upstream.Enabled() {
+		forwarder, err = federation.NewForwarder(cfg.Upstream)
+		if err != nil {
+			return nil, err
+		}
+		observers = append(observers, controller.WithObserver(forwarder))
+	}
+
+	control := controller.NewController(store, cfg.HashKey, observers...)
+
+	mapper, err := ingest.NewMapper(cfg.Ingest.CounterPatterns, cfg.Ingest.LabelTags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ingest counter patterns: %w", err)
+	}
+
+	alerts, err := alerting.NewEngine(cfg.Alerting, control)
+	if err != nil {
+		return nil, err
+	}
+
+	serverOptions := Options{
+		Control:           control,
+		CryptoKeys:        cryptoKeys,
+		RequireEncryption: cfg.RequireEncryption,
+		IPFilter:          ipFilter,
+		TLSConfig:         tlsConfig,
+		Authenticator:     authenticator,
+		Limiter:           limiter,
+		Limits:            cfg.Limits,
+		Cluster:           cfg.Cluster.Enabled(),
+		PeerSubnets:       peerSubnets,
+		GRPCOptions: []handlers.GRPCOption{
+			handlers.WithReplicationSource(primary),
+		},
+		HTTPOptions: []handlers.HandlerOption{
+			handlers.WithLimits(cfg.Limits.MaxBodySize, getMetricsLimits(cfg.Limits)),
+			handlers.WithIngestMapper(mapper),
+			handlers.WithAlerts(alerts),
+			handlers.WithHistory(recentValues),
+			handlers.WithReplication(replicationStatus),
+			handlers.WithKeyring(keys),
+			handlers.WithCardinality(series),
+		},
+	}
+	var (
+		servers     []Server
+		servingSelf bool
+	)
+	for _, listener := range cfg.Listeners() {
+		servers = append(servers, GetServer(listener.Protocol, listener.Address, serverOptions))
+		servingSelf = servingSelf || listener.Protocol == configs.GRPCProtocol && listener.Address == cfg.Cluster.Self
+	}
+
+	var ingesters []Server
+	if cfg.StatsD.Enabled() {
+		ingesters = append(ingesters, NewStatsDServer(cfg.StatsD, control, getMetricsLimits(cfg.Limits), ipFilter))
+	}
+	if cfg.Ingest.GraphiteAddress != "" {
+		ingesters = append(ingesters, NewGraphiteServer(cfg.Ingest.GraphiteAddress, control, mapper, getMetricsLimits(cfg.Limits), ipFilter))
+	}
+	if cfg.Cluster.Enabled() && !servingSelf {
+		// cluster nodes forward requests by gRPC
+		ingesters = append(ingesters, NewGRPCServer(cfg.Cluster.Self, serverOptions))
+	}
+
+	scraper, err := scrape.NewScraper(cfg.Scrape, control, cfg.Limits.MaxBodySize, getMetricsLimits(cfg.Limits))
+	if err != nil {
+		return nil, err
+	}
+
+	recorder, err := recording.NewRecorder(cfg.Recording, control)
+	if err != nil {
+		return nil, err
+	}
+
+	var exporter *export.Exporter
+	if cfg.Export.Enabled() {
+		exporter, err = export.NewExporter(cfg.Export, control)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 
 	return &application{
-		server:        server,
+		servers:       servers,
+		ingesters:     ingesters,
+		scraper:       scraper,
+		alerts:        alerts,
+		recorder:      recorder,
+		webhooks:      webhooks,
+		exporter:      exporter,
+		forwarder:     forwarder,
+		cluster:       clusterRepository,
+		replica:       replica,
+		certificates:  certificates,
+		authenticator: authenticator,
+		keyring:       keys,
+		cryptoKeys:    cryptoKeys,
+		replayGuard:   replayGuard,
+		limiter:       limiter,
+		series:        series,
+		tickerPool:    utils.NewTickerPool(),
+		ctx:           ctx,
+		cancel:        cancel,
 		profileServer: &http.Server{Addr: cfg.ProfileAddress},
 		repository:    repository,
 	}, nil
@@ -75,14 +341,75 @@ func GetApplication(cfg configs.ServerConfig) (*application, error) {
 func (a *application) Start() {
 	wg := sync.WaitGroup{}
 
-	// run server
+	// run HTTP and gRPC servers
+	for _, server := range a.servers {
+		wg.Add(1)
+		go func(server Server) {
+			defer wg.Done()
+			err := server.Run()
+			log.Infof("server %v closed: %v", server.GetAddress(), err)
+		}(server)
+	}
+
+	// run additional ingestion listeners
+	for _, ingester := range a.ingesters {
+		wg.Add(1)
+		go func(ingester Server) {
+			defer wg.Done()
+			err := ingester.Run()
+			log.Infof("ingester %v closed: %v", ingester.GetAddress(), err)
+		}(ingester)
+	}
+
+	// run webhook deliveries
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		err := a.server.Run()
-		log.Info("server closed:", err)
+		a.webhooks.Run(a.ctx)
 	}()
 
+	// run exporter
+	if a.exporter != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.exporter.Run(a.ctx)
+			log.Debugf("Exporter finished")
+		}()
+	}
+
+	// run replication from primary
+	if a.replica != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.replica.Run(a.ctx)
+			log.Debugf("Replication finished")
+		}()
+	}
+
+	// run periodic tasks
+	a.scraper.Start(a.ctx, a.tickerPool)
+	a.alerts.Start(a.ctx, a.tickerPool)
+	a.recorder.Start(a.ctx, a.tickerPool)
+	if a.forwarder != nil {
+		a.forwarder.Start(a.ctx, a.tickerPool)
+	}
+	if a.cluster != nil {
+		a.cluster.Start(a.ctx, a.tickerPool)
+	}
+	if a.certificates != nil {
+		a.certificates.Start(a.ctx, a.tickerPool)
+	}
+	if a.authenticator != nil {
+		a.authenticator.Start(a.ctx, a.tickerPool)
+	}
+	a.keyring.Start(a.ctx, a.tickerPool)
+	a.cryptoKeys.Start(a.ctx)
+	a.replayGuard.Start(a.ctx, a.tickerPool)
+	a.limiter.Start(a.ctx, a.tickerPool)
+	a.series.Start(a.ctx, a.tickerPool)
+
 	// run backup ticker
 	if backuper, ok := a.repository.(storage.Backuper); ok {
 		wg.Add(1)
@@ -100,9 +427,16 @@ func (a *application) Start() {
 		log.Infoln("profile server closed:", err)
 	}(a.profileServer)
 
-	log.Infoln("Application started, addr:", a.server.GetAddress())
+	log.Infoln("Application started, addr:", a.addresses())
 
 	wg.Wait()
+	a.tickerPool.Wait()
+
+	if a.forwarder != nil {
+		if err := a.forwarder.Close(); err != nil {
+			log.Error(err)
+		}
+	}
 
 	if backuper, ok := a.repository.(storage.Backuper); ok {
 		err := backuper.Backup()
@@ -111,14 +445,41 @@ func (a *application) Start() {
 		}
 	}
 
-	log.Infoln("Application stopped, addr:", a.server.GetAddress())
+	log.Infoln("Application stopped, addr:", a.addresses())
+}
+
+func (a *application) addresses() []string {
+	addresses := make([]string, 0, len(a.servers))
+	for _, server := range a.servers {
+		addresses = append(addresses, server.GetAddress())
+	}
+	return addresses
+}
+
+// primaryStatus reports replication state of primary server, which can't be promoted.
+type primaryStatus struct {
+	*replication.Primary
+}
+
+func (p primaryStatus) Promote() error {
+	return replication.ErrNotReplica
 }
 
 func (a *application) Stop() {
 	log.Infoln("Shutting down")
-	err := a.server.Close()
-	if err != nil {
-		log.Error(err)
+	a.cancel()
+
+	var err error
+	for _, server := range a.servers {
+		if err = server.Close(); err != nil {
+			log.Error(err)
+		}
+	}
+
+	for _, ingester := range a.ingesters {
+		if err = ingester.Close(); err != nil {
+			log.Error(err)
+		}
 	}
 
 	err = a.profileServer.Shutdown(context.TODO())
@@ -126,6 +487,16 @@ func (a *application) Stop() {
 		log.Error(err)
 	}
 
+	if a.cluster != nil {
+		a.cluster.Close()
+	}
+
+	if a.authenticator != nil {
+		if err = a.authenticator.Close(); err != nil {
+			log.Error(err)
+		}
+	}
+
 	err = a.repository.Shutdown()
 	if err != nil {
 		log.Error(err)
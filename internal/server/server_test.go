@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/auth"
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/quota"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+	pb "github.com/unbeman/ya-prac-mcas/proto"
+)
+
+type staticTokens []auth.Token
+
+func (s staticTokens) Load(ctx context.Context) ([]auth.Token, error) {
+	return s, nil
+}
+
+type counterObserver struct {
+	deltas chan int64
+}
+
+func (o counterObserver) Observe(metric metrics.Metric, counterDelta int64) {
+	o.deltas <- counterDelta
+}
+
+// Update outcomes common for both transports.
+const (
+	saved           = "saved"
+	unauthenticated = "unauthenticated"
+	quotaExceeded   = "quota exceeded"
+)
+
+func updateHTTP(t *testing.T, address, secret string) string {
+	request, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://%v/update/counter/PollCount/3", address), nil)
+	require.NoError(t, err)
+	if secret != "" {
+		request.Header.Set("Authorization", auth.BearerHeader(secret))
+	}
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	switch response.StatusCode {
+	case http.StatusOK:
+		return saved
+	case http.StatusUnauthorized:
+		return unauthenticated
+	case http.StatusTooManyRequests:
+		return quotaExceeded
+	}
+	return response.Status
+}
+
+func updateGRPC(t *testing.T, address, secret string) string {
+	options := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	if secret != "" {
+		options = append(options, grpc.WithPerRPCCredentials(auth.Credentials(secret)))
+	}
+	conn, err := grpc.Dial(address, options...)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = pb.NewMetricsCollectorClient(conn).UpdateMetric(context.Background(),
+		&pb.UpdateMetricRequest{Metric: metrics.NewCounter("PollCount", 3).ToProto()})
+	switch status.Code(err) {
+	case codes.OK:
+		return saved
+	case codes.Unauthenticated:
+		return unauthenticated
+	case codes.ResourceExhausted:
+		return quotaExceeded
+	}
+	return err.Error()
+}
+
+func TestGetServer_Transports(t *testing.T) {
+	tests := []struct {
+		protocol string
+		update   func(t *testing.T, address, secret string) string
+	}{
+		{protocol: configs.HTTPProtocol, update: updateHTTP},
+		{protocol: configs.GRPCProtocol, update: updateGRPC},
+	}
+	for _, tt := range tests {
+		t.Run(tt.protocol, func(t *testing.T) {
+			authenticator, err := auth.NewAuthenticator(context.Background(), staticTokens{
+				{Name: "agent", Hash: auth.HashToken("write-secret"), Scopes: []string{auth.WriteScope}},
+			}, 0)
+			require.NoError(t, err)
+			limiter := quota.NewLimiter(configs.QuotaConfig{RequestsPerSecond: 0.1, RequestsBurst: 1})
+			observer := counterObserver{deltas: make(chan int64, 10)}
+			repository := storage.NewRAMRepository()
+			address := freeAddress(t)
+			server := GetServer(tt.protocol, address, Options{
+				Control:       controller.NewController(repository, "", controller.WithObserver(observer)),
+				Authenticator: authenticator,
+				Limiter:       limiter,
+			})
+			go server.Run()
+			defer server.Close()
+			dial(t, address).Close()
+
+			assert.Equal(t, unauthenticated, tt.update(t, address, ""))
+			assert.Equal(t, saved, tt.update(t, address, "write-secret"))
+			assert.Equal(t, quotaExceeded, tt.update(t, address, "write-secret"))
+
+			counter, err := repository.GetCounter(context.Background(), "PollCount")
+			require.NoError(t, err)
+			assert.Equal(t, int64(3), counter.Value())
+			select {
+			case delta := <-observer.deltas:
+				assert.Equal(t, int64(3), delta)
+			case <-time.After(time.Second):
+				t.Fatal("saved update isn't observed")
+			}
+			assert.Empty(t, observer.deltas, "rejected updates aren't observed")
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/cardinality"
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/statsd"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+)
+
+const statsdPacketSize = 65535
+
+// StatsDServer receives StatsD lines over UDP and TCP, aggregates them
+// and saves to repository through controller.Controller every flush interval.
+// StatsD can't sign metrics, so packets and connections are accepted only from trusted subnets when they're set.
+type StatsDServer struct {
+	sync.Mutex
+	udpAddress    string
+	tcpAddress    string
+	flushInterval time.Duration
+	control       *controller.Controller
+	limits        metrics.Limits
+	ipFilter      *utils.IPFilter
+	aggregator    *statsd.Aggregator
+	udpConn       net.PacketConn
+	tcpListener   net.Listener
+	tcpConns      map[net.Conn]struct{}
+	closing       chan struct{}
+	wg            sync.WaitGroup
+}
+
+func NewStatsDServer(
+	cfg configs.StatsDConfig,
+	control *controller.Controller,
+	limits metrics.Limits,
+	ipFilter *utils.IPFilter) *StatsDServer {
+	return &StatsDServer{
+		udpAddress:    cfg.UDPAddress,
+		tcpAddress:    cfg.TCPAddress,
+		flushInterval: cfg.FlushInterval,
+		control:       control,
+		limits:        limits,
+		ipFilter:      ipFilter,
+		aggregator:    statsd.NewAggregator(),
+		tcpConns:      map[net.Conn]struct{}{},
+		closing:       make(chan struct{}),
+	}
+}
+
+func (s *StatsDServer) GetAddress() string {
+	if s.udpAddress != "" {
+		return s.udpAddress
+	}
+	return s.tcpAddress
+}
+
+func (s *StatsDServer) Run() error {
+	if err := s.listen(); err != nil {
+		s.Close()
+		return err
+	}
+
+	log.Info("starting StatsD server")
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closing:
+			s.wg.Wait()
+			s.flush()
+			return nil
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
+
+func (s *StatsDServer) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	select {
+	case <-s.closing:
+		return nil
+	default:
+		close(s.closing)
+	}
+
+	var err error
+	if s.udpConn != nil {
+		err = s.udpConn.Close()
+	}
+	if s.tcpListener != nil {
+		if tcpErr := s.tcpListener.Close(); err == nil {
+			err = tcpErr
+		}
+	}
+	for conn := range s.tcpConns {
+		conn.Close()
+	}
+	return err
+}
+
+func (s *StatsDServer) listen() error {
+	s.Lock()
+	defer s.Unlock()
+
+	select {
+	case <-s.closing:
+		return nil
+	default:
+	}
+
+	if s.udpAddress != "" {
+		conn, err := net.ListenPacket("udp", s.udpAddress)
+		if err != nil {
+			return fmt.Errorf("can't bind StatsD UDP address: %w", err)
+		}
+		s.udpConn = conn
+		s.wg.Add(1)
+		go s.serveUDP()
+	}
+
+	if s.tcpAddress != "" {
+		listener, err := net.Listen("tcp", s.tcpAddress)
+		if err != nil {
+			return fmt.Errorf("can't bind StatsD TCP address: %w", err)
+		}
+		s.tcpListener = listener
+		s.wg.Add(1)
+		go s.serveTCP()
+	}
+	return nil
+}
+
+func (s *StatsDServer) serveUDP() {
+	defer s.wg.Done()
+	buf := make([]byte, statsdPacketSize)
+	for {
+		n, addr, err := s.udpConn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Error("StatsD UDP read failed: ", err)
+			continue
+		}
+		if err = s.ipFilter.Check(utils.ParseHostIP(addr.String())); err != nil {
+			log.Debug("StatsD packet rejected: ", err)
+			continue
+		}
+		s.handle(buf[:n])
+	}
+}
+
+func (s *StatsDServer) serveTCP() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.tcpListener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Error("StatsD TCP accept failed: ", err)
+			continue
+		}
+		if err = s.ipFilter.Check(utils.ParseHostIP(conn.RemoteAddr().String())); err != nil {
+			log.Warn("StatsD connection rejected: ", err)
+			conn.Close()
+			continue
+		}
+
+		s.Lock()
+		select {
+		case <-s.closing:
+			// Close has already closed tracked connections
+			s.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		s.tcpConns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.Unlock()
+
+		go s.serveTCPConn(conn)
+	}
+}
+
+func (s *StatsDServer) serveTCPConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.Lock()
+		delete(s.tcpConns, conn)
+		s.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		s.handle(scanner.Bytes())
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Error("StatsD TCP read failed: ", err)
+	}
+}
+
+func (s *StatsDServer) handle(data []byte) {
+	samples, errs := statsd.ParsePacket(data)
+	for _, err := range errs {
+		log.Debug(err)
+	}
+	for _, sample := range samples {
+		if err := s.limits.CheckNameLength(sample.Name); err != nil {
+			log.Debug(err)
+			continue
+		}
+		s.aggregator.Add(sample)
+	}
+}
+
+// flush saves aggregated metrics by batches of MaxBatchSize, relative gauges are applied to the current repository values.
+// Metrics of batches failed by transient errors are merged back to aggregator, so they're saved by the next flush.
+// Permanently rejected batch is saved metric by metric, so only rejected series are dropped.
+func (s *StatsDServer) flush() {
+	ctx := context.Background()
+	slice, relativeGauges := s.aggregator.Flush()
+
+	for name, delta := range relativeGauges {
+		value := delta
+		current, err := s.control.GetMetric(ctx, metrics.Params{Name: name, Type: metrics.GaugeType})
+		switch {
+		case err == nil:
+			value += current.(metrics.Gauge).Value()
+		case !errors.Is(err, storage.ErrNotFound):
+			log.Errorf("StatsD: can't get gauge %v: %v", name, err)
+			continue
+		}
+		slice = append(slice, metrics.Params{Name: name, Type: metrics.GaugeType, ValueGauge: &value})
+	}
+
+	if len(slice) == 0 {
+		return
+	}
+
+	size := len(slice)
+	if s.limits.MaxBatchSize > 0 {
+		size = s.limits.MaxBatchSize
+	}
+	saved := 0
+	for start := 0; start < len(slice); start += size {
+		end := start + size
+		if end > len(slice) {
+			end = len(slice)
+		}
+		_, err := s.control.UpdateMetrics(controller.WithTrustedSource(ctx), slice[start:end])
+		switch {
+		case err == nil:
+			saved += end - start
+		case errors.Is(err, controller.ErrReadOnly):
+			log.Warnf("StatsD: %d metrics dropped: %v", end-start, err)
+		case isPermanent(err):
+			saved += s.saveEach(ctx, slice[start:end])
+		default:
+			log.Errorf("StatsD: can't save %d metrics, they're kept for the next flush: %v", end-start, err)
+			s.aggregator.Merge(slice[start:end])
+		}
+	}
+	log.Debugf("StatsD: %d metrics saved", saved)
+}
+
+// saveEach saves metrics one by one, permanently rejected ones are dropped, the others are kept for the next flush.
+// It returns count of saved metrics.
+func (s *StatsDServer) saveEach(ctx context.Context, slice metrics.ParamsSlice) int {
+	saved := 0
+	for _, params := range slice {
+		_, err := s.control.UpdateMetric(controller.WithTrustedSource(ctx), params)
+		switch {
+		case err == nil:
+			saved++
+		case isPermanent(err):
+			log.Warnf("StatsD: %v %v dropped: %v", params.Type, params.Name, err)
+		default:
+			log.Errorf("StatsD: can't save %v %v, it's kept for the next flush: %v", params.Type, params.Name, err)
+			s.aggregator.Merge(metrics.ParamsSlice{params})
+		}
+	}
+	return saved
+}
+
+// isPermanent reports whether update is rejected regardless of time, so retrying it is pointless.
+func isPermanent(err error) bool {
+	return errors.Is(err, cardinality.ErrLimitExceeded) ||
+		errors.Is(err, metrics.ErrTooLarge) ||
+		errors.Is(err, controller.ErrReadOnly)
+}
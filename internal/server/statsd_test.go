@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/cardinality"
+	"github.com/unbeman/ya-prac-mcas/internal/controller"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+	"github.com/unbeman/ya-prac-mcas/internal/storage"
+	"github.com/unbeman/ya-prac-mcas/internal/utils"
+)
+
+// unavailableRepository fails batch updates while down is set.
+type unavailableRepository struct {
+	storage.Repository
+	down atomic.Bool
+}
+
+var errUnavailable = errors.New("repository is unavailable")
+
+func (r *unavailableRepository) AddCounters(ctx context.Context, slice []metrics.Counter) ([]metrics.Counter, error) {
+	if r.down.Load() {
+		return nil, errUnavailable
+	}
+	return r.Repository.AddCounters(ctx, slice)
+}
+
+func (r *unavailableRepository) SetGauges(ctx context.Context, slice []metrics.Gauge) ([]metrics.Gauge, error) {
+	if r.down.Load() {
+		return nil, errUnavailable
+	}
+	return r.Repository.SetGauges(ctx, slice)
+}
+
+func TestStatsDServer_Flush(t *testing.T) {
+	repository := &unavailableRepository{Repository: storage.NewRAMRepository()}
+	repository.down.Store(true)
+	control := controller.NewController(repository, "")
+	server := NewStatsDServer(configs.StatsDConfig{}, control, metrics.Limits{MaxBatchSize: 1, MaxNameLength: 12}, nil)
+
+	server.handle([]byte("deploys:2|c\nFreeMemory:100|g\nlong_name_counter:1|c"))
+	server.flush()
+	_, err := repository.GetCounter(context.Background(), "deploys")
+	require.ErrorIs(t, err, storage.ErrNotFound)
+
+	server.handle([]byte("deploys:1|c"))
+	repository.down.Store(false)
+	server.flush()
+	counter, err := repository.GetCounter(context.Background(), "deploys")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), counter.Value(), "metrics of failed flush are saved by the next one")
+	gauge, err := repository.GetGauge(context.Background(), "FreeMemory")
+	require.NoError(t, err)
+	assert.Equal(t, 100.0, gauge.Value())
+	_, err = repository.GetCounter(context.Background(), "long_name_counter")
+	assert.ErrorIs(t, err, storage.ErrNotFound, "name length is limited")
+}
+
+func TestStatsDServer_FlushRejected(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		readOnly  bool
+		wantSaved bool
+	}{
+		{name: "series limit", wantSaved: true},
+		{name: "read-only replica", readOnly: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repository := storage.NewRAMRepository()
+			_, err := repository.AddCounter(ctx, "deploys", 1)
+			require.NoError(t, err)
+			index, err := cardinality.NewIndex(ctx, configs.CardinalityConfig{MaxSeries: 1}, repository)
+			require.NoError(t, err)
+			control := controller.NewController(repository, "", controller.WithCardinality(index),
+				controller.WithReadOnly(func() bool { return tt.readOnly }))
+			server := NewStatsDServer(configs.StatsDConfig{}, control, metrics.Limits{}, nil)
+
+			server.handle([]byte("deploys:2|c\nerrors:1|c"))
+			server.flush()
+			counter, err := repository.GetCounter(ctx, "deploys")
+			require.NoError(t, err)
+			if tt.wantSaved {
+				assert.Equal(t, int64(3), counter.Value(), "known series of rejected batch are saved")
+			} else {
+				assert.Equal(t, int64(1), counter.Value())
+			}
+
+			slice, _ := server.aggregator.Flush()
+			assert.Empty(t, slice, "rejected metrics aren't retried")
+		})
+	}
+}
+
+func freeUDPAddress(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestStatsDServer_TrustedSubnet(t *testing.T) {
+	tests := []struct {
+		name      string
+		subnet    string
+		wantSaved bool
+	}{
+		{name: "trusted client", subnet: "127.0.0.0/8", wantSaved: true},
+		{name: "untrusted client", subnet: "10.0.0.0/8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipFilter, err := utils.NewIPFilter(tt.subnet, "")
+			require.NoError(t, err)
+			repository := storage.NewRAMRepository()
+			udpAddress, tcpAddress := freeUDPAddress(t), freeAddress(t)
+			server := NewStatsDServer(configs.StatsDConfig{UDPAddress: udpAddress, TCPAddress: tcpAddress, FlushInterval: time.Hour},
+				controller.NewController(repository, ""), metrics.Limits{}, ipFilter)
+			go server.Run()
+			defer server.Close()
+
+			udp, err := net.Dial("udp", udpAddress)
+			require.NoError(t, err)
+			defer udp.Close()
+			received := func() bool {
+				conn, err := net.Dial("tcp", tcpAddress)
+				if err == nil {
+					fmt.Fprint(conn, "tcp:1|c\n")
+					conn.Close()
+				}
+				fmt.Fprint(udp, "udp:1|c")
+				server.flush()
+				_, tcpErr := repository.GetCounter(context.Background(), "tcp")
+				_, udpErr := repository.GetCounter(context.Background(), "udp")
+				if tt.wantSaved {
+					return tcpErr == nil && udpErr == nil
+				}
+				return tcpErr == nil || udpErr == nil
+			}
+			if tt.wantSaved {
+				assert.Eventually(t, received, time.Second, 10*time.Millisecond)
+			} else {
+				assert.Never(t, received, 200*time.Millisecond, 10*time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestStatsDServer_Close(t *testing.T) {
+	address := freeAddress(t)
+	repository := storage.NewRAMRepository()
+	server := NewStatsDServer(configs.StatsDConfig{TCPAddress: address, FlushInterval: time.Hour},
+		controller.NewController(repository, ""), metrics.Limits{}, nil)
+	done := make(chan error)
+	go func() {
+		done <- server.Run()
+	}()
+
+	conn := dial(t, address)
+	defer conn.Close()
+	fmt.Fprint(conn, "deploys:1|c\n")
+	require.Eventually(t, func() bool {
+		server.Lock()
+		defer server.Unlock()
+		return len(server.tcpConns) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, server.Close())
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Run isn't stopped by Close")
+	}
+	counter, err := repository.GetCounter(context.Background(), "deploys")
+	require.NoError(t, err, "aggregated metrics are flushed on close")
+	assert.Equal(t, int64(1), counter.Value())
+}
@@ -0,0 +1,126 @@
+package statsd
+
+import (
+	"math"
+	"sync"
+
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+type timerStats struct {
+	count   int64 // scaled by sample rate
+	samples int64 // actually received
+	sum     float64
+	lower   float64
+	upper   float64
+}
+
+// Aggregator accumulates samples between flushes, so counters hit repository once per flush.
+type Aggregator struct {
+	sync.Mutex
+	counters       map[string]float64
+	gauges         map[string]float64
+	relativeGauges map[string]float64
+	timers         map[string]*timerStats
+}
+
+// NewAggregator creates Aggregator.
+func NewAggregator() *Aggregator {
+	a := &Aggregator{}
+	a.reset()
+	return a
+}
+
+func (a *Aggregator) reset() {
+	a.counters = map[string]float64{}
+	a.gauges = map[string]float64{}
+	a.relativeGauges = map[string]float64{}
+	a.timers = map[string]*timerStats{}
+}
+
+// Add accumulates sample.
+func (a *Aggregator) Add(sample Sample) {
+	a.Lock()
+	defer a.Unlock()
+	switch sample.Type {
+	case CounterType:
+		a.counters[sample.Name] += sample.Value / sample.SampleRate
+	case GaugeType:
+		if !sample.Relative {
+			a.gauges[sample.Name] = sample.Value
+			delete(a.relativeGauges, sample.Name)
+			return
+		}
+		if _, ok := a.gauges[sample.Name]; ok {
+			a.gauges[sample.Name] += sample.Value
+			return
+		}
+		a.relativeGauges[sample.Name] += sample.Value
+	case TimerType, HistType:
+		stats, ok := a.timers[sample.Name]
+		if !ok {
+			stats = &timerStats{lower: sample.Value, upper: sample.Value}
+			a.timers[sample.Name] = stats
+		}
+		stats.count += int64(math.Round(1 / sample.SampleRate))
+		stats.samples++
+		stats.sum += sample.Value
+		stats.lower = math.Min(stats.lower, sample.Value)
+		stats.upper = math.Max(stats.upper, sample.Value)
+	}
+}
+
+// Flush returns accumulated metrics and resets state.
+// Counters are flushed by whole increments, fractional remainder of sampled counters is kept for the next flush.
+// Relative gauges are returned separately as deltas, they should be applied to current values.
+// Timers are converted to <name>.count counter and <name>.mean, <name>.lower, <name>.upper gauges.
+func (a *Aggregator) Flush() (metrics.ParamsSlice, map[string]float64) {
+	a.Lock()
+	defer a.Unlock()
+
+	counters, gauges := a.counters, a.gauges
+	for name, stats := range a.timers {
+		counters[name+".count"] += float64(stats.count)
+		gauges[name+".mean"] = stats.sum / float64(stats.samples)
+		gauges[name+".lower"] = stats.lower
+		gauges[name+".upper"] = stats.upper
+	}
+	relative := a.relativeGauges
+	a.reset()
+
+	slice := make(metrics.ParamsSlice, 0, len(counters)+len(gauges))
+	for name, value := range counters {
+		delta := int64(math.Trunc(value))
+		if remainder := value - float64(delta); remainder != 0 {
+			a.counters[name] = remainder
+		}
+		if delta == 0 {
+			continue
+		}
+		slice = append(slice, metrics.Params{Name: name, Type: metrics.CounterType, ValueCounter: &delta})
+	}
+	for name, value := range gauges {
+		v := value
+		slice = append(slice, metrics.Params{Name: name, Type: metrics.GaugeType, ValueGauge: &v})
+	}
+	return slice, relative
+}
+
+// Merge returns flushed metrics that weren't saved, so they're flushed again.
+// Counter increments are added to the accumulated ones, gauges are kept unless they're set after the flush.
+func (a *Aggregator) Merge(slice metrics.ParamsSlice) {
+	a.Lock()
+	defer a.Unlock()
+	for _, params := range slice {
+		switch params.Type {
+		case metrics.CounterType:
+			a.counters[params.Name] += float64(params.GetCounterValue())
+		case metrics.GaugeType:
+			if _, ok := a.gauges[params.Name]; ok {
+				continue
+			}
+			a.gauges[params.Name] = params.GetGaugeValue() + a.relativeGauges[params.Name]
+			delete(a.relativeGauges, params.Name)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+func TestAggregator_Flush(t *testing.T) {
+	a := NewAggregator()
+	a.Add(Sample{Name: "deploys", Type: CounterType, Value: 1, SampleRate: 1})
+	a.Add(Sample{Name: "deploys", Type: CounterType, Value: 2, SampleRate: 0.5})
+	a.Add(Sample{Name: "FreeMemory", Type: GaugeType, Value: 100, SampleRate: 1})
+	a.Add(Sample{Name: "FreeMemory", Type: GaugeType, Value: -10, SampleRate: 1, Relative: true})
+	a.Add(Sample{Name: "queue", Type: GaugeType, Value: 5, SampleRate: 1, Relative: true})
+	a.Add(Sample{Name: "latency", Type: TimerType, Value: 10, SampleRate: 1})
+	a.Add(Sample{Name: "latency", Type: TimerType, Value: 30, SampleRate: 1})
+
+	slice, relative := a.Flush()
+
+	got := map[string]*metrics.Params{}
+	for idx, params := range slice {
+		got[params.Name] = &slice[idx]
+	}
+	assert.Len(t, got, 6)
+	assert.Equal(t, int64(5), got["deploys"].GetCounterValue())
+	assert.Equal(t, 90.0, got["FreeMemory"].GetGaugeValue())
+	assert.Equal(t, int64(2), got["latency.count"].GetCounterValue())
+	assert.Equal(t, 20.0, got["latency.mean"].GetGaugeValue())
+	assert.Equal(t, 10.0, got["latency.lower"].GetGaugeValue())
+	assert.Equal(t, 30.0, got["latency.upper"].GetGaugeValue())
+	assert.Equal(t, map[string]float64{"queue": 5}, relative)
+
+	slice, relative = a.Flush()
+	assert.Empty(t, slice)
+	assert.Empty(t, relative)
+}
+
+func TestAggregator_FlushRemainder(t *testing.T) {
+	a := NewAggregator()
+	a.Add(Sample{Name: "requests", Type: CounterType, Value: 1, SampleRate: 0.4})
+
+	slice, _ := a.Flush()
+	require.Len(t, slice, 1)
+	assert.Equal(t, int64(2), slice[0].GetCounterValue())
+
+	a.Add(Sample{Name: "requests", Type: CounterType, Value: 1, SampleRate: 0.4})
+	slice, _ = a.Flush()
+	require.Len(t, slice, 1)
+	assert.Equal(t, int64(3), slice[0].GetCounterValue(), "remainder of the previous flush is added")
+
+	slice, _ = a.Flush()
+	assert.Empty(t, slice, "remainder below one isn't flushed")
+}
+
+func TestAggregator_Merge(t *testing.T) {
+	a := NewAggregator()
+	a.Add(Sample{Name: "deploys", Type: CounterType, Value: 2, SampleRate: 1})
+	a.Add(Sample{Name: "FreeMemory", Type: GaugeType, Value: 100, SampleRate: 1})
+	a.Add(Sample{Name: "Alloc", Type: GaugeType, Value: 10, SampleRate: 1})
+	slice, _ := a.Flush()
+
+	a.Add(Sample{Name: "deploys", Type: CounterType, Value: 1, SampleRate: 1})
+	a.Add(Sample{Name: "FreeMemory", Type: GaugeType, Value: 50, SampleRate: 1})
+	a.Add(Sample{Name: "Alloc", Type: GaugeType, Value: 5, SampleRate: 1, Relative: true})
+	a.Merge(slice)
+
+	slice, relative := a.Flush()
+	got := map[string]*metrics.Params{}
+	for idx, params := range slice {
+		got[params.Name] = &slice[idx]
+	}
+	assert.Equal(t, int64(3), got["deploys"].GetCounterValue())
+	assert.Equal(t, 50.0, got["FreeMemory"].GetGaugeValue(), "gauge set after flush wins")
+	assert.Equal(t, 15.0, got["Alloc"].GetGaugeValue(), "relative gauge is applied to merged value")
+	assert.Empty(t, relative)
+}
@@ -0,0 +1,96 @@
+// Package statsd describes StatsD protocol parsing and aggregation.
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StatsD metric types.
+const (
+	CounterType = "c"
+	GaugeType   = "g"
+	TimerType   = "ms"
+	HistType    = "h"
+)
+
+var ErrInvalidLine = errors.New("invalid statsd line")
+
+// Sample is a single parsed StatsD measurement.
+type Sample struct {
+	Name       string
+	Type       string
+	Value      float64
+	SampleRate float64
+	Relative   bool // gauge value is a delta to the current one
+}
+
+// ParseLine parses line in format `name:value|type[|@rate]`.
+func ParseLine(line string) (Sample, error) {
+	sample := Sample{SampleRate: 1}
+
+	parts := strings.Split(line, "|")
+	if len(parts) < 2 {
+		return sample, fmt.Errorf("%w: (%v) no type", ErrInvalidLine, line)
+	}
+
+	colon := strings.LastIndexByte(parts[0], ':')
+	if colon <= 0 {
+		return sample, fmt.Errorf("%w: (%v) no name", ErrInvalidLine, line)
+	}
+	sample.Name = parts[0][:colon]
+	parts[0] = parts[0][colon+1:]
+
+	sample.Type = parts[1]
+	switch sample.Type {
+	case CounterType, GaugeType, TimerType, HistType:
+	default:
+		return sample, fmt.Errorf("%w: (%v) unknown type %v", ErrInvalidLine, line, sample.Type)
+	}
+
+	rawValue := parts[0]
+	if sample.Type == GaugeType && (strings.HasPrefix(rawValue, "+") || strings.HasPrefix(rawValue, "-")) {
+		sample.Relative = true
+	}
+	value, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil {
+		return sample, fmt.Errorf("%w: (%v) value - %v", ErrInvalidLine, line, err)
+	}
+	sample.Value = value
+
+	for _, part := range parts[2:] {
+		if !strings.HasPrefix(part, "@") {
+			continue // tags and other extensions are ignored
+		}
+		rate, err := strconv.ParseFloat(part[1:], 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			return sample, fmt.Errorf("%w: (%v) sample rate %v", ErrInvalidLine, line, part)
+		}
+		sample.SampleRate = rate
+	}
+	return sample, nil
+}
+
+// ParsePacket parses newline separated lines, invalid lines are returned as errors
+// and don't prevent parsing of others.
+func ParsePacket(data []byte) ([]Sample, []error) {
+	var (
+		samples []Sample
+		errs    []error
+	)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		sample, err := ParseLine(line)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		samples = append(samples, sample)
+	}
+	return samples, errs
+}
@@ -0,0 +1,85 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    Sample
+		wantErr bool
+	}{
+		{
+			name: "counter",
+			line: "deploys:1|c",
+			want: Sample{Name: "deploys", Type: CounterType, Value: 1, SampleRate: 1},
+		},
+		{
+			name: "counter with sample rate",
+			line: "requests:3|c|@0.1",
+			want: Sample{Name: "requests", Type: CounterType, Value: 3, SampleRate: 0.1},
+		},
+		{
+			name: "gauge",
+			line: "FreeMemory:1024.5|g",
+			want: Sample{Name: "FreeMemory", Type: GaugeType, Value: 1024.5, SampleRate: 1},
+		},
+		{
+			name: "relative gauge",
+			line: "queue:-5|g",
+			want: Sample{Name: "queue", Type: GaugeType, Value: -5, SampleRate: 1, Relative: true},
+		},
+		{
+			name: "timer with tags",
+			line: "latency:320|ms|#env:prod",
+			want: Sample{Name: "latency", Type: TimerType, Value: 320, SampleRate: 1},
+		},
+		{
+			name:    "no type",
+			line:    "deploys:1",
+			wantErr: true,
+		},
+		{
+			name:    "unknown type",
+			line:    "deploys:1|s",
+			wantErr: true,
+		},
+		{
+			name:    "invalid value",
+			line:    "deploys:one|c",
+			wantErr: true,
+		},
+		{
+			name:    "invalid sample rate",
+			line:    "deploys:1|c|@2",
+			wantErr: true,
+		},
+		{
+			name:    "no name",
+			line:    ":1|c",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseLine(tt.line)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidLine)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestParsePacket(t *testing.T) {
+	samples, errs := ParsePacket([]byte("a:1|c\nbad\n\nb:2|g\n"))
+	assert.Len(t, samples, 2)
+	assert.Len(t, errs, 1)
+}
@@ -28,9 +28,9 @@ func GetEncryptedMessage(rsaPubKey *rsa.PublicKey, data []byte) ([]byte, string,
 		return nil, "", fmt.Errorf("AES gen failed, %w", err)
 	}
 
-	aesMessage, err := aesEncrypt(aesKey, data)
+	msg, err := SealMessage(aesKey, data)
 	if err != nil {
-		return nil, "", fmt.Errorf("aes encryption failed, %w", err)
+		return nil, "", err
 	}
 
 	encryptedKey, err := rsaEncrypt(rsaPubKey, aesKey)
@@ -38,20 +38,11 @@ func GetEncryptedMessage(rsaPubKey *rsa.PublicKey, data []byte) ([]byte, string,
 		return nil, "", fmt.Errorf("rsa encryption failed, %w", err)
 	}
 
-	msg := make([]byte, base64.RawStdEncoding.EncodedLen(len(aesMessage)))
-	base64.RawStdEncoding.Encode(msg, aesMessage)
-
 	key := base64.RawStdEncoding.EncodeToString(encryptedKey)
 	return msg, key, nil
 }
 
 func GetDecryptedMessage(rsaPrivateKey *rsa.PrivateKey, cypher []byte, aesEncryptedKey string) ([]byte, error) {
-	encryptedMsg := make([]byte, base64.RawStdEncoding.DecodedLen(len(cypher)))
-	_, err := base64.RawStdEncoding.Decode(encryptedMsg, cypher)
-	if err != nil {
-		return nil, err
-	}
-
 	encryptedKey, err := base64.RawStdEncoding.DecodeString(aesEncryptedKey)
 	if err != nil {
 		return nil, err
@@ -62,7 +53,30 @@ func GetDecryptedMessage(rsaPrivateKey *rsa.PrivateKey, cypher []byte, aesEncryp
 		return nil, fmt.Errorf("rsa decryption failed, %w", err)
 	}
 
-	msg, err := aesDecrypt(key, encryptedMsg)
+	return OpenMessage(key, cypher)
+}
+
+// SealMessage encrypts data by AES key, the message is base64 encoded.
+func SealMessage(aesKey []byte, data []byte) ([]byte, error) {
+	aesMessage, err := aesEncrypt(aesKey, data)
+	if err != nil {
+		return nil, fmt.Errorf("aes encryption failed, %w", err)
+	}
+
+	msg := make([]byte, base64.RawStdEncoding.EncodedLen(len(aesMessage)))
+	base64.RawStdEncoding.Encode(msg, aesMessage)
+	return msg, nil
+}
+
+// OpenMessage decrypts base64 encoded message sealed by AES key.
+func OpenMessage(aesKey []byte, cypher []byte) ([]byte, error) {
+	encryptedMsg := make([]byte, base64.RawStdEncoding.DecodedLen(len(cypher)))
+	_, err := base64.RawStdEncoding.Decode(encryptedMsg, cypher)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := aesDecrypt(aesKey, encryptedMsg)
 	if err != nil {
 		return nil, fmt.Errorf("aes decryption failed, %w", err)
 	}
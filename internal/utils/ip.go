@@ -19,25 +19,120 @@ func GetOutboundIP() (string, error) {
 	return ip, nil
 }
 
-func CheckIPBelongsNetwork(incomingIP string, trustedSubnet *net.IPNet) error {
-	ip := net.ParseIP(incomingIP)
-	if ip == nil || !trustedSubnet.Contains(ip) {
-		return fmt.Errorf("%v - %w", ip, ErrInvalidIP)
+// Subnets is a set of IPv4 and IPv6 networks.
+type Subnets []*net.IPNet
+
+// ParseSubnets parses comma-separated CIDRs, an address without mask is the network of the single address.
+func ParseSubnets(list string) (Subnets, error) {
+	var subnets Subnets
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			subnets = append(subnets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+// Contains reports if IP belongs to any of subnets.
+func (s Subnets) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
 	}
-	return nil
+	for _, subnet := range s {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
-func GetTrustedSubnet(cidr string) (*net.IPNet, error) {
-	var (
-		trustedSubnet *net.IPNet
-		err           error
-	)
+// IPFilter resolves client IP of request and checks it belongs to trusted subnets.
+// Client IP is the transport peer address, forwarding headers are honoured
+// only when the peer is a trusted proxy, so clients can't spoof their address.
+type IPFilter struct {
+	trusted Subnets
+	proxies Subnets
+}
 
-	if cidr != "" {
-		_, trustedSubnet, err = net.ParseCIDR(cidr)
-		if err != nil {
-			return nil, fmt.Errorf("can't parse trusted subnet, reason: %w", err)
+// NewIPFilter creates IPFilter of comma-separated CIDRs, nil filter is returned when neither is set.
+func NewIPFilter(trustedSubnets, trustedProxies string) (*IPFilter, error) {
+	trusted, err := ParseSubnets(trustedSubnets)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse trusted subnet, reason: %w", err)
+	}
+	proxies, err := ParseSubnets(trustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse trusted proxies, reason: %w", err)
+	}
+	if len(trusted) == 0 && len(proxies) == 0 {
+		return nil, nil
+	}
+	return &IPFilter{trusted: trusted, proxies: proxies}, nil
+}
+
+// Enabled reports if client IP is checked.
+func (f *IPFilter) Enabled() bool {
+	return f != nil && len(f.trusted) > 0
+}
+
+// ClientIP returns IP of client connected from peer address, forwardedFor and realIP are values of
+// X-Forwarded-For and X-Real-IP headers. X-Forwarded-For is read from right to left skipping trusted proxies,
+// so the first untrusted hop is the client. Nil is returned when no valid address is found.
+func (f *IPFilter) ClientIP(peerAddr string, forwardedFor []string, realIP []string) net.IP {
+	ip := ParseHostIP(peerAddr)
+	if f == nil || !f.proxies.Contains(ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, header := range forwardedFor {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) > 0 {
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip = ParseHostIP(strings.TrimSpace(hops[i]))
+			if ip == nil || !f.proxies.Contains(ip) {
+				return ip
+			}
 		}
+		return ip
+	}
+	if len(realIP) > 0 {
+		return ParseHostIP(strings.TrimSpace(realIP[0]))
+	}
+	return ip
+}
+
+// Check returns error when IP doesn't belong to trusted subnets.
+func (f *IPFilter) Check(ip net.IP) error {
+	if !f.Enabled() || f.trusted.Contains(ip) {
+		return nil
+	}
+	return fmt.Errorf("%v - %w", ip, ErrInvalidIP)
+}
+
+// ParseHostIP returns IP of address with or without port, nil is returned for invalid address.
+func ParseHostIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
 	}
-	return trustedSubnet, nil
+	return net.ParseIP(strings.Trim(addr, "[]"))
 }
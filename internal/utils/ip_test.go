@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSubnets(t *testing.T) {
+	subnets, err := ParseSubnets("10.0.0.0/8, 2001:db8::/32,192.0.2.7,::1")
+	require.NoError(t, err)
+	require.Len(t, subnets, 4)
+	assert.True(t, subnets.Contains(net.ParseIP("10.1.2.3")))
+	assert.True(t, subnets.Contains(net.ParseIP("2001:db8::1")))
+	assert.True(t, subnets.Contains(net.ParseIP("192.0.2.7")))
+	assert.False(t, subnets.Contains(net.ParseIP("192.0.2.8")))
+	assert.True(t, subnets.Contains(net.ParseIP("::1")))
+	assert.False(t, subnets.Contains(nil))
+
+	_, err = ParseSubnets("10.0.0.0/33")
+	assert.Error(t, err)
+	_, err = ParseSubnets("proxy")
+	assert.Error(t, err)
+}
+
+func TestIPFilter_ClientIP(t *testing.T) {
+	filter, err := NewIPFilter("10.0.0.0/8,2001:db8::/32", "192.0.2.0/24,fd00::/8")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name         string
+		peer         string
+		forwardedFor []string
+		realIP       []string
+		want         string
+	}{
+		{name: "direct client", peer: "10.1.1.1:5000", want: "10.1.1.1"},
+		{name: "direct IPv6 client", peer: "[2001:db8::5]:5000", want: "2001:db8::5"},
+		{name: "spoofed headers of untrusted peer", peer: "203.0.113.5:5000", forwardedFor: []string{"10.1.1.1"}, realIP: []string{"10.1.1.1"}, want: "203.0.113.5"},
+		{name: "client behind proxy", peer: "192.0.2.1:443", forwardedFor: []string{"10.1.1.1"}, want: "10.1.1.1"},
+		{name: "proxy chain", peer: "192.0.2.1:443", forwardedFor: []string{"10.1.1.1, 192.0.2.2", "fd00::1"}, want: "10.1.1.1"},
+		{name: "spoofed hop before client", peer: "192.0.2.1:443", forwardedFor: []string{"10.9.9.9, 203.0.113.5"}, want: "203.0.113.5"},
+		{name: "real IP of proxy", peer: "192.0.2.1:443", realIP: []string{"2001:db8::7"}, want: "2001:db8::7"},
+		{name: "proxy without headers", peer: "192.0.2.1:443", want: "192.0.2.1"},
+		{name: "invalid hop", peer: "192.0.2.1:443", forwardedFor: []string{"unknown"}},
+		{name: "no peer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := filter.ClientIP(tt.peer, tt.forwardedFor, tt.realIP)
+			if tt.want == "" {
+				assert.Nil(t, ip)
+				assert.ErrorIs(t, filter.Check(ip), ErrInvalidIP)
+				return
+			}
+			assert.Equal(t, tt.want, ip.String())
+		})
+	}
+}
+
+func TestIPFilter_Check(t *testing.T) {
+	filter, err := NewIPFilter("10.0.0.0/8,2001:db8::/32", "")
+	require.NoError(t, err)
+	assert.NoError(t, filter.Check(net.ParseIP("10.0.0.1")))
+	assert.NoError(t, filter.Check(net.ParseIP("2001:db8::1")))
+	assert.ErrorIs(t, filter.Check(net.ParseIP("192.168.0.1")), ErrInvalidIP)
+
+	disabled, err := NewIPFilter("", "")
+	require.NoError(t, err)
+	assert.False(t, disabled.Enabled())
+	assert.NoError(t, disabled.Check(nil))
+	assert.Equal(t, "10.0.0.1", disabled.ClientIP("10.0.0.1:80", []string{"192.168.0.1"}, nil).String())
+}
@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+)
+
+// CertReloader keeps server certificate and client CA bundle, they're reloaded when files change,
+// so certificates are rotated without restart.
+type CertReloader struct {
+	sync.RWMutex
+	certFile       string
+	keyFile        string
+	caFile         string
+	reloadInterval time.Duration
+	modTime        time.Time
+	cert           *tls.Certificate
+	clientCAs      *x509.CertPool
+}
+
+// NewCertReloader loads configured certificate files.
+func NewCertReloader(cfg configs.TLSConfig) (*CertReloader, error) {
+	r := &CertReloader{
+		certFile:       cfg.CertFile,
+		keyFile:        cfg.KeyFile,
+		caFile:         cfg.ClientCAFile,
+		reloadInterval: cfg.ReloadInterval,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Start runs periodic check of certificate files.
+func (r *CertReloader) Start(ctx context.Context, pool *TickerPool) {
+	pool.AddTask(ctx, "TLS certificates reload", func(ctx context.Context) {
+		if err := r.Reload(); err != nil {
+			log.Errorf("TLS certificates not reloaded: %v", err)
+		}
+	}, r.reloadInterval)
+}
+
+// Reload loads certificate files if any of them changed since previous load.
+// Previous certificates are kept on error.
+func (r *CertReloader) Reload() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	r.RLock()
+	unchanged := r.cert != nil && !modTime.After(r.modTime)
+	r.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("can't load TLS certificate: %w", err)
+	}
+	var clientCAs *x509.CertPool
+	if r.caFile != "" {
+		if clientCAs, err = loadCertPool(r.caFile); err != nil {
+			return err
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if r.cert != nil {
+		log.Info("TLS certificates reloaded")
+	}
+	r.cert, r.clientCAs, r.modTime = &cert, clientCAs, modTime
+	return nil
+}
+
+func (r *CertReloader) lastModified() (time.Time, error) {
+	var last time.Time
+	for _, path := range []string{r.certFile, r.keyFile, r.caFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return last, fmt.Errorf("can't load TLS certificate: %w", err)
+		}
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last, nil
+}
+
+// Config returns server TLS settings using the current certificates.
+func (r *CertReloader) Config() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.RLock()
+			defer r.RUnlock()
+			return r.cert, nil
+		},
+	}
+	if r.caFile != "" {
+		// verified by hand, so reloaded CA bundle is used
+		cfg.ClientAuth = tls.RequireAnyClientCert
+		cfg.VerifyPeerCertificate = r.verifyClient
+	}
+	return cfg
+}
+
+func (r *CertReloader) verifyClient(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return errors.New("no client certificate")
+	}
+
+	r.RLock()
+	opts := x509.VerifyOptions{
+		Roots:         r.clientCAs,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	r.RUnlock()
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// GetClientTLSConfig returns TLS settings of connection to server, it's nil when TLS is disabled.
+func GetClientTLSConfig(cfg configs.ClientTLSConfig) (*tls.Config, error) {
+	if !cfg.IsEnabled() {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: cfg.ServerName}
+	if cfg.CAFile != "" {
+		roots, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load TLS client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't load CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("can't load CA bundle: no certificates in %v", path)
+	}
+	return pool, nil
+}
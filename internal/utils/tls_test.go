@@ -0,0 +1,173 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue writes certificate signed by CA and its key to dir, returns their paths.
+func (ca *testCA) issue(t *testing.T, dir, name string, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	writePEM(t, certPath, "CERTIFICATE", der)
+	writePEM(t, keyPath, "EC PRIVATE KEY", keyDER)
+	return certPath, keyPath
+}
+
+func (ca *testCA) write(t *testing.T, path string) {
+	writePEM(t, path, "CERTIFICATE", ca.cert.Raw)
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+}
+
+// startTLSServer returns URL of HTTPS server, httptest server isn't used as it sets its own certificate.
+func startTLSServer(t *testing.T, reloader *CertReloader) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+		TLSConfig: reloader.Config(),
+		ErrorLog:  log.New(io.Discard, "", 0),
+	}
+	go server.ServeTLS(listener, "", "")
+	t.Cleanup(func() { server.Close() })
+	return "https://" + listener.Addr().String()
+}
+
+func get(cfg configs.ClientTLSConfig, url string) error {
+	tlsConfig, err := GetClientTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	response, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
+
+func TestCertReloader_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caPath := filepath.Join(dir, "ca.crt")
+	ca.write(t, caPath)
+	serverCert, serverKey := ca.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, dir, "client", x509.ExtKeyUsageClientAuth)
+
+	reloader, err := NewCertReloader(configs.TLSConfig{CertFile: serverCert, KeyFile: serverKey, ClientCAFile: caPath})
+	require.NoError(t, err)
+	url := startTLSServer(t, reloader)
+
+	assert.NoError(t, get(configs.ClientTLSConfig{CAFile: caPath, CertFile: clientCert, KeyFile: clientKey}, url))
+	assert.Error(t, get(configs.ClientTLSConfig{CAFile: caPath}, url), "client certificate is required")
+
+	otherCA := newTestCA(t)
+	otherCert, otherKey := otherCA.issue(t, dir, "other", x509.ExtKeyUsageClientAuth)
+	assert.Error(t, get(configs.ClientTLSConfig{CAFile: caPath, CertFile: otherCert, KeyFile: otherKey}, url),
+		"client certificate of unknown CA")
+	assert.Error(t, get(configs.ClientTLSConfig{Enabled: true, CertFile: clientCert, KeyFile: clientKey}, url),
+		"server CA isn't trusted by system roots")
+}
+
+func TestCertReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	oldCA, newCA := newTestCA(t), newTestCA(t)
+	oldCAPath, newCAPath := filepath.Join(dir, "old-ca.crt"), filepath.Join(dir, "new-ca.crt")
+	oldCA.write(t, oldCAPath)
+	newCA.write(t, newCAPath)
+	serverCert, serverKey := oldCA.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+
+	reloader, err := NewCertReloader(configs.TLSConfig{CertFile: serverCert, KeyFile: serverKey})
+	require.NoError(t, err)
+	url := startTLSServer(t, reloader)
+	require.NoError(t, get(configs.ClientTLSConfig{CAFile: oldCAPath}, url))
+
+	// certificate rotated by CA
+	newCA.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(serverCert, later, later))
+	require.NoError(t, os.Chtimes(serverKey, later, later))
+	require.NoError(t, reloader.Reload())
+
+	assert.NoError(t, get(configs.ClientTLSConfig{CAFile: newCAPath}, url))
+	assert.Error(t, get(configs.ClientTLSConfig{CAFile: oldCAPath}, url))
+
+	// broken files keep previous certificate
+	require.NoError(t, os.WriteFile(serverCert, []byte("broken"), 0600))
+	require.NoError(t, os.Chtimes(serverCert, later.Add(time.Minute), later.Add(time.Minute)))
+	assert.Error(t, reloader.Reload())
+	assert.NoError(t, get(configs.ClientTLSConfig{CAFile: newCAPath}, url))
+}
+
+func TestGetClientTLSConfig_Disabled(t *testing.T) {
+	tlsConfig, err := GetClientTLSConfig(configs.ClientTLSConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, tlsConfig)
+
+	_, err = GetClientTLSConfig(configs.ClientTLSConfig{CAFile: "missing.crt"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,217 @@
+// Package webhook pushes metric changes to subscribed URLs.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+// SignatureHeader keeps hex encoded HMAC-SHA256 of request body, it's set only when hash key is set.
+const SignatureHeader = "HashSHA256"
+
+const workersCount = 4
+
+// Event is pushed to subscription URL as JSON.
+// Hash field is the metric hash calculated with the server key, as in update requests.
+type Event struct {
+	metrics.Params
+	Change float64   `json:"change"`
+	Time   time.Time `json:"time"`
+}
+
+type delivery struct {
+	url  string
+	body []byte
+}
+
+type subscription struct {
+	configs.WebhookSubscription
+	// notified keeps values of the last pushes by metric type and name.
+	notified map[string]float64
+}
+
+// Dispatcher matches updated metrics against subscriptions and delivers events
+// through bounded queue, events are dropped when queue is full, so updates are never blocked.
+type Dispatcher struct {
+	sync.Mutex
+	subscriptions []*subscription
+	hashKey       []byte
+	queue         chan delivery
+	client        http.Client
+	retries       int
+	retryInterval time.Duration
+	now           func() time.Time
+}
+
+// NewDispatcher creates Dispatcher, returns error on invalid subscription.
+func NewDispatcher(cfg configs.WebhooksConfig, hashKey string) (*Dispatcher, error) {
+	d := &Dispatcher{
+		hashKey:       []byte(hashKey),
+		queue:         make(chan delivery, cfg.QueueSize),
+		client:        http.Client{Timeout: cfg.Timeout},
+		retries:       cfg.Retries,
+		retryInterval: cfg.RetryInterval,
+		now:           time.Now,
+	}
+	for _, sub := range cfg.Subscriptions {
+		if sub.URL == "" {
+			return nil, fmt.Errorf("webhook %v: no url", sub.Pattern)
+		}
+		if _, err := path.Match(sub.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("webhook %v: invalid pattern: %w", sub.Pattern, err)
+		}
+		if sub.Type != "" {
+			if err := metrics.CheckType(sub.Type); err != nil {
+				return nil, fmt.Errorf("webhook %v: %w", sub.Pattern, err)
+			}
+		}
+		d.subscriptions = append(d.subscriptions, &subscription{WebhookSubscription: sub, notified: map[string]float64{}})
+	}
+	return d, nil
+}
+
+// Observe queues events of subscriptions matching saved metric.
+// counterDelta is the increment applied to counter, it's ignored for gauges.
+func (d *Dispatcher) Observe(metric metrics.Metric, counterDelta int64) {
+	if len(d.subscriptions) == 0 {
+		return
+	}
+
+	var value, previous float64
+	switch m := metric.(type) {
+	case metrics.Gauge:
+		value = m.Value()
+		previous = value
+	case metrics.Counter:
+		value = float64(m.Value())
+		previous = value - float64(counterDelta)
+	default:
+		return
+	}
+	key := metric.GetType() + "/" + metric.GetName()
+
+	d.Lock()
+	defer d.Unlock()
+	for _, sub := range d.subscriptions {
+		if sub.Type != "" && sub.Type != metric.GetType() {
+			continue
+		}
+		if ok, _ := path.Match(sub.Pattern, metric.GetName()); !ok {
+			continue
+		}
+
+		base, seen := sub.notified[key]
+		if !seen {
+			base = previous
+		}
+		change := value - base
+		if math.Abs(change) < sub.MinChange {
+			if !seen {
+				sub.notified[key] = base
+			}
+			continue
+		}
+		sub.notified[key] = value
+
+		params := metric.ToParams()
+		if len(d.hashKey) > 0 {
+			params.Hash = metric.Hash(d.hashKey)
+		}
+		body, err := json.Marshal(Event{Params: params, Change: change, Time: d.now()})
+		if err != nil {
+			log.Errorf("webhook %v: can't encode event: %v", sub.URL, err)
+			continue
+		}
+		select {
+		case d.queue <- delivery{url: sub.URL, body: body}:
+		default:
+			log.Warnf("webhook %v: queue is full, event for %v dropped", sub.URL, metric.GetName())
+		}
+	}
+}
+
+// Run delivers queued events until ctx is done, nothing is started without subscriptions.
+func (d *Dispatcher) Run(ctx context.Context) {
+	if len(d.subscriptions) == 0 {
+		return
+	}
+	wg := sync.WaitGroup{}
+	for i := 0; i < workersCount; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case item := <-d.queue:
+					d.deliver(ctx, item)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// deliver posts event retrying with exponential backoff on errors and non-2xx responses.
+func (d *Dispatcher) deliver(ctx context.Context, item delivery) {
+	wait := d.retryInterval
+	for attempt := 0; ; attempt++ {
+		err := d.post(ctx, item)
+		if err == nil {
+			return
+		}
+		if attempt >= d.retries {
+			log.Errorf("webhook %v: delivery failed after %d attempts: %v", item.url, attempt+1, err)
+			return
+		}
+		log.Debugf("webhook %v: attempt %d failed: %v", item.url, attempt+1, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+func (d *Dispatcher) post(ctx context.Context, item delivery) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, item.url, bytes.NewReader(item.body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if len(d.hashKey) > 0 {
+		h := hmac.New(sha256.New, d.hashKey)
+		h.Write(item.body)
+		request.Header.Set(SignatureHeader, hex.EncodeToString(h.Sum(nil)))
+	}
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %v", response.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/unbeman/ya-prac-mcas/configs"
+	"github.com/unbeman/ya-prac-mcas/internal/metrics"
+)
+
+func TestNewDispatcher(t *testing.T) {
+	tests := []struct {
+		name    string
+		sub     configs.WebhookSubscription
+		wantErr bool
+	}{
+		{name: "good", sub: configs.WebhookSubscription{URL: "http://localhost", Pattern: "Deploy*", Type: metrics.CounterType}},
+		{name: "no url", sub: configs.WebhookSubscription{Pattern: "Deploy*"}, wantErr: true},
+		{name: "bad pattern", sub: configs.WebhookSubscription{URL: "http://localhost", Pattern: "[Deploy"}, wantErr: true},
+		{name: "bad type", sub: configs.WebhookSubscription{URL: "http://localhost", Pattern: "*", Type: "fruit"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewDispatcher(configs.WebhooksConfig{Subscriptions: []configs.WebhookSubscription{tt.sub}}, "")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestDispatcher_Observe(t *testing.T) {
+	d, err := NewDispatcher(configs.WebhooksConfig{
+		QueueSize: 10,
+		Subscriptions: []configs.WebhookSubscription{
+			{URL: "http://deploys", Pattern: "Deploy*", Type: metrics.CounterType},
+			{URL: "http://memory", Pattern: "FreeMemory", MinChange: 10},
+		},
+	}, "")
+	require.NoError(t, err)
+
+	d.Observe(metrics.NewCounter("Deploys", 5), 1)
+	d.Observe(metrics.NewGauge("Deploys", 5), 0) // type doesn't match
+	d.Observe(metrics.NewGauge("FreeMemory", 100), 0)
+	d.Observe(metrics.NewGauge("FreeMemory", 105), 0)
+	d.Observe(metrics.NewGauge("FreeMemory", 89), 0)
+	d.Observe(metrics.NewGauge("FreeMemory", 95), 0)
+
+	var got []Event
+	for len(d.queue) > 0 {
+		item := <-d.queue
+		var event Event
+		require.NoError(t, json.Unmarshal(item.body, &event))
+		got = append(got, event)
+	}
+	require.Len(t, got, 2)
+	assert.Equal(t, "Deploys", got[0].Name)
+	assert.Equal(t, int64(5), got[0].GetCounterValue())
+	assert.Equal(t, 1.0, got[0].Change)
+	assert.Equal(t, "FreeMemory", got[1].Name)
+	assert.Equal(t, 89.0, got[1].GetGaugeValue())
+	assert.Equal(t, -11.0, got[1].Change)
+}
+
+func TestDispatcher_QueueFull(t *testing.T) {
+	d, err := NewDispatcher(configs.WebhooksConfig{
+		QueueSize:     1,
+		Subscriptions: []configs.WebhookSubscription{{URL: "http://hook", Pattern: "*"}},
+	}, "")
+	require.NoError(t, err)
+
+	d.Observe(metrics.NewGauge("A", 1), 0)
+	d.Observe(metrics.NewGauge("B", 1), 0)
+	assert.Len(t, d.queue, 1)
+}
+
+func TestDispatcher_Run(t *testing.T) {
+	const key = "secret"
+	var (
+		mu       sync.Mutex
+		received []Event
+		attempts int32
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		h := hmac.New(sha256.New, []byte(key))
+		h.Write(body)
+		assert.Equal(t, hex.EncodeToString(h.Sum(nil)), r.Header.Get(SignatureHeader))
+
+		var event Event
+		require.NoError(t, json.Unmarshal(body, &event))
+		mu.Lock()
+		received = append(received, event)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	d, err := NewDispatcher(configs.WebhooksConfig{
+		QueueSize:     10,
+		Retries:       2,
+		RetryInterval: time.Millisecond,
+		Timeout:       time.Second,
+		Subscriptions: []configs.WebhookSubscription{{URL: server.URL, Pattern: "Deploys"}},
+	}, key)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+
+	counter := metrics.NewCounter("Deploys", 1)
+	d.Observe(counter, 1)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == 1
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+	assert.Equal(t, counter.Hash([]byte(key)), received[0].Hash)
+}
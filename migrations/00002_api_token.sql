@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+create table if not exists api_token
+(
+    token_hash text not null
+        constraint api_token_pk
+            primary key,
+    name       text not null,
+    scopes     text not null,
+    created_at timestamptz not null default now(),
+    revoked_at timestamptz
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+drop table if exists api_token;
+-- +goose StatementEnd
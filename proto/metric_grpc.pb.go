@@ -23,6 +23,8 @@ const (
 	MetricsCollector_GetMetrics_FullMethodName    = "/mcas.MetricsCollector/GetMetrics"
 	MetricsCollector_UpdateMetric_FullMethodName  = "/mcas.MetricsCollector/UpdateMetric"
 	MetricsCollector_UpdateMetrics_FullMethodName = "/mcas.MetricsCollector/UpdateMetrics"
+	MetricsCollector_Query_FullMethodName         = "/mcas.MetricsCollector/Query"
+	MetricsCollector_Replicate_FullMethodName     = "/mcas.MetricsCollector/Replicate"
 	MetricsCollector_Ping_FullMethodName          = "/mcas.MetricsCollector/Ping"
 )
 
@@ -34,6 +36,8 @@ type MetricsCollectorClient interface {
 	GetMetrics(ctx context.Context, in *GetMetricsRequest, opts ...grpc.CallOption) (*GetMetricsResponse, error)
 	UpdateMetric(ctx context.Context, in *UpdateMetricRequest, opts ...grpc.CallOption) (*UpdateMetricResponse, error)
 	UpdateMetrics(ctx context.Context, in *UpdateMetricsRequest, opts ...grpc.CallOption) (*UpdateMetricsResponse, error)
+	Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (*QueryResponse, error)
+	Replicate(ctx context.Context, in *ReplicateRequest, opts ...grpc.CallOption) (MetricsCollector_ReplicateClient, error)
 	Ping(ctx context.Context, in *PingRequest, opts ...grpc.CallOption) (*PingResponse, error)
 }
 
@@ -81,6 +85,47 @@ func (c *metricsCollectorClient) UpdateMetrics(ctx context.Context, in *UpdateMe
 	return out, nil
 }
 
+func (c *metricsCollectorClient) Query(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (*QueryResponse, error) {
+	out := new(QueryResponse)
+	err := c.cc.Invoke(ctx, MetricsCollector_Query_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricsCollectorClient) Replicate(ctx context.Context, in *ReplicateRequest, opts ...grpc.CallOption) (MetricsCollector_ReplicateClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MetricsCollector_ServiceDesc.Streams[0], MetricsCollector_Replicate_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metricsCollectorReplicateClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type MetricsCollector_ReplicateClient interface {
+	Recv() (*ReplicationEvent, error)
+	grpc.ClientStream
+}
+
+type metricsCollectorReplicateClient struct {
+	grpc.ClientStream
+}
+
+func (x *metricsCollectorReplicateClient) Recv() (*ReplicationEvent, error) {
+	m := new(ReplicationEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 func (c *metricsCollectorClient) Ping(ctx context.Context, in *PingRequest, opts ...grpc.CallOption) (*PingResponse, error) {
 	out := new(PingResponse)
 	err := c.cc.Invoke(ctx, MetricsCollector_Ping_FullMethodName, in, out, opts...)
@@ -98,6 +143,8 @@ type MetricsCollectorServer interface {
 	GetMetrics(context.Context, *GetMetricsRequest) (*GetMetricsResponse, error)
 	UpdateMetric(context.Context, *UpdateMetricRequest) (*UpdateMetricResponse, error)
 	UpdateMetrics(context.Context, *UpdateMetricsRequest) (*UpdateMetricsResponse, error)
+	Query(context.Context, *QueryRequest) (*QueryResponse, error)
+	Replicate(*ReplicateRequest, MetricsCollector_ReplicateServer) error
 	Ping(context.Context, *PingRequest) (*PingResponse, error)
 	mustEmbedUnimplementedMetricsCollectorServer()
 }
@@ -118,6 +165,12 @@ func (UnimplementedMetricsCollectorServer) UpdateMetric(context.Context, *Update
 func (UnimplementedMetricsCollectorServer) UpdateMetrics(context.Context, *UpdateMetricsRequest) (*UpdateMetricsResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method UpdateMetrics not implemented")
 }
+func (UnimplementedMetricsCollectorServer) Query(context.Context, *QueryRequest) (*QueryResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Query not implemented")
+}
+func (UnimplementedMetricsCollectorServer) Replicate(*ReplicateRequest, MetricsCollector_ReplicateServer) error {
+	return status.Errorf(codes.Unimplemented, "method Replicate not implemented")
+}
 func (UnimplementedMetricsCollectorServer) Ping(context.Context, *PingRequest) (*PingResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Ping not implemented")
 }
@@ -206,6 +259,45 @@ func _MetricsCollector_UpdateMetrics_Handler(srv interface{}, ctx context.Contex
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetricsCollector_Query_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(QueryRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricsCollectorServer).Query(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MetricsCollector_Query_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricsCollectorServer).Query(ctx, req.(*QueryRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetricsCollector_Replicate_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ReplicateRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MetricsCollectorServer).Replicate(m, &metricsCollectorReplicateServer{stream})
+}
+
+type MetricsCollector_ReplicateServer interface {
+	Send(*ReplicationEvent) error
+	grpc.ServerStream
+}
+
+type metricsCollectorReplicateServer struct {
+	grpc.ServerStream
+}
+
+func (x *metricsCollectorReplicateServer) Send(m *ReplicationEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 func _MetricsCollector_Ping_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(PingRequest)
 	if err := dec(in); err != nil {
@@ -247,11 +339,21 @@ var MetricsCollector_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "UpdateMetrics",
 			Handler:    _MetricsCollector_UpdateMetrics_Handler,
 		},
+		{
+			MethodName: "Query",
+			Handler:    _MetricsCollector_Query_Handler,
+		},
 		{
 			MethodName: "Ping",
 			Handler:    _MetricsCollector_Ping_Handler,
 		},
 	},
-	Streams:  []grpc.StreamDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Replicate",
+			Handler:       _MetricsCollector_Replicate_Handler,
+			ServerStreams: true,
+		},
+	},
 	Metadata: "proto/metric.proto",
 }